@@ -0,0 +1,828 @@
+package atlas
+
+import (
+	"flag"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vonaka/shreplic/server/smr"
+	"github.com/vonaka/shreplic/state"
+	"github.com/vonaka/shreplic/tools/dlog"
+	"github.com/vonaka/shreplic/tools/fastrpc"
+)
+
+// phases of a command at a replica
+const (
+	NONE uint8 = iota
+	START
+	COLLECT
+	RECOVER
+	COMMITTED
+	EXECUTED
+)
+
+// Replica of Atlas.
+//
+// The coordinator of a command sends it to a fast quorum of n/2+f
+// replicas, each of them reports the conflicting commands it knows.
+// The command is committed at once if every dependency is reported by
+// at least f replicas, otherwise the union of the dependencies is agreed
+// upon by f+1 replicas. Committed commands are executed in dependency
+// order, the strongly connected components in the order of their dots.
+type Replica struct {
+	*smr.Replica
+
+	FQ   smr.Quorum
+	Slow smr.AnyOf
+	Rec  smr.AnyOf
+
+	fqSize    int
+	fq        []int32
+	seq       int32
+	cmds      map[Dot]*cmdDesc
+	conflicts []map[state.Key]*keyDeps
+	execUpTo  []int32
+	waiting   map[Dot]time.Time
+	stack     []*cmdDesc
+
+	timeout  time.Duration
+	tickChan chan struct{}
+
+	sender smr.Sender
+	cs     CommunicationSupply
+}
+
+type cmdDesc struct {
+	dot    Dot
+	phase  uint8
+	cmd    state.Command
+	quorum []int32
+	deps   []int32
+
+	// acceptor
+	bal   int32
+	abal  int32
+	acmd  state.Command
+	adeps []int32
+
+	// coordinator or recovery
+	propose    *smr.GPropose
+	pbal       int32
+	collectSet *smr.MsgSet
+	acceptSet  *smr.MsgSet
+	recSet     *smr.MsgSet
+
+	index   int
+	lowlink int
+}
+
+type keyDeps struct {
+	last      int32
+	lastWrite int32
+}
+
+type CommunicationSupply struct {
+	maxLatency time.Duration
+
+	collectChan      chan fastrpc.Serializable
+	collectAckChan   chan fastrpc.Serializable
+	consensusChan    chan fastrpc.Serializable
+	consensusAckChan chan fastrpc.Serializable
+	commitChan       chan fastrpc.Serializable
+	recChan          chan fastrpc.Serializable
+	recAckChan       chan fastrpc.Serializable
+
+	collectRPC      uint8
+	collectAckRPC   uint8
+	consensusRPC    uint8
+	consensusAckRPC uint8
+	commitRPC       uint8
+	recRPC          uint8
+	recAckRPC       uint8
+}
+
+func NewReplica(rid int, addrs []string, exec, dr bool,
+	f int, args string, ps map[string]struct{}) *Replica {
+
+	fs := flag.NewFlagSet("custom Atlas arguments", flag.ExitOnError)
+	timeout := fs.Int("timeout", 1000, "Milliseconds to wait for the commit of a command before recovering it")
+	fs.Parse(strings.Fields(args))
+
+	r := &Replica{
+		Replica: smr.NewReplica(rid, f, addrs, false, exec, false, dr, ps),
+
+		seq:      0,
+		cmds:     make(map[Dot]*cmdDesc),
+		execUpTo: make([]int32, len(addrs)),
+		waiting:  make(map[Dot]time.Time),
+		stack:    make([]*cmdDesc, 0, 16),
+
+		timeout:  time.Duration(*timeout) * time.Millisecond,
+		tickChan: make(chan struct{}, 1),
+	}
+
+	if r.N < 2*r.F+1 {
+		log.Fatalf("Atlas cannot tolerate %d failures with %d replicas", r.F, r.N)
+	}
+	r.fqSize = r.N/2 + r.F
+	r.Slow = smr.AnyOf(r.F + 1)
+	r.Rec = smr.AnyOf(r.N - r.F)
+	log.Println("Fast quorum size:", r.fqSize)
+
+	r.conflicts = make([]map[state.Key]*keyDeps, r.N)
+	for q := 0; q < r.N; q++ {
+		r.conflicts[q] = make(map[state.Key]*keyDeps)
+		r.execUpTo[q] = -1
+	}
+
+	r.sender = smr.NewSender(r.Replica)
+	initCs(&r.cs, r.RPC)
+
+	go r.run()
+
+	return r
+}
+
+// Messages registers in t the messages of the protocol
+func Messages(t *fastrpc.Table) {
+	initCs(new(CommunicationSupply), t)
+}
+
+func initCs(cs *CommunicationSupply, t *fastrpc.Table) {
+	cs.maxLatency = 0
+
+	cs.collectChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.collectAckChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.consensusChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.consensusAckChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.commitChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.recChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.recAckChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+
+	cs.collectRPC = t.Register(new(MCollect), cs.collectChan)
+	cs.collectAckRPC = t.Register(new(MCollectAck), cs.collectAckChan)
+	cs.consensusRPC = t.Register(new(MConsensus), cs.consensusChan)
+	cs.consensusAckRPC = t.Register(new(MConsensusAck), cs.consensusAckChan)
+	cs.commitRPC = t.Register(new(MCommit), cs.commitChan)
+	cs.recRPC = t.Register(new(MRec), cs.recChan)
+	cs.recAckRPC = t.Register(new(MRecAck), cs.recAckChan)
+}
+
+func (r *Replica) run() {
+	r.ConnectToPeers()
+	latencies := r.ComputeClosestPeers()
+	for _, l := range latencies {
+		d := time.Duration(l*1000*1000) * time.Nanosecond
+		if d > r.cs.maxLatency {
+			r.cs.maxLatency = d
+		}
+	}
+
+	// the fast quorum of the replica is made of the closest ones
+	r.fq = []int32{r.Id}
+	for _, q := range r.PreferredPeerOrder {
+		if len(r.fq) == r.fqSize {
+			break
+		}
+		if q != r.Id {
+			r.fq = append(r.fq, q)
+		}
+	}
+	r.FQ = smr.NewQuorum(r.fqSize)
+	for _, q := range r.fq {
+		r.FQ[q] = struct{}{}
+	}
+
+	go r.WaitForClientConnections()
+	go r.clock()
+
+	for !r.Shutdown {
+		select {
+		case propose := <-r.ProposeChan:
+			r.handlePropose(propose)
+
+		case m := <-r.cs.collectChan:
+			collect := m.(*MCollect)
+			r.handleCollect(collect)
+			collect.Free()
+
+		case m := <-r.cs.collectAckChan:
+			ack := m.(*MCollectAck)
+			r.handleCollectAck(ack)
+
+		case m := <-r.cs.consensusChan:
+			consensus := m.(*MConsensus)
+			r.handleConsensus(consensus)
+			consensus.Free()
+
+		case m := <-r.cs.consensusAckChan:
+			ack := m.(*MConsensusAck)
+			r.handleConsensusAck(ack)
+
+		case m := <-r.cs.commitChan:
+			commit := m.(*MCommit)
+			r.handleCommit(commit)
+			commit.Free()
+
+		case m := <-r.cs.recChan:
+			rec := m.(*MRec)
+			r.handleRec(rec)
+			rec.Free()
+
+		case m := <-r.cs.recAckChan:
+			ack := m.(*MRecAck)
+			r.handleRecAck(ack)
+
+		case <-r.tickChan:
+			r.checkTimeouts()
+		}
+	}
+}
+
+func (r *Replica) clock() {
+	for !r.Shutdown {
+		time.Sleep(r.timeout / 2)
+		r.tickChan <- struct{}{}
+	}
+}
+
+func (r *Replica) handlePropose(propose *smr.GPropose) {
+	dot := Dot{
+		Replica: r.Id,
+		Seq:     r.seq,
+	}
+	r.seq++
+
+	desc := r.desc(dot)
+	desc.propose = propose
+	desc.cmd = propose.Command
+	desc.quorum = r.fq
+	desc.deps = r.depsOf(&desc.cmd)
+	desc.phase = COLLECT
+	r.addConflicts(&desc.cmd, dot)
+	r.waiting[dot] = time.Now()
+
+	desc.collectSet = desc.collectSet.ReinitMsgSet(r.FQ, func(_, _ interface{}) bool {
+		return true
+	}, func(interface{}) {}, r.getCollectHandler(desc))
+
+	collect := &MCollect{
+		Replica: r.Id,
+		Dot:     dot,
+		Cmd:     desc.cmd,
+		Quorum:  desc.quorum,
+		Deps:    desc.deps,
+	}
+	r.sender.SendToAll(collect, r.cs.collectRPC)
+	r.handleCollectAck(&MCollectAck{
+		Replica: r.Id,
+		Dot:     dot,
+		Deps:    desc.deps,
+	})
+}
+
+func (r *Replica) handleCollect(msg *MCollect) {
+	desc := r.desc(msg.Dot)
+	if desc.phase >= COMMITTED {
+		return
+	}
+	if desc.phase == NONE {
+		desc.phase = START
+		desc.cmd = msg.Cmd
+		desc.quorum = msg.Quorum
+		r.wait(msg.Dot)
+	}
+	if desc.phase != START || desc.bal != 0 || !inQuorum(r.Id, msg.Quorum) {
+		return
+	}
+
+	desc.deps = union(r.depsOf(&desc.cmd), msg.Deps)
+	desc.phase = COLLECT
+	r.addConflicts(&desc.cmd, msg.Dot)
+
+	ack := &MCollectAck{
+		Replica: r.Id,
+		Dot:     msg.Dot,
+		Deps:    desc.deps,
+	}
+	r.sender.SendTo(msg.Replica, ack, r.cs.collectAckRPC)
+}
+
+func (r *Replica) handleCollectAck(msg *MCollectAck) {
+	desc := r.desc(msg.Dot)
+	if desc.phase != COLLECT || desc.bal != 0 || desc.collectSet == nil {
+		return
+	}
+	desc.collectSet.Add(msg.Replica, false, msg)
+}
+
+func (r *Replica) getCollectHandler(desc *cmdDesc) smr.MsgSetHandler {
+	return func(_ interface{}, msgs []interface{}) {
+		if desc.phase != COLLECT || desc.bal != 0 {
+			return
+		}
+
+		deps := make([]int32, r.N)
+		copy(deps, desc.deps)
+		for _, m := range msgs {
+			deps = union(deps, m.(*MCollectAck).Deps)
+		}
+
+		// fast path: every dependency is reported by f replicas
+		fast := true
+		for q := 0; q < r.N && fast; q++ {
+			n := 0
+			for _, m := range msgs {
+				if m.(*MCollectAck).Deps[q] == deps[q] {
+					n++
+				}
+			}
+			fast = deps[q] == -1 || n >= r.F
+		}
+
+		if fast {
+			r.commit(desc.dot, desc.cmd, deps)
+		} else {
+			r.startConsensus(desc, r.Id+1, desc.cmd, deps)
+		}
+	}
+}
+
+func (r *Replica) startConsensus(desc *cmdDesc, ballot int32, cmd state.Command, deps []int32) {
+	desc.pbal = ballot
+	desc.acceptSet = desc.acceptSet.ReinitMsgSet(r.Slow, func(_, _ interface{}) bool {
+		return true
+	}, func(interface{}) {}, r.getConsensusHandler(desc, ballot, cmd, deps))
+
+	consensus := &MConsensus{
+		Replica: r.Id,
+		Dot:     desc.dot,
+		Ballot:  ballot,
+		Cmd:     cmd,
+		Deps:    deps,
+	}
+	r.sender.SendToAll(consensus, r.cs.consensusRPC)
+	r.handleConsensus(consensus)
+}
+
+func (r *Replica) handleConsensus(msg *MConsensus) {
+	desc := r.desc(msg.Dot)
+	if desc.phase >= COMMITTED || msg.Ballot < desc.bal {
+		return
+	}
+	desc.bal = msg.Ballot
+	desc.abal = msg.Ballot
+	desc.acmd = msg.Cmd
+	desc.adeps = msg.Deps
+	r.wait(msg.Dot)
+
+	ack := &MConsensusAck{
+		Replica: r.Id,
+		Dot:     msg.Dot,
+		Ballot:  msg.Ballot,
+	}
+	if msg.Replica == r.Id {
+		r.handleConsensusAck(ack)
+	} else {
+		r.sender.SendTo(msg.Replica, ack, r.cs.consensusAckRPC)
+	}
+}
+
+func (r *Replica) handleConsensusAck(msg *MConsensusAck) {
+	desc := r.desc(msg.Dot)
+	if desc.phase >= COMMITTED || msg.Ballot != desc.pbal || desc.acceptSet == nil {
+		return
+	}
+	desc.acceptSet.Add(msg.Replica, false, msg)
+}
+
+func (r *Replica) getConsensusHandler(desc *cmdDesc, ballot int32,
+	cmd state.Command, deps []int32) smr.MsgSetHandler {
+	return func(_ interface{}, _ []interface{}) {
+		if desc.phase >= COMMITTED || desc.pbal != ballot {
+			return
+		}
+		r.commit(desc.dot, cmd, deps)
+	}
+}
+
+func (r *Replica) commit(dot Dot, cmd state.Command, deps []int32) {
+	commit := &MCommit{
+		Replica: r.Id,
+		Dot:     dot,
+		Cmd:     cmd,
+		Deps:    deps,
+	}
+	r.sender.SendToAll(commit, r.cs.commitRPC)
+	r.handleCommit(commit)
+}
+
+func (r *Replica) handleCommit(msg *MCommit) {
+	desc := r.desc(msg.Dot)
+	if desc.phase >= COMMITTED {
+		return
+	}
+	desc.phase = COMMITTED
+	desc.cmd = msg.Cmd
+	desc.deps = msg.Deps
+	if desc.cmd.Op != state.NONE {
+		r.addConflicts(&desc.cmd, msg.Dot)
+	}
+	delete(r.waiting, msg.Dot)
+	r.execute()
+}
+
+// checkTimeouts recovers the commands that are not committed in time.
+// The coordinator of a command is the first to try.
+func (r *Replica) checkTimeouts() {
+	now := time.Now()
+	for dot, t := range r.waiting {
+		timeout := r.timeout
+		if dot.Replica != r.Id {
+			timeout *= 2
+		}
+		if now.Sub(t) >= timeout {
+			r.waiting[dot] = now
+			r.recover(r.desc(dot))
+		}
+	}
+}
+
+func (r *Replica) recover(desc *cmdDesc) {
+	ballot := r.nextBallot(desc.bal)
+	log.Printf("Recovering %v with ballot %d", desc.dot, ballot)
+
+	desc.pbal = ballot
+	desc.recSet = desc.recSet.ReinitMsgSet(r.Rec, func(_, _ interface{}) bool {
+		return true
+	}, func(interface{}) {}, r.getRecHandler(desc, ballot))
+
+	rec := &MRec{
+		Replica: r.Id,
+		Dot:     desc.dot,
+		Ballot:  ballot,
+		Payload: smr.FALSE,
+		Cmd:     state.NOOP()[0],
+		Quorum:  []int32{},
+	}
+	if desc.phase != NONE {
+		rec.Payload = smr.TRUE
+		rec.Cmd = desc.cmd
+		rec.Quorum = desc.quorum
+	}
+	r.sender.SendToAll(rec, r.cs.recRPC)
+	r.handleRec(rec)
+}
+
+func (r *Replica) handleRec(msg *MRec) {
+	desc := r.desc(msg.Dot)
+	if desc.phase < COMMITTED {
+		if msg.Ballot <= desc.bal {
+			return
+		}
+		desc.bal = msg.Ballot
+		if desc.phase == NONE && msg.Payload == smr.TRUE {
+			desc.phase = START
+			desc.cmd = msg.Cmd
+			desc.quorum = msg.Quorum
+		}
+		if desc.phase == START {
+			desc.deps = r.depsOf(&desc.cmd)
+			desc.phase = RECOVER
+			r.addConflicts(&desc.cmd, msg.Dot)
+		}
+		r.wait(msg.Dot)
+	}
+
+	ack := &MRecAck{
+		Replica: r.Id,
+		Dot:     msg.Dot,
+		Ballot:  msg.Ballot,
+		ABallot: desc.abal,
+		Phase:   desc.phase,
+		Cmd:     desc.cmd,
+		Quorum:  desc.quorum,
+		Deps:    desc.deps,
+	}
+	if desc.phase == EXECUTED {
+		ack.Phase = COMMITTED
+	}
+	if desc.phase < COMMITTED && desc.abal > 0 {
+		ack.Cmd = desc.acmd
+		ack.Deps = desc.adeps
+	}
+	if ack.Quorum == nil {
+		ack.Quorum = []int32{}
+	}
+	if ack.Deps == nil {
+		ack.Deps = []int32{}
+	}
+
+	if msg.Replica == r.Id {
+		r.handleRecAck(ack)
+	} else {
+		r.sender.SendTo(msg.Replica, ack, r.cs.recAckRPC)
+	}
+}
+
+func (r *Replica) handleRecAck(msg *MRecAck) {
+	desc := r.desc(msg.Dot)
+	if desc.phase >= COMMITTED || msg.Ballot != desc.pbal || desc.recSet == nil {
+		return
+	}
+	desc.recSet.Add(msg.Replica, false, msg)
+}
+
+func (r *Replica) getRecHandler(desc *cmdDesc, ballot int32) smr.MsgSetHandler {
+	done := false
+	return func(_ interface{}, msgs []interface{}) {
+		if done || desc.phase >= COMMITTED || desc.pbal != ballot {
+			return
+		}
+		done = true
+
+		var (
+			accepted *MRecAck
+			payload  *MRecAck
+		)
+		for _, m := range msgs {
+			ack := m.(*MRecAck)
+			if ack.Phase >= COMMITTED {
+				r.commit(desc.dot, ack.Cmd, ack.Deps)
+				return
+			}
+			if ack.ABallot > 0 && (accepted == nil || ack.ABallot > accepted.ABallot) {
+				accepted = ack
+			}
+			if ack.Phase != NONE && payload == nil {
+				payload = ack
+			}
+		}
+
+		if accepted != nil {
+			r.startConsensus(desc, ballot, accepted.Cmd, accepted.Deps)
+			return
+		}
+		if payload == nil {
+			// the command cannot have been committed
+			r.startConsensus(desc, ballot, state.NOOP()[0], r.noDeps())
+			return
+		}
+
+		// unless the fast path is known to be impossible, only the
+		// dependencies reported by the fast quorum are considered
+		all := false
+		for _, m := range msgs {
+			ack := m.(*MRecAck)
+			all = all || ack.Replica == desc.dot.Replica ||
+				(ack.Phase == RECOVER && inQuorum(ack.Replica, payload.Quorum))
+		}
+		deps := r.noDeps()
+		reported := false
+		for _, m := range msgs {
+			ack := m.(*MRecAck)
+			if (ack.Phase == COLLECT || ack.Phase == RECOVER) &&
+				(all || inQuorum(ack.Replica, payload.Quorum)) {
+				deps = union(deps, ack.Deps)
+				reported = true
+			}
+		}
+		if !reported {
+			for _, m := range msgs {
+				ack := m.(*MRecAck)
+				if ack.Phase == COLLECT || ack.Phase == RECOVER {
+					deps = union(deps, ack.Deps)
+				}
+			}
+		}
+		r.startConsensus(desc, ballot, payload.Cmd, deps)
+	}
+}
+
+func (r *Replica) execute() {
+	again := make([]*smr.GPropose, 0)
+
+	for progress := true; progress; {
+		progress = false
+		for q := int32(0); q < int32(r.N); q++ {
+			for {
+				desc, exists := r.cmds[Dot{q, r.execUpTo[q] + 1}]
+				if !exists || desc.phase < COMMITTED {
+					break
+				}
+				if desc.phase == COMMITTED && !r.findSCC(desc, &again) {
+					break
+				}
+				r.execUpTo[q]++
+				progress = true
+			}
+		}
+	}
+
+	for _, p := range again {
+		r.handlePropose(p)
+	}
+}
+
+func (r *Replica) findSCC(root *cmdDesc, again *[]*smr.GPropose) bool {
+	index := 1
+	r.stack = r.stack[0:0]
+	ok := r.strongconnect(root, &index, again)
+	for _, desc := range r.stack {
+		desc.index = 0
+	}
+	r.stack = r.stack[0:0]
+	return ok
+}
+
+// strongconnect is Tarjan's algorithm, where a command depends on
+// every command of the replicas up to the ones given by its deps
+func (r *Replica) strongconnect(v *cmdDesc, index *int, again *[]*smr.GPropose) bool {
+	v.index = *index
+	v.lowlink = *index
+	*index++
+	l := len(r.stack)
+	r.stack = append(r.stack, v)
+
+	for q := int32(0); q < int32(r.N); q++ {
+		for i := r.execUpTo[q] + 1; i <= v.deps[q]; i++ {
+			dot := Dot{q, i}
+			w := r.desc(dot)
+			if w.phase == EXECUTED {
+				continue
+			}
+			if w.phase < COMMITTED {
+				dlog.Printf("Waiting for %v", dot)
+				r.wait(dot)
+				return false
+			}
+			if w.index == 0 {
+				if !r.strongconnect(w, index, again) {
+					return false
+				}
+				if w.lowlink < v.lowlink {
+					v.lowlink = w.lowlink
+				}
+			} else if r.inStack(w) && w.index < v.lowlink {
+				v.lowlink = w.index
+			}
+		}
+	}
+
+	if v.lowlink == v.index {
+		scc := r.stack[l:]
+		sortByDot(scc)
+		for _, w := range scc {
+			r.executeCommand(w, again)
+		}
+		r.stack = r.stack[0:l]
+	}
+	return true
+}
+
+func (r *Replica) executeCommand(desc *cmdDesc, again *[]*smr.GPropose) {
+	desc.phase = EXECUTED
+	desc.index = 0
+
+	v := state.NIL()
+	if r.Exec && desc.cmd.Op != state.NONE {
+		dlog.Printf("Executing " + desc.cmd.String())
+		v = desc.cmd.Execute(r.State)
+	}
+
+	p := desc.propose
+	if p == nil {
+		return
+	}
+	desc.propose = nil
+	if desc.cmd.Op == state.NONE && p.Command.Op != state.NONE {
+		// the command has been replaced by a no-op during recovery
+		*again = append(*again, p)
+		return
+	}
+	if !r.Dreply {
+		v = state.NIL()
+	}
+	rep := &smr.ProposeReplyTS{
+		OK:        smr.TRUE,
+		CommandId: p.CommandId,
+		Value:     v,
+		Timestamp: p.Timestamp,
+	}
+	r.ReplyProposeTS(rep, p.Reply, p.Mutex)
+}
+
+func (r *Replica) inStack(desc *cmdDesc) bool {
+	for _, d := range r.stack {
+		if d == desc {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Replica) depsOf(cmd *state.Command) []int32 {
+	deps := r.noDeps()
+	write := !state.ReadOnly(cmd)
+	for q := 0; q < r.N; q++ {
+		for _, k := range state.ConflictKeys(cmd) {
+			kd, exists := r.conflicts[q][k]
+			if !exists {
+				continue
+			}
+			d := kd.lastWrite
+			if write {
+				d = kd.last
+			}
+			if d > deps[q] {
+				deps[q] = d
+			}
+		}
+	}
+	return deps
+}
+
+func (r *Replica) addConflicts(cmd *state.Command, dot Dot) {
+	write := !state.ReadOnly(cmd)
+	for _, k := range state.ConflictKeys(cmd) {
+		kd, exists := r.conflicts[dot.Replica][k]
+		if !exists {
+			kd = &keyDeps{
+				last:      -1,
+				lastWrite: -1,
+			}
+			r.conflicts[dot.Replica][k] = kd
+		}
+		if kd.last < dot.Seq {
+			kd.last = dot.Seq
+		}
+		if write && kd.lastWrite < dot.Seq {
+			kd.lastWrite = dot.Seq
+		}
+	}
+}
+
+func (r *Replica) desc(dot Dot) *cmdDesc {
+	desc, exists := r.cmds[dot]
+	if !exists {
+		desc = &cmdDesc{
+			dot:   dot,
+			phase: NONE,
+			bal:   0,
+			abal:  0,
+			pbal:  -1,
+		}
+		r.cmds[dot] = desc
+	}
+	return desc
+}
+
+func (r *Replica) wait(dot Dot) {
+	if _, exists := r.waiting[dot]; !exists {
+		r.waiting[dot] = time.Now()
+	}
+}
+
+func (r *Replica) noDeps() []int32 {
+	deps := make([]int32, r.N)
+	for q := range deps {
+		deps[q] = -1
+	}
+	return deps
+}
+
+// nextBallot returns the smallest ballot of the replica above b.
+// Ballot q+1 is reserved to the coordinator q of a command.
+func (r *Replica) nextBallot(b int32) int32 {
+	n := int32(r.N)
+	return (b/n+1)*n + r.Id + 1
+}
+
+func union(deps1, deps2 []int32) []int32 {
+	deps := make([]int32, len(deps1))
+	for q := range deps1 {
+		deps[q] = deps1[q]
+		if q < len(deps2) && deps2[q] > deps[q] {
+			deps[q] = deps2[q]
+		}
+	}
+	return deps
+}
+
+func inQuorum(rid int32, q []int32) bool {
+	for _, id := range q {
+		if id == rid {
+			return true
+		}
+	}
+	return false
+}
+
+func sortByDot(descs []*cmdDesc) {
+	sort.Slice(descs, func(i, j int) bool {
+		d1, d2 := descs[i].dot, descs[j].dot
+		return d1.Seq < d2.Seq || (d1.Seq == d2.Seq && d1.Replica < d2.Replica)
+	})
+}
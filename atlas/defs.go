@@ -0,0 +1,79 @@
+package atlas
+
+import (
+	"fmt"
+
+	"github.com/vonaka/shreplic/state"
+)
+
+// Dot identifies the Seq-th command coordinated by Replica
+type Dot struct {
+	Replica int32
+	Seq     int32
+}
+
+func (dot Dot) String() string {
+	return fmt.Sprintf("%v.%v", dot.Replica, dot.Seq)
+}
+
+// Deps[q] = s means that a command depends on all the commands
+// coordinated by q up to the s-th one
+
+// MCollect is sent by the coordinator of Dot to every replica, those
+// of the fast Quorum compute the dependencies of Cmd on top of Deps
+type MCollect struct {
+	Replica int32
+	Dot     Dot
+	Cmd     state.Command
+	Quorum  []int32
+	Deps    []int32
+}
+
+type MCollectAck struct {
+	Replica int32
+	Dot     Dot
+	Deps    []int32
+}
+
+type MConsensus struct {
+	Replica int32
+	Dot     Dot
+	Ballot  int32
+	Cmd     state.Command
+	Deps    []int32
+}
+
+type MConsensusAck struct {
+	Replica int32
+	Dot     Dot
+	Ballot  int32
+}
+
+type MCommit struct {
+	Replica int32
+	Dot     Dot
+	Cmd     state.Command
+	Deps    []int32
+}
+
+// MRec starts the recovery of Dot, Cmd and Quorum
+// are meaningful only if Payload is TRUE
+type MRec struct {
+	Replica int32
+	Dot     Dot
+	Ballot  int32
+	Payload uint8
+	Cmd     state.Command
+	Quorum  []int32
+}
+
+type MRecAck struct {
+	Replica int32
+	Dot     Dot
+	Ballot  int32
+	ABallot int32
+	Phase   uint8
+	Cmd     state.Command
+	Quorum  []int32
+	Deps    []int32
+}
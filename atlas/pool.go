@@ -0,0 +1,182 @@
+package atlas
+
+import (
+	"sync"
+
+	"github.com/vonaka/shreplic/tools/fastrpc"
+)
+
+var mCollectPool = sync.Pool{
+	New: func() interface{} {
+		return new(MCollect)
+	},
+}
+
+// GetMCollect returns an empty MCollect taken from its pool
+func GetMCollect() *MCollect {
+	return mCollectPool.Get().(*MCollect)
+}
+
+// PutMCollect empties m and returns it to its pool
+func PutMCollect(m *MCollect) {
+	*m = MCollect{}
+	mCollectPool.Put(m)
+}
+
+func (m *MCollect) Free() {
+	PutMCollect(m)
+}
+
+func (m *MCollect) New() fastrpc.Serializable {
+	return GetMCollect()
+}
+
+var mCollectAckPool = sync.Pool{
+	New: func() interface{} {
+		return new(MCollectAck)
+	},
+}
+
+// GetMCollectAck returns an empty MCollectAck taken from its pool
+func GetMCollectAck() *MCollectAck {
+	return mCollectAckPool.Get().(*MCollectAck)
+}
+
+// PutMCollectAck empties m and returns it to its pool
+func PutMCollectAck(m *MCollectAck) {
+	*m = MCollectAck{}
+	mCollectAckPool.Put(m)
+}
+
+func (m *MCollectAck) Free() {
+	PutMCollectAck(m)
+}
+
+func (m *MCollectAck) New() fastrpc.Serializable {
+	return GetMCollectAck()
+}
+
+var mConsensusPool = sync.Pool{
+	New: func() interface{} {
+		return new(MConsensus)
+	},
+}
+
+// GetMConsensus returns an empty MConsensus taken from its pool
+func GetMConsensus() *MConsensus {
+	return mConsensusPool.Get().(*MConsensus)
+}
+
+// PutMConsensus empties m and returns it to its pool
+func PutMConsensus(m *MConsensus) {
+	*m = MConsensus{}
+	mConsensusPool.Put(m)
+}
+
+func (m *MConsensus) Free() {
+	PutMConsensus(m)
+}
+
+func (m *MConsensus) New() fastrpc.Serializable {
+	return GetMConsensus()
+}
+
+var mConsensusAckPool = sync.Pool{
+	New: func() interface{} {
+		return new(MConsensusAck)
+	},
+}
+
+// GetMConsensusAck returns an empty MConsensusAck taken from its pool
+func GetMConsensusAck() *MConsensusAck {
+	return mConsensusAckPool.Get().(*MConsensusAck)
+}
+
+// PutMConsensusAck empties m and returns it to its pool
+func PutMConsensusAck(m *MConsensusAck) {
+	*m = MConsensusAck{}
+	mConsensusAckPool.Put(m)
+}
+
+func (m *MConsensusAck) Free() {
+	PutMConsensusAck(m)
+}
+
+func (m *MConsensusAck) New() fastrpc.Serializable {
+	return GetMConsensusAck()
+}
+
+var mCommitPool = sync.Pool{
+	New: func() interface{} {
+		return new(MCommit)
+	},
+}
+
+// GetMCommit returns an empty MCommit taken from its pool
+func GetMCommit() *MCommit {
+	return mCommitPool.Get().(*MCommit)
+}
+
+// PutMCommit empties m and returns it to its pool
+func PutMCommit(m *MCommit) {
+	*m = MCommit{}
+	mCommitPool.Put(m)
+}
+
+func (m *MCommit) Free() {
+	PutMCommit(m)
+}
+
+func (m *MCommit) New() fastrpc.Serializable {
+	return GetMCommit()
+}
+
+var mRecPool = sync.Pool{
+	New: func() interface{} {
+		return new(MRec)
+	},
+}
+
+// GetMRec returns an empty MRec taken from its pool
+func GetMRec() *MRec {
+	return mRecPool.Get().(*MRec)
+}
+
+// PutMRec empties m and returns it to its pool
+func PutMRec(m *MRec) {
+	*m = MRec{}
+	mRecPool.Put(m)
+}
+
+func (m *MRec) Free() {
+	PutMRec(m)
+}
+
+func (m *MRec) New() fastrpc.Serializable {
+	return GetMRec()
+}
+
+var mRecAckPool = sync.Pool{
+	New: func() interface{} {
+		return new(MRecAck)
+	},
+}
+
+// GetMRecAck returns an empty MRecAck taken from its pool
+func GetMRecAck() *MRecAck {
+	return mRecAckPool.Get().(*MRecAck)
+}
+
+// PutMRecAck empties m and returns it to its pool
+func PutMRecAck(m *MRecAck) {
+	*m = MRecAck{}
+	mRecAckPool.Put(m)
+}
+
+func (m *MRecAck) Free() {
+	PutMRecAck(m)
+}
+
+func (m *MRecAck) New() fastrpc.Serializable {
+	return GetMRecAck()
+}
@@ -0,0 +1,618 @@
+package chain
+
+import (
+	"flag"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/vonaka/shreplic/server/smr"
+	"github.com/vonaka/shreplic/state"
+	"github.com/vonaka/shreplic/tools/dlog"
+	"github.com/vonaka/shreplic/tools/fastrpc"
+)
+
+// SEEN_HISTORY is the number of clean writes whose
+// command ids are remembered to ignore duplicates
+const SEEN_HISTORY = 1 << 16
+
+// Replica of chain replication.
+//
+// Writes are ordered by the head and applied by every replica from the
+// head to the tail, which commits them. Reads are executed by the tail.
+// In CRAQ mode, any replica executes a read on its own unless it has
+// applied an uncommitted write conflicting with the read. In this case
+// it asks the tail for the last committed write and reads the version
+// of its state that corresponds to it.
+//
+// Replicas declared dead by the master are removed from the chain. Once
+// they answer again, they are appended to the chain and their predecessor
+// sends them its state before any new write.
+type Replica struct {
+	*smr.Replica
+
+	order []int32
+	alive []bool
+	chain []int32
+	craq  bool
+
+	seq       int32
+	applied   int32
+	committed int32
+	clean     int32
+	writes    map[int32]*MWrite
+	buffered  map[int32]*MWrite
+	versions  map[int32]state.Version
+	values    map[int32]state.Value
+	seen      map[CommandId]int32
+	proposes  map[CommandId]*smr.GPropose
+	reads     map[int32]*pendingRead
+	readId    int32
+
+	epoch     int32
+	joined    []bool
+	joining   bool
+	installed int32
+
+	reconfChan chan *smr.ReconfigureArgs
+
+	sender smr.Sender
+	cs     CommunicationSupply
+}
+
+type pendingRead struct {
+	propose *smr.GPropose
+	msg     *MRead
+}
+
+type CommunicationSupply struct {
+	maxLatency time.Duration
+
+	forwardChan   chan fastrpc.Serializable
+	writeChan     chan fastrpc.Serializable
+	commitChan    chan fastrpc.Serializable
+	readChan      chan fastrpc.Serializable
+	readReplyChan chan fastrpc.Serializable
+	joinChan      chan fastrpc.Serializable
+
+	forwardRPC   uint8
+	writeRPC     uint8
+	commitRPC    uint8
+	readRPC      uint8
+	readReplyRPC uint8
+	joinRPC      uint8
+}
+
+func NewReplica(rid int, addrs []string, exec, dr bool, f int,
+	qfile, args string, ps map[string]struct{}) *Replica {
+
+	fs := flag.NewFlagSet("custom chain replication arguments", flag.ExitOnError)
+	craq := fs.Bool("craq", false, "Serve clean reads from any replica (CRAQ)")
+	fs.Parse(strings.Fields(args))
+
+	r := &Replica{
+		Replica: smr.NewReplica(rid, f, addrs, false, exec, false, dr, ps),
+
+		alive: make([]bool, len(addrs)),
+		craq:  *craq,
+
+		seq:       0,
+		applied:   -1,
+		committed: -1,
+		clean:     -1,
+		writes:    make(map[int32]*MWrite),
+		buffered:  make(map[int32]*MWrite),
+		versions:  make(map[int32]state.Version),
+		values:    make(map[int32]state.Value),
+		seen:      make(map[CommandId]int32),
+		proposes:  make(map[CommandId]*smr.GPropose),
+		reads:     make(map[int32]*pendingRead),
+		readId:    0,
+
+		epoch:     0,
+		joined:    make([]bool, len(addrs)),
+		joining:   false,
+		installed: 0,
+
+		reconfChan: make(chan *smr.ReconfigureArgs, 8),
+	}
+
+	var err error
+	r.order, err = smr.NewChainFromFile(qfile, r.Replica)
+	if err != nil && err != smr.NO_QUORUM_FILE {
+		log.Println("Cannot read the chain from", qfile, ":", err)
+	}
+	for i := range r.alive {
+		r.alive[i] = true
+	}
+	r.updateChain()
+	log.Println("Chain:", r.chain)
+
+	r.sender = smr.NewSender(r.Replica)
+	initCs(&r.cs, r.RPC)
+
+	go r.run()
+
+	return r
+}
+
+// Messages registers in t the messages of the protocol
+func Messages(t *fastrpc.Table) {
+	initCs(new(CommunicationSupply), t)
+}
+
+func initCs(cs *CommunicationSupply, t *fastrpc.Table) {
+	cs.maxLatency = 0
+
+	cs.forwardChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.writeChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.commitChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.readChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.readReplyChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.joinChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+
+	cs.forwardRPC = t.Register(new(MForward), cs.forwardChan)
+	cs.writeRPC = t.Register(new(MWrite), cs.writeChan)
+	cs.commitRPC = t.Register(new(MCommit), cs.commitChan)
+	cs.readRPC = t.Register(new(MRead), cs.readChan)
+	cs.readReplyRPC = t.Register(new(MReadReply), cs.readReplyChan)
+	cs.joinRPC = t.Register(new(MJoin), cs.joinChan)
+}
+
+// Reconfigure removes from the chain the replicas that are not alive
+// and appends to it those that have joined again
+func (r *Replica) Reconfigure(args *smr.ReconfigureArgs, reply *smr.ReconfigureReply) error {
+	a := &smr.ReconfigureArgs{
+		Epoch:  args.Epoch,
+		Alive:  make([]bool, len(args.Alive)),
+		Joined: make([]bool, len(args.Joined)),
+	}
+	copy(a.Alive, args.Alive)
+	copy(a.Joined, args.Joined)
+	r.reconfChan <- a
+	return nil
+}
+
+func (r *Replica) run() {
+	r.ConnectToPeers()
+	latencies := r.ComputeClosestPeers()
+	for _, l := range latencies {
+		d := time.Duration(l*1000*1000) * time.Nanosecond
+		if d > r.cs.maxLatency {
+			r.cs.maxLatency = d
+		}
+	}
+
+	go r.WaitForClientConnections()
+
+	for !r.Shutdown {
+		select {
+		case propose := <-r.ProposeChan:
+			r.handlePropose(propose)
+
+		case m := <-r.cs.forwardChan:
+			forward := m.(*MForward)
+			r.handleForward(forward)
+
+		case m := <-r.cs.writeChan:
+			write := m.(*MWrite)
+			r.handleWrite(write)
+
+		case m := <-r.cs.commitChan:
+			commit := m.(*MCommit)
+			r.handleCommit(commit)
+			commit.Free()
+
+		case m := <-r.cs.readChan:
+			read := m.(*MRead)
+			r.handleRead(read)
+
+		case m := <-r.cs.readReplyChan:
+			reply := m.(*MReadReply)
+			r.handleReadReply(reply)
+			reply.Free()
+
+		case m := <-r.cs.joinChan:
+			join := m.(*MJoin)
+			r.handleJoin(join)
+			join.Free()
+
+		case args := <-r.reconfChan:
+			r.handleReconfigure(args)
+		}
+	}
+}
+
+func (r *Replica) handlePropose(propose *smr.GPropose) {
+	if propose.Command.Op == state.GET || propose.Command.Op == state.SCAN {
+		r.handleClientRead(propose)
+		return
+	}
+
+	cmdId := CommandId{
+		ClientId: propose.ClientId,
+		SeqNum:   propose.CommandId,
+	}
+	r.proposes[cmdId] = propose
+	r.forward(&MForward{
+		Replica: r.Id,
+		CmdId:   cmdId,
+		Cmd:     propose.Command,
+	})
+}
+
+func (r *Replica) forward(msg *MForward) {
+	if r.head() == r.Id {
+		r.handleForward(msg)
+	} else {
+		r.sender.SendTo(r.head(), msg, r.cs.forwardRPC)
+	}
+}
+
+func (r *Replica) handleForward(msg *MForward) {
+	if _, exists := r.seen[msg.CmdId]; exists {
+		return
+	}
+	if r.head() != r.Id {
+		// the chain has changed
+		r.forward(msg)
+		return
+	}
+
+	r.handleWrite(&MWrite{
+		Replica: r.Id,
+		Origin:  msg.Replica,
+		Seq:     r.seq,
+		CmdId:   msg.CmdId,
+		Cmd:     msg.Cmd,
+	})
+}
+
+func (r *Replica) handleWrite(msg *MWrite) {
+	if msg.Seq <= r.applied {
+		return
+	}
+	if msg.Seq > r.applied+1 {
+		r.buffered[msg.Seq] = msg
+		return
+	}
+
+	r.apply(msg)
+	for w, exists := r.buffered[r.applied+1]; exists; w, exists = r.buffered[r.applied+1] {
+		delete(r.buffered, w.Seq)
+		r.apply(w)
+	}
+	r.advance()
+}
+
+func (r *Replica) apply(msg *MWrite) {
+	r.applied = msg.Seq
+	if r.seq <= msg.Seq {
+		r.seq = msg.Seq + 1
+	}
+	r.seen[msg.CmdId] = msg.Seq
+	r.writes[msg.Seq] = msg
+
+	if r.Exec {
+		dlog.Printf("Executing " + msg.Cmd.String())
+		v := msg.Cmd.Execute(r.State)
+		r.versions[msg.Seq] = r.State.Version()
+		if msg.Origin == r.Id {
+			r.values[msg.Seq] = v
+		}
+	}
+
+	if r.tail() == r.Id {
+		r.commit(msg.Seq)
+	} else {
+		r.sender.SendTo(r.successor(), &MWrite{
+			Replica: r.Id,
+			Origin:  msg.Origin,
+			Seq:     msg.Seq,
+			CmdId:   msg.CmdId,
+			Cmd:     msg.Cmd,
+		}, r.cs.writeRPC)
+	}
+}
+
+func (r *Replica) commit(seq int32) {
+	commit := &MCommit{
+		Replica: r.Id,
+		Seq:     seq,
+	}
+	r.sender.SendToAll(commit, r.cs.commitRPC)
+	r.handleCommit(commit)
+}
+
+func (r *Replica) handleCommit(msg *MCommit) {
+	if msg.Seq > r.committed {
+		r.committed = msg.Seq
+		r.advance()
+	}
+}
+
+// advance marks clean the committed writes that are applied
+func (r *Replica) advance() {
+	for r.clean < r.committed && r.clean < r.applied {
+		r.clean++
+		w := r.writes[r.clean]
+		delete(r.writes, r.clean)
+		delete(r.versions, r.clean-1)
+
+		if w.Origin != r.Id {
+			continue
+		}
+		v := r.values[w.Seq]
+		delete(r.values, w.Seq)
+		if p, exists := r.proposes[w.CmdId]; exists {
+			delete(r.proposes, w.CmdId)
+			r.reply(p, v)
+		}
+	}
+
+	if len(r.seen) > 2*SEEN_HISTORY {
+		for cmdId, seq := range r.seen {
+			if seq < r.clean-SEEN_HISTORY {
+				delete(r.seen, cmdId)
+			}
+		}
+	}
+}
+
+func (r *Replica) handleClientRead(propose *smr.GPropose) {
+	if r.tail() == r.Id || (r.craq && r.isClean(&propose.Command)) {
+		r.reply(propose, r.read(&propose.Command, r.State.Version()))
+		return
+	}
+
+	msg := &MRead{
+		Replica: r.Id,
+		Id:      r.readId,
+		Cmd:     propose.Command,
+	}
+	if r.craq {
+		msg.Cmd = state.NOOP()[0]
+	}
+	r.readId++
+	r.reads[msg.Id] = &pendingRead{
+		propose: propose,
+		msg:     msg,
+	}
+	r.sender.SendTo(r.tail(), msg, r.cs.readRPC)
+}
+
+// isClean tells whether no uncommitted write conflicts with cmd
+func (r *Replica) isClean(cmd *state.Command) bool {
+	for s := r.clean + 1; s <= r.applied; s++ {
+		if w, exists := r.writes[s]; exists && state.Conflict(&w.Cmd, cmd) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Replica) handleRead(msg *MRead) {
+	if r.tail() != r.Id {
+		// the chain has changed
+		r.sender.SendTo(r.tail(), msg, r.cs.readRPC)
+		return
+	}
+
+	reply := &MReadReply{
+		Replica: r.Id,
+		Id:      msg.Id,
+		Seq:     r.applied,
+		Value:   state.NIL(),
+	}
+	if msg.Cmd.Op != state.NONE {
+		reply.Value = r.read(&msg.Cmd, r.State.Version())
+	}
+	r.sender.SendTo(msg.Replica, reply, r.cs.readReplyRPC)
+}
+
+func (r *Replica) handleReadReply(msg *MReadReply) {
+	pr, exists := r.reads[msg.Id]
+	if !exists {
+		return
+	}
+	delete(r.reads, msg.Id)
+
+	v := msg.Value
+	if r.craq {
+		// reading a more recent committed write is fine as well
+		seq := msg.Seq
+		if seq < r.clean {
+			seq = r.clean
+		}
+		ver, exists := r.versions[seq]
+		if !exists {
+			ver = r.State.Version()
+		}
+		v = r.read(&pr.propose.Command, ver)
+	}
+	r.reply(pr.propose, v)
+}
+
+func (r *Replica) read(cmd *state.Command, ver state.Version) state.Value {
+	if !r.Exec {
+		return state.NIL()
+	}
+	v, err := cmd.ReadAt(r.State, ver)
+	if err != nil {
+		v, _ = cmd.ReadAt(r.State, r.State.Version())
+	}
+	return v
+}
+
+func (r *Replica) reply(p *smr.GPropose, v state.Value) {
+	if !r.Dreply {
+		v = state.NIL()
+	}
+	rep := &smr.ProposeReplyTS{
+		OK:        smr.TRUE,
+		CommandId: p.CommandId,
+		Value:     v,
+		Timestamp: p.Timestamp,
+	}
+	r.ReplyProposeTS(rep, p.Reply, p.Mutex)
+}
+
+func (r *Replica) handleReconfigure(args *smr.ReconfigureArgs) {
+	if args.Epoch <= r.epoch {
+		return
+	}
+	r.epoch = args.Epoch
+
+	oldHead, oldTail, oldSucc := r.head(), r.tail(), r.successor()
+	for i := range r.alive {
+		r.alive[i] = i < len(args.Alive) && args.Alive[i]
+		r.joined[i] = i < len(args.Joined) && args.Joined[i]
+		if r.joined[i] {
+			r.moveToTail(int32(i))
+		}
+	}
+	r.alive[r.Id] = true
+	r.updateChain()
+	log.Println("New chain:", r.chain)
+
+	if r.joined[r.Id] && r.installed < r.epoch {
+		// the state comes from the predecessor
+		r.joining = true
+		return
+	}
+	if r.tail() == r.Id && oldTail != r.Id {
+		// the writes that reached the new tail are committed
+		r.commit(r.applied)
+	}
+	if s := r.successor(); s != -1 && r.joined[s] {
+		r.sendState(s)
+	} else if r.tail() != r.Id && s != oldSucc {
+		// the new successor might have missed some writes
+		for s := r.clean + 1; s <= r.applied; s++ {
+			w := r.writes[s]
+			r.sender.SendTo(r.successor(), &MWrite{
+				Replica: r.Id,
+				Origin:  w.Origin,
+				Seq:     w.Seq,
+				CmdId:   w.CmdId,
+				Cmd:     w.Cmd,
+			}, r.cs.writeRPC)
+		}
+	}
+	if r.head() != oldHead {
+		r.buffered = make(map[int32]*MWrite)
+		for cmdId, p := range r.proposes {
+			if _, exists := r.seen[cmdId]; !exists {
+				r.forward(&MForward{
+					Replica: r.Id,
+					CmdId:   cmdId,
+					Cmd:     p.Command,
+				})
+			}
+		}
+	}
+	if r.tail() != oldTail {
+		for _, pr := range r.reads {
+			if r.tail() == r.Id {
+				r.handleRead(pr.msg)
+			} else {
+				r.sender.SendTo(r.tail(), pr.msg, r.cs.readRPC)
+			}
+		}
+	}
+}
+
+// sendState brings to the replica to, which joins the chain
+// again, every write applied so far
+func (r *Replica) sendState(to int32) {
+	data := make([]state.Command, 0)
+	err := r.State.Range(r.State.Version(), func(k state.Key, v state.Value) bool {
+		data = append(data, state.Command{
+			Op: state.PUT,
+			K:  k,
+			V:  v,
+		})
+		return true
+	})
+	if err != nil {
+		log.Println("Cannot take a snapshot:", err)
+		return
+	}
+
+	r.sender.SendTo(to, &MJoin{
+		Replica: r.Id,
+		Epoch:   r.epoch,
+		Seq:     r.applied,
+		Data:    data,
+	}, r.cs.joinRPC)
+}
+
+func (r *Replica) handleJoin(msg *MJoin) {
+	if msg.Epoch < r.installed {
+		return
+	}
+	r.installed = msg.Epoch
+	r.joining = false
+
+	// the write Seq is executed at the position Seq
+	r.State.Install(state.Version(msg.Seq), msg.Data)
+	r.seq = msg.Seq + 1
+	r.applied = msg.Seq
+	r.committed = msg.Seq
+	r.clean = msg.Seq
+	r.writes = make(map[int32]*MWrite)
+	r.buffered = make(map[int32]*MWrite)
+	r.versions = make(map[int32]state.Version)
+	r.values = make(map[int32]state.Value)
+	log.Println("Joined the chain after write", msg.Seq)
+
+	if s := r.successor(); s != -1 && msg.Epoch == r.epoch && r.joined[s] {
+		r.sendState(s)
+	}
+	for cmdId, p := range r.proposes {
+		if _, exists := r.seen[cmdId]; !exists {
+			r.forward(&MForward{
+				Replica: r.Id,
+				CmdId:   cmdId,
+				Cmd:     p.Command,
+			})
+		}
+	}
+}
+
+// moveToTail puts id at the end of the chain order
+func (r *Replica) moveToTail(id int32) {
+	order := make([]int32, 0, len(r.order))
+	for _, i := range r.order {
+		if i != id {
+			order = append(order, i)
+		}
+	}
+	r.order = append(order, id)
+}
+
+func (r *Replica) updateChain() {
+	r.chain = make([]int32, 0, len(r.order))
+	for _, id := range r.order {
+		if r.alive[id] {
+			r.chain = append(r.chain, id)
+		}
+	}
+}
+
+func (r *Replica) head() int32 {
+	return r.chain[0]
+}
+
+func (r *Replica) tail() int32 {
+	return r.chain[len(r.chain)-1]
+}
+
+func (r *Replica) successor() int32 {
+	for i, id := range r.chain {
+		if id == r.Id && i+1 < len(r.chain) {
+			return r.chain[i+1]
+		}
+	}
+	return -1
+}
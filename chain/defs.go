@@ -0,0 +1,64 @@
+package chain
+
+import (
+	"fmt"
+
+	"github.com/vonaka/shreplic/state"
+)
+
+type CommandId struct {
+	ClientId int32
+	SeqNum   int32
+}
+
+func (cmdId CommandId) String() string {
+	return fmt.Sprintf("%v,%v", cmdId.ClientId, cmdId.SeqNum)
+}
+
+// MForward brings to the head a write received by Replica
+type MForward struct {
+	Replica int32
+	CmdId   CommandId
+	Cmd     state.Command
+}
+
+// MWrite is the Seq-th write, it travels from the head to the tail.
+// Origin is the replica that replies to the client.
+type MWrite struct {
+	Replica int32
+	Origin  int32
+	Seq     int32
+	CmdId   CommandId
+	Cmd     state.Command
+}
+
+// MCommit is broadcast by the tail once it has applied
+// every write up to Seq
+type MCommit struct {
+	Replica int32
+	Seq     int32
+}
+
+// MRead asks the tail to execute Cmd. In CRAQ mode Cmd is a no-op and
+// the tail only tells the last write it has committed.
+type MRead struct {
+	Replica int32
+	Id      int32
+	Cmd     state.Command
+}
+
+type MReadReply struct {
+	Replica int32
+	Id      int32
+	Seq     int32
+	Value   state.Value
+}
+
+// MJoin brings to a replica that joins the chain again in Epoch
+// the content of the state once every write up to Seq is applied
+type MJoin struct {
+	Replica int32
+	Epoch   int32
+	Seq     int32
+	Data    []state.Command
+}
@@ -0,0 +1,157 @@
+package chain
+
+import (
+	"sync"
+
+	"github.com/vonaka/shreplic/tools/fastrpc"
+)
+
+var mForwardPool = sync.Pool{
+	New: func() interface{} {
+		return new(MForward)
+	},
+}
+
+// GetMForward returns an empty MForward taken from its pool
+func GetMForward() *MForward {
+	return mForwardPool.Get().(*MForward)
+}
+
+// PutMForward empties m and returns it to its pool
+func PutMForward(m *MForward) {
+	*m = MForward{}
+	mForwardPool.Put(m)
+}
+
+func (m *MForward) Free() {
+	PutMForward(m)
+}
+
+func (m *MForward) New() fastrpc.Serializable {
+	return GetMForward()
+}
+
+var mWritePool = sync.Pool{
+	New: func() interface{} {
+		return new(MWrite)
+	},
+}
+
+// GetMWrite returns an empty MWrite taken from its pool
+func GetMWrite() *MWrite {
+	return mWritePool.Get().(*MWrite)
+}
+
+// PutMWrite empties m and returns it to its pool
+func PutMWrite(m *MWrite) {
+	*m = MWrite{}
+	mWritePool.Put(m)
+}
+
+func (m *MWrite) Free() {
+	PutMWrite(m)
+}
+
+func (m *MWrite) New() fastrpc.Serializable {
+	return GetMWrite()
+}
+
+var mCommitPool = sync.Pool{
+	New: func() interface{} {
+		return new(MCommit)
+	},
+}
+
+// GetMCommit returns an empty MCommit taken from its pool
+func GetMCommit() *MCommit {
+	return mCommitPool.Get().(*MCommit)
+}
+
+// PutMCommit empties m and returns it to its pool
+func PutMCommit(m *MCommit) {
+	*m = MCommit{}
+	mCommitPool.Put(m)
+}
+
+func (m *MCommit) Free() {
+	PutMCommit(m)
+}
+
+func (m *MCommit) New() fastrpc.Serializable {
+	return GetMCommit()
+}
+
+var mReadPool = sync.Pool{
+	New: func() interface{} {
+		return new(MRead)
+	},
+}
+
+// GetMRead returns an empty MRead taken from its pool
+func GetMRead() *MRead {
+	return mReadPool.Get().(*MRead)
+}
+
+// PutMRead empties m and returns it to its pool
+func PutMRead(m *MRead) {
+	*m = MRead{}
+	mReadPool.Put(m)
+}
+
+func (m *MRead) Free() {
+	PutMRead(m)
+}
+
+func (m *MRead) New() fastrpc.Serializable {
+	return GetMRead()
+}
+
+var mReadReplyPool = sync.Pool{
+	New: func() interface{} {
+		return new(MReadReply)
+	},
+}
+
+// GetMReadReply returns an empty MReadReply taken from its pool
+func GetMReadReply() *MReadReply {
+	return mReadReplyPool.Get().(*MReadReply)
+}
+
+// PutMReadReply empties m and returns it to its pool
+func PutMReadReply(m *MReadReply) {
+	*m = MReadReply{}
+	mReadReplyPool.Put(m)
+}
+
+func (m *MReadReply) Free() {
+	PutMReadReply(m)
+}
+
+func (m *MReadReply) New() fastrpc.Serializable {
+	return GetMReadReply()
+}
+
+var mJoinPool = sync.Pool{
+	New: func() interface{} {
+		return new(MJoin)
+	},
+}
+
+// GetMJoin returns an empty MJoin taken from its pool
+func GetMJoin() *MJoin {
+	return mJoinPool.Get().(*MJoin)
+}
+
+// PutMJoin empties m and returns it to its pool
+func PutMJoin(m *MJoin) {
+	*m = MJoin{}
+	mJoinPool.Put(m)
+}
+
+func (m *MJoin) Free() {
+	PutMJoin(m)
+}
+
+func (m *MJoin) New() fastrpc.Serializable {
+	return GetMJoin()
+}
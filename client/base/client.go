@@ -13,16 +13,17 @@ import (
 	"net/http"
 	"net/rpc"
 	"os"
-	"os/exec"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/vonaka/shreplic/master/defs"
 	"github.com/vonaka/shreplic/server/smr"
+	"github.com/vonaka/shreplic/shard"
 	"github.com/vonaka/shreplic/state"
 	"github.com/vonaka/shreplic/tools/fastrpc"
+	"github.com/vonaka/shreplic/tools/mtls"
+	"github.com/vonaka/shreplic/tools/transport"
 )
 
 type Client struct {
@@ -45,6 +46,10 @@ type Client struct {
 	LocalRead  bool
 	Leaderless bool
 
+	// GetTimestamp, if set, gives the Timestamp field
+	// of the proposal that carries cmd
+	GetTimestamp func(cmd *state.Command) int64
+
 	RPC       *fastrpc.Table
 	ResChan   chan []byte
 	Waiting   chan struct{}
@@ -59,9 +64,43 @@ type Client struct {
 	masterAddr     string
 	replicaList    []string
 	collocatedWith string
+
+	shards   *shard.Map
+	groups   []*groupConn
+	group    int
+	rerouted int32
+}
+
+// groupConn holds the connections of the client to a consensus group.
+// The fields of the client describe the group that is currently used.
+type groupConn struct {
+	n            int
+	leaderId     int
+	closestId    int
+	collocatedId int
+	ping         []float64
+	minLatency   float64
+	maxLatency   float64
+	replicaList  []string
+	servers      []net.Conn
+	readers      []*bufio.Reader
+	writers      []*bufio.Writer
 }
 
-const TIMEOUT = 3 * time.Second
+const (
+	TIMEOUT = 3 * time.Second
+	// MOVING_WAIT is the time to wait before asking again
+	// for the partition map while a range is being moved
+	MOVING_WAIT = 100 * time.Millisecond
+)
+
+var BAD_BEACON_REPLY = errors.New("Unexpected reply to a beacon")
+
+// TLS secures the connections of clients, nil means plaintext
+var TLS *mtls.Config = nil
+
+// Transport carries the connections to the replicas
+var Transport = transport.TCP
 
 func NewClient(maddr string, mport int, fast, lread, leaderLess, verbose bool) *Client {
 	return NewClientWithLog(maddr, mport, fast, lread, leaderLess, verbose, nil)
@@ -107,6 +146,11 @@ func NewClientWithLog(maddr string, mport int,
 		masterAddr:     maddr,
 		replicaList:    nil,
 		collocatedWith: "",
+
+		shards:   nil,
+		groups:   nil,
+		group:    0,
+		rerouted: -1,
 	}
 }
 
@@ -122,21 +166,41 @@ func (c *Client) Connect() error {
 	}
 	defer master.Close()
 
-	c.Println("Getting list of replicas...")
-	rl, err := askMaster(master, "GetReplicaList", c.Logger)
+	c.Println("Getting partition map...")
+	sm, err := askMaster(master, "GetShardMap", 0, c.Logger)
 	if err != nil {
 		return err
 	}
-	masterReply := rl.(*defs.GetReplicaListReply)
-	c.replicaList = masterReply.ReplicaList
+	c.shards = &sm.(*defs.GetShardMapReply).Map
+	c.Println("Partition map", c.shards)
+
+	c.groups = make([]*groupConn, c.shards.Groups)
+	for g := range c.groups {
+		c.groups[g] = &groupConn{}
+		c.group = g
+		c.LeaderId = -1
+		c.ClosestId = -1
+		c.CollocatedId = -1
+		c.Ping = []float64{}
+		if err := c.connectGroup(master, g); err != nil {
+			return err
+		}
+		c.save()
+	}
+	c.load(0)
 
-	c.Println("Searching for the closest replica...")
-	err = c.findClosestReplica(masterReply.AliveList)
+	c.Println("Connected")
+	return nil
+}
+
+func (c *Client) connectGroup(master *rpc.Client, g int) error {
+	c.Println("Getting list of replicas of group", g, "...")
+	rl, err := askMaster(master, "GetReplicaList", g, c.Logger)
 	if err != nil {
 		return err
 	}
-	c.Println("Node list", c.replicaList)
-	c.Println("Closest (alive)", c.ClosestId)
+	masterReply := rl.(*defs.GetReplicaListReply)
+	c.replicaList = masterReply.ReplicaList
 
 	c.N = len(c.replicaList)
 	c.servers = make([]net.Conn, c.N)
@@ -145,7 +209,7 @@ func (c *Client) Connect() error {
 
 	if !c.Leaderless {
 		c.Println("Getting leader from master...")
-		gl, err := askMaster(master, "GetLeader", c.Logger)
+		gl, err := askMaster(master, "GetLeader", g, c.Logger)
 		if err != nil {
 			return err
 		}
@@ -165,13 +229,25 @@ func (c *Client) Connect() error {
 
 	for _, i := range toConnect {
 		c.Println("Connection to", i, "->", c.replicaList[i])
-		c.servers[i], err = dial(c.replicaList[i], false, c.Logger)
+		c.servers[i], err = dial(Transport, c.replicaList[i],
+			mtls.ReplicaName(g, int32(i)), false, c.Logger)
 		if err != nil {
 			return err
 		}
 		c.readers[i] = bufio.NewReader(c.servers[i])
 		c.writers[i] = bufio.NewWriter(c.servers[i])
-		go func(reader *bufio.Reader) {
+	}
+
+	c.Println("Searching for the closest replica...")
+	err = c.findClosestReplica(masterReply.AliveList)
+	if err != nil {
+		return err
+	}
+	c.Println("Node list", c.replicaList)
+	c.Println("Closest (alive)", c.ClosestId)
+
+	for _, i := range toConnect {
+		go func(i int, reader *bufio.Reader) {
 			// track RPC-table
 			for c.ReadTable {
 				var (
@@ -181,6 +257,26 @@ func (c *Client) Connect() error {
 				if msgType, err = reader.ReadByte(); err != nil {
 					break
 				}
+				if msgType == smr.WRONG_GROUP || msgType == smr.BUSY {
+					// this is the OK field of a ProposeReplyTS
+					reader.UnreadByte()
+					rep := &smr.ProposeReplyTS{}
+					if err = rep.Unmarshal(reader); err != nil {
+						break
+					}
+					if rep.OK == smr.BUSY {
+						if rep.CommandId == c.LastPropose.CommandId {
+							c.retry(i, rep)
+						}
+						continue
+					}
+					if rep.CommandId == c.LastPropose.CommandId &&
+						rep.CommandId != c.rerouted {
+						c.rerouted = rep.CommandId
+						c.reroute()
+					}
+					continue
+				}
 				p, exists := c.RPC.Get(msgType)
 				if !exists {
 					c.Println("Error: received unknown message:", msgType)
@@ -194,15 +290,22 @@ func (c *Client) Connect() error {
 					p.Chan <- obj
 				}(obj)
 			}
-		}(c.readers[i])
+		}(i, c.readers[i])
 	}
 
-	c.Println("Connected")
 	return nil
 }
 
 func (c *Client) Disconnect() {
-	for _, server := range c.servers {
+	servers := c.servers
+	if c.groups != nil {
+		c.save()
+		servers = nil
+		for _, g := range c.groups {
+			servers = append(servers, g.servers...)
+		}
+	}
+	for _, server := range servers {
 		if server != nil {
 			server.Close()
 		}
@@ -218,15 +321,27 @@ func (c *Client) Reconnect() error {
 	}
 	defer master.Close()
 
+	c.Println("Getting partition map...")
+	sm, err := askMaster(master, "GetShardMap", 0, c.Logger)
+	if err != nil {
+		return err
+	}
+	c.shards = &sm.(*defs.GetShardMapReply).Map
+
 	if !c.Leaderless {
-		c.Println("Getting leader from master...")
-		gl, err := askMaster(master, "GetLeader", c.Logger)
-		if err != nil {
-			return err
+		current := c.group
+		for g := range c.groups {
+			c.activate(g)
+			c.Println("Getting leader of group", g, "from master...")
+			gl, err := askMaster(master, "GetLeader", g, c.Logger)
+			if err != nil {
+				return err
+			}
+			masterReply := gl.(*defs.GetLeaderReply)
+			c.LeaderId = masterReply.LeaderId
+			c.Println("The leader is replicas", c.LeaderId)
 		}
-		masterReply := gl.(*defs.GetLeaderReply)
-		c.LeaderId = masterReply.LeaderId
-		c.Println("The leader is replicas", c.LeaderId)
+		c.activate(current)
 	}
 
 	return nil
@@ -268,7 +383,29 @@ func (c *Client) Read(key int64) []byte {
 	return c.execute(args)
 }
 
+// Scan reads the keys [key, key+count]. If they are served by several
+// groups, each group is asked for its part, one after the other.
 func (c *Client) Scan(key, count int64) []byte {
+	if len(c.groups) > 1 {
+		cmd := state.Command{
+			Op: state.SCAN,
+			K:  state.Key(key),
+			V:  make([]byte, 8),
+		}
+		binary.LittleEndian.PutUint64(cmd.V, uint64(count))
+		lo, hi := state.KeyRange(&cmd)
+		if parts := c.shards.Cut(lo, hi); len(parts) > 1 {
+			v := make([]byte, 0)
+			for _, p := range parts {
+				v = append(v, c.scan(int64(p[0]), int64(p[1]-p[0]))...)
+			}
+			return v
+		}
+	}
+	return c.scan(key, count)
+}
+
+func (c *Client) scan(key, count int64) []byte {
 	c.Reading = false
 	c.Seqnum++
 	args := smr.Propose{
@@ -287,6 +424,21 @@ func (c *Client) Scan(key, count int64) []byte {
 	return c.execute(args)
 }
 
+// Propose submits an arbitrary command
+func (c *Client) Propose(cmd state.Command) []byte {
+	c.Reading = false
+	c.Seqnum++
+	args := smr.Propose{
+		CommandId: c.Seqnum,
+		ClientId:  c.ClientId,
+		Command:   cmd,
+		Timestamp: 0,
+	}
+
+	c.Println(args.Command.String())
+	return c.execute(args)
+}
+
 func (c *Client) Stats() string {
 	c.writers[c.ClosestId].WriteByte(smr.STATS)
 	c.writers[c.ClosestId].Flush()
@@ -295,6 +447,11 @@ func (c *Client) Stats() string {
 	return string(bytes.Trim(arr, "\x00"))
 }
 
+// Connected tells whether the client is connected to replica rid
+func (c *Client) Connected(rid int) bool {
+	return c.readers[rid] != nil
+}
+
 func (c *Client) ProposeReplyFrom(rid int) (*smr.ProposeReplyTS, error) {
 	rep := &smr.ProposeReplyTS{}
 	err := rep.Unmarshal(c.readers[rid])
@@ -325,6 +482,17 @@ func (c *Client) SendMsg(rid int32, code uint8, msg fastrpc.Serializable) {
 }
 
 func (c *Client) execute(args smr.Propose) []byte {
+	c.send(args)
+	c.Waiting <- struct{}{}
+	return <-c.ResChan
+}
+
+func (c *Client) send(args smr.Propose) {
+	c.route(args.Command.K)
+	if c.GetTimestamp != nil {
+		args.Timestamp = c.GetTimestamp(&args.Command)
+	}
+
 	submitter := c.LeaderId
 	if c.Leaderless {
 		submitter = c.ClosestId
@@ -347,9 +515,102 @@ func (c *Client) execute(args smr.Propose) []byte {
 			}
 		}
 	}
+}
 
-	c.Waiting <- struct{}{}
-	return <-c.ResChan
+// route makes the group that serves k the current one
+func (c *Client) route(k state.Key) {
+	if len(c.groups) < 2 {
+		return
+	}
+	g := c.shards.Lookup(k)
+	for g == shard.MOVING {
+		time.Sleep(MOVING_WAIT)
+		c.refreshShards()
+		g = c.shards.Lookup(k)
+	}
+	c.activate(g)
+}
+
+// reroute sends the last proposal again after a replica
+// has answered that its group does not serve the key
+func (c *Client) reroute() {
+	c.Println("Wrong group for", c.LastPropose.Command.String())
+	if !c.refreshShards() {
+		time.Sleep(MOVING_WAIT)
+	}
+	c.send(c.LastPropose)
+}
+
+// retry sends the last proposal again to the replica rid
+// once the time it has asked to wait in rep has elapsed
+func (c *Client) retry(rid int, rep *smr.ProposeReplyTS) {
+	c.Println("Replica", rid, "is busy, retrying", c.LastPropose.CommandId)
+	time.Sleep(time.Duration(rep.RetryAfter))
+	w := c.writers[rid]
+	w.WriteByte(smr.PROPOSE)
+	c.LastPropose.Marshal(w)
+	w.Flush()
+}
+
+// refreshShards asks the master for the partition map
+// and tells whether the map has changed
+func (c *Client) refreshShards() bool {
+	master, err := c.dialMaster()
+	if err != nil {
+		return false
+	}
+	defer master.Close()
+
+	sm, err := askMaster(master, "GetShardMap", 0, c.Logger)
+	if err != nil {
+		return false
+	}
+	m := &sm.(*defs.GetShardMapReply).Map
+	if m.Epoch <= c.shards.Epoch {
+		return false
+	}
+	c.shards = m
+	c.Println("Partition map", c.shards)
+	return true
+}
+
+func (c *Client) activate(g int) {
+	if g == c.group {
+		return
+	}
+	c.save()
+	c.load(g)
+}
+
+func (c *Client) save() {
+	g := c.groups[c.group]
+	g.n = c.N
+	g.leaderId = c.LeaderId
+	g.closestId = c.ClosestId
+	g.collocatedId = c.CollocatedId
+	g.ping = c.Ping
+	g.minLatency = c.MinLatency
+	g.maxLatency = c.MaxLatency
+	g.replicaList = c.replicaList
+	g.servers = c.servers
+	g.readers = c.readers
+	g.writers = c.writers
+}
+
+func (c *Client) load(i int) {
+	g := c.groups[i]
+	c.group = i
+	c.N = g.n
+	c.LeaderId = g.leaderId
+	c.ClosestId = g.closestId
+	c.CollocatedId = g.collocatedId
+	c.Ping = g.ping
+	c.MinLatency = g.minLatency
+	c.MaxLatency = g.maxLatency
+	c.replicaList = g.replicaList
+	c.servers = g.servers
+	c.readers = g.readers
+	c.writers = g.writers
 }
 
 func (c *Client) findClosestReplica(alive []bool) error {
@@ -373,9 +634,8 @@ func (c *Client) findClosestReplica(alive []bool) error {
 			c.ClosestId = i
 		}
 
-		out, err := exec.Command("ping", addr, "-c 3", "-q").Output()
+		latency, err := c.rtt(i)
 		if err == nil {
-			latency, _ := strconv.ParseFloat(strings.Split(string(out), "/")[4], 64)
 			c.Logger.Println(i, "->", latency)
 			c.Ping = append(c.Ping, latency)
 
@@ -399,16 +659,52 @@ func (c *Client) findClosestReplica(alive []bool) error {
 	return nil
 }
 
+// rtt returns the mean round-trip time of beacons to the replica i
+// in milliseconds. It must be called before the replies of i are read.
+func (c *Client) rtt(i int) (float64, error) {
+	const pings = 3
+	var (
+		rtt   time.Duration
+		reply smr.BeaconReply
+	)
+	defer c.servers[i].SetReadDeadline(time.Time{})
+
+	for p := 0; p < pings; p++ {
+		c.writers[i].WriteByte(smr.GENERIC_SMR_BEACON)
+		beacon := &smr.Beacon{
+			Timestamp: time.Now().UnixNano(),
+		}
+		beacon.Marshal(c.writers[i])
+		if err := c.writers[i].Flush(); err != nil {
+			return 0, err
+		}
+
+		c.servers[i].SetReadDeadline(time.Now().Add(TIMEOUT))
+		code, err := c.readers[i].ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if code != smr.GENERIC_SMR_BEACON_REPLY {
+			return 0, BAD_BEACON_REPLY
+		}
+		if err := reply.Unmarshal(c.readers[i]); err != nil {
+			return 0, err
+		}
+		rtt += time.Duration(time.Now().UnixNano() - reply.Timestamp)
+	}
+	return float64(rtt) / float64(pings*time.Millisecond), nil
+}
+
 func (c *Client) dialMaster() (*rpc.Client, error) {
 	addr := fmt.Sprintf("%s:%d", c.masterAddr, c.masterPort)
-	conn, err := dial(addr, true, c.Logger)
+	conn, err := dial(transport.TCP, addr, mtls.MASTER, true, c.Logger)
 	if err != nil {
 		return nil, err
 	}
 	return rpc.NewClient(conn), nil
 }
 
-func dial(addr string, connect bool, logger *log.Logger) (net.Conn, error) {
+func dial(t transport.Transport, addr, name string, connect bool, logger *log.Logger) (net.Conn, error) {
 	var (
 		err  error    = nil
 		conn net.Conn = nil
@@ -416,7 +712,7 @@ func dial(addr string, connect bool, logger *log.Logger) (net.Conn, error) {
 	)
 
 	for try := 0; try < 3; try++ {
-		conn, err = net.DialTimeout("tcp", addr, TIMEOUT)
+		conn, err = TLS.Dial(t, addr, name, TIMEOUT)
 		if err == nil {
 			if connect {
 				io.WriteString(conn, "CONNECT "+rpc.DefaultRPCPath+" HTTP/1.0\n\n")
@@ -441,29 +737,38 @@ func dial(addr string, connect bool, logger *log.Logger) (net.Conn, error) {
 	return nil, errors.New("cannot connect")
 }
 
-func askMaster(master *rpc.Client, method string, l *log.Logger) (interface{}, error) {
+func askMaster(master *rpc.Client, method string, group int, l *log.Logger) (interface{}, error) {
 	var (
 		gl     *defs.GetLeaderReply
 		rl     *defs.GetReplicaListReply
+		sm     *defs.GetShardMapReply
 		glArgs *defs.GetLeaderArgs
 		rlArgs *defs.GetReplicaListArgs
+		smArgs *defs.GetShardMapArgs
 	)
 
 	for i := 0; i < 100; i++ {
 		if method == "GetReplicaList" {
 			rl = &defs.GetReplicaListReply{}
-			rlArgs = &defs.GetReplicaListArgs{}
+			rlArgs = &defs.GetReplicaListArgs{Group: group}
 			err := call(master, "Master."+method, rlArgs, rl, l)
 			if err == nil && rl.Ready {
 				return rl, nil
 			}
 		} else if method == "GetLeader" {
 			gl = &defs.GetLeaderReply{}
-			glArgs = &defs.GetLeaderArgs{}
+			glArgs = &defs.GetLeaderArgs{Group: group}
 			err := call(master, "Master."+method, glArgs, gl, l)
 			if err == nil {
 				return gl, nil
 			}
+		} else if method == "GetShardMap" {
+			sm = &defs.GetShardMapReply{}
+			smArgs = &defs.GetShardMapArgs{}
+			err := call(master, "Master."+method, smArgs, sm, l)
+			if err == nil {
+				return sm, nil
+			}
 		}
 	}
 
@@ -109,6 +109,29 @@ func (c *SimpleClient) Scan(key, count int64) []byte {
 	return v
 }
 
+// Propose returns nil if no response has been received
+func (c *SimpleClient) Propose(cmd state.Command) []byte {
+	v := make(chan []byte, 1)
+	go func() {
+		v <- c.Client.Propose(cmd)
+	}()
+	<-c.Waiting
+	var err error
+	if c.WaitResponse != nil {
+		err = c.WaitResponse()
+	} else {
+		if c.Fast {
+			err = c.waitReplies(c.ClosestId, c.Seqnum)
+		} else {
+			err = c.waitReplies(c.LastSubmitter, c.Seqnum)
+		}
+	}
+	if err != nil {
+		return nil
+	}
+	return <-v
+}
+
 func (c *SimpleClient) Run() error {
 	return c.run(true)
 }
@@ -204,6 +227,23 @@ func (c *SimpleClient) waitReplies(rid int, cmdId int32) error {
 		if rep.CommandId != cmdId {
 			continue
 		}
+		if rep.OK == smr.BUSY {
+			// replicas might remember the reply to cmdId
+			c.Seqnum++
+			c.LastPropose.CommandId = c.Seqnum
+			cmdId = c.Seqnum
+			c.retry(rid, rep)
+			continue
+		}
+		if rep.OK == smr.WRONG_GROUP {
+			c.reroute()
+			if c.Fast {
+				rid = c.ClosestId
+			} else {
+				rid = c.LastSubmitter
+			}
+			continue
+		}
 		if rep.OK == smr.TRUE {
 			c.Println("Returning:", rep.Value.String())
 			c.ResChan <- rep.Value
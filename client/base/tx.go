@@ -0,0 +1,139 @@
+package base
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/vonaka/shreplic/state"
+)
+
+var TX_UNKNOWN = errors.New("Transaction outcome is unknown")
+
+// Tx is a set of writes applied atomically across groups.
+//
+// The client coordinates two-phase commit: every group touched by the
+// transaction prepares its part through its replication protocol, then
+// the decision is replicated by the group of the smallest key before
+// being sent to the other groups. Replicas must reply to clients only
+// after execution (which is the default, see -dreply).
+type Tx struct {
+	c      *SimpleClient
+	writes map[state.Key]state.Value
+}
+
+func (c *SimpleClient) Begin() *Tx {
+	return &Tx{
+		c:      c,
+		writes: make(map[state.Key]state.Value),
+	}
+}
+
+func (t *Tx) Write(key int64, value []byte) {
+	t.writes[state.Key(key)] = value
+}
+
+// Commit returns true if the transaction has been committed. In case
+// of error the transaction will be eventually finished by the master
+// (see RecoverTx), unless its writes do not fit in a command, in which
+// case nothing is proposed and state.TX_TOO_LARGE is returned.
+func (t *Tx) Commit() (bool, error) {
+	if len(t.writes) == 0 {
+		return true, nil
+	}
+
+	c := t.c
+	all := make([]state.Key, 0, len(t.writes))
+	for k := range t.writes {
+		all = append(all, k)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i] < all[j]
+	})
+	tx := &state.Tx{
+		Id:    state.TxId(int64(c.ClientId)<<32 | int64(uint32(c.Seqnum+1))),
+		Coord: all[0],
+		All:   all,
+	}
+
+	parts := c.participants(tx, t.writes)
+	prepares := make([]state.Command, len(parts))
+	for i, p := range parts {
+		cmd, err := state.PrepareCommand(p)
+		if err != nil {
+			return false, err
+		}
+		prepares[i] = cmd
+	}
+
+	// a transaction that blocks this one and is abandoned
+	// by its coordinator is finished by the master
+	commit := true
+	prepared := make([]*state.Tx, 0, len(parts))
+	for i, p := range parts {
+		// a participant that did not answer might have prepared
+		prepared = append(prepared, p)
+		if ok, _ := state.Vote(c.Propose(prepares[i])); !ok {
+			commit = false
+			break
+		}
+	}
+
+	if commit {
+		d := c.Propose(state.DecideCommand(tx.Id, tx.Coord, true))
+		if d == nil {
+			return false, TX_UNKNOWN
+		}
+		commit = state.Decision(d)
+	}
+
+	for _, p := range prepared {
+		c.Propose(state.FinishCommand(p, commit))
+	}
+	return commit, nil
+}
+
+// RecoverTx finishes a transaction whose coordinator might have failed.
+// The transaction is aborted unless it has already been decided.
+func (c *SimpleClient) RecoverTx(t *state.Tx) (bool, error) {
+	d := c.Propose(state.DecideCommand(t.Id, t.Coord, false))
+	if d == nil {
+		return false, TX_UNKNOWN
+	}
+	commit := state.Decision(d)
+	for _, p := range c.participants(t, nil) {
+		c.Propose(state.FinishCommand(p, commit))
+	}
+	return commit, nil
+}
+
+// participants splits the keys of t between the groups that serve them
+func (c *Client) participants(t *state.Tx, writes map[state.Key]state.Value) []*state.Tx {
+	parts := make(map[int]*state.Tx)
+	groups := make([]int, 0)
+	for _, k := range t.All {
+		g := 0
+		if len(c.groups) > 1 {
+			g = c.shards.Lookup(k)
+		}
+		p, exists := parts[g]
+		if !exists {
+			p = &state.Tx{
+				Id:    t.Id,
+				Coord: t.Coord,
+				All:   t.All,
+			}
+			parts[g] = p
+			groups = append(groups, g)
+		}
+		p.Keys = append(p.Keys, k)
+		if writes != nil {
+			p.Values = append(p.Values, writes[k])
+		}
+	}
+
+	ps := make([]*state.Tx, len(groups))
+	for i, g := range groups {
+		ps[i] = parts[g]
+	}
+	return ps
+}
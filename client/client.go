@@ -12,8 +12,13 @@ import (
 
 	"github.com/vonaka/shreplic/client/base"
 	"github.com/vonaka/shreplic/curp"
+	"github.com/vonaka/shreplic/fastpaxos"
 	"github.com/vonaka/shreplic/paxoi"
+	"github.com/vonaka/shreplic/pbft"
 	"github.com/vonaka/shreplic/tools/dlog"
+	"github.com/vonaka/shreplic/tools/mtls"
+	"github.com/vonaka/shreplic/tools/transport"
+	"github.com/vonaka/shreplic/unistore"
 )
 
 var (
@@ -34,12 +39,29 @@ var (
 	logFile        = flag.String("logf", "", "Path to the log file")
 	paxoiClient    = flag.Bool("paxoi", false, "Run Paxoi external client")
 	curpClient     = flag.Bool("curp", false, "Run CURP external client")
+	unistoreClient = flag.Bool("unistore", false, "Run Unistore external client")
+	fpaxosClient   = flag.Bool("fastpaxos", false, "Run Fast Paxos external client")
+	pbftClient     = flag.Bool("pbft", false, "Run PBFT external client")
 	args           = flag.String("args", "", "Custom arguments")
+	certFile       = flag.String("cert", "", "Certificate of the client (enables TLS)")
+	keyFile        = flag.String("key", "", "Private key of the certificate")
+	caFile         = flag.String("ca", "", "Certificate of the CA that signs the certificates of all nodes")
+	transp         = flag.String("transport", "tcp", "Transport of the connections to the replicas: tcp, udp, unix or unix:<dir>")
 )
 
 func main() {
 	flag.Parse()
 
+	var err error
+	base.TLS, err = mtls.Load(*certFile, *keyFile, *caFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	base.Transport, err = transport.Get(*transp)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	var wg sync.WaitGroup
 	for i := 0; i < *cloneNb+1; i++ {
 		wg.Add(1)
@@ -78,6 +100,27 @@ func runSimpleClient(i int) {
 		if err != nil {
 			fmt.Println(err)
 		}
+	} else if *unistoreClient {
+		c := unistore.NewClient(*maddr, *collocatedWith, *mport, *reqNum, *writes,
+			*psize, *conflicts, *fast, *lread, *noLeader, *verbose, l, *args)
+		err := c.Run()
+		if err != nil {
+			fmt.Println(err)
+		}
+	} else if *fpaxosClient {
+		c := fastpaxos.NewClient(*maddr, *collocatedWith, *mport, *reqNum, *writes,
+			*psize, *conflicts, *fast, *lread, *noLeader, *verbose, l, *args)
+		err := c.Run()
+		if err != nil {
+			fmt.Println(err)
+		}
+	} else if *pbftClient {
+		c := pbft.NewClient(*maddr, *collocatedWith, *mport, *reqNum, *writes,
+			*psize, *conflicts, *fast, *lread, *noLeader, *verbose, l, *args)
+		err := c.Run()
+		if err != nil {
+			fmt.Println(err)
+		}
 	} else {
 		c := base.NewSimpleClient(*maddr, *collocatedWith, *mport, *reqNum,
 			*writes, *psize, *conflicts, *fast, *lread, *noLeader, *verbose, l)
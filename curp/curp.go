@@ -217,6 +217,8 @@ func (r *Replica) run() {
 				tb := b
 				r.getCmdDesc(b.CmdSlot, &tb, -1)
 			}
+			// the accepts and acks are handled as copies
+			aacks.Free()
 
 		case m := <-r.cs.commitChan:
 			commit := m.(*MCommit)
@@ -234,6 +236,7 @@ func (r *Replica) run() {
 				}
 				r.sender.SendToClient(sync.CmdId.ClientId, rep, r.cs.syncReplyRPC)
 			}
+			sync.Free()
 		}
 	}
 }
@@ -354,61 +357,111 @@ func (r *Replica) handleCommit(msg *MCommit, desc *commandDesc) {
 	r.deliver(desc, desc.cmdSlot)
 }
 
+type unsyncedCmds struct {
+	reads  int
+	writes int
+}
+
+type lastSlots struct {
+	last      int
+	lastWrite int
+}
+
+func unsyncedKeys(cmd state.Command) []string {
+	ks := state.ConflictKeys(&cmd)
+	keys := make([]string, len(ks))
+	for i, k := range ks {
+		keys[i] = strconv.FormatInt(int64(k), 10)
+	}
+	return keys
+}
+
 func (r *Replica) sync(cmdId CommandId, cmd state.Command) {
-	if r.isLeader {
+	if r.isLeader || r.synced.Has(cmdId.String()) {
 		return
 	}
-	key := strconv.FormatInt(int64(cmd.K), 10)
-	r.unsynced.Upsert(key, nil,
-		func(exists bool, mapV, _ interface{}) interface{} {
-			if exists {
-				if r.synced.Has(cmdId.String()) {
-					return mapV
+	r.synced.Set(cmdId.String(), struct{}{})
+	readOnly := state.ReadOnly(&cmd)
+	for _, key := range unsyncedKeys(cmd) {
+		r.unsynced.Upsert(key, nil,
+			func(exists bool, mapV, _ interface{}) interface{} {
+				if !exists {
+					return unsyncedCmds{}
 				}
-				r.synced.Set(cmdId.String(), struct{}{})
-				v := mapV.(int) - 1
-				if v < 0 {
-					v = 0
+				u := mapV.(unsyncedCmds)
+				if readOnly && u.reads > 0 {
+					u.reads--
+				} else if !readOnly && u.writes > 0 {
+					u.writes--
 				}
-				return v
-			}
-			r.synced.Set(cmdId.String(), struct{}{})
-			return 0
-		})
+				return u
+			})
+	}
 }
 
 func (r *Replica) unsync(cmd state.Command) {
-	key := strconv.FormatInt(int64(cmd.K), 10)
-	r.unsynced.Upsert(key, nil,
-		func(exists bool, mapV, _ interface{}) interface{} {
-			if exists {
-				return mapV.(int) + 1
-			}
-			return 1
-		})
+	readOnly := state.ReadOnly(&cmd)
+	for _, key := range unsyncedKeys(cmd) {
+		r.unsynced.Upsert(key, nil,
+			func(exists bool, mapV, _ interface{}) interface{} {
+				u := unsyncedCmds{}
+				if exists {
+					u = mapV.(unsyncedCmds)
+				}
+				if readOnly {
+					u.reads++
+				} else {
+					u.writes++
+				}
+				return u
+			})
+	}
 }
 
 func (r *Replica) leaderUnsync(cmd state.Command, slot int) int {
 	depSlot := -1
-	key := strconv.FormatInt(int64(cmd.K), 10)
-	r.unsynced.Upsert(key, nil,
-		func(exists bool, mapV, _ interface{}) interface{} {
-			if exists {
-				if mapV.(int) > slot {
-					return mapV
+	readOnly := state.ReadOnly(&cmd)
+	for _, key := range unsyncedKeys(cmd) {
+		r.unsynced.Upsert(key, nil,
+			func(exists bool, mapV, _ interface{}) interface{} {
+				ls := lastSlots{
+					last:      -1,
+					lastWrite: -1,
 				}
-				depSlot = mapV.(int)
-			}
-			return slot
-		})
+				if exists {
+					ls = mapV.(lastSlots)
+					if ls.last > slot {
+						return ls
+					}
+					d := ls.last
+					if readOnly {
+						d = ls.lastWrite
+					}
+					if d > depSlot {
+						depSlot = d
+					}
+				}
+				ls.last = slot
+				if !readOnly {
+					ls.lastWrite = slot
+				}
+				return ls
+			})
+	}
 	return depSlot
 }
 
 func (r *Replica) ok(cmd state.Command) uint8 {
-	key := strconv.FormatInt(int64(cmd.K), 10)
-	v, exists := r.unsynced.Get(key)
-	if exists && v.(int) > 0 {
-		return FALSE
+	readOnly := state.ReadOnly(&cmd)
+	for _, key := range unsyncedKeys(cmd) {
+		v, exists := r.unsynced.Get(key)
+		if !exists {
+			continue
+		}
+		u := v.(unsyncedCmds)
+		if u.writes > 0 || (!readOnly && u.reads > 0) {
+			return FALSE
+		}
 	}
 	return TRUE
 }
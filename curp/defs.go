@@ -94,38 +94,6 @@ type MSyncReply struct {
 	Rep     []byte
 }
 
-func (m *MReply) New() fastrpc.Serializable {
-	return new(MReply)
-}
-
-func (m *MAccept) New() fastrpc.Serializable {
-	return new(MAccept)
-}
-
-func (m *MAcceptAck) New() fastrpc.Serializable {
-	return new(MAcceptAck)
-}
-
-func (m *MAAcks) New() fastrpc.Serializable {
-	return new(MAAcks)
-}
-
-func (m *MRecordAck) New() fastrpc.Serializable {
-	return new(MRecordAck)
-}
-
-func (m *MCommit) New() fastrpc.Serializable {
-	return new(MCommit)
-}
-
-func (m *MSync) New() fastrpc.Serializable {
-	return new(MSync)
-}
-
-func (m *MSyncReply) New() fastrpc.Serializable {
-	return new(MSyncReply)
-}
-
 type CommunicationSupply struct {
 	maxLatency time.Duration
 
@@ -148,17 +116,22 @@ type CommunicationSupply struct {
 	syncReplyRPC uint8
 }
 
+// Messages registers in t the messages of the protocol
+func Messages(t *fastrpc.Table) {
+	initCs(new(CommunicationSupply), t)
+}
+
 func initCs(cs *CommunicationSupply, t *fastrpc.Table) {
 	cs.maxLatency = 0
 
-	cs.replyChan = make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE)
-	cs.acceptChan = make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE)
-	cs.acceptAckChan = make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE)
-	cs.aacksChan = make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE)
-	cs.recordAckChan = make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE)
-	cs.commitChan = make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE)
-	cs.syncChan = make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE)
-	cs.syncReplyChan = make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE)
+	cs.replyChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.acceptChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.acceptAckChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.aacksChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.recordAckChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.commitChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.syncChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.syncReplyChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
 
 	cs.replyRPC = t.Register(new(MReply), cs.replyChan)
 	cs.acceptRPC = t.Register(new(MAccept), cs.acceptChan)
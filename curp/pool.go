@@ -0,0 +1,207 @@
+package curp
+
+import (
+	"sync"
+
+	"github.com/vonaka/shreplic/tools/fastrpc"
+)
+
+var mReplyPool = sync.Pool{
+	New: func() interface{} {
+		return new(MReply)
+	},
+}
+
+// GetMReply returns an empty MReply taken from its pool
+func GetMReply() *MReply {
+	return mReplyPool.Get().(*MReply)
+}
+
+// PutMReply empties m and returns it to its pool
+func PutMReply(m *MReply) {
+	*m = MReply{}
+	mReplyPool.Put(m)
+}
+
+func (m *MReply) Free() {
+	PutMReply(m)
+}
+
+func (m *MReply) New() fastrpc.Serializable {
+	return GetMReply()
+}
+
+var mAcceptPool = sync.Pool{
+	New: func() interface{} {
+		return new(MAccept)
+	},
+}
+
+// GetMAccept returns an empty MAccept taken from its pool
+func GetMAccept() *MAccept {
+	return mAcceptPool.Get().(*MAccept)
+}
+
+// PutMAccept empties m and returns it to its pool
+func PutMAccept(m *MAccept) {
+	*m = MAccept{}
+	mAcceptPool.Put(m)
+}
+
+func (m *MAccept) Free() {
+	PutMAccept(m)
+}
+
+func (m *MAccept) New() fastrpc.Serializable {
+	return GetMAccept()
+}
+
+var mAcceptAckPool = sync.Pool{
+	New: func() interface{} {
+		return new(MAcceptAck)
+	},
+}
+
+// GetMAcceptAck returns an empty MAcceptAck taken from its pool
+func GetMAcceptAck() *MAcceptAck {
+	return mAcceptAckPool.Get().(*MAcceptAck)
+}
+
+// PutMAcceptAck empties m and returns it to its pool
+func PutMAcceptAck(m *MAcceptAck) {
+	*m = MAcceptAck{}
+	mAcceptAckPool.Put(m)
+}
+
+func (m *MAcceptAck) Free() {
+	PutMAcceptAck(m)
+}
+
+func (m *MAcceptAck) New() fastrpc.Serializable {
+	return GetMAcceptAck()
+}
+
+var mAAcksPool = sync.Pool{
+	New: func() interface{} {
+		return new(MAAcks)
+	},
+}
+
+// GetMAAcks returns an empty MAAcks taken from its pool
+func GetMAAcks() *MAAcks {
+	return mAAcksPool.Get().(*MAAcks)
+}
+
+// PutMAAcks empties m and returns it to its pool
+func PutMAAcks(m *MAAcks) {
+	*m = MAAcks{}
+	mAAcksPool.Put(m)
+}
+
+func (m *MAAcks) Free() {
+	PutMAAcks(m)
+}
+
+func (m *MAAcks) New() fastrpc.Serializable {
+	return GetMAAcks()
+}
+
+var mRecordAckPool = sync.Pool{
+	New: func() interface{} {
+		return new(MRecordAck)
+	},
+}
+
+// GetMRecordAck returns an empty MRecordAck taken from its pool
+func GetMRecordAck() *MRecordAck {
+	return mRecordAckPool.Get().(*MRecordAck)
+}
+
+// PutMRecordAck empties m and returns it to its pool
+func PutMRecordAck(m *MRecordAck) {
+	*m = MRecordAck{}
+	mRecordAckPool.Put(m)
+}
+
+func (m *MRecordAck) Free() {
+	PutMRecordAck(m)
+}
+
+func (m *MRecordAck) New() fastrpc.Serializable {
+	return GetMRecordAck()
+}
+
+var mCommitPool = sync.Pool{
+	New: func() interface{} {
+		return new(MCommit)
+	},
+}
+
+// GetMCommit returns an empty MCommit taken from its pool
+func GetMCommit() *MCommit {
+	return mCommitPool.Get().(*MCommit)
+}
+
+// PutMCommit empties m and returns it to its pool
+func PutMCommit(m *MCommit) {
+	*m = MCommit{}
+	mCommitPool.Put(m)
+}
+
+func (m *MCommit) Free() {
+	PutMCommit(m)
+}
+
+func (m *MCommit) New() fastrpc.Serializable {
+	return GetMCommit()
+}
+
+var mSyncPool = sync.Pool{
+	New: func() interface{} {
+		return new(MSync)
+	},
+}
+
+// GetMSync returns an empty MSync taken from its pool
+func GetMSync() *MSync {
+	return mSyncPool.Get().(*MSync)
+}
+
+// PutMSync empties m and returns it to its pool
+func PutMSync(m *MSync) {
+	*m = MSync{}
+	mSyncPool.Put(m)
+}
+
+func (m *MSync) Free() {
+	PutMSync(m)
+}
+
+func (m *MSync) New() fastrpc.Serializable {
+	return GetMSync()
+}
+
+var mSyncReplyPool = sync.Pool{
+	New: func() interface{} {
+		return new(MSyncReply)
+	},
+}
+
+// GetMSyncReply returns an empty MSyncReply taken from its pool
+func GetMSyncReply() *MSyncReply {
+	return mSyncReplyPool.Get().(*MSyncReply)
+}
+
+// PutMSyncReply empties m and returns it to its pool
+func PutMSyncReply(m *MSyncReply) {
+	*m = MSyncReply{}
+	mSyncReplyPool.Put(m)
+}
+
+func (m *MSyncReply) Free() {
+	PutMSyncReply(m)
+}
+
+func (m *MSyncReply) New() fastrpc.Serializable {
+	return GetMSyncReply()
+}
@@ -0,0 +1,206 @@
+// shr-dump decodes the files recorded by servers started with
+// -capture and prints the messages they contain, ordered by time.
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vonaka/shreplic/atlas"
+	"github.com/vonaka/shreplic/chain"
+	"github.com/vonaka/shreplic/curp"
+	"github.com/vonaka/shreplic/epaxos"
+	"github.com/vonaka/shreplic/fastpaxos"
+	"github.com/vonaka/shreplic/hermes"
+	"github.com/vonaka/shreplic/mencius"
+	"github.com/vonaka/shreplic/n2paxos"
+	"github.com/vonaka/shreplic/paxoi"
+	"github.com/vonaka/shreplic/paxos"
+	"github.com/vonaka/shreplic/pbft"
+	"github.com/vonaka/shreplic/raft"
+	"github.com/vonaka/shreplic/server/smr"
+	"github.com/vonaka/shreplic/tempo"
+	"github.com/vonaka/shreplic/tools/capture"
+	"github.com/vonaka/shreplic/tools/fastrpc"
+	"github.com/vonaka/shreplic/unistore"
+	"github.com/vonaka/shreplic/vr"
+)
+
+var asJSON = flag.Bool("json", false, "Print one JSON object per message")
+
+// protocols register their messages as their replicas do
+var protocols = []func(*fastrpc.Table){
+	atlas.Messages,
+	chain.Messages,
+	curp.Messages,
+	epaxos.Messages,
+	fastpaxos.Messages,
+	hermes.Messages,
+	mencius.Messages,
+	n2paxos.Messages,
+	paxoi.Messages,
+	paxos.Messages,
+	pbft.Messages,
+	raft.Messages,
+	tempo.Messages,
+	unistore.Messages,
+	vr.Messages,
+}
+
+type unmarshaler interface {
+	Unmarshal(io.Reader) error
+}
+
+// generic are the messages of smr, whose codes are fixed
+var generic = map[uint8]func() unmarshaler{
+	smr.PROPOSE:                  func() unmarshaler { return new(smr.Propose) },
+	smr.PROPOSE_REPLY:            func() unmarshaler { return new(smr.ProposeReplyTS) },
+	smr.READ:                     func() unmarshaler { return new(smr.Read) },
+	smr.PROPOSE_AND_READ:         func() unmarshaler { return new(smr.ProposeAndRead) },
+	smr.GENERIC_SMR_BEACON:       func() unmarshaler { return new(smr.Beacon) },
+	smr.GENERIC_SMR_BEACON_REPLY: func() unmarshaler { return new(smr.BeaconReply) },
+}
+
+var genericNames = map[uint8]string{
+	smr.PROPOSE:                  "smr.Propose",
+	smr.PROPOSE_REPLY:            "smr.ProposeReplyTS",
+	smr.READ:                     "smr.Read",
+	smr.PROPOSE_AND_READ:         "smr.ProposeAndRead",
+	smr.GENERIC_SMR_BEACON:       "smr.Beacon",
+	smr.GENERIC_SMR_BEACON_REPLY: "smr.BeaconReply",
+}
+
+type entry struct {
+	Time    time.Time   `json:"time"`
+	Replica int32       `json:"replica"`
+	Link    string      `json:"link"`
+	Dir     string      `json:"dir"`
+	Code    uint8       `json:"code"`
+	Type    string      `json:"type"`
+	Msg     interface{} `json:"msg,omitempty"`
+	Raw     string      `json:"raw,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-json] capture-file...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	protos := make(map[string]fastrpc.Serializable)
+	for _, messages := range protocols {
+		t := fastrpc.NewTable()
+		messages(t)
+		t.Each(func(_ uint8, p fastrpc.Pair) {
+			protos[strings.TrimPrefix(fmt.Sprintf("%T", p.Obj), "*")] = p.Obj
+		})
+	}
+
+	var entries []*entry
+	for _, path := range flag.Args() {
+		es, err := load(path, protos)
+		if err != nil {
+			log.Fatalf("%s: %v", path, err)
+		}
+		entries = append(entries, es...)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Time.Before(entries[j].Time)
+	})
+
+	enc := json.NewEncoder(os.Stdout)
+	for _, e := range entries {
+		if *asJSON {
+			if enc.Encode(e) != nil {
+				e.Msg = fmt.Sprintf("%+v", e.Msg)
+				enc.Encode(e)
+			}
+			continue
+		}
+		fmt.Printf("%s %s %s %s", e.Time.Format(time.RFC3339Nano),
+			e.Link, e.Dir, e.Type)
+		if e.Msg != nil {
+			fmt.Printf(" %s", strings.TrimPrefix(fmt.Sprintf("%+v", e.Msg), "&"))
+		}
+		if e.Error != "" {
+			fmt.Printf(" error: %s raw: %s", e.Error, e.Raw)
+		} else if e.Raw != "" {
+			fmt.Printf(" raw: %s", e.Raw)
+		}
+		fmt.Println()
+	}
+}
+
+func load(path string, protos map[string]fastrpc.Serializable) ([]*entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c, err := capture.Open(f)
+	if err != nil {
+		return nil, err
+	}
+	link := strings.TrimSuffix(filepath.Base(path), ".cap")
+
+	var entries []*entry
+	for {
+		fr, err := c.Next()
+		if err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return entries, err
+		}
+
+		e := &entry{
+			Time:    fr.Time,
+			Replica: c.Replica,
+			Link:    link,
+			Dir:     "recv",
+			Code:    fr.Code,
+		}
+		if fr.Dir == capture.SEND {
+			e.Dir = "send"
+		}
+
+		var msg unmarshaler
+		if name, exists := c.Names[fr.Code]; exists {
+			e.Type = name
+			if p, exists := protos[name]; exists {
+				msg = p.New()
+			}
+		} else if newMsg, exists := generic[fr.Code]; exists {
+			e.Type = genericNames[fr.Code]
+			msg = newMsg()
+		} else {
+			e.Type = fmt.Sprintf("unknown(%d)", fr.Code)
+		}
+
+		if msg == nil {
+			e.Raw = hex.EncodeToString(fr.Payload)
+		} else if err := msg.Unmarshal(bytes.NewReader(fr.Payload)); err != nil {
+			e.Error = err.Error()
+			e.Raw = hex.EncodeToString(fr.Payload)
+		} else {
+			e.Msg = msg
+		}
+		entries = append(entries, e)
+	}
+}
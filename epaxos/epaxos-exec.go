@@ -15,7 +15,8 @@ const (
 )
 
 type Exec struct {
-	r *Replica
+	r     *Replica
+	stack []*Instance
 }
 
 type SCComponent struct {
@@ -43,16 +44,14 @@ func (e *Exec) executeCommand(replica int32, instance int32) bool {
 	return true
 }
 
-var stack []*Instance = make([]*Instance, 0, 100)
-
 func (e *Exec) findSCC(root *Instance) bool {
 	index := 1
 	// find SCCs using Tarjan's algorithm
-	stack = stack[0:0]
+	e.stack = e.stack[0:0]
 	ret := e.strongconnect(root, &index)
 	// reset all indexes in the stack
-	for j := 0; j < len(stack); j++ {
-		stack[j].Index = 0
+	for j := 0; j < len(e.stack); j++ {
+		e.stack[j].Index = 0
 	}
 	return ret
 }
@@ -62,14 +61,14 @@ func (e *Exec) strongconnect(v *Instance, index *int) bool {
 	v.Lowlink = *index
 	*index = *index + 1
 
-	l := len(stack)
-	if l == cap(stack) {
+	l := len(e.stack)
+	if l == cap(e.stack) {
 		newSlice := make([]*Instance, l, 2*l)
-		copy(newSlice, stack)
-		stack = newSlice
+		copy(newSlice, e.stack)
+		e.stack = newSlice
 	}
-	stack = stack[0 : l+1]
-	stack[l] = v
+	e.stack = e.stack[0 : l+1]
+	e.stack[l] = v
 
 	if v.Cmds == nil {
 		dlog.Printf("Null instance! \n")
@@ -122,7 +121,7 @@ func (e *Exec) strongconnect(v *Instance, index *int) bool {
 
 	if v.Lowlink == v.Index {
 		//found SCC
-		list := stack[l:]
+		list := e.stack[l:]
 
 		//execute commands in the increasing order of the Seq field
 		sort.Sort(nodeArray(list))
@@ -131,7 +130,7 @@ func (e *Exec) strongconnect(v *Instance, index *int) bool {
 				shouldRespond := e.r.Dreply && w.lb != nil && w.lb.clientProposals != nil
 				dlog.Printf("Executing "+w.Cmds[idx].String()+" at %d.%d with (seq=%d, deps=%d, scc_size=%d, shouldRespond=%t)\n", w.id.replica, w.id.instance, w.Seq, w.Deps, len(list), shouldRespond)
 				if w.Cmds[idx].Op == state.NONE {
-					// nothing to do
+					e.r.State.Skip()
 				} else if shouldRespond {
 					val := w.Cmds[idx].Execute(e.r.State)
 					e.r.ReplyProposeTS(
@@ -139,23 +138,26 @@ func (e *Exec) strongconnect(v *Instance, index *int) bool {
 							TRUE,
 							w.lb.clientProposals[idx].CommandId,
 							val,
-							w.lb.clientProposals[idx].Timestamp},
+							w.lb.clientProposals[idx].Timestamp, 0},
 						w.lb.clientProposals[idx].Reply,
 						w.lb.clientProposals[idx].Mutex)
-				} else if w.Cmds[idx].Op == state.PUT {
+				} else if state.IsWrite(&w.Cmds[idx]) {
 					w.Cmds[idx].Execute(e.r.State)
+				} else {
+					e.r.State.Skip()
 				}
 			}
 			w.Status = EXECUTED
+			e.r.Trace.Event(w.id.traceId(), "execute")
 		}
-		stack = stack[0:l]
+		e.stack = e.stack[0:l]
 	}
 
 	return true
 }
 
 func (e *Exec) inStack(w *Instance) bool {
-	for _, u := range stack {
+	for _, u := range e.stack {
 		if w == u {
 			return true
 		}
@@ -0,0 +1,43 @@
+package epaxos
+
+import "github.com/vonaka/shreplic/tools/trace"
+
+func (id *instanceId) traceId() trace.Id {
+	return trace.Instance(id.replica, id.instance)
+}
+
+func (m *Prepare) TraceIds(f func(trace.Id)) {
+	f(trace.Instance(m.Replica, m.Instance))
+}
+
+func (m *PrepareReply) TraceIds(f func(trace.Id)) {
+	f(trace.Instance(m.Replica, m.Instance))
+}
+
+func (m *PreAccept) TraceIds(f func(trace.Id)) {
+	f(trace.Instance(m.Replica, m.Instance))
+}
+
+func (m *PreAcceptReply) TraceIds(f func(trace.Id)) {
+	f(trace.Instance(m.Replica, m.Instance))
+}
+
+func (m *Accept) TraceIds(f func(trace.Id)) {
+	f(trace.Instance(m.Replica, m.Instance))
+}
+
+func (m *AcceptReply) TraceIds(f func(trace.Id)) {
+	f(trace.Instance(m.Replica, m.Instance))
+}
+
+func (m *Commit) TraceIds(f func(trace.Id)) {
+	f(trace.Instance(m.Replica, m.Instance))
+}
+
+func (m *TryPreAccept) TraceIds(f func(trace.Id)) {
+	f(trace.Instance(m.Replica, m.Instance))
+}
+
+func (m *TryPreAcceptReply) TraceIds(f func(trace.Id)) {
+	f(trace.Instance(m.Replica, m.Instance))
+}
@@ -11,6 +11,8 @@ import (
 	"github.com/vonaka/shreplic/state"
 	"github.com/vonaka/shreplic/tools/dlog"
 	"github.com/vonaka/shreplic/tools/fastrpc"
+	"github.com/vonaka/shreplic/tools/metrics"
+	"github.com/vonaka/shreplic/tools/trace"
 )
 
 const MAX_INSTANCE = 10 * 1024 * 1024
@@ -35,9 +37,6 @@ const HT_INIT_SIZE = 200000
 // - must run with thriftiness on (recovery is incorrect otherwise)
 // - when conflicts are transitive skip waiting prior commuting commands
 
-var cpMarker []state.Command
-var cpcounter = 0
-
 type Replica struct {
 	*smr.Replica
 	prepareChan           chan fastrpc.Serializable
@@ -71,11 +70,22 @@ type Replica struct {
 	latestCPInstance      int32
 	clientMutex           *sync.Mutex // for synchronizing when sending replies to clients from multiple go-routines
 	instancesToRecover    chan *instanceId
+	reproposals           []*smr.GPropose
 	IsLeader              bool // does this replica think it is the leader
 	maxRecvBallot         int32
 	batchWait             int
 	transconf             bool
 	ignoreSeq             bool
+	cpMarker              []state.Command
+	cpcounter             int
+	fastClockChan         chan bool
+	slowClockChan         chan bool
+	deferMap              map[uint64]uint64
+	fastPaths             *metrics.Counter
+	slowPaths             *metrics.Counter
+	conflicted            *metrics.Counter
+	recoveries            *metrics.Counter
+	commitTime            *metrics.Histogram
 }
 
 type InstPair struct {
@@ -127,16 +137,16 @@ type LeaderBookkeeping struct {
 func NewReplica(id int, peerAddrList []string, thrifty bool, exec bool, lread bool, dreply bool, beacon bool, durable bool, batchWait int, transconf bool, failures int, ps map[string]struct{}) *Replica {
 	r := &Replica{
 		smr.NewReplica(id, failures, peerAddrList, thrifty, exec, lread, dreply, ps),
-		make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE),
-		make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE),
-		make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE),
-		make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE),
-		make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE),
-		make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE*3),
-		make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE*3),
-		make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE*2),
-		make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE),
-		make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, smr.QUEUE_SIZE),
+		make(chan fastrpc.Serializable, smr.QUEUE_SIZE),
+		make(chan fastrpc.Serializable, smr.QUEUE_SIZE),
+		make(chan fastrpc.Serializable, smr.QUEUE_SIZE),
+		make(chan fastrpc.Serializable, smr.QUEUE_SIZE),
+		make(chan fastrpc.Serializable, smr.QUEUE_SIZE*3),
+		make(chan fastrpc.Serializable, smr.QUEUE_SIZE*3),
+		make(chan fastrpc.Serializable, smr.QUEUE_SIZE*2),
+		make(chan fastrpc.Serializable, smr.QUEUE_SIZE),
+		make(chan fastrpc.Serializable, smr.QUEUE_SIZE),
 		0, 0, 0, 0, 0, 0, 0, 0, 0,
 		make([][]*Instance, len(peerAddrList)),
 		make([]int32, len(peerAddrList)),
@@ -150,11 +160,18 @@ func NewReplica(id int, peerAddrList []string, thrifty bool, exec bool, lread bo
 		-1,
 		new(sync.Mutex),
 		make(chan *instanceId, smr.CHAN_BUFFER_SIZE),
+		nil,
 		false,
 		-1,
 		batchWait,
 		transconf,
 		true,
+		make([]state.Command, 0),
+		0,
+		nil,
+		nil,
+		make(map[uint64]uint64),
+		nil, nil, nil, nil, nil,
 	}
 
 	r.Beacon = beacon
@@ -172,28 +189,40 @@ func NewReplica(id int, peerAddrList []string, thrifty bool, exec bool, lread bo
 		r.conflicts[i] = make(map[state.Key]*InstPair, HT_INIT_SIZE)
 	}
 
-	r.exec = &Exec{r}
+	r.exec = &Exec{r, make([]*Instance, 0, 100)}
 
-	cpMarker = make([]state.Command, 0)
-
-	//register RPCs
-	r.prepareRPC = r.RPC.Register(new(Prepare), r.prepareChan)
-	r.prepareReplyRPC = r.RPC.Register(new(PrepareReply), r.prepareReplyChan)
-	r.preAcceptRPC = r.RPC.Register(new(PreAccept), r.preAcceptChan)
-	r.preAcceptReplyRPC = r.RPC.Register(new(PreAcceptReply), r.preAcceptReplyChan)
-	r.acceptRPC = r.RPC.Register(new(Accept), r.acceptChan)
-	r.acceptReplyRPC = r.RPC.Register(new(AcceptReply), r.acceptReplyChan)
-	r.commitRPC = r.RPC.Register(new(Commit), r.commitChan)
-	r.tryPreAcceptRPC = r.RPC.Register(new(TryPreAccept), r.tryPreAcceptChan)
-	r.tryPreAcceptReplyRPC = r.RPC.Register(new(TryPreAcceptReply), r.tryPreAcceptReplyChan)
+	r.register(r.RPC)
 
 	r.Stats.M["weird"], r.Stats.M["conflicted"], r.Stats.M["slow"], r.Stats.M["fast"], r.Stats.M["totalCommitTime"], r.Stats.M["totalBatching"], r.Stats.M["totalBatchingSize"] = 0, 0, 0, 0, 0, 0, 0
 
+	r.fastPaths = r.Metrics().Counter("shr_epaxos_fast_paths_total", "Instances committed on the fast path")
+	r.slowPaths = r.Metrics().Counter("shr_epaxos_slow_paths_total", "Instances committed on the slow path")
+	r.conflicted = r.Metrics().Counter("shr_epaxos_conflicts_total", "PreAccept replies with different attributes")
+	r.recoveries = r.Metrics().Counter("shr_epaxos_recoveries_total", "Instances recovered")
+	r.commitTime = r.Metrics().Histogram("shr_epaxos_commit_seconds", "Time to commit the instances of the replica", metrics.DefBuckets)
+
 	go r.run()
 
 	return r
 }
 
+// Messages registers in t the messages of the protocol
+func Messages(t *fastrpc.Table) {
+	new(Replica).register(t)
+}
+
+func (r *Replica) register(t *fastrpc.Table) {
+	r.prepareRPC = t.Register(new(Prepare), r.prepareChan)
+	r.prepareReplyRPC = t.Register(new(PrepareReply), r.prepareReplyChan)
+	r.preAcceptRPC = t.Register(new(PreAccept), r.preAcceptChan)
+	r.preAcceptReplyRPC = t.Register(new(PreAcceptReply), r.preAcceptReplyChan)
+	r.acceptRPC = t.Register(new(Accept), r.acceptChan)
+	r.acceptReplyRPC = t.Register(new(AcceptReply), r.acceptReplyChan)
+	r.commitRPC = t.Register(new(Commit), r.commitChan)
+	r.tryPreAcceptRPC = t.Register(new(TryPreAccept), r.tryPreAcceptChan)
+	r.tryPreAcceptReplyRPC = t.Register(new(TryPreAcceptReply), r.tryPreAcceptReplyChan)
+}
+
 //append a log entry to stable storage
 func (r *Replica) recordInstanceMetadata(inst *Instance) {
 	if !r.Durable {
@@ -238,19 +267,16 @@ func (r *Replica) sync() {
 
 /* Clock goroutine */
 
-var fastClockChan chan bool
-var slowClockChan chan bool
-
 func (r *Replica) fastClock() {
 	for !r.Shutdown {
 		time.Sleep(time.Duration(r.batchWait) * time.Millisecond) // ms
-		fastClockChan <- true
+		r.fastClockChan <- true
 	}
 }
 func (r *Replica) slowClock() {
 	for !r.Shutdown {
 		time.Sleep(150 * 1e6) // 150 ms
-		slowClockChan <- true
+		r.slowClockChan <- true
 	}
 }
 
@@ -293,8 +319,8 @@ func (r *Replica) run() {
 		go r.executeCommands()
 	}
 
-	slowClockChan = make(chan bool, 1)
-	fastClockChan = make(chan bool, 1)
+	r.slowClockChan = make(chan bool, 1)
+	r.fastClockChan = make(chan bool, 1)
 	go r.slowClock()
 
 	//Enabled fast clock when batching
@@ -324,7 +350,7 @@ func (r *Replica) run() {
 			}
 			break
 
-		case <-fastClockChan:
+		case <-r.fastClockChan:
 			//activate new proposals channel
 			onOffProposeChan = r.ProposeChan
 			break
@@ -395,7 +421,7 @@ func (r *Replica) run() {
 			r.ReplyBeacon(beacon)
 			break
 
-		case <-slowClockChan:
+		case <-r.slowClockChan:
 			if r.Beacon {
 				log.Printf("weird %d; conflicted %d; slow %d; fast %d\n", r.Stats.M["weird"], r.Stats.M["conflicted"], r.Stats.M["slow"], r.Stats.M["fast"])
 				for q := int32(0); q < int32(r.N); q++ {
@@ -410,6 +436,14 @@ func (r *Replica) run() {
 		case iid := <-r.instancesToRecover:
 			r.startRecoveryForInstance(iid.replica, iid.instance)
 		}
+
+		// the proposals of instances taken by other commands,
+		// not sent back to ProposeChan as it might be full
+		for len(r.reproposals) > 0 {
+			p := r.reproposals[0]
+			r.reproposals = r.reproposals[1:]
+			r.handlePropose(p)
+		}
 	}
 }
 
@@ -685,28 +719,31 @@ func (r *Replica) updateCommitted(replica int32) {
 
 func (r *Replica) updateConflicts(cmds []state.Command, replica int32, instance int32, seq int32) {
 	for i := 0; i < len(cmds); i++ {
-		if dpair, present := r.conflicts[replica][cmds[i].K]; present {
-			if dpair.last < instance {
-				r.conflicts[replica][cmds[i].K].last = instance
-			}
-			if dpair.lastWrite < instance && cmds[i].Op != state.GET {
-				r.conflicts[replica][cmds[i].K].lastWrite = instance
-			}
-		} else {
-			r.conflicts[replica][cmds[i].K] = &InstPair{
-				last:      instance,
-				lastWrite: -1,
-			}
-			if cmds[i].Op != state.GET {
-				r.conflicts[replica][cmds[i].K].lastWrite = instance
+		write := !state.ReadOnly(&cmds[i])
+		for _, k := range state.ConflictKeys(&cmds[i]) {
+			if dpair, present := r.conflicts[replica][k]; present {
+				if dpair.last < instance {
+					r.conflicts[replica][k].last = instance
+				}
+				if dpair.lastWrite < instance && write {
+					r.conflicts[replica][k].lastWrite = instance
+				}
+			} else {
+				r.conflicts[replica][k] = &InstPair{
+					last:      instance,
+					lastWrite: -1,
+				}
+				if write {
+					r.conflicts[replica][k].lastWrite = instance
+				}
 			}
-		}
-		if s, present := r.maxSeqPerKey[cmds[i].K]; present {
-			if s < seq {
-				r.maxSeqPerKey[cmds[i].K] = seq
+			if s, present := r.maxSeqPerKey[k]; present {
+				if s < seq {
+					r.maxSeqPerKey[k] = seq
+				}
+			} else {
+				r.maxSeqPerKey[k] = seq
 			}
-		} else {
-			r.maxSeqPerKey[cmds[i].K] = seq
 		}
 	}
 }
@@ -717,29 +754,34 @@ func (r *Replica) updateAttributes(cmds []state.Command, seq int32, deps []int32
 		if r.Id != replica && int32(q) == replica {
 			continue
 		}
+	cmdsLoop:
 		for i := 0; i < len(cmds); i++ {
-			if dpair, present := (r.conflicts[q])[cmds[i].K]; present {
-				d := dpair.lastWrite
-				if cmds[i].Op != state.GET {
-					d = dpair.last
-				}
+			for _, k := range state.ConflictKeys(&cmds[i]) {
+				if dpair, present := (r.conflicts[q])[k]; present {
+					d := dpair.lastWrite
+					if !state.ReadOnly(&cmds[i]) {
+						d = dpair.last
+					}
 
-				if d > deps[q] {
-					deps[q] = d
-					if seq <= r.InstanceSpace[q][d].Seq {
-						seq = r.InstanceSpace[q][d].Seq + 1
+					if d > deps[q] {
+						deps[q] = d
+						if seq <= r.InstanceSpace[q][d].Seq {
+							seq = r.InstanceSpace[q][d].Seq + 1
+						}
+						changed = true
+						break cmdsLoop
 					}
-					changed = true
-					break
 				}
 			}
 		}
 	}
 	for i := 0; i < len(cmds); i++ {
-		if s, present := r.maxSeqPerKey[cmds[i].K]; present {
-			if seq <= s {
-				changed = true
-				seq = s + 1
+		for _, k := range state.ConflictKeys(&cmds[i]) {
+			if s, present := r.maxSeqPerKey[k]; present {
+				if seq <= s {
+					changed = true
+					seq = s + 1
+				}
 			}
 		}
 	}
@@ -809,7 +851,7 @@ func (r *Replica) handlePropose(propose *smr.GPropose) {
 
 	r.startPhase1(cmds, r.Id, r.crtInstance[r.Id], r.Id, proposals)
 
-	cpcounter += len(cmds)
+	r.cpcounter += len(cmds)
 
 }
 
@@ -830,6 +872,9 @@ func (r *Replica) startPhase1(cmds []state.Command, replica int32, instance int3
 	inst := r.newInstance(replica, instance, cmds, ballot, ballot, PREACCEPTED, seq, deps)
 	inst.lb = r.newLeaderBookkeeping(proposals, deps, comDeps, deps, ballot, cmds, PREACCEPTED, -1)
 	r.InstanceSpace[replica][instance] = inst
+	for _, p := range proposals {
+		r.Trace.Link(trace.Command(p.ClientId, p.CommandId), inst.id.traceId())
+	}
 
 	r.updateConflicts(cmds, replica, instance, seq)
 
@@ -970,6 +1015,7 @@ func (r *Replica) handlePreAcceptReply(pareply *PreAcceptReply) {
 			r.M.Lock()
 			r.Stats.M["conflicted"]++
 			r.M.Unlock()
+			r.conflicted.Inc()
 		}
 	}
 
@@ -1018,7 +1064,7 @@ func (r *Replica) handlePreAcceptReply(pareply *PreAcceptReply) {
 						TRUE,
 						inst.lb.clientProposals[i].CommandId,
 						state.NIL(),
-						inst.lb.clientProposals[i].Timestamp},
+						inst.lb.clientProposals[i].Timestamp, 0},
 					inst.lb.clientProposals[i].Reply,
 					inst.lb.clientProposals[i].Mutex)
 			}
@@ -1032,6 +1078,8 @@ func (r *Replica) handlePreAcceptReply(pareply *PreAcceptReply) {
 			r.Stats.M["totalCommitTime"] += int(time.Now().UnixNano() - inst.proposeTime)
 		}
 		r.M.Unlock()
+		r.fastPaths.Inc()
+		r.observeCommit(inst, "fast")
 	} else if inst.lb.preAcceptOKs >= r.Replica.FastQuorumSize()-1 {
 		// } else if inst.lb.preAcceptOKs >= r.N/2 && !precondition {
 		dlog.Printf("Slow path %d.%d (inst.lb.allEqual=%t, allCommitted=%t, isInitialBallot=%t)\n", pareply.Replica, pareply.Instance, allEqual, allCommitted, isInitialBallot)
@@ -1053,6 +1101,7 @@ func (r *Replica) handlePreAcceptReply(pareply *PreAcceptReply) {
 			r.Stats.M["weird"]++
 		}
 		r.M.Unlock()
+		r.slowPaths.Inc()
 	} else {
 		dlog.Printf("Not enough pre-accept replies in %d.%d (preAcceptOk=%d, slowQuorumSize=%d, precondition=%t)\n", pareply.Replica, pareply.Instance, lb.preAcceptOKs, r.Replica.SlowQuorumSize(), precondition)
 	}
@@ -1148,7 +1197,7 @@ func (r *Replica) handleAcceptReply(areply *AcceptReply) {
 						TRUE,
 						inst.lb.clientProposals[i].CommandId,
 						state.NIL(),
-						inst.lb.clientProposals[i].Timestamp},
+						inst.lb.clientProposals[i].Timestamp, 0},
 					inst.lb.clientProposals[i].Reply,
 					inst.lb.clientProposals[i].Mutex)
 			}
@@ -1160,6 +1209,7 @@ func (r *Replica) handleAcceptReply(areply *AcceptReply) {
 			r.Stats.M["totalCommitTime"] += int(time.Now().UnixNano() - inst.proposeTime)
 		}
 		r.M.Unlock()
+		r.observeCommit(inst, "slow")
 	} else {
 		dlog.Println("Not enough")
 	}
@@ -1205,7 +1255,7 @@ func (r *Replica) handleCommit(commit *Commit) {
 		if len(commit.Command) == 1 && commit.Command[0].Op == state.NONE && inst.lb.clientProposals != nil {
 			for _, p := range inst.lb.clientProposals {
 				dlog.Printf("In %d.%d, re-proposing %s \n", commit.Replica, commit.Instance, p.Command.String())
-				r.ProposeChan <- p
+				r.reproposals = append(r.reproposals, p)
 			}
 			inst.lb.clientProposals = nil
 		}
@@ -1217,6 +1267,7 @@ func (r *Replica) handleCommit(commit *Commit) {
 	inst.Seq = commit.Seq
 	inst.Deps = commit.Deps
 	inst.Status = COMMITTED
+	r.Trace.Event(trace.Instance(commit.Replica, commit.Instance), "commit")
 
 	r.updateConflicts(commit.Command, commit.Replica, commit.Instance, commit.Seq)
 	r.updateCommitted(commit.Replica)
@@ -1237,7 +1288,16 @@ func (r *Replica) BeTheLeader(args *smr.BeTheLeaderArgs, reply *smr.BeTheLeaderR
 	return nil
 }
 
+func (r *Replica) observeCommit(inst *Instance, path string) {
+	r.Trace.Event(inst.id.traceId(), "commit", "shr.path", path)
+	if inst.proposeTime != 0 {
+		r.commitTime.Observe(float64(time.Now().UnixNano()-inst.proposeTime) / 1e9)
+	}
+}
+
 func (r *Replica) startRecoveryForInstance(replica int32, instance int32) {
+	r.recoveries.Inc()
+	r.Trace.Event(trace.Instance(replica, instance), "recovery")
 	inst := r.InstanceSpace[replica][instance]
 	if inst == nil {
 		inst = r.newInstanceDefault(replica, instance)
@@ -1587,7 +1647,7 @@ func (r *Replica) handleTryPreAcceptReply(tpar *TryPreAcceptReply) {
 
 	if notInQuorum == r.N/2 {
 		//this is to prevent defer cycles
-		if present, dq, _ := deferredByInstance(tpar.Replica, tpar.Instance); present {
+		if present, dq, _ := r.deferredByInstance(tpar.Replica, tpar.Instance); present {
 			if lb.possibleQuorum[dq] {
 				dlog.Printf("Abandon recovery in %d.%d restart phase1 \n", tpar.Replica, tpar.Instance)
 				//an instance whose leader must have been in this instance's quorum has been deferred for this instance => contradiction
@@ -1603,24 +1663,22 @@ func (r *Replica) handleTryPreAcceptReply(tpar *TryPreAcceptReply) {
 	if lb.tpaReps >= r.N/2 {
 		dlog.Printf("Abandon recovery in %d.%d \n", tpar.Replica, tpar.Instance)
 		//defer recovery and update deferred information
-		updateDeferred(tpar.Replica, tpar.Instance, tpar.ConflictReplica, tpar.ConflictInstance)
+		r.updateDeferred(tpar.Replica, tpar.Instance, tpar.ConflictReplica, tpar.ConflictInstance)
 		lb.tryingToPreAccept = false
 	}
 }
 
 // helper functions and structures to prevent defer cycles while recovering
 
-var deferMap = make(map[uint64]uint64)
-
-func updateDeferred(dr int32, di int32, r int32, i int32) {
+func (r *Replica) updateDeferred(dr int32, di int32, q int32, i int32) {
 	daux := (uint64(dr) << 32) | uint64(di)
-	aux := (uint64(r) << 32) | uint64(i)
-	deferMap[aux] = daux
+	aux := (uint64(q) << 32) | uint64(i)
+	r.deferMap[aux] = daux
 }
 
-func deferredByInstance(q int32, i int32) (bool, int32, int32) {
+func (r *Replica) deferredByInstance(q int32, i int32) (bool, int32, int32) {
 	aux := (uint64(q) << 32) | uint64(i)
-	daux, present := deferMap[aux]
+	daux, present := r.deferMap[aux]
 	if !present {
 		return false, 0, 0
 	}
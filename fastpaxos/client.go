@@ -0,0 +1,44 @@
+package fastpaxos
+
+import (
+	"errors"
+	"log"
+
+	"github.com/vonaka/shreplic/client/base"
+	"github.com/vonaka/shreplic/server/smr"
+)
+
+type Client struct {
+	*base.SimpleClient
+}
+
+// NewClient returns a client that sends its commands to every
+// acceptor and waits for the reply of the leader
+func NewClient(maddr, collocated string, mport, reqNum, writes, psize, conflict int,
+	fast, lread, leaderless, verbose bool, logger *log.Logger, args string) *Client {
+
+	c := &Client{
+		SimpleClient: base.NewSimpleClient(maddr, collocated, mport, reqNum, writes,
+			psize, conflict, true, false, false, verbose, logger),
+	}
+
+	c.WaitResponse = func() error {
+		for {
+			rep, err := c.ProposeReplyFrom(c.LeaderId)
+			if err != nil {
+				return err
+			}
+			if rep.CommandId != c.Seqnum {
+				continue
+			}
+			if rep.OK != smr.TRUE {
+				return errors.New("Failed to receive a response.")
+			}
+			c.Println("Returning:", rep.Value.String())
+			c.ResChan <- rep.Value
+			return nil
+		}
+	}
+
+	return c
+}
@@ -0,0 +1,81 @@
+package fastpaxos
+
+import (
+	"fmt"
+
+	"github.com/vonaka/shreplic/state"
+)
+
+type CommandId struct {
+	ClientId int32
+	SeqNum   int32
+}
+
+func (cmdId CommandId) String() string {
+	return fmt.Sprintf("%v,%v", cmdId.ClientId, cmdId.SeqNum)
+}
+
+type Entry struct {
+	CmdId CommandId
+	Cmd   state.Command
+}
+
+// The leader of ballot b coordinates the fast round 2b and
+// the classic round 2b+1 of every slot from which it has started
+// the fast rounds (see MAny). The value of a slot is a set of
+// commands that are executed in the order of their identifiers.
+
+// MPropose gives to acceptors commands that have not been chosen
+type MPropose struct {
+	Replica int32
+	Entries []Entry
+}
+
+// M2B is the vote of an acceptor in a fast round
+type M2B struct {
+	Replica int32
+	Round   int32
+	Slot    int32
+	Value   []Entry
+}
+
+type MAccept struct {
+	Replica int32
+	Round   int32
+	Slot    int32
+	Value   []Entry
+}
+
+type MAcceptAck struct {
+	Replica int32
+	Round   int32
+	Slot    int32
+}
+
+type MCommit struct {
+	Replica int32
+	Slot    int32
+	Value   []Entry
+}
+
+type MPrepare struct {
+	Replica int32
+	Ballot  int32
+	From    int32
+}
+
+// MPromise reports the votes of an acceptor for every slot from
+// MPrepare.From to Last, the last slot in which it has voted
+type MPromise struct {
+	Replica int32
+	Ballot  int32
+	Last    int32
+	Votes   []M2B
+}
+
+// MAny starts the fast rounds of Ballot from slot From
+type MAny struct {
+	Replica int32
+	Ballot  int32
+	From    int32
+}
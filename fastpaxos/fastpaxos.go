@@ -0,0 +1,809 @@
+package fastpaxos
+
+import (
+	"flag"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vonaka/shreplic/server/smr"
+	"github.com/vonaka/shreplic/state"
+	"github.com/vonaka/shreplic/tools/dlog"
+	"github.com/vonaka/shreplic/tools/fastrpc"
+)
+
+// MAX_SET is the maximal number of commands in a slot
+const MAX_SET = 64
+
+// Replica of Fast Paxos.
+//
+// Clients send their commands to every acceptor, each acceptor puts
+// the command in its next slot and votes for it in the fast round.
+// The leader learns a slot as soon as a fast quorum voted for the same
+// value. Otherwise (collision), it chooses a value in the classic round
+// and proposes again the commands that lost.
+//
+// In the generalized mode an acceptor puts in the same slot the commands
+// that commute with each other, which are thus not ordered differently
+// by different acceptors.
+type Replica struct {
+	*smr.Replica
+
+	FQ smr.ThreeQuarters
+	M  smr.Majority
+
+	ballot      int32
+	fast        bool
+	fastFrom    int32
+	cur         int32
+	last        int32
+	frontier    int32
+	generalized bool
+
+	slots    map[int32]*slotDesc
+	waiting  map[int32]struct{}
+	assigned map[CommandId]int32
+	executed map[CommandId]struct{}
+	proposes map[CommandId]*smr.GPropose
+	queue    []Entry
+	prepare  *smr.MsgSet
+
+	window     time.Duration
+	timeout    time.Duration
+	tickChan   chan struct{}
+	leaderChan chan struct{}
+
+	sender smr.Sender
+	cs     CommunicationSupply
+}
+
+type slotDesc struct {
+	// acceptor
+	voted  bool
+	open   bool
+	vround int32
+	value  []Entry
+
+	// leader
+	reports    map[int32][]Entry
+	start      time.Time
+	recovering bool
+	acks       *smr.MsgSet
+
+	committed bool
+	cvalue    []Entry
+}
+
+type CommunicationSupply struct {
+	maxLatency time.Duration
+
+	proposeChan   chan fastrpc.Serializable
+	twoBChan      chan fastrpc.Serializable
+	acceptChan    chan fastrpc.Serializable
+	acceptAckChan chan fastrpc.Serializable
+	commitChan    chan fastrpc.Serializable
+	prepareChan   chan fastrpc.Serializable
+	promiseChan   chan fastrpc.Serializable
+	anyChan       chan fastrpc.Serializable
+
+	proposeRPC   uint8
+	twoBRPC      uint8
+	acceptRPC    uint8
+	acceptAckRPC uint8
+	commitRPC    uint8
+	prepareRPC   uint8
+	promiseRPC   uint8
+	anyRPC       uint8
+}
+
+func NewReplica(rid int, addrs []string, exec, dr bool,
+	f int, args string, ps map[string]struct{}) *Replica {
+
+	fs := flag.NewFlagSet("custom Fast Paxos arguments", flag.ExitOnError)
+	generalized := fs.Bool("generalized", false, "Do not order commuting commands (Generalized Paxos)")
+	window := fs.Int("window", 1, "Milliseconds during which a slot accepts new commuting commands")
+	timeout := fs.Int("timeout", 100, "Milliseconds to wait for a fast quorum before recovery")
+	fs.Parse(strings.Fields(args))
+
+	r := &Replica{
+		Replica: smr.NewReplica(rid, f, addrs, false, exec, false, dr, ps),
+
+		ballot:      0,
+		fast:        true,
+		fastFrom:    0,
+		cur:         -1,
+		last:        -1,
+		frontier:    0,
+		generalized: *generalized,
+
+		slots:    make(map[int32]*slotDesc),
+		waiting:  make(map[int32]struct{}),
+		assigned: make(map[CommandId]int32),
+		executed: make(map[CommandId]struct{}),
+		proposes: make(map[CommandId]*smr.GPropose),
+		queue:    make([]Entry, 0),
+
+		window:     time.Duration(*window) * time.Millisecond,
+		timeout:    time.Duration(*timeout) * time.Millisecond,
+		tickChan:   make(chan struct{}, 1),
+		leaderChan: make(chan struct{}, 1),
+	}
+
+	r.M = smr.NewMajorityOf(r.N)
+	r.FQ = smr.NewThreeQuartersOf(r.N)
+	// any two fast quorums must intersect with every classic quorum
+	if s := r.FastQuorumSize() + 1; s > r.FQ.Size() {
+		r.FQ = smr.ThreeQuarters(s)
+	}
+	log.Println("Fast quorum size:", r.FQ.Size())
+
+	r.sender = smr.NewSender(r.Replica)
+	initCs(&r.cs, r.RPC)
+
+	go r.run()
+
+	return r
+}
+
+// Messages registers in t the messages of the protocol
+func Messages(t *fastrpc.Table) {
+	initCs(new(CommunicationSupply), t)
+}
+
+func initCs(cs *CommunicationSupply, t *fastrpc.Table) {
+	cs.maxLatency = 0
+
+	cs.proposeChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.twoBChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.acceptChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.acceptAckChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.commitChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.prepareChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.promiseChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.anyChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+
+	cs.proposeRPC = t.Register(new(MPropose), cs.proposeChan)
+	cs.twoBRPC = t.Register(new(M2B), cs.twoBChan)
+	cs.acceptRPC = t.Register(new(MAccept), cs.acceptChan)
+	cs.acceptAckRPC = t.Register(new(MAcceptAck), cs.acceptAckChan)
+	cs.commitRPC = t.Register(new(MCommit), cs.commitChan)
+	cs.prepareRPC = t.Register(new(MPrepare), cs.prepareChan)
+	cs.promiseRPC = t.Register(new(MPromise), cs.promiseChan)
+	cs.anyRPC = t.Register(new(MAny), cs.anyChan)
+}
+
+func (r *Replica) BeTheLeader(args *smr.BeTheLeaderArgs, reply *smr.BeTheLeaderReply) error {
+	r.leaderChan <- struct{}{}
+	reply.Leader = r.Id
+	if reply.Leader == 0 {
+		// see smr.BeTheLeaderReply
+		reply.Leader = smr.ZERO_ID
+	}
+	return nil
+}
+
+func (r *Replica) run() {
+	r.ConnectToPeers()
+	latencies := r.ComputeClosestPeers()
+	for _, l := range latencies {
+		d := time.Duration(l*1000*1000) * time.Nanosecond
+		if d > r.cs.maxLatency {
+			r.cs.maxLatency = d
+		}
+	}
+
+	go r.WaitForClientConnections()
+	go r.clock()
+
+	for !r.Shutdown {
+		select {
+		case propose := <-r.ProposeChan:
+			e := Entry{
+				CmdId: CommandId{
+					ClientId: propose.ClientId,
+					SeqNum:   propose.CommandId,
+				},
+				Cmd: propose.Command,
+			}
+			if _, exists := r.executed[e.CmdId]; !exists {
+				r.proposes[e.CmdId] = propose
+			}
+			r.assign(e)
+
+		case m := <-r.cs.proposeChan:
+			propose := m.(*MPropose)
+			for _, e := range propose.Entries {
+				// the commit of the slot that e lost might not be here yet
+				delete(r.assigned, e.CmdId)
+				r.assign(e)
+			}
+			propose.Free()
+
+		case m := <-r.cs.twoBChan:
+			twoB := m.(*M2B)
+			r.handle2B(twoB)
+			twoB.Free()
+
+		case m := <-r.cs.acceptChan:
+			acc := m.(*MAccept)
+			r.handleAccept(acc)
+			acc.Free()
+
+		case m := <-r.cs.acceptAckChan:
+			ack := m.(*MAcceptAck)
+			r.handleAcceptAck(ack)
+
+		case m := <-r.cs.commitChan:
+			commit := m.(*MCommit)
+			r.handleCommit(commit)
+			commit.Free()
+
+		case m := <-r.cs.prepareChan:
+			prepare := m.(*MPrepare)
+			r.handlePrepare(prepare)
+			prepare.Free()
+
+		case m := <-r.cs.promiseChan:
+			promise := m.(*MPromise)
+			r.handlePromise(promise)
+
+		case m := <-r.cs.anyChan:
+			any := m.(*MAny)
+			r.handleAny(any)
+			any.Free()
+
+		case <-r.tickChan:
+			if r.cur != -1 {
+				r.close(r.cur)
+			}
+			if r.isLeader() {
+				r.checkTimeouts()
+			}
+
+		case <-r.leaderChan:
+			r.becomeLeader()
+		}
+	}
+}
+
+func (r *Replica) clock() {
+	for !r.Shutdown {
+		time.Sleep(r.window)
+		r.tickChan <- struct{}{}
+	}
+}
+
+// assign puts e in the slot the acceptor is currently voting for
+func (r *Replica) assign(e Entry) {
+	if _, exists := r.executed[e.CmdId]; exists {
+		return
+	}
+	if _, exists := r.assigned[e.CmdId]; exists {
+		return
+	}
+	if !r.fast {
+		r.queue = append(r.queue, e)
+		return
+	}
+
+	if r.cur != -1 {
+		desc := r.slot(r.cur)
+		if r.generalized && len(desc.value) < MAX_SET && commutes(e, desc.value) {
+			desc.value = insert(desc.value, e)
+			r.assigned[e.CmdId] = r.cur
+			return
+		}
+		r.close(r.cur)
+	}
+
+	s := r.last + 1
+	if s < r.fastFrom {
+		s = r.fastFrom
+	}
+	for desc, exists := r.slots[s]; exists && (desc.voted || desc.committed); desc, exists = r.slots[s] {
+		s++
+	}
+
+	desc := r.slot(s)
+	desc.voted = true
+	desc.open = true
+	desc.vround = 2 * r.ballot
+	desc.value = []Entry{e}
+	r.assigned[e.CmdId] = s
+	r.last = s
+	r.cur = s
+
+	if !r.generalized {
+		r.close(s)
+	}
+}
+
+// close sends to the leader the vote for the slot s
+func (r *Replica) close(s int32) {
+	desc := r.slot(s)
+	r.cur = -1
+	if !desc.open {
+		return
+	}
+	desc.open = false
+
+	twoB := &M2B{
+		Replica: r.Id,
+		Round:   desc.vround,
+		Slot:    s,
+		Value:   desc.value,
+	}
+	if r.isLeader() {
+		r.handle2B(twoB)
+	} else {
+		r.sender.SendTo(r.leader(), twoB, r.cs.twoBRPC)
+	}
+}
+
+func (r *Replica) handle2B(msg *M2B) {
+	if !r.isLeader() || msg.Round != 2*r.ballot {
+		return
+	}
+	desc := r.slot(msg.Slot)
+	if desc.committed || desc.recovering {
+		return
+	}
+
+	if len(desc.reports) == 0 {
+		desc.start = time.Now()
+		r.waiting[msg.Slot] = struct{}{}
+	}
+	desc.reports[msg.Replica] = msg.Value
+
+	support := make(map[string]int)
+	best := 0
+	for _, v := range desc.reports {
+		k := valueKey(v)
+		support[k]++
+		if support[k] > best {
+			best = support[k]
+		}
+		if support[k] >= r.FQ.Size() {
+			r.commit(msg.Slot, v)
+			return
+		}
+	}
+
+	// collision: no value can be voted by a fast quorum anymore
+	if best+r.N-len(desc.reports) < r.FQ.Size() && len(desc.reports) >= r.M.Size() {
+		r.recover(msg.Slot)
+	}
+}
+
+func (r *Replica) checkTimeouts() {
+	for s := range r.waiting {
+		desc := r.slot(s)
+		if !desc.committed && !desc.recovering &&
+			len(desc.reports) >= r.M.Size() && time.Since(desc.start) > r.timeout {
+			r.recover(s)
+		}
+	}
+}
+
+// recover chooses the value of the slot s in the classic round
+func (r *Replica) recover(s int32) {
+	desc := r.slot(s)
+	desc.recovering = true
+
+	votes := make([][]Entry, 0, len(desc.reports))
+	for _, v := range desc.reports {
+		votes = append(votes, v)
+	}
+	r.accept(s, r.pick(votes))
+}
+
+// pick returns a value that might have been chosen by a fast quorum
+// given the votes of a classic quorum, or the union of the votes
+func (r *Replica) pick(votes [][]Entry) []Entry {
+	support := make(map[string]int)
+	for _, v := range votes {
+		k := valueKey(v)
+		support[k]++
+		if support[k] >= r.FQ.Size()-(r.N-len(votes)) {
+			return v
+		}
+	}
+
+	union := make([]Entry, 0)
+	seen := make(map[CommandId]struct{})
+	for _, v := range votes {
+		for _, e := range v {
+			if _, exists := seen[e.CmdId]; !exists {
+				seen[e.CmdId] = struct{}{}
+				union = insert(union, e)
+			}
+		}
+	}
+	return union
+}
+
+func (r *Replica) accept(s int32, value []Entry) {
+	desc := r.slot(s)
+	desc.recovering = true
+	desc.acks = desc.acks.ReinitMsgSet(r.M, func(_, _ interface{}) bool {
+		return true
+	}, func(interface{}) {}, func(interface{}, []interface{}) {
+		r.commit(s, value)
+	})
+
+	acc := &MAccept{
+		Replica: r.Id,
+		Round:   2*r.ballot + 1,
+		Slot:    s,
+		Value:   value,
+	}
+	r.sender.SendToAll(acc, r.cs.acceptRPC)
+	r.handleAccept(acc)
+}
+
+func (r *Replica) handleAccept(msg *MAccept) {
+	if msg.Round < 2*r.ballot {
+		return
+	}
+	if b := msg.Round / 2; b > r.ballot {
+		// the prepare of the new leader has not been received yet
+		r.ballot = b
+		r.fast = false
+	}
+
+	desc := r.slot(msg.Slot)
+	if desc.committed || (desc.voted && desc.vround > msg.Round) {
+		return
+	}
+	if desc.open {
+		r.cur = -1
+	}
+	r.unassign(msg.Slot, desc.value, msg.Value)
+	desc.voted = true
+	desc.open = false
+	desc.vround = msg.Round
+	desc.value = msg.Value
+	if msg.Slot > r.last {
+		r.last = msg.Slot
+	}
+
+	ack := &MAcceptAck{
+		Replica: r.Id,
+		Round:   msg.Round,
+		Slot:    msg.Slot,
+	}
+	if msg.Replica == r.Id {
+		r.handleAcceptAck(ack)
+	} else {
+		r.sender.SendTo(msg.Replica, ack, r.cs.acceptAckRPC)
+	}
+}
+
+func (r *Replica) handleAcceptAck(msg *MAcceptAck) {
+	if !r.isLeader() || msg.Round != 2*r.ballot+1 {
+		return
+	}
+	desc := r.slot(msg.Slot)
+	if desc.committed || desc.acks == nil {
+		return
+	}
+	desc.acks.Add(msg.Replica, false, msg)
+}
+
+func (r *Replica) commit(s int32, value []Entry) {
+	desc := r.slot(s)
+	if desc.committed {
+		return
+	}
+
+	// the commands that lost are proposed again
+	lost := make([]Entry, 0)
+	chosen := make(map[CommandId]struct{}, len(value))
+	for _, e := range value {
+		chosen[e.CmdId] = struct{}{}
+	}
+	for _, v := range desc.reports {
+		for _, e := range v {
+			if _, exists := chosen[e.CmdId]; !exists {
+				chosen[e.CmdId] = struct{}{}
+				lost = append(lost, e)
+			}
+		}
+	}
+
+	commit := &MCommit{
+		Replica: r.Id,
+		Slot:    s,
+		Value:   value,
+	}
+	r.sender.SendToAll(commit, r.cs.commitRPC)
+	r.handleCommit(commit)
+
+	if len(lost) > 0 {
+		propose := &MPropose{
+			Replica: r.Id,
+			Entries: lost,
+		}
+		r.sender.SendToAll(propose, r.cs.proposeRPC)
+		for _, e := range lost {
+			r.assign(e)
+		}
+	}
+}
+
+func (r *Replica) handleCommit(msg *MCommit) {
+	desc := r.slot(msg.Slot)
+	if desc.committed {
+		return
+	}
+	if desc.open {
+		r.cur = -1
+		desc.open = false
+	}
+	r.unassign(msg.Slot, desc.value, msg.Value)
+	desc.committed = true
+	desc.cvalue = msg.Value
+	desc.reports = nil
+	delete(r.waiting, msg.Slot)
+	r.execute()
+}
+
+// unassign forgets the commands of the slot s that are not in value,
+// so that the acceptor can vote for them in another slot
+func (r *Replica) unassign(s int32, old, value []Entry) {
+	in := make(map[CommandId]struct{}, len(value))
+	for _, e := range value {
+		in[e.CmdId] = struct{}{}
+	}
+	for _, e := range old {
+		if _, exists := in[e.CmdId]; !exists && r.assigned[e.CmdId] == s {
+			delete(r.assigned, e.CmdId)
+		}
+	}
+}
+
+func (r *Replica) execute() {
+	for {
+		desc, exists := r.slots[r.frontier]
+		if !exists || !desc.committed {
+			return
+		}
+
+		for _, e := range desc.cvalue {
+			if _, exists := r.executed[e.CmdId]; exists {
+				continue
+			}
+			r.executed[e.CmdId] = struct{}{}
+			delete(r.assigned, e.CmdId)
+
+			v := state.NIL()
+			if r.Exec {
+				dlog.Printf("Executing " + e.Cmd.String())
+				v = e.Cmd.Execute(r.State)
+			}
+
+			p, exists := r.proposes[e.CmdId]
+			if !exists {
+				continue
+			}
+			delete(r.proposes, e.CmdId)
+			if !r.isLeader() {
+				continue
+			}
+			if !r.Dreply {
+				v = state.NIL()
+			}
+			rep := &smr.ProposeReplyTS{
+				OK:        smr.TRUE,
+				CommandId: p.CommandId,
+				Value:     v,
+				Timestamp: p.Timestamp,
+			}
+			r.ReplyProposeTS(rep, p.Reply, p.Mutex)
+		}
+		r.frontier++
+	}
+}
+
+func (r *Replica) becomeLeader() {
+	if r.isLeader() && r.fast {
+		return
+	}
+
+	r.ballot = smr.NextBallotOf(r.Id, r.ballot, r.N)
+	log.Println("I am the leader, ballot", r.ballot)
+	r.prepare = r.prepare.ReinitMsgSet(r.M, func(_, _ interface{}) bool {
+		return true
+	}, func(interface{}) {}, r.handlePromises)
+
+	prepare := &MPrepare{
+		Replica: r.Id,
+		Ballot:  r.ballot,
+		From:    r.frontier,
+	}
+	r.sender.SendToAll(prepare, r.cs.prepareRPC)
+	r.handlePrepare(prepare)
+}
+
+func (r *Replica) handlePrepare(msg *MPrepare) {
+	if msg.Ballot < r.ballot {
+		return
+	}
+	r.ballot = msg.Ballot
+	r.fast = false
+	if r.cur != -1 {
+		r.slot(r.cur).open = false
+		r.cur = -1
+	}
+
+	promise := &MPromise{
+		Replica: r.Id,
+		Ballot:  msg.Ballot,
+		Last:    r.last,
+		Votes:   make([]M2B, 0),
+	}
+	for s := msg.From; s <= r.last; s++ {
+		desc, exists := r.slots[s]
+		if !exists || !desc.voted {
+			continue
+		}
+		vote := M2B{
+			Replica: r.Id,
+			Round:   desc.vround,
+			Slot:    s,
+			Value:   desc.value,
+		}
+		if desc.committed {
+			// higher than any round of the previous leaders
+			vote.Round = 2*msg.Ballot - 1
+			vote.Value = desc.cvalue
+		}
+		promise.Votes = append(promise.Votes, vote)
+	}
+
+	if msg.Replica == r.Id {
+		r.handlePromise(promise)
+	} else {
+		r.sender.SendTo(msg.Replica, promise, r.cs.promiseRPC)
+	}
+}
+
+func (r *Replica) handlePromise(msg *MPromise) {
+	if !r.isLeader() || r.fast || msg.Ballot != r.ballot {
+		return
+	}
+	r.prepare.Add(msg.Replica, false, msg)
+}
+
+func (r *Replica) handlePromises(_ interface{}, msgs []interface{}) {
+	if r.fast {
+		return
+	}
+
+	from, last := r.frontier, r.last
+	votes := make(map[int32][]*M2B)
+	for _, m := range msgs {
+		p := m.(*MPromise)
+		if p.Last > last {
+			last = p.Last
+		}
+		for i := range p.Votes {
+			v := &p.Votes[i]
+			votes[v.Slot] = append(votes[v.Slot], v)
+		}
+	}
+
+	for s := from; s <= last; s++ {
+		if desc, exists := r.slots[s]; exists && desc.committed {
+			r.sender.SendToAll(&MCommit{
+				Replica: r.Id,
+				Slot:    s,
+				Value:   desc.cvalue,
+			}, r.cs.commitRPC)
+			continue
+		}
+
+		// only the votes of the highest round count
+		round := int32(-1)
+		for _, v := range votes[s] {
+			if v.Round > round {
+				round = v.Round
+			}
+		}
+		vs := make([][]Entry, 0)
+		for _, v := range votes[s] {
+			if v.Round == round {
+				vs = append(vs, v.Value)
+			}
+		}
+
+		var value []Entry
+		if round%2 == 1 {
+			value = vs[0]
+		} else if len(vs) > 0 {
+			value = r.pick(vs)
+		} else {
+			value = make([]Entry, 0)
+		}
+		r.accept(s, value)
+	}
+
+	any := &MAny{
+		Replica: r.Id,
+		Ballot:  r.ballot,
+		From:    last + 1,
+	}
+	r.sender.SendToAll(any, r.cs.anyRPC)
+	r.handleAny(any)
+}
+
+func (r *Replica) handleAny(msg *MAny) {
+	if msg.Ballot != r.ballot {
+		return
+	}
+	r.fast = true
+	r.fastFrom = msg.From
+
+	queue := r.queue
+	r.queue = make([]Entry, 0)
+	for _, e := range queue {
+		r.assign(e)
+	}
+}
+
+func (r *Replica) slot(s int32) *slotDesc {
+	desc, exists := r.slots[s]
+	if !exists {
+		desc = &slotDesc{
+			reports: make(map[int32][]Entry),
+		}
+		r.slots[s] = desc
+	}
+	if desc.reports == nil && !desc.committed {
+		desc.reports = make(map[int32][]Entry)
+	}
+	return desc
+}
+
+func (r *Replica) leader() int32 {
+	return smr.Leader(r.ballot, r.N)
+}
+
+func (r *Replica) isLeader() bool {
+	return r.leader() == r.Id
+}
+
+func commutes(e Entry, value []Entry) bool {
+	for i := range value {
+		if state.Conflict(&e.Cmd, &value[i].Cmd) {
+			return false
+		}
+	}
+	return true
+}
+
+// insert keeps value sorted by command identifiers
+func insert(value []Entry, e Entry) []Entry {
+	i := sort.Search(len(value), func(i int) bool {
+		return less(e.CmdId, value[i].CmdId)
+	})
+	value = append(value, Entry{})
+	copy(value[i+1:], value[i:])
+	value[i] = e
+	return value
+}
+
+func less(a, b CommandId) bool {
+	return a.ClientId < b.ClientId ||
+		(a.ClientId == b.ClientId && a.SeqNum < b.SeqNum)
+}
+
+func valueKey(value []Entry) string {
+	var b strings.Builder
+	for _, e := range value {
+		b.WriteString(e.CmdId.String())
+		b.WriteByte(';')
+	}
+	return b.String()
+}
@@ -0,0 +1,207 @@
+package fastpaxos
+
+import (
+	"sync"
+
+	"github.com/vonaka/shreplic/tools/fastrpc"
+)
+
+var mProposePool = sync.Pool{
+	New: func() interface{} {
+		return new(MPropose)
+	},
+}
+
+// GetMPropose returns an empty MPropose taken from its pool
+func GetMPropose() *MPropose {
+	return mProposePool.Get().(*MPropose)
+}
+
+// PutMPropose empties m and returns it to its pool
+func PutMPropose(m *MPropose) {
+	*m = MPropose{}
+	mProposePool.Put(m)
+}
+
+func (m *MPropose) Free() {
+	PutMPropose(m)
+}
+
+func (m *MPropose) New() fastrpc.Serializable {
+	return GetMPropose()
+}
+
+var m2BPool = sync.Pool{
+	New: func() interface{} {
+		return new(M2B)
+	},
+}
+
+// GetM2B returns an empty M2B taken from its pool
+func GetM2B() *M2B {
+	return m2BPool.Get().(*M2B)
+}
+
+// PutM2B empties m and returns it to its pool
+func PutM2B(m *M2B) {
+	*m = M2B{}
+	m2BPool.Put(m)
+}
+
+func (m *M2B) Free() {
+	PutM2B(m)
+}
+
+func (m *M2B) New() fastrpc.Serializable {
+	return GetM2B()
+}
+
+var mAcceptPool = sync.Pool{
+	New: func() interface{} {
+		return new(MAccept)
+	},
+}
+
+// GetMAccept returns an empty MAccept taken from its pool
+func GetMAccept() *MAccept {
+	return mAcceptPool.Get().(*MAccept)
+}
+
+// PutMAccept empties m and returns it to its pool
+func PutMAccept(m *MAccept) {
+	*m = MAccept{}
+	mAcceptPool.Put(m)
+}
+
+func (m *MAccept) Free() {
+	PutMAccept(m)
+}
+
+func (m *MAccept) New() fastrpc.Serializable {
+	return GetMAccept()
+}
+
+var mAcceptAckPool = sync.Pool{
+	New: func() interface{} {
+		return new(MAcceptAck)
+	},
+}
+
+// GetMAcceptAck returns an empty MAcceptAck taken from its pool
+func GetMAcceptAck() *MAcceptAck {
+	return mAcceptAckPool.Get().(*MAcceptAck)
+}
+
+// PutMAcceptAck empties m and returns it to its pool
+func PutMAcceptAck(m *MAcceptAck) {
+	*m = MAcceptAck{}
+	mAcceptAckPool.Put(m)
+}
+
+func (m *MAcceptAck) Free() {
+	PutMAcceptAck(m)
+}
+
+func (m *MAcceptAck) New() fastrpc.Serializable {
+	return GetMAcceptAck()
+}
+
+var mCommitPool = sync.Pool{
+	New: func() interface{} {
+		return new(MCommit)
+	},
+}
+
+// GetMCommit returns an empty MCommit taken from its pool
+func GetMCommit() *MCommit {
+	return mCommitPool.Get().(*MCommit)
+}
+
+// PutMCommit empties m and returns it to its pool
+func PutMCommit(m *MCommit) {
+	*m = MCommit{}
+	mCommitPool.Put(m)
+}
+
+func (m *MCommit) Free() {
+	PutMCommit(m)
+}
+
+func (m *MCommit) New() fastrpc.Serializable {
+	return GetMCommit()
+}
+
+var mPreparePool = sync.Pool{
+	New: func() interface{} {
+		return new(MPrepare)
+	},
+}
+
+// GetMPrepare returns an empty MPrepare taken from its pool
+func GetMPrepare() *MPrepare {
+	return mPreparePool.Get().(*MPrepare)
+}
+
+// PutMPrepare empties m and returns it to its pool
+func PutMPrepare(m *MPrepare) {
+	*m = MPrepare{}
+	mPreparePool.Put(m)
+}
+
+func (m *MPrepare) Free() {
+	PutMPrepare(m)
+}
+
+func (m *MPrepare) New() fastrpc.Serializable {
+	return GetMPrepare()
+}
+
+var mPromisePool = sync.Pool{
+	New: func() interface{} {
+		return new(MPromise)
+	},
+}
+
+// GetMPromise returns an empty MPromise taken from its pool
+func GetMPromise() *MPromise {
+	return mPromisePool.Get().(*MPromise)
+}
+
+// PutMPromise empties m and returns it to its pool
+func PutMPromise(m *MPromise) {
+	*m = MPromise{}
+	mPromisePool.Put(m)
+}
+
+func (m *MPromise) Free() {
+	PutMPromise(m)
+}
+
+func (m *MPromise) New() fastrpc.Serializable {
+	return GetMPromise()
+}
+
+var mAnyPool = sync.Pool{
+	New: func() interface{} {
+		return new(MAny)
+	},
+}
+
+// GetMAny returns an empty MAny taken from its pool
+func GetMAny() *MAny {
+	return mAnyPool.Get().(*MAny)
+}
+
+// PutMAny empties m and returns it to its pool
+func PutMAny(m *MAny) {
+	*m = MAny{}
+	mAnyPool.Put(m)
+}
+
+func (m *MAny) Free() {
+	PutMAny(m)
+}
+
+func (m *MAny) New() fastrpc.Serializable {
+	return GetMAny()
+}
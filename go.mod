@@ -4,7 +4,6 @@ go 1.14
 
 require (
 	github.com/efficient/gobin-codegen v0.0.0-20150314021255-a693c7cf61a5
-	github.com/emirpasic/gods v1.12.0
 	github.com/google/uuid v1.1.1
 	github.com/orcaman/concurrent-map v0.0.0-20190826125027-8c72a8bb44f6
 )
@@ -0,0 +1,71 @@
+package hermes
+
+import (
+	"fmt"
+
+	"github.com/vonaka/shreplic/state"
+)
+
+// key status
+const (
+	VALID = iota
+	INVALID
+	WRITE
+	REPLAY
+)
+
+// TS is the logical timestamp of a write, ties are broken by Replica
+type TS struct {
+	Version int32
+	Replica int32
+}
+
+func (ts TS) Less(other TS) bool {
+	return ts.Version < other.Version ||
+		(ts.Version == other.Version && ts.Replica < other.Replica)
+}
+
+func (ts TS) String() string {
+	return fmt.Sprintf("%v.%v", ts.Version, ts.Replica)
+}
+
+// MInv invalidates the key of Cmd and carries its new value
+type MInv struct {
+	Replica int32
+	Ts      TS
+	Cmd     state.Command
+}
+
+type MAck struct {
+	Replica int32
+	Key     int64
+	Ts      TS
+}
+
+// MVal validates Key once every live replica has acknowledged Ts
+type MVal struct {
+	Replica int32
+	Key     int64
+	Ts      TS
+}
+
+// MJoin asks a member for its keys once it has installed
+// the membership Epoch, in which Replica has joined again
+type MJoin struct {
+	Replica int32
+	Epoch   int32
+}
+
+// Entry is the state of a key, Valid is TRUE if the key is valid
+type Entry struct {
+	Ts    TS
+	Valid uint8
+	Cmd   state.Command
+}
+
+// MKeys carries the keys of a member of the membership Epoch
+type MKeys struct {
+	Replica int32
+	Epoch   int32
+	Keys    []Entry
+}
@@ -0,0 +1,593 @@
+package hermes
+
+import (
+	"flag"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/vonaka/shreplic/server/smr"
+	"github.com/vonaka/shreplic/state"
+	"github.com/vonaka/shreplic/tools/dlog"
+	"github.com/vonaka/shreplic/tools/fastrpc"
+)
+
+// Replica of Hermes.
+//
+// Any replica coordinates the writes it receives. A write invalidates
+// its key at every live replica, and the key is validated again once
+// all of them have acknowledged it. Reads of a valid key are served
+// locally, as long as the membership lease of the replica holds.
+//
+// The membership is the liveness view of the master. The lease of a
+// replica is renewed each time the master pings it with the epoch of
+// the last membership the replica is part of, and a replica declared
+// dead is removed from the membership once its lease expired. A removed
+// replica that answers the master again joins the next membership: it
+// serves no command until it has fetched the keys of the others.
+type Replica struct {
+	*smr.Replica
+
+	keys    map[state.Key]*key
+	writes  map[state.Key]*write
+	invalid int
+	stalled []*smr.GPropose
+
+	live       []bool
+	lease      time.Duration
+	lastPing   int64
+	epoch      int32
+	member     int32
+	installed  int32
+	joinEpoch  int32
+	joining    map[int32]struct{}
+	joins      []*MJoin
+	reconfChan chan *smr.ReconfigureArgs
+	tickChan   chan struct{}
+
+	sender smr.Sender
+	cs     CommunicationSupply
+}
+
+type key struct {
+	ts      TS
+	status  int
+	cmd     state.Command
+	waiting []*smr.GPropose
+}
+
+// write is coordinated by the replica, propose
+// is nil if the write is replayed
+type write struct {
+	ts      TS
+	cmd     state.Command
+	value   state.Value
+	acks    map[int32]struct{}
+	propose *smr.GPropose
+}
+
+type CommunicationSupply struct {
+	maxLatency time.Duration
+
+	invChan  chan fastrpc.Serializable
+	ackChan  chan fastrpc.Serializable
+	valChan  chan fastrpc.Serializable
+	joinChan chan fastrpc.Serializable
+	keysChan chan fastrpc.Serializable
+
+	invRPC  uint8
+	ackRPC  uint8
+	valRPC  uint8
+	joinRPC uint8
+	keysRPC uint8
+}
+
+func NewReplica(rid int, addrs []string, exec, dr bool,
+	f int, args string, ps map[string]struct{}) *Replica {
+
+	fs := flag.NewFlagSet("custom Hermes arguments", flag.ExitOnError)
+	lease := fs.Int("lease", 5000, "Milliseconds the membership lease lasts after a ping of the master")
+	fs.Parse(strings.Fields(args))
+
+	r := &Replica{
+		Replica: smr.NewReplica(rid, f, addrs, false, exec, false, dr, ps),
+
+		keys:    make(map[state.Key]*key),
+		writes:  make(map[state.Key]*write),
+		invalid: 0,
+		stalled: []*smr.GPropose{},
+
+		live:       make([]bool, len(addrs)),
+		lease:      time.Duration(*lease) * time.Millisecond,
+		lastPing:   time.Now().UnixNano(),
+		epoch:      0,
+		member:     1,
+		installed:  0,
+		joinEpoch:  0,
+		joining:    nil,
+		joins:      []*MJoin{},
+		reconfChan: make(chan *smr.ReconfigureArgs, 8),
+		tickChan:   make(chan struct{}, 1),
+	}
+
+	for i := range r.live {
+		r.live[i] = true
+	}
+
+	r.sender = smr.NewSender(r.Replica)
+	initCs(&r.cs, r.RPC)
+
+	go r.run()
+
+	return r
+}
+
+// Messages registers in t the messages of the protocol
+func Messages(t *fastrpc.Table) {
+	initCs(new(CommunicationSupply), t)
+}
+
+func initCs(cs *CommunicationSupply, t *fastrpc.Table) {
+	cs.maxLatency = 0
+
+	cs.invChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.ackChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.valChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.joinChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.keysChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+
+	cs.invRPC = t.Register(new(MInv), cs.invChan)
+	cs.ackRPC = t.Register(new(MAck), cs.ackChan)
+	cs.valRPC = t.Register(new(MVal), cs.valChan)
+	cs.joinRPC = t.Register(new(MJoin), cs.joinChan)
+	cs.keysRPC = t.Register(new(MKeys), cs.keysChan)
+}
+
+// Ping renews the membership lease of the replica if it
+// is part of the membership of the epoch of the master
+func (r *Replica) Ping(args *smr.PingArgs, reply *smr.PingReply) error {
+	if atomic.LoadInt32(&r.member) == 1 && args.Epoch == atomic.LoadInt32(&r.epoch) {
+		atomic.StoreInt64(&r.lastPing, time.Now().UnixNano())
+	}
+	return nil
+}
+
+// Reconfigure installs the membership of args once the lease of the
+// removed replicas has expired. A replica that joins again stops
+// serving commands until it has fetched the keys of the others.
+func (r *Replica) Reconfigure(args *smr.ReconfigureArgs, reply *smr.ReconfigureReply) error {
+	if int(r.Id) < len(args.Joined) && args.Joined[r.Id] {
+		atomic.StoreInt32(&r.member, 0)
+	}
+	if args.Epoch > atomic.LoadInt32(&r.epoch) {
+		atomic.StoreInt32(&r.epoch, args.Epoch)
+	}
+	time.AfterFunc(r.lease, func() {
+		r.reconfChan <- args
+	})
+	return nil
+}
+
+func (r *Replica) run() {
+	r.ConnectToPeers()
+	latencies := r.ComputeClosestPeers()
+	for _, l := range latencies {
+		d := time.Duration(l*1000*1000) * time.Nanosecond
+		if d > r.cs.maxLatency {
+			r.cs.maxLatency = d
+		}
+	}
+
+	go r.WaitForClientConnections()
+	go r.clock()
+
+	for !r.Shutdown {
+		select {
+		case propose := <-r.ProposeChan:
+			r.handlePropose(propose)
+
+		case m := <-r.cs.invChan:
+			inv := m.(*MInv)
+			r.handleInv(inv)
+			inv.Free()
+
+		case m := <-r.cs.ackChan:
+			ack := m.(*MAck)
+			r.handleAck(ack)
+			ack.Free()
+
+		case m := <-r.cs.valChan:
+			val := m.(*MVal)
+			r.handleVal(val)
+			val.Free()
+
+		case m := <-r.cs.joinChan:
+			join := m.(*MJoin)
+			r.handleJoin(join)
+
+		case m := <-r.cs.keysChan:
+			keys := m.(*MKeys)
+			r.handleKeys(keys)
+			keys.Free()
+
+		case args := <-r.reconfChan:
+			r.handleReconfigure(args)
+
+		case <-r.tickChan:
+			r.retryStalled()
+		}
+	}
+}
+
+func (r *Replica) clock() {
+	for !r.Shutdown {
+		time.Sleep(r.lease / 10)
+		r.tickChan <- struct{}{}
+	}
+}
+
+func (r *Replica) handlePropose(propose *smr.GPropose) {
+	if atomic.LoadInt32(&r.member) == 0 {
+		r.stalled = append(r.stalled, propose)
+		return
+	}
+	k := r.key(propose.Command.K)
+
+	switch propose.Command.Op {
+	case state.GET:
+		if k.status != VALID {
+			k.waiting = append(k.waiting, propose)
+		} else if !r.leased() {
+			r.stalled = append(r.stalled, propose)
+		} else {
+			r.reply(propose, r.execute(&propose.Command))
+		}
+
+	case state.SCAN:
+		// a scan might read any key
+		if r.invalid > 0 || !r.leased() {
+			r.stalled = append(r.stalled, propose)
+		} else {
+			r.reply(propose, r.execute(&propose.Command))
+		}
+
+	default:
+		if _, pending := r.writes[propose.Command.K]; pending || k.status != VALID {
+			k.waiting = append(k.waiting, propose)
+			return
+		}
+		ts := TS{
+			Version: k.ts.Version + 1,
+			Replica: r.Id,
+		}
+		r.apply(k, ts, propose.Command)
+		r.coordinate(propose.Command.K, k, &write{
+			ts:      ts,
+			cmd:     propose.Command,
+			value:   r.execute(&propose.Command),
+			acks:    make(map[int32]struct{}),
+			propose: propose,
+		})
+	}
+}
+
+// coordinate invalidates the key of w at every replica
+func (r *Replica) coordinate(K state.Key, k *key, w *write) {
+	if w.propose == nil {
+		r.setStatus(k, REPLAY)
+	} else {
+		r.setStatus(k, WRITE)
+	}
+	w.acks[r.Id] = struct{}{}
+	r.writes[K] = w
+
+	r.sender.SendToAll(&MInv{
+		Replica: r.Id,
+		Ts:      w.ts,
+		Cmd:     w.cmd,
+	}, r.cs.invRPC)
+	r.checkAcks(K, w)
+}
+
+func (r *Replica) handleInv(msg *MInv) {
+	k := r.key(msg.Cmd.K)
+	if k.ts.Less(msg.Ts) {
+		r.apply(k, msg.Ts, msg.Cmd)
+		r.execute(&msg.Cmd)
+		r.setStatus(k, INVALID)
+	}
+
+	r.sender.SendTo(msg.Replica, &MAck{
+		Replica: r.Id,
+		Key:     int64(msg.Cmd.K),
+		Ts:      msg.Ts,
+	}, r.cs.ackRPC)
+}
+
+func (r *Replica) handleAck(msg *MAck) {
+	K := state.Key(msg.Key)
+	w, exists := r.writes[K]
+	if !exists || w.ts != msg.Ts {
+		return
+	}
+	w.acks[msg.Replica] = struct{}{}
+	r.checkAcks(K, w)
+}
+
+// checkAcks completes w once every live replica has acknowledged it
+func (r *Replica) checkAcks(K state.Key, w *write) {
+	for i, alive := range r.live {
+		if _, exists := w.acks[int32(i)]; alive && !exists {
+			return
+		}
+	}
+
+	delete(r.writes, K)
+	if w.propose != nil {
+		r.reply(w.propose, w.value)
+	}
+	k := r.keys[K]
+	if k.ts == w.ts {
+		r.sender.SendToAll(&MVal{
+			Replica: r.Id,
+			Key:     int64(K),
+			Ts:      w.ts,
+		}, r.cs.valRPC)
+		r.validate(k)
+	} else if k.status == VALID {
+		// a more recent write has already been validated
+		r.validate(k)
+	} else {
+		r.replay(K, k)
+	}
+}
+
+func (r *Replica) handleVal(msg *MVal) {
+	k := r.key(state.Key(msg.Key))
+	if k.ts == msg.Ts && k.status == INVALID {
+		r.validate(k)
+	}
+}
+
+// validate serves the commands that were waiting for k to be valid
+func (r *Replica) validate(k *key) {
+	r.setStatus(k, VALID)
+	waiting := k.waiting
+	k.waiting = nil
+	for _, p := range waiting {
+		r.handlePropose(p)
+	}
+	if r.invalid == 0 {
+		r.retryStalled()
+	}
+}
+
+func (r *Replica) retryStalled() {
+	if len(r.stalled) == 0 || atomic.LoadInt32(&r.member) == 0 || !r.leased() {
+		return
+	}
+	stalled := r.stalled
+	r.stalled = []*smr.GPropose{}
+	for _, p := range stalled {
+		r.handlePropose(p)
+	}
+}
+
+func (r *Replica) handleReconfigure(args *smr.ReconfigureArgs) {
+	if args.Epoch <= r.installed {
+		return
+	}
+	r.installed = args.Epoch
+	alive := func(i int) bool {
+		return i < len(args.Alive) && args.Alive[i]
+	}
+	joined := func(i int) bool {
+		return i < len(args.Joined) && args.Joined[i]
+	}
+
+	if joined(int(r.Id)) || r.joining != nil {
+		// the membership known by the replica is stale
+		for i := range r.live {
+			r.live[i] = alive(i)
+		}
+		r.join(args.Epoch, args.Joined)
+	} else {
+		for i := range r.live {
+			if joined(i) && alive(i) {
+				r.live[i] = true
+				// i might have missed the pending invalidations
+				for _, w := range r.writes {
+					r.sender.SendTo(int32(i), &MInv{
+						Replica: r.Id,
+						Ts:      w.ts,
+						Cmd:     w.cmd,
+					}, r.cs.invRPC)
+				}
+			} else {
+				r.live[i] = r.live[i] && alive(i)
+			}
+		}
+	}
+	r.live[r.Id] = true
+	log.Println("Live replicas:", r.live)
+
+	for K, w := range r.writes {
+		r.checkAcks(K, w)
+	}
+	for K, k := range r.keys {
+		r.replay(K, k)
+	}
+
+	joins := r.joins
+	r.joins = []*MJoin{}
+	for _, j := range joins {
+		r.handleJoin(j)
+	}
+}
+
+// join fetches the keys of the live replicas
+// that have not joined in the membership epoch
+func (r *Replica) join(epoch int32, joined []bool) {
+	r.joinEpoch = epoch
+	r.joining = make(map[int32]struct{})
+	for i, alive := range r.live {
+		if alive && int32(i) != r.Id && (i >= len(joined) || !joined[i]) {
+			r.joining[int32(i)] = struct{}{}
+			r.sender.SendTo(int32(i), &MJoin{
+				Replica: r.Id,
+				Epoch:   epoch,
+			}, r.cs.joinRPC)
+		}
+	}
+	r.checkJoined()
+}
+
+func (r *Replica) handleJoin(msg *MJoin) {
+	if msg.Epoch > r.installed {
+		r.joins = append(r.joins, msg)
+		return
+	}
+
+	keys := make([]Entry, 0, len(r.keys))
+	for _, k := range r.keys {
+		if k.ts.Replica == -1 {
+			continue
+		}
+		valid := smr.FALSE
+		if k.status == VALID {
+			valid = smr.TRUE
+		}
+		keys = append(keys, Entry{
+			Ts:    k.ts,
+			Valid: valid,
+			Cmd:   k.cmd,
+		})
+	}
+	r.sender.SendTo(msg.Replica, &MKeys{
+		Replica: r.Id,
+		Epoch:   msg.Epoch,
+		Keys:    keys,
+	}, r.cs.keysRPC)
+}
+
+func (r *Replica) handleKeys(msg *MKeys) {
+	if _, waiting := r.joining[msg.Replica]; !waiting || msg.Epoch != r.joinEpoch {
+		return
+	}
+	delete(r.joining, msg.Replica)
+
+	for i := range msg.Keys {
+		e := &msg.Keys[i]
+		k := r.key(e.Cmd.K)
+		if !k.ts.Less(e.Ts) {
+			continue
+		}
+		r.apply(k, e.Ts, e.Cmd)
+		r.execute(&e.Cmd)
+		if e.Valid == smr.TRUE {
+			r.validate(k)
+		} else {
+			r.setStatus(k, INVALID)
+		}
+	}
+	r.checkJoined()
+}
+
+// checkJoined makes the replica a member once it has the keys
+// of every live replica, the invalid keys are then replayed
+func (r *Replica) checkJoined() {
+	if len(r.joining) > 0 {
+		return
+	}
+	r.joining = nil
+	for K, k := range r.keys {
+		if _, pending := r.writes[K]; !pending && k.status == INVALID {
+			r.coordinate(K, k, &write{
+				ts:      k.ts,
+				cmd:     k.cmd,
+				value:   state.NIL(),
+				acks:    make(map[int32]struct{}),
+				propose: nil,
+			})
+		}
+	}
+	atomic.StoreInt32(&r.member, 1)
+	log.Println("Joined the membership of epoch", r.joinEpoch)
+}
+
+// replay coordinates again the write that invalidated
+// k if its coordinator is dead
+func (r *Replica) replay(K state.Key, k *key) {
+	if _, pending := r.writes[K]; pending ||
+		k.status != INVALID || r.live[k.ts.Replica] {
+		return
+	}
+	r.coordinate(K, k, &write{
+		ts:      k.ts,
+		cmd:     k.cmd,
+		value:   state.NIL(),
+		acks:    make(map[int32]struct{}),
+		propose: nil,
+	})
+}
+
+func (r *Replica) apply(k *key, ts TS, cmd state.Command) {
+	k.ts = ts
+	k.cmd = cmd
+}
+
+func (r *Replica) execute(cmd *state.Command) state.Value {
+	if !r.Exec {
+		return state.NIL()
+	}
+	dlog.Printf("Executing " + cmd.String())
+	if !state.IsWrite(cmd) {
+		// reads are local and take no position
+		return cmd.Read(r.State)
+	}
+	return cmd.Execute(r.State)
+}
+
+func (r *Replica) setStatus(k *key, status int) {
+	if k.status == VALID && status != VALID {
+		r.invalid++
+	} else if k.status != VALID && status == VALID {
+		r.invalid--
+	}
+	k.status = status
+}
+
+func (r *Replica) key(K state.Key) *key {
+	k, exists := r.keys[K]
+	if !exists {
+		k = &key{
+			ts: TS{
+				Version: 0,
+				Replica: -1,
+			},
+			status: VALID,
+			cmd:    state.NOOP()[0],
+		}
+		r.keys[K] = k
+	}
+	return k
+}
+
+func (r *Replica) leased() bool {
+	last := time.Unix(0, atomic.LoadInt64(&r.lastPing))
+	return time.Since(last) < r.lease
+}
+
+func (r *Replica) reply(p *smr.GPropose, v state.Value) {
+	if !r.Dreply {
+		v = state.NIL()
+	}
+	rep := &smr.ProposeReplyTS{
+		OK:        smr.TRUE,
+		CommandId: p.CommandId,
+		Value:     v,
+		Timestamp: p.Timestamp,
+	}
+	r.ReplyProposeTS(rep, p.Reply, p.Mutex)
+}
@@ -0,0 +1,132 @@
+package hermes
+
+import (
+	"sync"
+
+	"github.com/vonaka/shreplic/tools/fastrpc"
+)
+
+var mInvPool = sync.Pool{
+	New: func() interface{} {
+		return new(MInv)
+	},
+}
+
+// GetMInv returns an empty MInv taken from its pool
+func GetMInv() *MInv {
+	return mInvPool.Get().(*MInv)
+}
+
+// PutMInv empties m and returns it to its pool
+func PutMInv(m *MInv) {
+	*m = MInv{}
+	mInvPool.Put(m)
+}
+
+func (m *MInv) Free() {
+	PutMInv(m)
+}
+
+func (m *MInv) New() fastrpc.Serializable {
+	return GetMInv()
+}
+
+var mAckPool = sync.Pool{
+	New: func() interface{} {
+		return new(MAck)
+	},
+}
+
+// GetMAck returns an empty MAck taken from its pool
+func GetMAck() *MAck {
+	return mAckPool.Get().(*MAck)
+}
+
+// PutMAck empties m and returns it to its pool
+func PutMAck(m *MAck) {
+	*m = MAck{}
+	mAckPool.Put(m)
+}
+
+func (m *MAck) Free() {
+	PutMAck(m)
+}
+
+func (m *MAck) New() fastrpc.Serializable {
+	return GetMAck()
+}
+
+var mValPool = sync.Pool{
+	New: func() interface{} {
+		return new(MVal)
+	},
+}
+
+// GetMVal returns an empty MVal taken from its pool
+func GetMVal() *MVal {
+	return mValPool.Get().(*MVal)
+}
+
+// PutMVal empties m and returns it to its pool
+func PutMVal(m *MVal) {
+	*m = MVal{}
+	mValPool.Put(m)
+}
+
+func (m *MVal) Free() {
+	PutMVal(m)
+}
+
+func (m *MVal) New() fastrpc.Serializable {
+	return GetMVal()
+}
+
+var mJoinPool = sync.Pool{
+	New: func() interface{} {
+		return new(MJoin)
+	},
+}
+
+// GetMJoin returns an empty MJoin taken from its pool
+func GetMJoin() *MJoin {
+	return mJoinPool.Get().(*MJoin)
+}
+
+// PutMJoin empties m and returns it to its pool
+func PutMJoin(m *MJoin) {
+	*m = MJoin{}
+	mJoinPool.Put(m)
+}
+
+func (m *MJoin) Free() {
+	PutMJoin(m)
+}
+
+func (m *MJoin) New() fastrpc.Serializable {
+	return GetMJoin()
+}
+
+var mKeysPool = sync.Pool{
+	New: func() interface{} {
+		return new(MKeys)
+	},
+}
+
+// GetMKeys returns an empty MKeys taken from its pool
+func GetMKeys() *MKeys {
+	return mKeysPool.Get().(*MKeys)
+}
+
+// PutMKeys empties m and returns it to its pool
+func PutMKeys(m *MKeys) {
+	*m = MKeys{}
+	mKeysPool.Put(m)
+}
+
+func (m *MKeys) Free() {
+	PutMKeys(m)
+}
+
+func (m *MKeys) New() fastrpc.Serializable {
+	return GetMKeys()
+}
@@ -0,0 +1,512 @@
+package hermes
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+type byteReader interface {
+	io.Reader
+	ReadByte() (c byte, err error)
+}
+
+func (t *TS) BinarySize() (nbytes int, sizeKnown bool) {
+	return 8, true
+}
+
+type TSCache struct {
+	mu    sync.Mutex
+	cache []*TS
+}
+
+func NewTSCache() *TSCache {
+	c := &TSCache{}
+	c.cache = make([]*TS, 0)
+	return c
+}
+
+func (p *TSCache) Get() *TS {
+	var t *TS
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &TS{}
+	}
+	return t
+}
+func (p *TSCache) Put(t *TS) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *TS) Marshal(wire io.Writer) {
+	var b [8]byte
+	var bs []byte
+	bs = b[:8]
+	tmp32 := t.Version
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	tmp32 = t.Replica
+	bs[4] = byte(tmp32)
+	bs[5] = byte(tmp32 >> 8)
+	bs[6] = byte(tmp32 >> 16)
+	bs[7] = byte(tmp32 >> 24)
+	wire.Write(bs)
+}
+
+func (t *TS) Unmarshal(wire io.Reader) error {
+	var b [8]byte
+	var bs []byte
+	bs = b[:8]
+	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+		return err
+	}
+	t.Version = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.Replica = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
+	return nil
+}
+
+func (t *MInv) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type MInvCache struct {
+	mu    sync.Mutex
+	cache []*MInv
+}
+
+func NewMInvCache() *MInvCache {
+	c := &MInvCache{}
+	c.cache = make([]*MInv, 0)
+	return c
+}
+
+func (p *MInvCache) Get() *MInv {
+	var t *MInv
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &MInv{}
+	}
+	return t
+}
+func (p *MInvCache) Put(t *MInv) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *MInv) Marshal(wire io.Writer) {
+	var b [12]byte
+	var bs []byte
+	bs = b[:12]
+	tmp32 := t.Replica
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	tmp32 = t.Ts.Version
+	bs[4] = byte(tmp32)
+	bs[5] = byte(tmp32 >> 8)
+	bs[6] = byte(tmp32 >> 16)
+	bs[7] = byte(tmp32 >> 24)
+	tmp32 = t.Ts.Replica
+	bs[8] = byte(tmp32)
+	bs[9] = byte(tmp32 >> 8)
+	bs[10] = byte(tmp32 >> 16)
+	bs[11] = byte(tmp32 >> 24)
+	wire.Write(bs)
+	t.Cmd.Marshal(wire)
+}
+
+func (t *MInv) Unmarshal(wire io.Reader) error {
+	var b [12]byte
+	var bs []byte
+	bs = b[:12]
+	if _, err := io.ReadAtLeast(wire, bs, 12); err != nil {
+		return err
+	}
+	t.Replica = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.Ts.Version = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
+	t.Ts.Replica = int32((uint32(bs[8]) | (uint32(bs[9]) << 8) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 24)))
+	t.Cmd.Unmarshal(wire)
+	return nil
+}
+
+func (t *MAck) BinarySize() (nbytes int, sizeKnown bool) {
+	return 20, true
+}
+
+type MAckCache struct {
+	mu    sync.Mutex
+	cache []*MAck
+}
+
+func NewMAckCache() *MAckCache {
+	c := &MAckCache{}
+	c.cache = make([]*MAck, 0)
+	return c
+}
+
+func (p *MAckCache) Get() *MAck {
+	var t *MAck
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &MAck{}
+	}
+	return t
+}
+func (p *MAckCache) Put(t *MAck) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *MAck) Marshal(wire io.Writer) {
+	var b [20]byte
+	var bs []byte
+	bs = b[:20]
+	tmp32 := t.Replica
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	tmp64 := t.Key
+	bs[4] = byte(tmp64)
+	bs[5] = byte(tmp64 >> 8)
+	bs[6] = byte(tmp64 >> 16)
+	bs[7] = byte(tmp64 >> 24)
+	bs[8] = byte(tmp64 >> 32)
+	bs[9] = byte(tmp64 >> 40)
+	bs[10] = byte(tmp64 >> 48)
+	bs[11] = byte(tmp64 >> 56)
+	tmp32 = t.Ts.Version
+	bs[12] = byte(tmp32)
+	bs[13] = byte(tmp32 >> 8)
+	bs[14] = byte(tmp32 >> 16)
+	bs[15] = byte(tmp32 >> 24)
+	tmp32 = t.Ts.Replica
+	bs[16] = byte(tmp32)
+	bs[17] = byte(tmp32 >> 8)
+	bs[18] = byte(tmp32 >> 16)
+	bs[19] = byte(tmp32 >> 24)
+	wire.Write(bs)
+}
+
+func (t *MAck) Unmarshal(wire io.Reader) error {
+	var b [20]byte
+	var bs []byte
+	bs = b[:20]
+	if _, err := io.ReadAtLeast(wire, bs, 20); err != nil {
+		return err
+	}
+	t.Replica = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.Key = int64((uint64(bs[4]) | (uint64(bs[5]) << 8) | (uint64(bs[6]) << 16) | (uint64(bs[7]) << 24) | (uint64(bs[8]) << 32) | (uint64(bs[9]) << 40) | (uint64(bs[10]) << 48) | (uint64(bs[11]) << 56)))
+	t.Ts.Version = int32((uint32(bs[12]) | (uint32(bs[13]) << 8) | (uint32(bs[14]) << 16) | (uint32(bs[15]) << 24)))
+	t.Ts.Replica = int32((uint32(bs[16]) | (uint32(bs[17]) << 8) | (uint32(bs[18]) << 16) | (uint32(bs[19]) << 24)))
+	return nil
+}
+
+func (t *MVal) BinarySize() (nbytes int, sizeKnown bool) {
+	return 20, true
+}
+
+type MValCache struct {
+	mu    sync.Mutex
+	cache []*MVal
+}
+
+func NewMValCache() *MValCache {
+	c := &MValCache{}
+	c.cache = make([]*MVal, 0)
+	return c
+}
+
+func (p *MValCache) Get() *MVal {
+	var t *MVal
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &MVal{}
+	}
+	return t
+}
+func (p *MValCache) Put(t *MVal) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *MVal) Marshal(wire io.Writer) {
+	var b [20]byte
+	var bs []byte
+	bs = b[:20]
+	tmp32 := t.Replica
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	tmp64 := t.Key
+	bs[4] = byte(tmp64)
+	bs[5] = byte(tmp64 >> 8)
+	bs[6] = byte(tmp64 >> 16)
+	bs[7] = byte(tmp64 >> 24)
+	bs[8] = byte(tmp64 >> 32)
+	bs[9] = byte(tmp64 >> 40)
+	bs[10] = byte(tmp64 >> 48)
+	bs[11] = byte(tmp64 >> 56)
+	tmp32 = t.Ts.Version
+	bs[12] = byte(tmp32)
+	bs[13] = byte(tmp32 >> 8)
+	bs[14] = byte(tmp32 >> 16)
+	bs[15] = byte(tmp32 >> 24)
+	tmp32 = t.Ts.Replica
+	bs[16] = byte(tmp32)
+	bs[17] = byte(tmp32 >> 8)
+	bs[18] = byte(tmp32 >> 16)
+	bs[19] = byte(tmp32 >> 24)
+	wire.Write(bs)
+}
+
+func (t *MVal) Unmarshal(wire io.Reader) error {
+	var b [20]byte
+	var bs []byte
+	bs = b[:20]
+	if _, err := io.ReadAtLeast(wire, bs, 20); err != nil {
+		return err
+	}
+	t.Replica = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.Key = int64((uint64(bs[4]) | (uint64(bs[5]) << 8) | (uint64(bs[6]) << 16) | (uint64(bs[7]) << 24) | (uint64(bs[8]) << 32) | (uint64(bs[9]) << 40) | (uint64(bs[10]) << 48) | (uint64(bs[11]) << 56)))
+	t.Ts.Version = int32((uint32(bs[12]) | (uint32(bs[13]) << 8) | (uint32(bs[14]) << 16) | (uint32(bs[15]) << 24)))
+	t.Ts.Replica = int32((uint32(bs[16]) | (uint32(bs[17]) << 8) | (uint32(bs[18]) << 16) | (uint32(bs[19]) << 24)))
+	return nil
+}
+
+func (t *MJoin) BinarySize() (nbytes int, sizeKnown bool) {
+	return 8, true
+}
+
+type MJoinCache struct {
+	mu    sync.Mutex
+	cache []*MJoin
+}
+
+func NewMJoinCache() *MJoinCache {
+	c := &MJoinCache{}
+	c.cache = make([]*MJoin, 0)
+	return c
+}
+
+func (p *MJoinCache) Get() *MJoin {
+	var t *MJoin
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &MJoin{}
+	}
+	return t
+}
+func (p *MJoinCache) Put(t *MJoin) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *MJoin) Marshal(wire io.Writer) {
+	var b [8]byte
+	var bs []byte
+	bs = b[:8]
+	tmp32 := t.Replica
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	tmp32 = t.Epoch
+	bs[4] = byte(tmp32)
+	bs[5] = byte(tmp32 >> 8)
+	bs[6] = byte(tmp32 >> 16)
+	bs[7] = byte(tmp32 >> 24)
+	wire.Write(bs)
+}
+
+func (t *MJoin) Unmarshal(wire io.Reader) error {
+	var b [8]byte
+	var bs []byte
+	bs = b[:8]
+	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+		return err
+	}
+	t.Replica = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.Epoch = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
+	return nil
+}
+
+func (t *Entry) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type EntryCache struct {
+	mu    sync.Mutex
+	cache []*Entry
+}
+
+func NewEntryCache() *EntryCache {
+	c := &EntryCache{}
+	c.cache = make([]*Entry, 0)
+	return c
+}
+
+func (p *EntryCache) Get() *Entry {
+	var t *Entry
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &Entry{}
+	}
+	return t
+}
+func (p *EntryCache) Put(t *Entry) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *Entry) Marshal(wire io.Writer) {
+	var b [9]byte
+	var bs []byte
+	bs = b[:9]
+	tmp32 := t.Ts.Version
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	tmp32 = t.Ts.Replica
+	bs[4] = byte(tmp32)
+	bs[5] = byte(tmp32 >> 8)
+	bs[6] = byte(tmp32 >> 16)
+	bs[7] = byte(tmp32 >> 24)
+	bs[8] = byte(t.Valid)
+	wire.Write(bs)
+	t.Cmd.Marshal(wire)
+}
+
+func (t *Entry) Unmarshal(wire io.Reader) error {
+	var b [9]byte
+	var bs []byte
+	bs = b[:9]
+	if _, err := io.ReadAtLeast(wire, bs, 9); err != nil {
+		return err
+	}
+	t.Ts.Version = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.Ts.Replica = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
+	t.Valid = uint8(bs[8])
+	t.Cmd.Unmarshal(wire)
+	return nil
+}
+
+func (t *MKeys) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type MKeysCache struct {
+	mu    sync.Mutex
+	cache []*MKeys
+}
+
+func NewMKeysCache() *MKeysCache {
+	c := &MKeysCache{}
+	c.cache = make([]*MKeys, 0)
+	return c
+}
+
+func (p *MKeysCache) Get() *MKeys {
+	var t *MKeys
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &MKeys{}
+	}
+	return t
+}
+func (p *MKeysCache) Put(t *MKeys) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *MKeys) Marshal(wire io.Writer) {
+	var b [10]byte
+	var bs []byte
+	bs = b[:8]
+	tmp32 := t.Replica
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	tmp32 = t.Epoch
+	bs[4] = byte(tmp32)
+	bs[5] = byte(tmp32 >> 8)
+	bs[6] = byte(tmp32 >> 16)
+	bs[7] = byte(tmp32 >> 24)
+	wire.Write(bs)
+	bs = b[:]
+	alen1 := int64(len(t.Keys))
+	if wlen := binary.PutVarint(bs, alen1); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen1; i++ {
+		t.Keys[i].Marshal(wire)
+	}
+}
+
+func (t *MKeys) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [10]byte
+	var bs []byte
+	bs = b[:8]
+	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+		return err
+	}
+	t.Replica = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.Epoch = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
+	alen1, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Keys = make([]Entry, alen1)
+	for i := int64(0); i < alen1; i++ {
+		t.Keys[i].Unmarshal(wire)
+	}
+	return nil
+}
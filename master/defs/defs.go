@@ -1,8 +1,17 @@
 package defs
 
+import (
+	"github.com/vonaka/shreplic/server/smr"
+	"github.com/vonaka/shreplic/shard"
+	"github.com/vonaka/shreplic/state"
+)
+
 type RegisterArgs struct {
-	Addr string
-	Port int
+	Addr  string
+	Port  int
+	Group int
+	// Rtt is the round-trip time to the master in milliseconds
+	Rtt float64
 }
 
 type RegisterReply struct {
@@ -12,16 +21,51 @@ type RegisterReply struct {
 	IsLeader  bool
 }
 
-type GetLeaderArgs struct{}
+type GetLeaderArgs struct {
+	Group int
+}
 
 type GetLeaderReply struct {
 	LeaderId int
 }
 
-type GetReplicaListArgs struct{}
+type GetReplicaListArgs struct {
+	Group int
+}
 
 type GetReplicaListReply struct {
 	ReplicaList []string
 	AliveList   []bool
 	Ready       bool
 }
+
+type GetShardMapArgs struct{}
+
+type GetShardMapReply struct {
+	Map shard.Map
+}
+
+type SplitArgs struct {
+	Key state.Key
+}
+
+type SplitReply struct {
+	Map shard.Map
+}
+
+type MoveArgs struct {
+	Key   state.Key
+	Group int
+}
+
+type MoveReply struct {
+	Map shard.Map
+}
+
+type SetLinkArgs struct {
+	Group   int
+	Replica int
+	Link    smr.LinkArgs
+}
+
+type SetLinkReply struct{}
@@ -6,10 +6,9 @@ import (
 	"fmt"
 	"log"
 	"math"
-	"net"
 	"net/http"
 	"net/rpc"
-	"os/exec"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -17,19 +16,70 @@ import (
 
 	"github.com/vonaka/shreplic/master/defs"
 	"github.com/vonaka/shreplic/server/smr"
+	"github.com/vonaka/shreplic/shard"
+	"github.com/vonaka/shreplic/state"
+	"github.com/vonaka/shreplic/tools/metrics"
+	"github.com/vonaka/shreplic/tools/mtls"
+	"github.com/vonaka/shreplic/tools/transport"
 )
 
 var (
-	portnum  = flag.Int("port", 7087, "Port to listen on")
-	numNodes = flag.Int("N", 3, "Number of replicas")
+	portnum   = flag.Int("port", 7087, "Port to listen on")
+	numNodes  = flag.Int("N", 3, "Number of replicas per group")
+	numGroups = flag.Int("G", 1, "Number of consensus groups")
+	partition = flag.String("partition", shard.RANGE, "Partitioning of the key space (range or hash)")
+	buckets   = flag.Int64("buckets", 1024, "Number of buckets (only for hash partitioning)")
+	maddr     = flag.String("maddr", "", "Address of a running master (only with -split, -move or -link)")
+	split     = flag.String("split", "", "Ask a running master to split the range that contains this key")
+	move      = flag.String("move", "", "Ask a running master to move the range that contains a key to a group (<key>:<group>)")
+	link      = flag.String("link", "", "Ask a running master to change an emulated link (<from>:<to>:<delay>[:<jitter>[:<loss>]], from c for the clients)")
+	linkGroup = flag.Int("group", 0, "Group of the link (only with -link)")
+	certFile  = flag.String("cert", "", "Certificate of the master (enables TLS)")
+	keyFile   = flag.String("key", "", "Private key of the certificate")
+	caFile    = flag.String("ca", "", "Certificate of the CA that signs the certificates of all nodes")
+)
+
+// TLS secures the connections of the master, nil means plaintext
+var TLS *mtls.Config = nil
+
+// RTT_ALPHA is the weight of a new round-trip time in the latencies of a group
+const RTT_ALPHA = 0.1
+
+// PING_TIMEOUT is the time after which a replica
+// that does not answer a ping is considered as dead
+const PING_TIMEOUT = 2 * time.Second
+
+const (
+	// FREEZE_RETRY is the time after which the freeze
+	// of a range that is not executed is proposed again
+	FREEZE_RETRY = 1 * time.Second
+	// FREEZE_TIMEOUT is the time after which a move is given up
+	// if the freeze of the range is still not executed
+	FREEZE_TIMEOUT = 30 * time.Second
+	FREEZE_POLL    = 50 * time.Millisecond
+)
+
+var (
+	NOT_FROZEN = errors.New("Range could not be frozen by its group")
+	NO_REPLICA = errors.New("No replica of the group is alive")
+	NOT_DONE   = errors.New("Command was not executed by the group")
+	NO_ANSWER  = errors.New("Replica did not answer in time")
 )
 
 type Master struct {
 	N          int
+	groups     []*group
+	shards     *shard.Map
+	lock       *sync.Mutex
+	reconfLock *sync.Mutex
+	metrics    *metrics.Registry
+}
+
+type group struct {
+	id         int
 	nodeList   []string
 	addrList   []string
 	portList   []int
-	lock       *sync.Mutex
 	nodes      []*rpc.Client
 	leader     []bool
 	alive      []bool
@@ -37,45 +87,76 @@ type Master struct {
 	finishInit bool
 	initCond   *sync.Cond
 	nextLeader int
+	epoch      int32
 }
 
 func main() {
 	flag.Parse()
 
+	var err error
+	TLS, err = mtls.Load(*certFile, *keyFile, *caFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *split != "" || *move != "" || *link != "" {
+		admin()
+		return
+	}
+
+	shards, err := shard.NewMap(*partition, *numGroups, *buckets)
+	if err != nil {
+		log.Fatalf("%v: %s", err, *partition)
+	}
+
 	log.Printf("Master starting on port %d", *portnum)
-	log.Printf("...waiting for %d replicas", *numNodes)
+	log.Printf("...waiting for %d groups of %d replicas", *numGroups, *numNodes)
 
 	master := &Master{
 		N:          *numNodes,
-		nodeList:   make([]string, 0, *numNodes),
-		addrList:   make([]string, 0, *numNodes),
-		portList:   make([]int, 0, *numNodes),
+		groups:     make([]*group, *numGroups),
+		shards:     shards,
 		lock:       new(sync.Mutex),
-		nodes:      make([]*rpc.Client, *numNodes),
-		leader:     make([]bool, *numNodes),
-		alive:      make([]bool, *numNodes),
-		latencies:  make([]float64, *numNodes),
-		finishInit: false,
-		nextLeader: -1,
-	}
-	master.initCond = sync.NewCond(master.lock)
-
-	rpc.Register(master)
-	rpc.HandleHTTP()
-	l, err := net.Listen("tcp", fmt.Sprintf(":%d", *portnum))
+		reconfLock: new(sync.Mutex),
+		metrics:    metrics.NewRegistry(),
+	}
+	for i := range master.groups {
+		master.groups[i] = &group{
+			id:         i,
+			nodeList:   make([]string, 0, *numNodes),
+			addrList:   make([]string, 0, *numNodes),
+			portList:   make([]int, 0, *numNodes),
+			nodes:      make([]*rpc.Client, *numNodes),
+			leader:     make([]bool, *numNodes),
+			alive:      make([]bool, *numNodes),
+			latencies:  make([]float64, *numNodes),
+			finishInit: false,
+			initCond:   sync.NewCond(master.lock),
+			nextLeader: -1,
+		}
+	}
+
+	master.initMetrics()
+
+	http.HandleFunc(rpc.DefaultRPCPath, master.serveRPC)
+	http.Handle("/metrics", master.metrics)
+	l, err := TLS.Listen(transport.TCP, fmt.Sprintf(":%d", *portnum))
 	if err != nil {
 		log.Fatal("Master listen error:", err)
 	}
 
-	go master.run()
+	for _, g := range master.groups {
+		go master.run(g)
+	}
+	go master.recoverTxs()
 
 	http.Serve(l, nil)
 }
 
-func (master *Master) run() {
+func (master *Master) run(g *group) {
 	for {
 		master.lock.Lock()
-		if len(master.nodeList) == master.N {
+		if len(g.nodeList) == master.N {
 			master.lock.Unlock()
 			break
 		}
@@ -84,59 +165,90 @@ func (master *Master) run() {
 	}
 	time.Sleep(2 * time.Second)
 
+	// the fields of g are only written by this goroutine,
+	// with master.lock held as the RPCs of the master read them
 	for i := 0; i < master.N; {
-		var err error
-		addr := fmt.Sprintf("%s:%d", master.addrList[i], master.portList[i]+1000)
-		master.nodes[i], err = rpc.DialHTTP("tcp", addr)
+		addr := fmt.Sprintf("%s:%d", g.addrList[i], g.portList[i]+1000)
+		node, err := TLS.DialHTTP(addr, mtls.ReplicaName(g.id, int32(i)))
 		if err != nil {
 			log.Printf("Error connecting to replica %d (%v), retrying...", i, addr)
 			time.Sleep(1 * time.Second)
 		} else {
+			master.lock.Lock()
+			g.nodes[i] = node
+			master.lock.Unlock()
 			btlReply := smr.NewBeTheLeaderReply()
-			if master.leader[i] {
-				err = master.nodes[i].Call("Replica.BeTheLeader",
+			if g.leader[i] {
+				err = node.Call("Replica.BeTheLeader",
 					new(smr.BeTheLeaderArgs), btlReply)
 				if err != nil {
 					log.Fatal("Not today Zurg!")
 				}
 				smr.UpdateBeTheLeaderReply(btlReply)
+				master.lock.Lock()
 				if btlReply.Leader != -1 && btlReply.Leader != int32(i) {
-					master.leader[i] = false
-					master.leader[int(btlReply.Leader)] = true
+					g.leader[i] = false
+					g.leader[int(btlReply.Leader)] = true
 				}
-				master.nextLeader = int(btlReply.NextLeader)
+				g.nextLeader = int(btlReply.NextLeader)
+				master.lock.Unlock()
 			}
 			i++
 		}
 	}
 
+	master.reconfLock.Lock()
+	master.pushShardMap(g)
+	master.reconfLock.Unlock()
+
+	group := strconv.Itoa(g.id)
+	failures := master.metrics.Counter("shr_master_failures_total",
+		"Replicas detected as failed", "group", group)
+	leaderChanges := master.metrics.Counter("shr_master_leader_changes_total",
+		"Leaders elected after the failure of the previous one", "group", group)
+	pings := master.metrics.Histogram("shr_master_ping_seconds",
+		"Latency of the pings of the replicas", metrics.DefBuckets, "group", group)
+
 	var new_leader bool
-	pingNode := func(i int, node *rpc.Client) {
-		err := node.Call("Replica.Ping", new(smr.PingArgs), new(smr.PingReply))
+	pingNode := func(i int) {
+		start := time.Now()
+		node, err := g.ping(i)
+		rtt := time.Since(start)
+		pings.Observe(rtt.Seconds())
+
+		master.lock.Lock()
+		defer master.lock.Unlock()
+		if old := g.nodes[i]; old != node {
+			g.nodes[i] = node
+			// the calls on a copy of old (see replicas) fail
+			go old.Close()
+		}
 		if err != nil {
-			master.alive[i] = false
-			if master.leader[i] {
+			g.alive[i] = false
+			if g.leader[i] {
 				new_leader = true
-				master.leader[i] = false
+				g.leader[i] = false
 			}
 		} else {
-			master.alive[i] = true
+			g.alive[i] = true
+			ms := float64(rtt) / float64(time.Millisecond)
+			g.latencies[i] = (1-RTT_ALPHA)*g.latencies[i] + RTT_ALPHA*ms
 		}
 	}
-	master.lock.Lock()
-	for i, node := range master.nodes {
-		pingNode(i, node)
+	for i := range g.nodes {
+		pingNode(i)
 	}
 	// initialization is finished
 	// (i.e., slice `alive` has been computed)
-	master.finishInit = true
-	master.initCond.Broadcast()
+	master.lock.Lock()
+	g.finishInit = true
+	g.initCond.Broadcast()
 	master.lock.Unlock()
 
 	beTheLeader := func(i int) error {
-		if master.alive[i] {
+		if g.alive[i] {
 			btlReply := smr.NewBeTheLeaderReply()
-			err := master.nodes[i].Call("Replica.BeTheLeader",
+			err := g.nodes[i].Call("Replica.BeTheLeader",
 				new(smr.BeTheLeaderArgs), btlReply)
 			if err == nil {
 				smr.UpdateBeTheLeaderReply(btlReply)
@@ -144,9 +256,11 @@ func (master *Master) run() {
 				if btlReply.Leader != -1 {
 					leaderI = int(btlReply.Leader)
 				}
-				master.leader[leaderI] = true
-				master.nextLeader = int(btlReply.NextLeader)
-				log.Printf("Replica %d is the new leader", leaderI)
+				master.lock.Lock()
+				g.leader[leaderI] = true
+				g.nextLeader = int(btlReply.NextLeader)
+				master.lock.Unlock()
+				log.Printf("Replica %d of group %d is the new leader", leaderI, g.id)
 				return nil
 			}
 			return err
@@ -157,36 +271,204 @@ func (master *Master) run() {
 	for {
 		time.Sleep(3 * time.Second)
 		new_leader = false
-		for i, node := range master.nodes {
-			pingNode(i, node)
+		failed := false
+		joined := make([]bool, len(g.nodes))
+		rejoined := false
+		for i := range g.nodes {
+			wasAlive := g.alive[i]
+			pingNode(i)
+			if wasAlive && !g.alive[i] {
+				failed = true
+				failures.Inc()
+			} else if !wasAlive && g.alive[i] {
+				log.Printf("Replica %d of group %d is back", i, g.id)
+				joined[i] = true
+				rejoined = true
+			}
 		}
 
+		if failed || rejoined {
+			master.reconfigure(g, joined)
+		}
 		if !new_leader {
 			continue
 		}
-		if master.nextLeader != -1 {
-			if beTheLeader(master.nextLeader) == nil {
+		if g.nextLeader != -1 {
+			if beTheLeader(g.nextLeader) == nil {
+				leaderChanges.Inc()
 				continue
 			}
 		}
-		for i := range master.nodes {
+		for _, i := range g.closest() {
 			if beTheLeader(i) == nil {
+				leaderChanges.Inc()
 				break
 			}
 		}
 	}
 }
 
+type pingResult struct {
+	node *rpc.Client
+	err  error
+}
+
+// ping pings the replica i of g, which is dialed again if it was
+// dead, within PING_TIMEOUT and returns the client of the replica
+func (g *group) ping(i int) (*rpc.Client, error) {
+	node, dial := g.nodes[i], !g.alive[i]
+	args := &smr.PingArgs{
+		Epoch: g.epoch,
+	}
+	c := make(chan pingResult, 1)
+	go func() {
+		n := node
+		if dial {
+			addr := fmt.Sprintf("%s:%d", g.addrList[i], g.portList[i]+1000)
+			if d, err := TLS.DialHTTP(addr, mtls.ReplicaName(g.id, int32(i))); err == nil {
+				n = d
+			}
+		}
+		c <- pingResult{n, n.Call("Replica.Ping", args, new(smr.PingReply))}
+	}()
+
+	select {
+	case res := <-c:
+		return res.node, res.err
+	case <-time.After(PING_TIMEOUT):
+		go func() {
+			if res := <-c; res.node != node {
+				res.node.Close()
+			}
+		}()
+		return node, NO_ANSWER
+	}
+}
+
+// closest returns the replicas of g by increasing round-trip time
+func (g *group) closest() []int {
+	rs := make([]int, len(g.nodes))
+	for i := range rs {
+		rs[i] = i
+	}
+	sort.SliceStable(rs, func(i, j int) bool {
+		return g.latencies[rs[i]] < g.latencies[rs[j]]
+	})
+	return rs
+}
+
+func (master *Master) initMetrics() {
+	master.metrics.GaugeFunc("shr_master_replicas_alive",
+		"Replicas of each group that answer the pings", func(set metrics.Setter) {
+			master.lock.Lock()
+			defer master.lock.Unlock()
+			for _, g := range master.groups {
+				alive := 0
+				for _, a := range g.alive {
+					if a {
+						alive++
+					}
+				}
+				set(float64(alive), "group", strconv.Itoa(g.id))
+			}
+		})
+	master.metrics.GaugeFunc("shr_master_leader",
+		"Leader of each group, -1 if unknown", func(set metrics.Setter) {
+			master.lock.Lock()
+			defer master.lock.Unlock()
+			for _, g := range master.groups {
+				leader := -1
+				for i, l := range g.leader {
+					if l {
+						leader = i
+					}
+				}
+				set(float64(leader), "group", strconv.Itoa(g.id))
+			}
+		})
+}
+
+// reconfigure tells the alive replicas of g which replicas
+// are alive and which ones have joined the group again
+func (master *Master) reconfigure(g *group, joined []bool) {
+	g.epoch++
+	args := &smr.ReconfigureArgs{
+		Epoch:  g.epoch,
+		Alive:  make([]bool, len(g.alive)),
+		Joined: joined,
+	}
+	copy(args.Alive, g.alive)
+
+	for i, node := range g.nodes {
+		if !args.Alive[i] {
+			continue
+		}
+		err := node.Call("Replica.Reconfigure", args, new(smr.ReconfigureReply))
+		if err != nil {
+			log.Printf("Cannot reconfigure replica %d of group %d: %v", i, g.id, err)
+		}
+	}
+}
+
+// pushShardMap must be called with reconfLock held
+func (master *Master) pushShardMap(g *group) {
+	master.lock.Lock()
+	args := &smr.SetShardMapArgs{
+		Group: g.id,
+		Map:   *master.shards.Copy(),
+	}
+	master.lock.Unlock()
+
+	nodes, _, _ := master.replicas(g)
+	for i, node := range nodes {
+		if node == nil {
+			continue
+		}
+		err := node.Call("Replica.SetShardMap", args, new(smr.SetShardMapReply))
+		if err != nil {
+			log.Printf("Cannot send partition map to replica %d of group %d: %v", i, g.id, err)
+		}
+	}
+}
+
+// publish must be called with reconfLock held
+func (master *Master) publish(m *shard.Map) {
+	master.lock.Lock()
+	master.shards = m
+	master.lock.Unlock()
+	log.Printf("Partition map %v", m)
+
+	for _, g := range master.groups {
+		master.pushShardMap(g)
+	}
+}
+
+func (master *Master) waitInit() {
+	master.lock.Lock()
+	defer master.lock.Unlock()
+
+	for _, g := range master.groups {
+		for !g.finishInit {
+			g.initCond.Wait()
+		}
+	}
+}
+
 func (master *Master) Register(args *defs.RegisterArgs, reply *defs.RegisterReply) error {
 	master.lock.Lock()
 	defer master.lock.Unlock()
 
-	nlen := len(master.nodeList)
+	if args.Group < 0 || args.Group >= len(master.groups) {
+		return shard.NO_SUCH_GROUP
+	}
+	g := master.groups[args.Group]
+
+	nlen := len(g.nodeList)
 	index := nlen
 
 	addrPort := fmt.Sprintf("%s:%d", args.Addr, args.Port)
 
-	for i, ap := range master.nodeList {
+	for i, ap := range g.nodeList {
 		if addrPort == ap {
 			index = i
 			break
@@ -194,49 +476,39 @@ func (master *Master) Register(args *defs.RegisterArgs, reply *defs.RegisterRepl
 	}
 
 	if index == nlen {
-		master.nodeList = master.nodeList[0 : nlen+1]
-		master.nodeList[nlen] = addrPort
-		master.addrList = master.addrList[0 : nlen+1]
-		master.addrList[nlen] = args.Addr
-		master.portList = master.portList[0 : nlen+1]
-		master.portList[nlen] = args.Port
-		master.leader[index] = false
+		g.nodeList = g.nodeList[0 : nlen+1]
+		g.nodeList[nlen] = addrPort
+		g.addrList = g.addrList[0 : nlen+1]
+		g.addrList[nlen] = args.Addr
+		g.portList = g.portList[0 : nlen+1]
+		g.portList[nlen] = args.Port
+		g.leader[index] = false
 		nlen++
 
-		addr := args.Addr
-		if addr == "" {
-			addr = "127.0.0.1"
-		}
-		out, err := exec.Command("ping", addr, "-c 2", "-q").Output()
-		if err == nil {
-			master.latencies[index], _ =
-				strconv.ParseFloat(strings.Split(string(out), "/")[4], 64)
-			log.Printf("node %v [%v] -> %vms away", index,
-				master.nodeList[index], master.latencies[index])
-		} else {
-			log.Fatal("cannot determine ping latency to " + addr)
-		}
+		g.latencies[index] = args.Rtt
+		log.Printf("node %v of group %v [%v] -> %vms away", index, g.id,
+			g.nodeList[index], g.latencies[index])
 	}
 
 	if nlen == master.N {
 		reply.Ready = true
 		reply.ReplicaId = index
-		reply.NodeList = master.nodeList
+		reply.NodeList = g.nodeList
 		reply.IsLeader = false
 
 		minLatency := math.MaxFloat64
 		leader := 0
 
-		for i := 0; i < len(master.leader); i++ {
-			if master.latencies[i] < minLatency {
-				minLatency = master.latencies[i]
+		for i := 0; i < len(g.leader); i++ {
+			if g.latencies[i] < minLatency {
+				minLatency = g.latencies[i]
 				leader = i
 			}
 		}
 
 		if leader == index {
-			log.Printf("Replica %d is the new leader", index)
-			master.leader[index] = true
+			log.Printf("Replica %d of group %d is the new leader", index, g.id)
+			g.leader[index] = true
 			reply.IsLeader = true
 		}
 
@@ -247,11 +519,20 @@ func (master *Master) Register(args *defs.RegisterArgs, reply *defs.RegisterRepl
 	return nil
 }
 
+// Ping lets the replicas measure their round-trip time to the master
+func (master *Master) Ping(args *smr.PingArgs, reply *smr.PingReply) error {
+	return nil
+}
+
 func (master *Master) GetLeader(args *defs.GetLeaderArgs, reply *defs.GetLeaderReply) error {
 	master.lock.Lock()
 	defer master.lock.Unlock()
 
-	for i, l := range master.leader {
+	if args.Group < 0 || args.Group >= len(master.groups) {
+		return shard.NO_SUCH_GROUP
+	}
+
+	for i, l := range master.groups[args.Group].leader {
 		if l {
 			*reply = defs.GetLeaderReply{
 				LeaderId: i,
@@ -265,11 +546,17 @@ func (master *Master) GetLeader(args *defs.GetLeaderArgs, reply *defs.GetLeaderR
 func (master *Master) GetReplicaList(args *defs.GetReplicaListArgs, reply *defs.GetReplicaListReply) error {
 	master.lock.Lock()
 
-	for !master.finishInit {
-		master.initCond.Wait()
+	if args.Group < 0 || args.Group >= len(master.groups) {
+		master.lock.Unlock()
+		return shard.NO_SUCH_GROUP
+	}
+	g := master.groups[args.Group]
+
+	for !g.finishInit {
+		g.initCond.Wait()
 	}
 
-	if len(master.nodeList) == master.N {
+	if len(g.nodeList) == master.N {
 		reply.Ready = true
 	} else {
 		reply.Ready = false
@@ -277,12 +564,384 @@ func (master *Master) GetReplicaList(args *defs.GetReplicaListArgs, reply *defs.
 
 	reply.ReplicaList = make([]string, 0)
 	reply.AliveList = make([]bool, 0)
-	for i, node := range master.nodeList {
+	for i, node := range g.nodeList {
 		reply.ReplicaList = append(reply.ReplicaList, node)
-		reply.AliveList = append(reply.AliveList, master.alive[i])
+		reply.AliveList = append(reply.AliveList, g.alive[i])
+	}
+
+	log.Printf("nodes list of group %d %v", g.id, reply.ReplicaList)
+	master.lock.Unlock()
+	return nil
+}
+
+func (master *Master) GetShardMap(args *defs.GetShardMapArgs, reply *defs.GetShardMapReply) error {
+	master.lock.Lock()
+	defer master.lock.Unlock()
+
+	reply.Map = *master.shards.Copy()
+	return nil
+}
+
+// session is the master as seen by the peer of a connection,
+// which reconfigures the system only if it is an administrator
+type session struct {
+	*Master
+	admin bool
+}
+
+// serveRPC serves the RPCs of the connection of req
+func (master *Master) serveRPC(w http.ResponseWriter, req *http.Request) {
+	srv := rpc.NewServer()
+	srv.RegisterName("Master", &session{
+		Master: master,
+		admin:  TLS.Authorized(req, mtls.MASTER, mtls.ADMIN),
+	})
+	srv.ServeHTTP(w, req)
+}
+
+func (s *session) Split(args *defs.SplitArgs, reply *defs.SplitReply) error {
+	if !s.admin {
+		return mtls.NOT_AUTHORIZED
+	}
+	return s.Master.Split(args, reply)
+}
+
+func (s *session) Move(args *defs.MoveArgs, reply *defs.MoveReply) error {
+	if !s.admin {
+		return mtls.NOT_AUTHORIZED
+	}
+	return s.Master.Move(args, reply)
+}
+
+func (s *session) SetLink(args *defs.SetLinkArgs, reply *defs.SetLinkReply) error {
+	if !s.admin {
+		return mtls.NOT_AUTHORIZED
 	}
+	return s.Master.SetLink(args, reply)
+}
+
+func (master *Master) Split(args *defs.SplitArgs, reply *defs.SplitReply) error {
+	master.waitInit()
+	master.reconfLock.Lock()
+	defer master.reconfLock.Unlock()
+
+	master.lock.Lock()
+	m := master.shards.Copy()
+	master.lock.Unlock()
+
+	if err := m.Split(args.Key); err != nil {
+		return err
+	}
+	master.publish(m)
+	reply.Map = *m.Copy()
+	return nil
+}
+
+// replicas returns the clients of the replicas of g, which ones are
+// alive and the proposer of g (see proposer), as they are now
+func (master *Master) replicas(g *group) ([]*rpc.Client, []bool, int) {
+	master.lock.Lock()
+	defer master.lock.Unlock()
+
+	nodes := make([]*rpc.Client, len(g.nodes))
+	copy(nodes, g.nodes)
+	alive := make([]bool, len(g.alive))
+	copy(alive, g.alive)
+	return nodes, alive, g.proposer()
+}
+
+// Move gives the range that contains args.Key to the group args.Group.
+//
+// The range is first frozen: the old group stops accepting commands on it
+// and clients wait for the move to complete. The old group then orders a
+// freeze of the range after the commands it has accepted, and once it is
+// executed, the content of the range is copied from a replica of the old
+// group to the new group, which orders it in its log as it does for the
+// thaw of the range. Finally the new group starts serving the range.
+func (master *Master) Move(args *defs.MoveArgs, reply *defs.MoveReply) error {
+	if args.Group < 0 || args.Group >= len(master.groups) {
+		return shard.NO_SUCH_GROUP
+	}
+
+	master.waitInit()
+	master.reconfLock.Lock()
+	defer master.reconfLock.Unlock()
+
+	master.lock.Lock()
+	m := master.shards.Copy()
+	master.lock.Unlock()
+
+	from := m.Lookup(args.Key)
+	if from == args.Group {
+		return shard.SAME_GROUP
+	}
+	rg, err := m.Assign(args.Key, shard.MOVING)
+	if err != nil {
+		return err
+	}
+	frozen := m.Copy()
+	master.publish(frozen)
+
+	rollback := func(err error) error {
+		master.thaw(from, frozen, rg)
+		m.Assign(args.Key, from)
+		master.publish(m)
+		return err
+	}
+
+	content, err := master.freeze(from, frozen, rg)
+	if err != nil {
+		return rollback(err)
+	}
+
+	// the range might have been frozen when it left the new group
+	if err := master.thaw(args.Group, frozen, rg); err != nil {
+		return rollback(err)
+	}
+	for _, cmd := range state.InstallCommands(content.Keys, content.Values) {
+		if _, err := master.propose(args.Group, cmd); err != nil {
+			return rollback(err)
+		}
+	}
+	log.Printf("Moved %d keys of [%d, %d] from group %d to group %d",
+		len(content.Keys), int64(rg.Lo), int64(rg.Hi), from, args.Group)
+
+	m.Assign(args.Key, args.Group)
+	master.publish(m)
+	reply.Map = *m.Copy()
+	return nil
+}
+
+// freeze makes the group g freeze the range rg of m and returns its
+// content once every command ordered before the freeze is executed
+func (master *Master) freeze(g int, m *shard.Map, rg shard.Range) (*smr.ExportRangeReply, error) {
+	freezeArgs := &smr.FreezeRangeArgs{
+		Map:   *m,
+		Range: rg,
+	}
+	exportArgs := &smr.ExportRangeArgs{
+		Map:   *m,
+		Range: rg,
+	}
+
+	deadline := time.Now().Add(FREEZE_TIMEOUT)
+	for time.Now().Before(deadline) {
+		nodes, alive, p := master.replicas(master.groups[g])
+		if p < 0 {
+			break
+		}
+		if err := nodes[p].Call("Replica.FreezeRange", freezeArgs, new(smr.FreezeRangeReply)); err != nil {
+			log.Printf("Cannot freeze range at replica %d of group %d: %v", p, g, err)
+		}
+		for retry := time.Now().Add(FREEZE_RETRY); time.Now().Before(retry); time.Sleep(FREEZE_POLL) {
+			for i, node := range nodes {
+				if !alive[i] {
+					continue
+				}
+				r := &smr.ExportRangeReply{}
+				if err := node.Call("Replica.ExportRange", exportArgs, r); err == nil {
+					return r, nil
+				}
+			}
+		}
+	}
+	return nil, NOT_FROZEN
+}
+
+// thaw makes the group g execute the commands on rg again
+func (master *Master) thaw(g int, m *shard.Map, rg shard.Range) error {
+	_, err := master.propose(g, m.Thaw(rg))
+	return err
+}
+
+// proposer returns the leader of g if it is alive, any alive replica
+// otherwise, or -1 if no replica of g is alive. It must be called
+// with master.lock held.
+func (g *group) proposer() int {
+	p := -1
+	for i := range g.nodes {
+		if g.alive[i] && (p < 0 || g.leader[i]) {
+			p = i
+		}
+	}
+	return p
+}
+
+// recoverTxs periodically finishes the transactions
+// whose coordinator did not finish them in time
+func (master *Master) recoverTxs() {
+	master.waitInit()
+
+	for {
+		time.Sleep(state.TX_TIMEOUT)
+		for _, g := range master.groups {
+			nodes, _, p := master.replicas(g)
+			if p < 0 {
+				continue
+			}
+			r := &smr.AbandonedTxsReply{}
+			if err := nodes[p].Call("Replica.AbandonedTxs", &smr.AbandonedTxsArgs{}, r); err != nil {
+				continue
+			}
+			for _, t := range r.Txs {
+				log.Printf("Recovering transaction %d prepared by group %d", t.Id, g.id)
+				if err := master.recoverTx(t); err != nil {
+					log.Printf("Cannot recover transaction %d: %v", t.Id, err)
+				}
+			}
+		}
+	}
+}
 
-	log.Printf("nodes list %v", reply.ReplicaList)
+// recoverTx aborts t unless its coordinator already decided it,
+// then commits or aborts it at every group that prepared it
+func (master *Master) recoverTx(t *state.Tx) error {
+	master.lock.Lock()
+	m := master.shards.Copy()
 	master.lock.Unlock()
+
+	d, err := master.propose(m.Lookup(t.Coord), state.DecideCommand(t.Id, t.Coord, false))
+	if err != nil {
+		return err
+	}
+	commit := state.Decision(d)
+
+	parts := make(map[int][]state.Key)
+	for _, k := range t.All {
+		g := m.Lookup(k)
+		parts[g] = append(parts[g], k)
+	}
+	for g, ks := range parts {
+		f := &state.Tx{
+			Id:   t.Id,
+			Keys: ks,
+		}
+		if _, err := master.propose(g, state.FinishCommand(f, commit)); err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// propose makes the group g execute cmd and returns its result
+func (master *Master) propose(g int, cmd state.Command) (state.Value, error) {
+	if g == shard.MOVING {
+		return nil, NOT_DONE
+	}
+	nodes, _, p := master.replicas(master.groups[g])
+	if p < 0 {
+		return nil, NO_REPLICA
+	}
+	r := &smr.ProposeCommandReply{}
+	err := nodes[p].Call("Replica.ProposeCommand", &smr.ProposeCommandArgs{Command: cmd}, r)
+	if err != nil {
+		return nil, err
+	}
+	if r.OK != smr.TRUE {
+		return nil, NOT_DONE
+	}
+	return r.Value, nil
+}
+
+// SetLink changes the emulated link from args.Link.Peer
+// to the replica args.Replica of the group args.Group
+func (master *Master) SetLink(args *defs.SetLinkArgs, reply *defs.SetLinkReply) error {
+	if args.Group < 0 || args.Group >= len(master.groups) {
+		return shard.NO_SUCH_GROUP
+	}
+	master.waitInit()
+
+	nodes, _, _ := master.replicas(master.groups[args.Group])
+	if args.Replica < 0 || args.Replica >= len(nodes) {
+		return smr.NO_SUCH_LINK
+	}
+	return nodes[args.Replica].Call("Replica.SetLink", &args.Link, new(smr.LinkReply))
+}
+
+func admin() {
+	mcli, err := TLS.DialHTTP(fmt.Sprintf("%s:%d", *maddr, *portnum), mtls.MASTER)
+	if err != nil {
+		log.Fatal("Cannot connect to master: ", err)
+	}
+	defer mcli.Close()
+
+	var m shard.Map
+	if *split != "" {
+		k, err := strconv.ParseInt(*split, 10, 64)
+		if err != nil {
+			log.Fatal(err)
+		}
+		reply := &defs.SplitReply{}
+		if err := mcli.Call("Master.Split", &defs.SplitArgs{Key: state.Key(k)}, reply); err != nil {
+			log.Fatal(err)
+		}
+		m = reply.Map
+	}
+	if *move != "" {
+		kg := strings.Split(*move, ":")
+		if len(kg) != 2 {
+			log.Fatal("-move must be of the form <key>:<group>")
+		}
+		k, err := strconv.ParseInt(kg[0], 10, 64)
+		if err != nil {
+			log.Fatal(err)
+		}
+		g, err := strconv.Atoi(kg[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+		reply := &defs.MoveReply{}
+		args := &defs.MoveArgs{
+			Key:   state.Key(k),
+			Group: g,
+		}
+		if err := mcli.Call("Master.Move", args, reply); err != nil {
+			log.Fatal(err)
+		}
+		m = reply.Map
+	}
+	if *link != "" {
+		args, err := parseLink(*link)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := mcli.Call("Master.SetLink", args, new(defs.SetLinkReply)); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Link %s of group %d set", *link, *linkGroup)
+		return
+	}
+	log.Printf("Partition map %v", &m)
+}
+
+func parseLink(s string) (*defs.SetLinkArgs, error) {
+	fs := strings.Split(s, ":")
+	if len(fs) < 3 || len(fs) > 5 {
+		return nil, errors.New("-link must be of the form <from>:<to>:<delay>[:<jitter>[:<loss>]]")
+	}
+	args := &defs.SetLinkArgs{
+		Group: *linkGroup,
+	}
+	if fs[0] == "c" {
+		args.Link.Peer = smr.CLIENTS
+	} else {
+		from, err := strconv.Atoi(fs[0])
+		if err != nil {
+			return nil, err
+		}
+		args.Link.Peer = int32(from)
+	}
+	to, err := strconv.Atoi(fs[1])
+	if err != nil {
+		return nil, err
+	}
+	args.Replica = to
+
+	vs := []*float64{&args.Link.Delay, &args.Link.Jitter, &args.Link.Loss}
+	for i, f := range fs[2:] {
+		if *vs[i], err = strconv.ParseFloat(f, 64); err != nil {
+			return nil, err
+		}
+	}
+	return args, nil
+}
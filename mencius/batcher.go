@@ -0,0 +1,91 @@
+package mencius
+
+import "sync/atomic"
+
+type Batcher struct {
+	accepts chan *MAccept
+	acks    chan *MAcceptAck
+	skips   chan *MSkip
+}
+
+func NewBatcher(r *Replica, size int) *Batcher {
+	b := &Batcher{
+		accepts: make(chan *MAccept, size),
+		acks:    make(chan *MAcceptAck, size),
+		skips:   make(chan *MSkip, size),
+	}
+
+	go func() {
+		for !r.Shutdown {
+			select {
+			case acc := <-b.accepts:
+				aLen := len(b.accepts) + 1
+				bLen := len(b.acks)
+				batch := &MBatch{
+					Accepts: make([]MAccept, aLen),
+					Acks:    make([]MAcceptAck, bLen),
+				}
+
+				batch.Accepts[0] = *acc
+				for i := 1; i < aLen; i++ {
+					batch.Accepts[i] = *<-b.accepts
+				}
+				for i := 0; i < bLen; i++ {
+					batch.Acks[i] = *<-b.acks
+				}
+
+				b.send(r, batch)
+
+			case ack := <-b.acks:
+				aLen := len(b.accepts)
+				bLen := len(b.acks) + 1
+				batch := &MBatch{
+					Accepts: make([]MAccept, aLen),
+					Acks:    make([]MAcceptAck, bLen),
+				}
+
+				for i := 0; i < aLen; i++ {
+					batch.Accepts[i] = *<-b.accepts
+				}
+				batch.Acks[0] = *ack
+				for i := 1; i < bLen; i++ {
+					batch.Acks[i] = *<-b.acks
+				}
+
+				b.send(r, batch)
+			}
+		}
+	}()
+
+	return b
+}
+
+// send adds to batch the pending skips, merging the consecutive
+// ones, and the frontier of r before sending it
+func (b *Batcher) send(r *Replica, batch *MBatch) {
+	batch.Replica = r.Id
+	batch.Executed = atomic.LoadInt32(&r.executed)
+	batch.Skips = make([]MSkip, 0, len(b.skips))
+	for sLen := len(b.skips); sLen > 0; sLen-- {
+		skip := <-b.skips
+		if n := len(batch.Skips); n > 0 && batch.Skips[n-1].To == skip.From {
+			batch.Skips[n-1].To = skip.To
+		} else {
+			batch.Skips = append(batch.Skips, *skip)
+		}
+	}
+	r.sender.SendToAll(batch, r.cs.batchRPC)
+}
+
+func (b *Batcher) SendAccept(acc *MAccept) {
+	b.accepts <- acc
+}
+
+func (b *Batcher) SendAcceptAck(ack *MAcceptAck) {
+	b.acks <- ack
+}
+
+// SendSkip sends skip with the next accept or acknowledgment
+func (b *Batcher) SendSkip(skip *MSkip) {
+	b.skips <- skip
+}
@@ -0,0 +1,65 @@
+package mencius
+
+import (
+	"fmt"
+
+	"github.com/vonaka/shreplic/state"
+)
+
+type CommandId struct {
+	ClientId int32
+	SeqNum   int32
+}
+
+func (cmdId CommandId) String() string {
+	return fmt.Sprintf("%v,%v", cmdId.ClientId, cmdId.SeqNum)
+}
+
+// MAccept proposes Cmd for Slot. The owner of a slot
+// proposes with ballot 0, other replicas only after revocation.
+type MAccept struct {
+	Replica int32
+	Ballot  int32
+	Slot    int32
+	CmdId   CommandId
+	Cmd     state.Command
+}
+
+type MAcceptAck struct {
+	Replica int32
+	Ballot  int32
+	Slot    int32
+}
+
+// MSkip tells that the slots of Replica in [From, To) are no-ops
+type MSkip struct {
+	Replica int32
+	From    int32
+	To      int32
+}
+
+// MBatch groups the messages of Replica. Skips are piggybacked
+// on the next batch and Executed is the frontier of Replica:
+// the slots executed by every replica are forgotten.
+type MBatch struct {
+	Replica  int32
+	Executed int32
+	Accepts  []MAccept
+	Acks     []MAcceptAck
+	Skips    []MSkip
+}
+
+// MPrepare revokes the slots of Owner in [From, To)
+type MPrepare struct {
+	Replica int32
+	Ballot  int32
+	Owner   int32
+	From    int32
+	To      int32
+}
+
+type MPromise struct {
+	Replica  int32
+	Ballot   int32
+	Accepted []MAccept
+}
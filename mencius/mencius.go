@@ -0,0 +1,555 @@
+package mencius
+
+import (
+	"flag"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/vonaka/shreplic/server/smr"
+	"github.com/vonaka/shreplic/state"
+	"github.com/vonaka/shreplic/tools/dlog"
+	"github.com/vonaka/shreplic/tools/fastrpc"
+)
+
+// REVOKE_AHEAD is the number of slots of a suspected replica
+// revoked past the highest slot known to be used
+const REVOKE_AHEAD = 1000
+
+// Replica of Mencius.
+//
+// Slot s is owned by replica s mod N, which is the only one to propose
+// in it with ballot 0. Whenever a replica learns that another one has
+// proposed in slot s, it skips its own unused slots below s. Slots of a
+// replica that makes no progress are revoked by Paxos with a higher ballot.
+// The skips are sent with the next batch of messages, and the slots
+// executed by every replica are forgotten.
+type Replica struct {
+	*smr.Replica
+
+	M smr.Majority
+
+	slots     map[int32]*slotDesc
+	pending   map[int32]*smr.GPropose
+	nextOwn   int32
+	frontier  int32
+	maxSeen   int32
+	maxBallot int32
+	revoking  *revocation
+	frontiers []int32
+	collected int32
+	executed  int32 // frontier, read atomically by the batcher
+
+	revokeTimeout time.Duration
+	lastProgress  time.Time
+	tickChan      chan struct{}
+
+	sender  smr.Sender
+	batcher *Batcher
+	cs      CommunicationSupply
+}
+
+type slotDesc struct {
+	ballot    int32
+	acc       *MAccept
+	acks      *smr.MsgSet
+	ackBallot int32
+	committed bool
+	cballot   int32
+}
+
+type revocation struct {
+	ballot   int32
+	owner    int32
+	from     int32
+	to       int32
+	start    time.Time
+	done     bool
+	promises *smr.MsgSet
+}
+
+type CommunicationSupply struct {
+	maxLatency time.Duration
+
+	batchChan   chan fastrpc.Serializable
+	skipChan    chan fastrpc.Serializable
+	prepareChan chan fastrpc.Serializable
+	promiseChan chan fastrpc.Serializable
+
+	batchRPC   uint8
+	skipRPC    uint8
+	prepareRPC uint8
+	promiseRPC uint8
+}
+
+var noCmdId = CommandId{
+	ClientId: -1,
+	SeqNum:   -1,
+}
+
+func NewReplica(rid int, addrs []string, exec, dr bool,
+	f int, args string, ps map[string]struct{}) *Replica {
+
+	fs := flag.NewFlagSet("custom Mencius arguments", flag.ExitOnError)
+	revoke := fs.Int("revoke", 1000, "Milliseconds without progress after which the slots of a replica are revoked")
+	fs.Parse(strings.Fields(args))
+
+	r := &Replica{
+		Replica: smr.NewReplica(rid, f, addrs, false, exec, false, dr, ps),
+
+		slots:     make(map[int32]*slotDesc),
+		pending:   make(map[int32]*smr.GPropose),
+		nextOwn:   int32(rid),
+		frontier:  0,
+		maxSeen:   -1,
+		maxBallot: 0,
+		revoking:  nil,
+		collected: 0,
+		executed:  0,
+
+		revokeTimeout: time.Duration(*revoke) * time.Millisecond,
+		tickChan:      make(chan struct{}, 1),
+	}
+
+	r.frontiers = make([]int32, r.N)
+	r.M = smr.NewMajorityOf(r.N)
+	r.sender = smr.NewSender(r.Replica)
+	r.batcher = NewBatcher(r, 16)
+	initCs(&r.cs, r.RPC)
+
+	go r.run()
+
+	return r
+}
+
+// Messages registers in t the messages of the protocol
+func Messages(t *fastrpc.Table) {
+	initCs(new(CommunicationSupply), t)
+}
+
+func initCs(cs *CommunicationSupply, t *fastrpc.Table) {
+	cs.maxLatency = 0
+
+	cs.batchChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.skipChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.prepareChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.promiseChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+
+	cs.batchRPC = t.Register(new(MBatch), cs.batchChan)
+	cs.skipRPC = t.Register(new(MSkip), cs.skipChan)
+	cs.prepareRPC = t.Register(new(MPrepare), cs.prepareChan)
+	cs.promiseRPC = t.Register(new(MPromise), cs.promiseChan)
+}
+
+func (r *Replica) run() {
+	r.ConnectToPeers()
+	latencies := r.ComputeClosestPeers()
+	for _, l := range latencies {
+		d := time.Duration(l*1000*1000) * time.Nanosecond
+		if d > r.cs.maxLatency {
+			r.cs.maxLatency = d
+		}
+	}
+
+	go r.WaitForClientConnections()
+	r.lastProgress = time.Now()
+	go r.clock()
+
+	for !r.Shutdown {
+		select {
+		case propose := <-r.ProposeChan:
+			r.handlePropose(propose)
+
+		case m := <-r.cs.batchChan:
+			batch := m.(*MBatch)
+			for i := range batch.Skips {
+				r.handleSkip(&batch.Skips[i])
+			}
+			for i := range batch.Accepts {
+				r.handleAccept(&batch.Accepts[i])
+			}
+			for i := range batch.Acks {
+				r.handleAcceptAck(&batch.Acks[i])
+			}
+			r.collect(batch.Replica, batch.Executed)
+			// the slots keep pointers into the slices of
+			// batch, which are not reused once it is freed
+			batch.Free()
+
+		case m := <-r.cs.skipChan:
+			skip := m.(*MSkip)
+			r.handleSkip(skip)
+			skip.Free()
+
+		case m := <-r.cs.prepareChan:
+			prepare := m.(*MPrepare)
+			r.handlePrepare(prepare)
+			prepare.Free()
+
+		case m := <-r.cs.promiseChan:
+			promise := m.(*MPromise)
+			r.handlePromise(promise)
+
+		case <-r.tickChan:
+			r.checkProgress()
+		}
+	}
+}
+
+func (r *Replica) clock() {
+	for !r.Shutdown {
+		time.Sleep(r.revokeTimeout / 2)
+		r.tickChan <- struct{}{}
+	}
+}
+
+func (r *Replica) handlePropose(propose *smr.GPropose) {
+	// slots that have been revoked cannot be used anymore
+	for d, exists := r.slots[r.nextOwn]; exists && d.ballot > 0; d, exists = r.slots[r.nextOwn] {
+		r.nextOwn += int32(r.N)
+	}
+
+	slot := r.nextOwn
+	r.nextOwn += int32(r.N)
+	r.pending[slot] = propose
+
+	acc := &MAccept{
+		Replica: r.Id,
+		Ballot:  0,
+		Slot:    slot,
+		CmdId: CommandId{
+			ClientId: propose.ClientId,
+			SeqNum:   propose.CommandId,
+		},
+		Cmd: propose.Command,
+	}
+	r.batcher.SendAccept(acc)
+	r.handleAccept(acc)
+}
+
+func (r *Replica) handleAccept(msg *MAccept) {
+	if msg.Ballot > r.maxBallot {
+		r.maxBallot = msg.Ballot
+	}
+	if msg.Slot > r.maxSeen {
+		r.maxSeen = msg.Slot
+	}
+	if msg.Ballot == 0 && msg.Replica != r.Id {
+		if skip := r.skipUntil(msg.Slot); skip != nil {
+			// sent with the acknowledgment of msg
+			r.batcher.SendSkip(skip)
+		}
+	}
+
+	desc := r.slot(msg.Slot)
+	if desc == nil {
+		return
+	}
+	if desc.committed {
+		if msg.Ballot == desc.cballot && (desc.acc == nil || desc.acc.Ballot != desc.cballot) {
+			desc.acc = msg
+			r.execute()
+		}
+		return
+	}
+	if msg.Ballot < desc.ballot {
+		return
+	}
+	desc.ballot = msg.Ballot
+	desc.acc = msg
+
+	ack := &MAcceptAck{
+		Replica: r.Id,
+		Ballot:  msg.Ballot,
+		Slot:    msg.Slot,
+	}
+	r.batcher.SendAcceptAck(ack)
+	r.handleAcceptAck(ack)
+}
+
+func (r *Replica) handleAcceptAck(msg *MAcceptAck) {
+	desc := r.slot(msg.Slot)
+	if desc == nil || desc.committed || msg.Ballot < desc.ackBallot {
+		return
+	}
+	if msg.Ballot > desc.ackBallot {
+		desc.ackBallot = msg.Ballot
+		desc.acks = desc.acks.ReinitMsgSet(r.M, func(_, _ interface{}) bool {
+			return true
+		}, func(interface{}) {}, r.getAcksHandler(desc))
+	}
+	desc.acks.Add(msg.Replica, false, msg)
+}
+
+func (r *Replica) getAcksHandler(desc *slotDesc) smr.MsgSetHandler {
+	return func(_ interface{}, _ []interface{}) {
+		if desc.committed {
+			return
+		}
+		desc.committed = true
+		desc.cballot = desc.ackBallot
+		r.execute()
+	}
+}
+
+// skipUntil turns into no-ops the unused slots of the replica
+// below s and returns the skip to send to the other replicas
+func (r *Replica) skipUntil(s int32) *MSkip {
+	if r.nextOwn >= s {
+		return nil
+	}
+
+	skip := &MSkip{
+		Replica: r.Id,
+		From:    r.nextOwn,
+		To:      r.firstOf(r.Id, s),
+	}
+	r.nextOwn = skip.To
+	r.handleSkip(skip)
+	return skip
+}
+
+func (r *Replica) handleSkip(msg *MSkip) {
+	if msg.To-1 > r.maxSeen {
+		r.maxSeen = msg.To - 1
+	}
+
+	for s := msg.From; s < msg.To; s += int32(r.N) {
+		desc := r.slot(s)
+		if desc == nil || desc.committed {
+			continue
+		}
+		desc.committed = true
+		desc.cballot = 0
+		desc.acc = &MAccept{
+			Replica: msg.Replica,
+			Ballot:  0,
+			Slot:    s,
+			CmdId:   noCmdId,
+			Cmd:     state.NOOP()[0],
+		}
+	}
+	r.execute()
+}
+
+func (r *Replica) execute() {
+	again := make([]*smr.GPropose, 0)
+
+	for {
+		desc, exists := r.slots[r.frontier]
+		if !exists || !desc.committed ||
+			desc.acc == nil || desc.acc.Ballot != desc.cballot {
+			break
+		}
+		s := r.frontier
+		r.frontier++
+		atomic.StoreInt32(&r.executed, r.frontier)
+		r.lastProgress = time.Now()
+
+		acc := desc.acc
+		v := state.NIL()
+		if r.Exec {
+			dlog.Printf("Executing " + acc.Cmd.String())
+			v = acc.Cmd.Execute(r.State)
+		}
+
+		p, exists := r.pending[s]
+		if !exists {
+			continue
+		}
+		delete(r.pending, s)
+		if acc.CmdId.ClientId != p.ClientId || acc.CmdId.SeqNum != p.CommandId {
+			// the slot has been revoked
+			again = append(again, p)
+			continue
+		}
+		if !r.Dreply {
+			v = state.NIL()
+		}
+		rep := &smr.ProposeReplyTS{
+			OK:        smr.TRUE,
+			CommandId: p.CommandId,
+			Value:     v,
+			Timestamp: p.Timestamp,
+		}
+		r.ReplyProposeTS(rep, p.Reply, p.Mutex)
+	}
+
+	for _, p := range again {
+		r.handlePropose(p)
+	}
+}
+
+// checkProgress revokes the slots of the replica
+// that prevents the execution of the next commands
+func (r *Replica) checkProgress() {
+	if time.Since(r.lastProgress) < r.revokeTimeout || r.frontier > r.maxSeen {
+		return
+	}
+	if r.revoking != nil && !r.revoking.done &&
+		time.Since(r.revoking.start) < r.revokeTimeout {
+		return
+	}
+
+	owner := r.frontier % int32(r.N)
+	if owner == r.Id {
+		if _, exists := r.pending[r.frontier]; !exists {
+			// there might be no message to piggyback it
+			if skip := r.skipUntil(r.frontier + 1); skip != nil {
+				r.sender.SendToAll(skip, r.cs.skipRPC)
+			}
+		}
+		return
+	}
+
+	r.maxBallot = smr.NextBallotOf(r.Id, r.maxBallot, r.N)
+	rv := &revocation{
+		ballot: r.maxBallot,
+		owner:  owner,
+		from:   r.frontier,
+		to:     r.maxSeen + 1 + int32(REVOKE_AHEAD*r.N),
+		start:  time.Now(),
+		done:   false,
+	}
+	rv.promises = rv.promises.ReinitMsgSet(r.M, func(_, _ interface{}) bool {
+		return true
+	}, func(interface{}) {}, r.getPromisesHandler(rv))
+	r.revoking = rv
+	log.Printf("Revoking slots of %d from %d to %d", owner, rv.from, rv.to)
+
+	prepare := &MPrepare{
+		Replica: r.Id,
+		Ballot:  rv.ballot,
+		Owner:   rv.owner,
+		From:    rv.from,
+		To:      rv.to,
+	}
+	r.sender.SendToAll(prepare, r.cs.prepareRPC)
+	r.handlePrepare(prepare)
+}
+
+func (r *Replica) handlePrepare(msg *MPrepare) {
+	if msg.Ballot > r.maxBallot {
+		r.maxBallot = msg.Ballot
+	}
+
+	first := r.firstOf(msg.Owner, msg.From)
+	for s := first; s < msg.To; s += int32(r.N) {
+		if desc, exists := r.slots[s]; exists && desc.ballot > msg.Ballot {
+			return
+		}
+	}
+
+	promise := &MPromise{
+		Replica:  r.Id,
+		Ballot:   msg.Ballot,
+		Accepted: make([]MAccept, 0),
+	}
+	for s := first; s < msg.To; s += int32(r.N) {
+		desc := r.slot(s)
+		if desc == nil {
+			continue
+		}
+		desc.ballot = msg.Ballot
+		if desc.acc != nil {
+			promise.Accepted = append(promise.Accepted, *desc.acc)
+		}
+	}
+
+	if msg.Replica == r.Id {
+		r.handlePromise(promise)
+	} else {
+		r.sender.SendTo(msg.Replica, promise, r.cs.promiseRPC)
+	}
+}
+
+func (r *Replica) handlePromise(msg *MPromise) {
+	rv := r.revoking
+	if rv == nil || rv.done || msg.Ballot != rv.ballot {
+		return
+	}
+	rv.promises.Add(msg.Replica, false, msg)
+}
+
+func (r *Replica) getPromisesHandler(rv *revocation) smr.MsgSetHandler {
+	return func(_ interface{}, msgs []interface{}) {
+		if rv.done {
+			return
+		}
+		rv.done = true
+
+		// adopt for each slot the value accepted with the highest ballot
+		chosen := make(map[int32]*MAccept)
+		for _, m := range msgs {
+			p := m.(*MPromise)
+			for i := range p.Accepted {
+				acc := &p.Accepted[i]
+				if c, exists := chosen[acc.Slot]; !exists || c.Ballot < acc.Ballot {
+					chosen[acc.Slot] = acc
+				}
+			}
+		}
+
+		for s := r.firstOf(rv.owner, rv.from); s < rv.to; s += int32(r.N) {
+			acc := &MAccept{
+				Replica: r.Id,
+				Ballot:  rv.ballot,
+				Slot:    s,
+				CmdId:   noCmdId,
+				Cmd:     state.NOOP()[0],
+			}
+			if c, exists := chosen[s]; exists {
+				acc.CmdId = c.CmdId
+				acc.Cmd = c.Cmd
+			}
+			r.batcher.SendAccept(acc)
+			r.handleAccept(acc)
+		}
+		r.lastProgress = time.Now()
+	}
+}
+
+// collect forgets the slots executed by every replica,
+// given that the frontier of replica is executed
+func (r *Replica) collect(replica, executed int32) {
+	if executed > r.frontiers[replica] {
+		r.frontiers[replica] = executed
+	}
+	r.frontiers[r.Id] = r.frontier
+
+	low := r.frontier
+	for _, f := range r.frontiers {
+		if f < low {
+			low = f
+		}
+	}
+	for ; r.collected < low; r.collected++ {
+		delete(r.slots, r.collected)
+	}
+}
+
+// slot returns the descriptor of s, or nil if s has been forgotten
+func (r *Replica) slot(s int32) *slotDesc {
+	if s < r.collected {
+		return nil
+	}
+	desc, exists := r.slots[s]
+	if !exists {
+		desc = &slotDesc{
+			ballot:    0,
+			ackBallot: 0,
+		}
+		desc.acks = desc.acks.ReinitMsgSet(r.M, func(_, _ interface{}) bool {
+			return true
+		}, func(interface{}) {}, r.getAcksHandler(desc))
+		r.slots[s] = desc
+	}
+	return desc
+}
+
+// firstOf returns the first slot of replica owner that is not below s
+func (r *Replica) firstOf(owner, s int32) int32 {
+	n := int32(r.N)
+	return s + ((owner-s%n)+n)%n
+}
@@ -0,0 +1,107 @@
+package mencius
+
+import (
+	"sync"
+
+	"github.com/vonaka/shreplic/tools/fastrpc"
+)
+
+var mBatchPool = sync.Pool{
+	New: func() interface{} {
+		return new(MBatch)
+	},
+}
+
+// GetMBatch returns an empty MBatch taken from its pool
+func GetMBatch() *MBatch {
+	return mBatchPool.Get().(*MBatch)
+}
+
+// PutMBatch empties m and returns it to its pool
+func PutMBatch(m *MBatch) {
+	*m = MBatch{}
+	mBatchPool.Put(m)
+}
+
+func (m *MBatch) Free() {
+	PutMBatch(m)
+}
+
+func (m *MBatch) New() fastrpc.Serializable {
+	return GetMBatch()
+}
+
+var mSkipPool = sync.Pool{
+	New: func() interface{} {
+		return new(MSkip)
+	},
+}
+
+// GetMSkip returns an empty MSkip taken from its pool
+func GetMSkip() *MSkip {
+	return mSkipPool.Get().(*MSkip)
+}
+
+// PutMSkip empties m and returns it to its pool
+func PutMSkip(m *MSkip) {
+	*m = MSkip{}
+	mSkipPool.Put(m)
+}
+
+func (m *MSkip) Free() {
+	PutMSkip(m)
+}
+
+func (m *MSkip) New() fastrpc.Serializable {
+	return GetMSkip()
+}
+
+var mPreparePool = sync.Pool{
+	New: func() interface{} {
+		return new(MPrepare)
+	},
+}
+
+// GetMPrepare returns an empty MPrepare taken from its pool
+func GetMPrepare() *MPrepare {
+	return mPreparePool.Get().(*MPrepare)
+}
+
+// PutMPrepare empties m and returns it to its pool
+func PutMPrepare(m *MPrepare) {
+	*m = MPrepare{}
+	mPreparePool.Put(m)
+}
+
+func (m *MPrepare) Free() {
+	PutMPrepare(m)
+}
+
+func (m *MPrepare) New() fastrpc.Serializable {
+	return GetMPrepare()
+}
+
+var mPromisePool = sync.Pool{
+	New: func() interface{} {
+		return new(MPromise)
+	},
+}
+
+// GetMPromise returns an empty MPromise taken from its pool
+func GetMPromise() *MPromise {
+	return mPromisePool.Get().(*MPromise)
+}
+
+// PutMPromise empties m and returns it to its pool
+func PutMPromise(m *MPromise) {
+	*m = MPromise{}
+	mPromisePool.Put(m)
+}
+
+func (m *MPromise) Free() {
+	PutMPromise(m)
+}
+
+func (m *MPromise) New() fastrpc.Serializable {
+	return GetMPromise()
+}
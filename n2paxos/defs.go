@@ -75,30 +75,6 @@ type MPaxosSync struct {
 	Cmds    []state.Command
 }
 
-func (m *M1A) New() fastrpc.Serializable {
-	return new(M1A)
-}
-
-func (m *M1B) New() fastrpc.Serializable {
-	return new(M1B)
-}
-
-func (m *M2A) New() fastrpc.Serializable {
-	return new(M2A)
-}
-
-func (m *M2B) New() fastrpc.Serializable {
-	return new(M2B)
-}
-
-func (m *M2s) New() fastrpc.Serializable {
-	return new(M2s)
-}
-
-func (m *MPaxosSync) New() fastrpc.Serializable {
-	return new(MPaxosSync)
-}
-
 type CommunicationSupply struct {
 	maxLatency time.Duration
 
@@ -117,15 +93,20 @@ type CommunicationSupply struct {
 	syncRPC uint8
 }
 
+// Messages registers in t the messages of the protocol
+func Messages(t *fastrpc.Table) {
+	initCs(new(CommunicationSupply), t)
+}
+
 func initCs(cs *CommunicationSupply, t *fastrpc.Table) {
 	cs.maxLatency = 0
 
-	cs.oneAChan = make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE)
-	cs.oneBChan = make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE)
-	cs.twoAChan = make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE)
-	cs.twoBChan = make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE)
-	cs.twosChan = make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE)
-	cs.syncChan = make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE)
+	cs.oneAChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.oneBChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.twoAChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.twoBChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.twosChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.syncChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
 
 	cs.oneARPC = t.Register(new(M1A), cs.oneAChan)
 	cs.oneBRPC = t.Register(new(M1B), cs.oneBChan)
@@ -5,6 +5,7 @@ import (
 	"log"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/orcaman/concurrent-map"
@@ -33,13 +34,18 @@ type Replica struct {
 	batcher *Batcher
 	history []commandStaticDesc
 
-	AQ smr.Quorum
+	AQ smr.QuorumI
 	qs smr.QuorumSet
 	cs CommunicationSupply
 
 	optExec     bool
 	deliverChan chan int
 
+	lease      time.Duration
+	drift      time.Duration
+	leaseUntil int64
+	executed   int32
+
 	descPool     sync.Pool
 	poolLevel    int
 	routineCount int
@@ -52,6 +58,7 @@ type commandDesc struct {
 	phase   int
 	cmdSlot int
 	propose *smr.GPropose
+	sent    time.Time
 
 	twoBs        *smr.MsgSet
 	afterPayload *tools.OptCondF
@@ -68,7 +75,7 @@ type commandStaticDesc struct {
 }
 
 func NewReplica(rid int, addrs []string, exec, dr, optExec bool,
-	pl, f int, qfile string, ps map[string]struct{}) *Replica {
+	pl, f int, qfile, fquorums string, lease, drift int, ps map[string]struct{}) *Replica {
 	cmap.SHARD_COUNT = 32768
 
 	r := &Replica{
@@ -90,6 +97,11 @@ func NewReplica(rid int, addrs []string, exec, dr, optExec bool,
 		optExec:     optExec,
 		deliverChan: make(chan int, smr.CHAN_BUFFER_SIZE),
 
+		lease:      time.Duration(lease) * time.Millisecond,
+		drift:      time.Duration(drift) * time.Millisecond,
+		leaseUntil: 0,
+		executed:   -1,
+
 		poolLevel:    pl,
 		routineCount: 0,
 
@@ -117,6 +129,16 @@ func NewReplica(rid int, addrs []string, exec, dr, optExec bool,
 		log.Fatal(err)
 	}
 
+	// n²Paxos has a stable leader, only
+	// the phase-2 quorums are of interest
+	if fquorums != "" {
+		fq, err := smr.NewFlexibleQuorums(fquorums, qfile, r.Replica)
+		if err != nil {
+			log.Fatal(err)
+		}
+		r.AQ = fq.Phase2(r.ballot)
+	}
+
 	initCs(&r.cs, r.RPC)
 
 	tools.HookUser1(func() {
@@ -155,6 +177,9 @@ func (r *Replica) run() {
 			r.getCmdDesc(int, "deliver")
 
 		case propose := <-r.ProposeChan:
+			if r.isLeader && r.readLocally(propose) {
+				break
+			}
 			if r.isLeader {
 				desc := r.getCmdDesc(r.lastCmdSlot, propose)
 				if desc == nil {
@@ -190,6 +215,8 @@ func (r *Replica) run() {
 				tb := b
 				r.getCmdDesc(b.CmdSlot, &tb)
 			}
+			// the 2As and 2Bs are handled as copies
+			m2s.Free()
 		}
 	}
 }
@@ -201,6 +228,7 @@ func (r *Replica) handlePropose(msg *smr.GPropose, desc *commandDesc, slot int)
 	}
 
 	desc.propose = msg
+	desc.sent = time.Now()
 
 	twoA := &M2A{
 		Replica: r.Id,
@@ -254,6 +282,9 @@ func (r *Replica) handle2B(msg *M2B, desc *commandDesc) {
 func get2BsHandler(r *Replica, desc *commandDesc) smr.MsgSetHandler {
 	return func(leaderMsg interface{}, msgs []interface{}) {
 		desc.phase = COMMIT
+		if r.isLeader && r.lease > 0 {
+			r.extendLease(desc.sent.Add(r.lease - r.drift))
+		}
 		r.deliver(desc, desc.cmdSlot)
 	}
 }
@@ -284,6 +315,7 @@ func (r *Replica) deliver(desc *commandDesc, slot int) {
 		r.delivered.Set(strconv.Itoa(slot), struct{}{})
 		dlog.Printf("Executing " + desc.cmd.String())
 		v := desc.cmd.Execute(r.State)
+		atomic.StoreInt32(&r.executed, int32(slot))
 		go func(nextSlot int) {
 			r.deliverChan <- nextSlot
 		}(slot + 1)
@@ -311,6 +343,49 @@ func (r *Replica) deliver(desc *commandDesc, slot int) {
 	})
 }
 
+// extendLease is called each time a phase-2 quorum has accepted a
+// command of the leader, which grants the lease from the moment
+// the command was sent.
+//
+// The leader of n²Paxos never changes, thus a replica does not have
+// to refrain from joining another leader once it has granted a lease.
+func (r *Replica) extendLease(until time.Time) {
+	for {
+		old := atomic.LoadInt64(&r.leaseUntil)
+		if until.UnixNano() <= old ||
+			atomic.CompareAndSwapInt64(&r.leaseUntil, old, until.UnixNano()) {
+			return
+		}
+	}
+}
+
+func (r *Replica) leased() bool {
+	return time.Now().UnixNano() < atomic.LoadInt64(&r.leaseUntil)
+}
+
+// readLocally answers propose from the local state if it is a read,
+// the lease holds and every previous command has been executed
+func (r *Replica) readLocally(propose *smr.GPropose) bool {
+	if r.lease == 0 || r.optExec || !r.Exec ||
+		state.IsWrite(&propose.Command) || !r.leased() ||
+		atomic.LoadInt32(&r.executed) != int32(r.lastCmdSlot-1) {
+		return false
+	}
+
+	v := propose.Command.Read(r.State)
+	if !r.Dreply {
+		v = state.NIL()
+	}
+	rep := &smr.ProposeReplyTS{
+		OK:        smr.TRUE,
+		CommandId: propose.CommandId,
+		Value:     v,
+		Timestamp: propose.Timestamp,
+	}
+	r.ReplyProposeTS(rep, propose.Reply, propose.Mutex)
+	return true
+}
+
 func (r *Replica) getCmdDesc(slot int, msg interface{}) *commandDesc {
 	slotStr := strconv.Itoa(slot)
 	if r.delivered.Has(slotStr) {
@@ -357,6 +432,7 @@ func (r *Replica) newDesc() *commandDesc {
 	desc.phase = START
 	desc.seq = (r.routineCount >= MaxDescRoutines)
 	desc.propose = nil
+	desc.sent = time.Time{}
 	desc.cmdId.SeqNum = -42
 
 	desc.afterPayload = desc.afterPayload.ReinitCondF(func() bool {
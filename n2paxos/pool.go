@@ -0,0 +1,157 @@
+package n2paxos
+
+import (
+	"sync"
+
+	"github.com/vonaka/shreplic/tools/fastrpc"
+)
+
+var m1APool = sync.Pool{
+	New: func() interface{} {
+		return new(M1A)
+	},
+}
+
+// GetM1A returns an empty M1A taken from its pool
+func GetM1A() *M1A {
+	return m1APool.Get().(*M1A)
+}
+
+// PutM1A empties m and returns it to its pool
+func PutM1A(m *M1A) {
+	*m = M1A{}
+	m1APool.Put(m)
+}
+
+func (m *M1A) Free() {
+	PutM1A(m)
+}
+
+func (m *M1A) New() fastrpc.Serializable {
+	return GetM1A()
+}
+
+var m1BPool = sync.Pool{
+	New: func() interface{} {
+		return new(M1B)
+	},
+}
+
+// GetM1B returns an empty M1B taken from its pool
+func GetM1B() *M1B {
+	return m1BPool.Get().(*M1B)
+}
+
+// PutM1B empties m and returns it to its pool
+func PutM1B(m *M1B) {
+	*m = M1B{}
+	m1BPool.Put(m)
+}
+
+func (m *M1B) Free() {
+	PutM1B(m)
+}
+
+func (m *M1B) New() fastrpc.Serializable {
+	return GetM1B()
+}
+
+var m2APool = sync.Pool{
+	New: func() interface{} {
+		return new(M2A)
+	},
+}
+
+// GetM2A returns an empty M2A taken from its pool
+func GetM2A() *M2A {
+	return m2APool.Get().(*M2A)
+}
+
+// PutM2A empties m and returns it to its pool
+func PutM2A(m *M2A) {
+	*m = M2A{}
+	m2APool.Put(m)
+}
+
+func (m *M2A) Free() {
+	PutM2A(m)
+}
+
+func (m *M2A) New() fastrpc.Serializable {
+	return GetM2A()
+}
+
+var m2BPool = sync.Pool{
+	New: func() interface{} {
+		return new(M2B)
+	},
+}
+
+// GetM2B returns an empty M2B taken from its pool
+func GetM2B() *M2B {
+	return m2BPool.Get().(*M2B)
+}
+
+// PutM2B empties m and returns it to its pool
+func PutM2B(m *M2B) {
+	*m = M2B{}
+	m2BPool.Put(m)
+}
+
+func (m *M2B) Free() {
+	PutM2B(m)
+}
+
+func (m *M2B) New() fastrpc.Serializable {
+	return GetM2B()
+}
+
+var m2sPool = sync.Pool{
+	New: func() interface{} {
+		return new(M2s)
+	},
+}
+
+// GetM2s returns an empty M2s taken from its pool
+func GetM2s() *M2s {
+	return m2sPool.Get().(*M2s)
+}
+
+// PutM2s empties m and returns it to its pool
+func PutM2s(m *M2s) {
+	*m = M2s{}
+	m2sPool.Put(m)
+}
+
+func (m *M2s) Free() {
+	PutM2s(m)
+}
+
+func (m *M2s) New() fastrpc.Serializable {
+	return GetM2s()
+}
+
+var mPaxosSyncPool = sync.Pool{
+	New: func() interface{} {
+		return new(MPaxosSync)
+	},
+}
+
+// GetMPaxosSync returns an empty MPaxosSync taken from its pool
+func GetMPaxosSync() *MPaxosSync {
+	return mPaxosSyncPool.Get().(*MPaxosSync)
+}
+
+// PutMPaxosSync empties m and returns it to its pool
+func PutMPaxosSync(m *MPaxosSync) {
+	*m = MPaxosSync{}
+	mPaxosSyncPool.Put(m)
+}
+
+func (m *MPaxosSync) Free() {
+	PutMPaxosSync(m)
+}
+
+func (m *MPaxosSync) New() fastrpc.Serializable {
+	return GetMPaxosSync()
+}
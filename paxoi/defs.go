@@ -3,13 +3,13 @@ package paxoi
 import (
 	"bytes"
 	"crypto/sha256"
-	"encoding/binary"
 	"fmt"
 	"time"
 
 	"github.com/vonaka/shreplic/server/smr"
 	"github.com/vonaka/shreplic/state"
 	"github.com/vonaka/shreplic/tools/fastrpc"
+	"github.com/vonaka/shreplic/tools/trace"
 )
 
 // status
@@ -65,6 +65,10 @@ func (cmdId CommandId) String() string {
 	return fmt.Sprintf("%v,%v", cmdId.ClientId, cmdId.SeqNum)
 }
 
+func (cmdId CommandId) TraceId() trace.Id {
+	return trace.Command(cmdId.ClientId, cmdId.SeqNum)
+}
+
 type Dep []CommandId
 
 func (d Dep) Contains(cmdId CommandId) bool {
@@ -155,17 +159,16 @@ func isNoop(c state.Command) bool {
 }
 
 func keysOf(cmd state.Command) []state.Key {
-	switch cmd.Op {
-	case state.SCAN:
-		count := binary.LittleEndian.Uint64(cmd.V)
-		ks := make([]state.Key, count)
-		for i := range ks {
-			ks[i] = cmd.K + state.Key(i)
-		}
-		return ks
-	default:
-		return []state.Key{cmd.K}
+	if cmd.Op != state.SCAN {
+		return state.ConflictKeys(&cmd)
+	}
+	// the count keys from the first one
+	lb, ub := state.KeyRange(&cmd)
+	ks := make([]state.Key, 0, ub-lb)
+	for k := lb; k < ub; k++ {
+		ks = append(ks, k)
 	}
+	return ks
 }
 
 type CommunicationSupply struct {
@@ -206,25 +209,30 @@ type CommunicationSupply struct {
 	acceptRPC        uint8
 }
 
+// Messages registers in t the messages of the protocol
+func Messages(t *fastrpc.Table) {
+	initCs(new(CommunicationSupply), t)
+}
+
 func initCs(cs *CommunicationSupply, t *fastrpc.Table) {
 	cs.maxLatency = 0
 
-	cs.fastAckChan = make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE)
-	cs.slowAckChan = make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE)
-	cs.lightSlowAckChan = make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE)
-	cs.acksChan = make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE)
-	cs.optAcksChan = make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE)
-	cs.replyChan = make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE)
-	cs.readReplyChan = make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE)
-	cs.newLeaderChan = make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE)
-	//cs.newLeaderAckChan = make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE)
-	cs.newLeaderAckNChan = make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE)
-	//cs.shareStateChan = make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE)
-	cs.syncChan = make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE)
-	cs.pingChan = make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE)
-	cs.pingRepChan = make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE)
-	cs.collectChan = make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE)
-	cs.acceptChan = make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE)
+	cs.fastAckChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.slowAckChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.lightSlowAckChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.acksChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.optAcksChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.replyChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.readReplyChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.newLeaderChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	//cs.newLeaderAckChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.newLeaderAckNChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	//cs.shareStateChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.syncChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.pingChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.pingRepChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.collectChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.acceptChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
 
 	cs.fastAckRPC = t.Register(new(MFastAck), cs.fastAckChan)
 	cs.slowAckRPC = t.Register(new(MSlowAck), cs.slowAckChan)
@@ -276,7 +284,7 @@ func (ki *fullKeyInfo) add(cmd state.Command, cmdId CommandId) {
 		ki.clientLastCmd = append(ki.clientLastCmd, cmdId)
 	}
 
-	if cmd.Op == state.PUT {
+	if !state.ReadOnly(&cmd) {
 		writeIndex, exists := ki.lastWriteIndex[cmdId.ClientId]
 
 		if exists {
@@ -300,7 +308,7 @@ func (ki *fullKeyInfo) remove(cmd state.Command, cmdId CommandId) {
 		delete(ki.lastCmdIndex, cmdId.ClientId)
 	}
 
-	if cmd.Op == state.PUT {
+	if !state.ReadOnly(&cmd) {
 		writeIndex, exists := ki.lastWriteIndex[cmdId.ClientId]
 
 		if exists {
@@ -315,7 +323,7 @@ func (ki *fullKeyInfo) remove(cmd state.Command, cmdId CommandId) {
 }
 
 func (ki *fullKeyInfo) getConflictCmds(cmd state.Command) []CommandId {
-	if cmd.Op == state.GET {
+	if state.ReadOnly(&cmd) {
 		return ki.clientLastWrite
 	} else {
 		return ki.clientLastCmd
@@ -337,7 +345,7 @@ func newLightKeyInfo() *lightKeyInfo {
 func (ki *lightKeyInfo) add(cmd state.Command, cmdId CommandId) {
 	ki.lastCmd = []CommandId{cmdId}
 
-	if cmd.Op == state.PUT {
+	if !state.ReadOnly(&cmd) {
 		ki.lastWrite = []CommandId{cmdId}
 	}
 }
@@ -353,7 +361,7 @@ func (ki *lightKeyInfo) remove(_ state.Command, cmdId CommandId) {
 }
 
 func (ki *lightKeyInfo) getConflictCmds(cmd state.Command) []CommandId {
-	if cmd.Op == state.GET {
+	if state.ReadOnly(&cmd) {
 		return ki.lastWrite
 	} else {
 		return ki.lastCmd
@@ -386,7 +394,7 @@ func (s *checksum) correct(cmdId CommandId, newHash SHash) {
 func (s *checksum) hash(cmd state.Command, cmdId CommandId) [32]byte {
 	var h [32]byte
 
-	if cmd.Op == state.PUT {
+	if !state.ReadOnly(&cmd) {
 		h = s.cmd
 	} else {
 		h = s.write
@@ -414,9 +422,54 @@ func (s *checksum) hash(cmd state.Command, cmdId CommandId) [32]byte {
 func (s *checksum) update(cmd state.Command, cmdId CommandId) SHash {
 	h := s.hash(cmd, cmdId)
 	s.cmd = h
-	if s.writeUpdate = (cmd.Op == state.PUT); s.writeUpdate {
+	if s.writeUpdate = !state.ReadOnly(&cmd); s.writeUpdate {
 		s.write = h
 	}
 	s.lastUpdate = cmdId
 	return SHash{h}
 }
+
+func (m *MFastAck) TraceIds(f func(trace.Id)) {
+	f(m.CmdId.TraceId())
+}
+
+func (m *MSlowAck) TraceIds(f func(trace.Id)) {
+	f(m.CmdId.TraceId())
+}
+
+func (m *MLightSlowAck) TraceIds(f func(trace.Id)) {
+	f(m.CmdId.TraceId())
+}
+
+func (m *MAcks) TraceIds(f func(trace.Id)) {
+	for _, a := range m.FastAcks {
+		f(a.CmdId.TraceId())
+	}
+	for _, a := range m.LightSlowAcks {
+		f(a.CmdId.TraceId())
+	}
+}
+
+func (m *MOptAcks) TraceIds(f func(trace.Id)) {
+	for _, a := range m.Acks {
+		f(a.CmdId.TraceId())
+	}
+}
+
+func (m *MReply) TraceIds(f func(trace.Id)) {
+	f(m.CmdId.TraceId())
+}
+
+func (m *MAccept) TraceIds(f func(trace.Id)) {
+	f(m.CmdId.TraceId())
+}
+
+func (m *MReadReply) TraceIds(f func(trace.Id)) {
+	f(m.CmdId.TraceId())
+}
+
+func (m *MNewLeaderAckN) TraceIds(f func(trace.Id)) {
+	for _, cmdId := range m.CmdIds {
+		f(cmdId.TraceId())
+	}
+}
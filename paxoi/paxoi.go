@@ -11,6 +11,7 @@ import (
 	"github.com/vonaka/shreplic/state"
 	"github.com/vonaka/shreplic/tools"
 	"github.com/vonaka/shreplic/tools/dlog"
+	"github.com/vonaka/shreplic/tools/metrics"
 )
 
 type Replica struct {
@@ -59,6 +60,10 @@ type Replica struct {
 	recStart       time.Time
 	newLeaderAckNs *smr.MsgSet
 
+	fastPaths  *metrics.Counter
+	slowPaths  *metrics.Counter
+	recoveries *metrics.Counter
+
 	// TODO: get rid of this
 	proposes map[CommandId]*smr.GPropose
 }
@@ -176,6 +181,10 @@ func NewReplica(rid int, addrs []string, exec, fastRead, dr, optExec, AQreconf b
 	//	r.dl = NewDelayLog(r)
 	//}
 
+	r.fastPaths = r.Metrics().Counter("shr_paxoi_fast_paths_total", "Commands delivered on the fast path")
+	r.slowPaths = r.Metrics().Counter("shr_paxoi_slow_paths_total", "Commands delivered on the slow path")
+	r.recoveries = r.Metrics().Counter("shr_paxoi_recoveries_total", "Recoveries started by a new leader")
+
 	initCs(&r.cs, r.RPC)
 
 	log.Println("the leader is:", r.leader(), "ballot is:", r.ballot)
@@ -341,6 +350,8 @@ func (r *Replica) run() {
 				ls := s
 				r.getCmdDesc(s.CmdId, &ls, nil)
 			}
+			// the acks are handled as copies
+			acks.Free()
 
 		case m := <-r.cs.optAcksChan:
 			optAcks := m.(*MOptAcks)
@@ -357,14 +368,17 @@ func (r *Replica) run() {
 				}
 				r.getCmdDesc(fastAck.CmdId, fastAck, nil)
 			}
+			optAcks.Free()
 
 		case m := <-r.cs.newLeaderChan:
 			newLeader := m.(*MNewLeader)
 			r.handleNewLeader(newLeader)
+			newLeader.Free()
 
 		case m := <-r.cs.syncChan:
 			sync := m.(*MSync)
 			r.handleSync(sync)
+			sync.Free()
 
 		// case m := <-r.cs.pingChan:
 		// 	ping := m.(*MPing)
@@ -631,6 +645,11 @@ func getFastAndSlowAcksHandler(r *Replica, desc *commandDesc) smr.MsgSetHandler
 		leaderFastAck := leaderMsg.(*MFastAck)
 
 		desc.phase = COMMIT
+		path := "fast"
+		if desc.slowPath {
+			path = "slow"
+		}
+		r.Trace.Event(leaderFastAck.CmdId.TraceId(), "commit", "shr.path", path)
 
 		for _, depCmdId := range desc.dep {
 			depDesc := r.getCmdDesc(depCmdId, nil, nil)
@@ -712,6 +731,7 @@ func (r *Replica) deliver(desc *commandDesc, cmdId CommandId) {
 
 	dlog.Printf("Executing " + desc.cmd.String())
 	v := desc.cmd.Execute(r.State)
+	r.Trace.Event(cmdId.TraceId(), "execute")
 
 	desc.successorsL.Lock()
 	if desc.successors != nil {
@@ -756,6 +776,7 @@ func (r *Replica) deliverReadDesc(rDesc *readDesc, cmdId CommandId) {
 	r.delivered.Set(cmdId.String(), struct{}{})
 	dlog.Printf("Executing " + rDesc.propose.Command.String())
 	v := rDesc.propose.Command.Execute(r.State)
+	r.Trace.Event(cmdId.TraceId(), "execute")
 
 	if !r.Dreply {
 		return
@@ -939,6 +960,11 @@ func (r *Replica) handleMsg(m interface{}, desc *commandDesc, cmdId CommandId) b
 		r.history[msg].cmd = desc.cmd
 		r.history[msg].dep = desc.dep
 		r.history[msg].slowPath = desc.slowPath
+		if desc.slowPath {
+			r.slowPaths.Inc()
+		} else {
+			r.fastPaths.Inc()
+		}
 		r.history[msg].defered = desc.defered
 		desc.active = false
 		desc.slowPathH.Free()
@@ -182,46 +182,6 @@ func (m *MSlowAck) New() fastrpc.Serializable {
 	return (*MSlowAck)(newFastAck())
 }
 
-func (m *MLightSlowAck) New() fastrpc.Serializable {
-	return new(MLightSlowAck)
-}
-
-func (m *MAcks) New() fastrpc.Serializable {
-	return new(MAcks)
-}
-
-func (m *MOptAcks) New() fastrpc.Serializable {
-	return new(MOptAcks)
-}
-
-func (m *MReply) New() fastrpc.Serializable {
-	return new(MReply)
-}
-
-func (m *MReadReply) New() fastrpc.Serializable {
-	return new(MReadReply)
-}
-
-func (m *MNewLeader) New() fastrpc.Serializable {
-	return new(MNewLeader)
-}
-
-func (m *MNewLeaderAck) New() fastrpc.Serializable {
-	return new(MNewLeaderAck)
-}
-
-func (m *MNewLeaderAckN) New() fastrpc.Serializable {
-	return new(MNewLeaderAckN)
-}
-
-func (m *MShareState) New() fastrpc.Serializable {
-	return new(MShareState)
-}
-
-func (m *MSync) New() fastrpc.Serializable {
-	return new(MSync)
-}
-
 func (m *MSync) Marshal(w io.Writer) {
 	e := gob.NewEncoder(w)
 
@@ -237,26 +197,6 @@ func (m *MSync) Unmarshal(r io.Reader) error {
 	return e.Decode(m)
 }
 
-func (m *MLightSync) New() fastrpc.Serializable {
-	return new(MLightSync)
-}
-
-func (m *MCollect) New() fastrpc.Serializable {
-	return new(MCollect)
-}
-
-func (m *MAccept) New() fastrpc.Serializable {
-	return new(MAccept)
-}
-
-func (m *MPing) New() fastrpc.Serializable {
-	return new(MPing)
-}
-
-func (m *MPingRep) New() fastrpc.Serializable {
-	return new(MPingRep)
-}
-
 ///////////////////////////////////////////////////////////////////////////////
 //                                                                           //
 //  Generated with gobin-codegen [https://code.google.com/p/gobin-codegen/]  //
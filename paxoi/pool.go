@@ -0,0 +1,382 @@
+package paxoi
+
+import (
+	"sync"
+
+	"github.com/vonaka/shreplic/tools/fastrpc"
+)
+
+var mLightSlowAckPool = sync.Pool{
+	New: func() interface{} {
+		return new(MLightSlowAck)
+	},
+}
+
+// GetMLightSlowAck returns an empty MLightSlowAck taken from its pool
+func GetMLightSlowAck() *MLightSlowAck {
+	return mLightSlowAckPool.Get().(*MLightSlowAck)
+}
+
+// PutMLightSlowAck empties m and returns it to its pool
+func PutMLightSlowAck(m *MLightSlowAck) {
+	*m = MLightSlowAck{}
+	mLightSlowAckPool.Put(m)
+}
+
+func (m *MLightSlowAck) Free() {
+	PutMLightSlowAck(m)
+}
+
+func (m *MLightSlowAck) New() fastrpc.Serializable {
+	return GetMLightSlowAck()
+}
+
+var mAcksPool = sync.Pool{
+	New: func() interface{} {
+		return new(MAcks)
+	},
+}
+
+// GetMAcks returns an empty MAcks taken from its pool
+func GetMAcks() *MAcks {
+	return mAcksPool.Get().(*MAcks)
+}
+
+// PutMAcks empties m and returns it to its pool
+func PutMAcks(m *MAcks) {
+	*m = MAcks{}
+	mAcksPool.Put(m)
+}
+
+func (m *MAcks) Free() {
+	PutMAcks(m)
+}
+
+func (m *MAcks) New() fastrpc.Serializable {
+	return GetMAcks()
+}
+
+var mOptAcksPool = sync.Pool{
+	New: func() interface{} {
+		return new(MOptAcks)
+	},
+}
+
+// GetMOptAcks returns an empty MOptAcks taken from its pool
+func GetMOptAcks() *MOptAcks {
+	return mOptAcksPool.Get().(*MOptAcks)
+}
+
+// PutMOptAcks empties m and returns it to its pool
+func PutMOptAcks(m *MOptAcks) {
+	*m = MOptAcks{}
+	mOptAcksPool.Put(m)
+}
+
+func (m *MOptAcks) Free() {
+	PutMOptAcks(m)
+}
+
+func (m *MOptAcks) New() fastrpc.Serializable {
+	return GetMOptAcks()
+}
+
+var mReplyPool = sync.Pool{
+	New: func() interface{} {
+		return new(MReply)
+	},
+}
+
+// GetMReply returns an empty MReply taken from its pool
+func GetMReply() *MReply {
+	return mReplyPool.Get().(*MReply)
+}
+
+// PutMReply empties m and returns it to its pool
+func PutMReply(m *MReply) {
+	*m = MReply{}
+	mReplyPool.Put(m)
+}
+
+func (m *MReply) Free() {
+	PutMReply(m)
+}
+
+func (m *MReply) New() fastrpc.Serializable {
+	return GetMReply()
+}
+
+var mReadReplyPool = sync.Pool{
+	New: func() interface{} {
+		return new(MReadReply)
+	},
+}
+
+// GetMReadReply returns an empty MReadReply taken from its pool
+func GetMReadReply() *MReadReply {
+	return mReadReplyPool.Get().(*MReadReply)
+}
+
+// PutMReadReply empties m and returns it to its pool
+func PutMReadReply(m *MReadReply) {
+	*m = MReadReply{}
+	mReadReplyPool.Put(m)
+}
+
+func (m *MReadReply) Free() {
+	PutMReadReply(m)
+}
+
+func (m *MReadReply) New() fastrpc.Serializable {
+	return GetMReadReply()
+}
+
+var mNewLeaderPool = sync.Pool{
+	New: func() interface{} {
+		return new(MNewLeader)
+	},
+}
+
+// GetMNewLeader returns an empty MNewLeader taken from its pool
+func GetMNewLeader() *MNewLeader {
+	return mNewLeaderPool.Get().(*MNewLeader)
+}
+
+// PutMNewLeader empties m and returns it to its pool
+func PutMNewLeader(m *MNewLeader) {
+	*m = MNewLeader{}
+	mNewLeaderPool.Put(m)
+}
+
+func (m *MNewLeader) Free() {
+	PutMNewLeader(m)
+}
+
+func (m *MNewLeader) New() fastrpc.Serializable {
+	return GetMNewLeader()
+}
+
+var mNewLeaderAckPool = sync.Pool{
+	New: func() interface{} {
+		return new(MNewLeaderAck)
+	},
+}
+
+// GetMNewLeaderAck returns an empty MNewLeaderAck taken from its pool
+func GetMNewLeaderAck() *MNewLeaderAck {
+	return mNewLeaderAckPool.Get().(*MNewLeaderAck)
+}
+
+// PutMNewLeaderAck empties m and returns it to its pool
+func PutMNewLeaderAck(m *MNewLeaderAck) {
+	*m = MNewLeaderAck{}
+	mNewLeaderAckPool.Put(m)
+}
+
+func (m *MNewLeaderAck) Free() {
+	PutMNewLeaderAck(m)
+}
+
+func (m *MNewLeaderAck) New() fastrpc.Serializable {
+	return GetMNewLeaderAck()
+}
+
+var mNewLeaderAckNPool = sync.Pool{
+	New: func() interface{} {
+		return new(MNewLeaderAckN)
+	},
+}
+
+// GetMNewLeaderAckN returns an empty MNewLeaderAckN taken from its pool
+func GetMNewLeaderAckN() *MNewLeaderAckN {
+	return mNewLeaderAckNPool.Get().(*MNewLeaderAckN)
+}
+
+// PutMNewLeaderAckN empties m and returns it to its pool
+func PutMNewLeaderAckN(m *MNewLeaderAckN) {
+	*m = MNewLeaderAckN{}
+	mNewLeaderAckNPool.Put(m)
+}
+
+func (m *MNewLeaderAckN) Free() {
+	PutMNewLeaderAckN(m)
+}
+
+func (m *MNewLeaderAckN) New() fastrpc.Serializable {
+	return GetMNewLeaderAckN()
+}
+
+var mShareStatePool = sync.Pool{
+	New: func() interface{} {
+		return new(MShareState)
+	},
+}
+
+// GetMShareState returns an empty MShareState taken from its pool
+func GetMShareState() *MShareState {
+	return mShareStatePool.Get().(*MShareState)
+}
+
+// PutMShareState empties m and returns it to its pool
+func PutMShareState(m *MShareState) {
+	*m = MShareState{}
+	mShareStatePool.Put(m)
+}
+
+func (m *MShareState) Free() {
+	PutMShareState(m)
+}
+
+func (m *MShareState) New() fastrpc.Serializable {
+	return GetMShareState()
+}
+
+var mSyncPool = sync.Pool{
+	New: func() interface{} {
+		return new(MSync)
+	},
+}
+
+// GetMSync returns an empty MSync taken from its pool
+func GetMSync() *MSync {
+	return mSyncPool.Get().(*MSync)
+}
+
+// PutMSync empties m and returns it to its pool
+func PutMSync(m *MSync) {
+	*m = MSync{}
+	mSyncPool.Put(m)
+}
+
+func (m *MSync) Free() {
+	PutMSync(m)
+}
+
+func (m *MSync) New() fastrpc.Serializable {
+	return GetMSync()
+}
+
+var mLightSyncPool = sync.Pool{
+	New: func() interface{} {
+		return new(MLightSync)
+	},
+}
+
+// GetMLightSync returns an empty MLightSync taken from its pool
+func GetMLightSync() *MLightSync {
+	return mLightSyncPool.Get().(*MLightSync)
+}
+
+// PutMLightSync empties m and returns it to its pool
+func PutMLightSync(m *MLightSync) {
+	*m = MLightSync{}
+	mLightSyncPool.Put(m)
+}
+
+func (m *MLightSync) Free() {
+	PutMLightSync(m)
+}
+
+func (m *MLightSync) New() fastrpc.Serializable {
+	return GetMLightSync()
+}
+
+var mCollectPool = sync.Pool{
+	New: func() interface{} {
+		return new(MCollect)
+	},
+}
+
+// GetMCollect returns an empty MCollect taken from its pool
+func GetMCollect() *MCollect {
+	return mCollectPool.Get().(*MCollect)
+}
+
+// PutMCollect empties m and returns it to its pool
+func PutMCollect(m *MCollect) {
+	*m = MCollect{}
+	mCollectPool.Put(m)
+}
+
+func (m *MCollect) Free() {
+	PutMCollect(m)
+}
+
+func (m *MCollect) New() fastrpc.Serializable {
+	return GetMCollect()
+}
+
+var mAcceptPool = sync.Pool{
+	New: func() interface{} {
+		return new(MAccept)
+	},
+}
+
+// GetMAccept returns an empty MAccept taken from its pool
+func GetMAccept() *MAccept {
+	return mAcceptPool.Get().(*MAccept)
+}
+
+// PutMAccept empties m and returns it to its pool
+func PutMAccept(m *MAccept) {
+	*m = MAccept{}
+	mAcceptPool.Put(m)
+}
+
+func (m *MAccept) Free() {
+	PutMAccept(m)
+}
+
+func (m *MAccept) New() fastrpc.Serializable {
+	return GetMAccept()
+}
+
+var mPingPool = sync.Pool{
+	New: func() interface{} {
+		return new(MPing)
+	},
+}
+
+// GetMPing returns an empty MPing taken from its pool
+func GetMPing() *MPing {
+	return mPingPool.Get().(*MPing)
+}
+
+// PutMPing empties m and returns it to its pool
+func PutMPing(m *MPing) {
+	*m = MPing{}
+	mPingPool.Put(m)
+}
+
+func (m *MPing) Free() {
+	PutMPing(m)
+}
+
+func (m *MPing) New() fastrpc.Serializable {
+	return GetMPing()
+}
+
+var mPingRepPool = sync.Pool{
+	New: func() interface{} {
+		return new(MPingRep)
+	},
+}
+
+// GetMPingRep returns an empty MPingRep taken from its pool
+func GetMPingRep() *MPingRep {
+	return mPingRepPool.Get().(*MPingRep)
+}
+
+// PutMPingRep empties m and returns it to its pool
+func PutMPingRep(m *MPingRep) {
+	*m = MPingRep{}
+	mPingRepPool.Put(m)
+}
+
+func (m *MPingRep) Free() {
+	PutMPingRep(m)
+}
+
+func (m *MPingRep) New() fastrpc.Serializable {
+	return GetMPingRep()
+}
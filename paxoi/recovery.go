@@ -16,6 +16,7 @@ func (r *Replica) handleNewLeader(msg *MNewLeader) {
 		return
 	}
 	log.Println("Recovering... with the ballot", msg.Ballot)
+	r.recoveries.Inc()
 	//r.recNum++
 
 	r.status = RECOVERING
@@ -5,12 +5,15 @@ import (
 	"io"
 	"log"
 	"math"
+	"sync/atomic"
 	"time"
 
 	"github.com/vonaka/shreplic/server/smr"
 	"github.com/vonaka/shreplic/state"
 	"github.com/vonaka/shreplic/tools/dlog"
 	"github.com/vonaka/shreplic/tools/fastrpc"
+	"github.com/vonaka/shreplic/tools/metrics"
+	"github.com/vonaka/shreplic/tools/trace"
 )
 
 const CHAN_BUFFER_SIZE = 200000
@@ -45,7 +48,30 @@ type Replica struct {
 	counter               int
 	flush                 bool
 	executedUpTo          int32
+	proposed              int32
+	executed              int32
 	batchWait             int
+	fq                    *smr.FlexibleQuorums
+	fastClockChan         chan bool
+	reproposals           []*smr.GPropose
+
+	lease        time.Duration
+	drift        time.Duration
+	leaseFrom    []time.Time
+	grantedTo    int32
+	grantedUntil time.Time
+
+	// the requests delayed by the lease granted to another
+	// leader, handled by the main loop once leaseTimer fires
+	leaseTimer        <-chan time.Time
+	delayedProposals  []*smr.GPropose
+	delayedPrepares   []*Prepare
+	delayedRecoveries []int32
+
+	recoveries  *metrics.Counter
+	leaseReads  *metrics.Counter
+	lags        *metrics.Histogram
+	proposeTime *metrics.Histogram
 
 	totalRecNum  int
 	totalSendNum int
@@ -76,14 +102,16 @@ type LeaderBookkeeping struct {
 	ballot          int32
 	cmds            []state.Command
 	lastTriedBallot int32
+	acceptSent      time.Time
+	proposed        time.Time
 }
 
-func NewReplica(id int, peerAddrList []string, Isleader bool, thrifty bool, exec bool, lread bool, dreply bool, durable bool, batchWait int, f int, ps map[string]struct{}) *Replica {
+func NewReplica(id int, peerAddrList []string, Isleader bool, thrifty bool, exec bool, lread bool, dreply bool, durable bool, batchWait int, f int, qfile, fquorums string, lease int, drift int, ps map[string]struct{}) *Replica {
 	makeChanWithSize := func(size int) chan fastrpc.Serializable {
 		return make(chan fastrpc.Serializable, size)
 	}
 	makeChan := func() chan fastrpc.Serializable {
-		return makeChanWithSize(smr.CHAN_BUFFER_SIZE)
+		return makeChanWithSize(smr.QUEUE_SIZE)
 	}
 	r := &Replica{
 		Replica:               smr.NewReplica(id, f, peerAddrList, thrifty, exec, lread, dreply, ps),
@@ -92,7 +120,7 @@ func NewReplica(id int, peerAddrList []string, Isleader bool, thrifty bool, exec
 		commitChan:            makeChan(),
 		commitShortChan:       makeChan(),
 		prepareReplyChan:      makeChan(),
-		acceptReplyChan:       makeChanWithSize(3 * smr.CHAN_BUFFER_SIZE),
+		acceptReplyChan:       makeChanWithSize(3 * smr.QUEUE_SIZE),
 		instancesToRecover:    make(chan int32, 3*smr.CHAN_BUFFER_SIZE),
 		prepareRPC:            0,
 		acceptRPC:             0,
@@ -110,13 +138,26 @@ func NewReplica(id int, peerAddrList []string, Isleader bool, thrifty bool, exec
 		counter:               0,
 		flush:                 true,
 		executedUpTo:          -1,
+		proposed:              -1,
+		executed:              -1,
 		batchWait:             batchWait,
+		lease:                 time.Duration(lease) * time.Millisecond,
+		drift:                 time.Duration(drift) * time.Millisecond,
+		leaseFrom:             make([]time.Time, len(peerAddrList)),
+		grantedTo:             -1,
+		grantedUntil:          time.Time{},
 		totalRecNum:           0,
 		totalSendNum:          0,
 	}
 
 	r.Durable = durable
 
+	fq, err := smr.NewFlexibleQuorums(fquorums, qfile, r.Replica)
+	if err != nil {
+		log.Fatal(err)
+	}
+	r.fq = fq
+
 	if Isleader {
 		r.BeTheLeader(nil, nil)
 	}
@@ -125,18 +166,38 @@ func NewReplica(id int, peerAddrList []string, Isleader bool, thrifty bool, exec
 		r.defaultBallot[i] = -1
 	}
 
-	r.prepareRPC = r.RPC.Register(new(Prepare), r.prepareChan)
-	r.acceptRPC = r.RPC.Register(new(Accept), r.acceptChan)
-	r.commitRPC = r.RPC.Register(new(Commit), r.commitChan)
-	r.commitShortRPC = r.RPC.Register(new(CommitShort), r.commitShortChan)
-	r.prepareReplyRPC = r.RPC.Register(new(PrepareReply), r.prepareReplyChan)
-	r.acceptReplyRPC = r.RPC.Register(new(AcceptReply), r.acceptReplyChan)
+	r.recoveries = r.Metrics().Counter("shr_paxos_recoveries_total", "Instances recovered")
+	r.leaseReads = r.Metrics().Counter("shr_paxos_lease_reads_total", "Reads served by the leader under its lease")
+	// proposed and executed are published by the run loop and the executor
+	r.Metrics().GaugeFunc("shr_execution_lag", "Instances not executed yet", func(set metrics.Setter) {
+		set(float64(atomic.LoadInt32(&r.proposed) - atomic.LoadInt32(&r.executed)))
+	})
+	r.lags = r.Metrics().Histogram("shr_execution_lag_entries",
+		"Instances not executed yet, each time some are executed", metrics.CountBuckets)
+	r.proposeTime = r.Metrics().Histogram("shr_paxos_proposal_seconds",
+		"Time to commit the instances proposed by the leader", metrics.DefBuckets)
+
+	r.register(r.RPC)
 
 	go r.run()
 
 	return r
 }
 
+// Messages registers in t the messages of the protocol
+func Messages(t *fastrpc.Table) {
+	new(Replica).register(t)
+}
+
+func (r *Replica) register(t *fastrpc.Table) {
+	r.prepareRPC = t.Register(new(Prepare), r.prepareChan)
+	r.acceptRPC = t.Register(new(Accept), r.acceptChan)
+	r.commitRPC = t.Register(new(Commit), r.commitChan)
+	r.commitShortRPC = t.Register(new(CommitShort), r.commitShortChan)
+	r.prepareReplyRPC = t.Register(new(PrepareReply), r.prepareReplyChan)
+	r.acceptReplyRPC = t.Register(new(AcceptReply), r.acceptReplyChan)
+}
+
 //append a log entry to stable storage
 func (r *Replica) recordInstanceMetadata(inst *Instance) {
 	if !r.Durable {
@@ -182,6 +243,108 @@ func (r *Replica) BeTheLeader(args *smr.BeTheLeaderArgs, reply *smr.BeTheLeaderR
 	return nil
 }
 
+// isQuorum tells whether the leader and oks acceptors of q form a quorum
+func (r *Replica) isQuorum(q smr.QuorumI, oks int) bool {
+	if q.Contains(r.Id) {
+		oks++
+	}
+	return oks >= q.Size()
+}
+
+// grant promises leader not to join the ballot
+// of another leader for the duration of the lease
+func (r *Replica) grant(leader int32) {
+	r.grantedTo = leader
+	r.grantedUntil = time.Now().Add(r.lease)
+}
+
+// leaseWait returns how long the lease
+// granted to a leader other than leader lasts
+func (r *Replica) leaseWait(leader int32) time.Duration {
+	if r.lease == 0 || r.grantedTo == leader {
+		return 0
+	}
+	return time.Until(r.grantedUntil)
+}
+
+// delay arms the timer after which the delayed requests are handled
+func (r *Replica) delay(d time.Duration) {
+	if r.leaseTimer == nil {
+		r.leaseTimer = time.After(d)
+	}
+}
+
+// handleDelayed handles the requests delayed by a lease, which
+// are delayed again if the lease has been granted anew since
+func (r *Replica) handleDelayed() {
+	r.leaseTimer = nil
+	prepares, iids, proposals := r.delayedPrepares, r.delayedRecoveries, r.delayedProposals
+	r.delayedPrepares, r.delayedRecoveries, r.delayedProposals = nil, nil, nil
+	for _, prepare := range prepares {
+		r.handlePrepare(prepare)
+	}
+	for _, iid := range iids {
+		r.handleRecovery(iid)
+	}
+	for _, propose := range proposals {
+		r.handlePropose(propose)
+	}
+}
+
+func (r *Replica) handleRecovery(iid int32) {
+	if d := r.leaseWait(r.Id); d > 0 {
+		r.delayedRecoveries = append(r.delayedRecoveries, iid)
+		r.delay(d)
+		return
+	}
+	r.recover(iid)
+}
+
+// leased tells whether a phase-2 quorum has granted
+// its lease to the replica, minus the clock drift
+func (r *Replica) leased() bool {
+	if r.lease == 0 {
+		return false
+	}
+	q := r.fq.Phase2(r.Id)
+	now := time.Now()
+	granted := 0
+	for id, from := range r.leaseFrom {
+		if q.Contains(int32(id)) && now.Before(from.Add(r.lease-r.drift)) {
+			granted++
+		}
+	}
+	return granted >= q.Size()
+}
+
+// readLocally answers the reads of proposals from the local
+// state and returns the remaining proposals and their commands
+func (r *Replica) readLocally(proposals []*smr.GPropose,
+	cmds []state.Command) ([]*smr.GPropose, []state.Command) {
+
+	ps, cs := proposals[:0], cmds[:0]
+	for i, p := range proposals {
+		if state.IsWrite(&cmds[i]) {
+			ps = append(ps, p)
+			cs = append(cs, cmds[i])
+			continue
+		}
+		val := cmds[i].Read(r.State)
+		r.leaseReads.Inc()
+		if !r.Dreply {
+			val = state.NIL()
+		}
+		preply := &smr.ProposeReplyTS{
+			OK:        TRUE,
+			CommandId: p.CommandId,
+			Value:     val,
+			Timestamp: p.Timestamp,
+		}
+		r.ReplyProposeTS(preply, p.Reply, p.Mutex)
+	}
+	return ps, cs
+}
+
 func (r *Replica) replyPrepare(replicaId int32, reply *PrepareReply) {
 	r.SendMsg(replicaId, r.prepareReplyRPC, reply)
 }
@@ -192,12 +355,10 @@ func (r *Replica) replyAccept(replicaId int32, reply *AcceptReply) {
 
 /* Clock goroutine */
 
-var fastClockChan chan bool
-
 func (r *Replica) fastClock() {
 	for !r.Shutdown {
 		time.Sleep(time.Duration(r.batchWait) * time.Millisecond) // ms
-		fastClockChan <- true
+		r.fastClockChan <- true
 	}
 }
 
@@ -219,7 +380,7 @@ func (r *Replica) run() {
 		go r.executeCommands()
 	}
 
-	fastClockChan = make(chan bool, 1)
+	r.fastClockChan = make(chan bool, 1)
 
 	//Enabled fast clock when batching
 	if r.BatchingEnabled() {
@@ -243,7 +404,7 @@ func (r *Replica) run() {
 			}
 			break
 
-		case <-fastClockChan:
+		case <-r.fastClockChan:
 			//activate new proposals channel
 			onOffProposeChan = r.ProposeChan
 			break
@@ -291,10 +452,23 @@ func (r *Replica) run() {
 			break
 
 		case iid := <-r.instancesToRecover:
-			r.recover(iid)
+			r.handleRecovery(iid)
 			break
+
+		case <-r.leaseTimer:
+			r.handleDelayed()
+			break
+		}
+
+		// the proposals of instances taken by other commands,
+		// not sent back to ProposeChan as it might be full
+		for len(r.reproposals) > 0 {
+			p := r.reproposals[0]
+			r.reproposals = r.reproposals[1:]
+			r.handlePropose(p)
 		}
 
+		atomic.StoreInt32(&r.proposed, r.crtInstance)
 	}
 }
 
@@ -335,20 +509,26 @@ func (r *Replica) bcastPrepare(instance int32) {
 
 }
 
-var pa Accept
-
 func (r *Replica) bcastAccept(instance int32) {
 	defer func() {
 		if err := recover(); err != nil {
 			log.Println("Accept bcast failed:", err)
 		}
 	}()
+	var pa Accept
 	pa.LeaderId = r.Id
 	pa.Instance = instance
 	pa.Ballot = r.instanceSpace[instance].lb.lastTriedBallot
 	pa.Command = r.instanceSpace[instance].lb.cmds
 	args := &pa
 
+	if r.lease > 0 && pa.Ballot >= r.maxRecvBallot {
+		lb := r.instanceSpace[instance].lb
+		lb.acceptSent = time.Now()
+		r.leaseFrom[r.Id] = lb.acceptSent
+		r.grant(r.Id)
+	}
+
 	n := r.N - 1
 
 	sent := 0
@@ -365,15 +545,16 @@ func (r *Replica) bcastAccept(instance int32) {
 
 }
 
-var pc Commit
-var pcs CommitShort
-
 func (r *Replica) bcastCommit(instance int32, ballot int32, command []state.Command) {
 	defer func() {
 		if err := recover(); err != nil {
 			log.Println("Commit bcast failed:", err)
 		}
 	}()
+	var (
+		pc  Commit
+		pcs CommitShort
+	)
 	pc.LeaderId = r.Id
 	pc.Instance = instance
 	pc.Ballot = ballot
@@ -399,11 +580,18 @@ func (r *Replica) bcastCommit(instance int32, ballot int32, command []state.Comm
 func (r *Replica) handlePropose(propose *smr.GPropose) {
 	if !r.IsLeader {
 		dlog.Printf("Not the leader, cannot propose %v\n", propose.CommandId)
-		preply := &smr.ProposeReplyTS{FALSE, -1, state.NIL(), 0}
+		preply := &smr.ProposeReplyTS{FALSE, -1, state.NIL(), 0, 0}
 		r.ReplyProposeTS(preply, propose.Reply, propose.Mutex)
 		return
 	}
 
+	if d := r.leaseWait(r.Id); d > 0 {
+		// another leader might still serve reads locally
+		r.delayedProposals = append(r.delayedProposals, propose)
+		r.delay(d)
+		return
+	}
+
 	batchSize := len(r.ProposeChan) + 1
 	dlog.Printf("Batched %d\n", batchSize)
 
@@ -417,14 +605,24 @@ func (r *Replica) handlePropose(propose *smr.GPropose) {
 		cmds[i] = prop.Command
 	}
 
+	if atomic.LoadInt32(&r.executed) == r.crtInstance && r.leased() {
+		proposals, cmds = r.readLocally(proposals, cmds)
+		if len(proposals) == 0 {
+			return
+		}
+	}
+
 	r.crtInstance++
 	r.instanceSpace[r.crtInstance] = &Instance{
 		nil,
 		r.defaultBallot[r.Id],
 		r.defaultBallot[r.Id],
 		PREPARING,
-		&LeaderBookkeeping{proposals, 0, 0, 0, r.Id, nil, -1}}
+		&LeaderBookkeeping{proposals, 0, 0, 0, r.Id, nil, -1, time.Time{}, time.Now()}}
 	r.makeBallot(r.crtInstance)
+	for _, p := range proposals {
+		r.Trace.Link(trace.Command(p.ClientId, p.CommandId), trace.Slot(r.crtInstance))
+	}
 
 	inst := r.instanceSpace[r.crtInstance]
 	lb := inst.lb
@@ -449,6 +647,13 @@ func (r *Replica) handlePrepare(prepare *Prepare) {
 		r.maxRecvBallot = prepare.Ballot
 	}
 
+	if d := r.leaseWait(prepare.LeaderId); d > 0 {
+		dlog.Printf("Lease granted, delaying Prepare of %d\n", prepare.LeaderId)
+		r.delayedPrepares = append(r.delayedPrepares, prepare)
+		r.delay(d)
+		return
+	}
+
 	inst := r.instanceSpace[prepare.Instance]
 	if inst == nil {
 		if prepare.Instance > r.crtInstance {
@@ -528,7 +733,13 @@ func (r *Replica) handleAccept(accept *Accept) {
 		r.sync()
 	}
 
-	areply := &AcceptReply{accept.Instance, inst.bal}
+	lease := FALSE
+	if r.lease > 0 && inst.bal == accept.Ballot && accept.Ballot == r.maxRecvBallot {
+		r.grant(accept.LeaderId)
+		lease = TRUE
+	}
+
+	areply := &AcceptReply{accept.Instance, inst.bal, r.Id, lease}
 	r.replyAccept(accept.LeaderId, areply)
 }
 
@@ -563,7 +774,7 @@ func (r *Replica) handleCommit(commit *Commit) {
 	if inst.lb != nil && inst.lb.clientProposals != nil {
 		for _, p := range inst.lb.clientProposals {
 			dlog.Printf("In %d, re-proposing %s \n", commit.Instance, p.Command.String())
-			r.ProposeChan <- p
+			r.reproposals = append(r.reproposals, p)
 		}
 		inst.lb.clientProposals = nil
 	}
@@ -572,6 +783,7 @@ func (r *Replica) handleCommit(commit *Commit) {
 	inst.bal = commit.Ballot
 	inst.vbal = commit.Ballot
 	inst.status = COMMITTED
+	r.Trace.Event(trace.Slot(commit.Instance), "commit")
 	r.recordInstanceMetadata(r.instanceSpace[commit.Instance])
 	r.recordCommands(commit.Command)
 }
@@ -596,6 +808,7 @@ func (r *Replica) handleCommitShort(commit *CommitShort) {
 	dlog.Printf("Committing \n")
 	r.instanceSpace[commit.Instance].status = COMMITTED
 	r.instanceSpace[commit.Instance].bal = commit.Ballot
+	r.Trace.Event(trace.Slot(commit.Instance), "commit")
 	r.recordInstanceMetadata(r.instanceSpace[commit.Instance])
 	r.recordCommands(r.instanceSpace[commit.Instance].cmds)
 }
@@ -632,12 +845,17 @@ func (r *Replica) handlePrepareReply(preply *PrepareReply) {
 		lb.cmds = preply.Command
 	}
 
+	q1 := r.fq.Phase1(r.Id)
+	if !q1.Contains(preply.AcceptorId) {
+		return
+	}
+
 	lb.prepareOKs++
 	if r.defaultBallot[preply.AcceptorId] < preply.DefaultBallot {
 		r.defaultBallot[preply.AcceptorId] = preply.DefaultBallot
 	}
 
-	if lb.prepareOKs < r.Replica.ReadQuorumSize() && len(preply.Command) != 0 {
+	if lb.prepareOKs < q1.Size() && len(preply.Command) != 0 {
 		r.totalRecNum += len(preply.Command)
 		log.Println("totalRecNum:", r.totalRecNum)
 	}
@@ -646,7 +864,7 @@ func (r *Replica) handlePrepareReply(preply *PrepareReply) {
 	// ignoring `lb.cmds = preply.Command` executed
 	// previously. This is strange
 
-	if lb.prepareOKs+1 >= r.Replica.ReadQuorumSize() {
+	if r.isQuorum(q1, lb.prepareOKs) {
 		if lb.clientProposals != nil {
 			dlog.Printf("Pushing client proposals")
 			cmds := make([]state.Command, len(lb.clientProposals))
@@ -664,15 +882,15 @@ func (r *Replica) handlePrepareReply(preply *PrepareReply) {
 
 		m := int32(math.MaxInt32)
 		count := 0
-		for _, e := range r.defaultBallot {
-			if e != -1 {
+		for id, e := range r.defaultBallot {
+			if e != -1 && q1.Contains(int32(id)) {
 				count++
 				if e < m {
 					m = e
 				}
 			}
 		}
-		if count >= r.Replica.ReadQuorumSize()-1 && m > r.smallestDefaultBallot {
+		if count >= q1.Size()-1 && m > r.smallestDefaultBallot {
 			r.smallestDefaultBallot = m
 		}
 
@@ -717,11 +935,22 @@ func (r *Replica) handleAcceptReply(areply *AcceptReply) {
 		return
 	}
 
+	q2 := r.fq.Phase2(r.Id)
+	if !q2.Contains(areply.AcceptorId) {
+		return
+	}
+
+	if areply.Lease == TRUE && r.leaseFrom[areply.AcceptorId].Before(lb.acceptSent) {
+		r.leaseFrom[areply.AcceptorId] = lb.acceptSent
+	}
+
 	lb.acceptOKs++
-	if lb.acceptOKs+1 >= r.Replica.WriteQuorumSize() {
+	if r.isQuorum(q2, lb.acceptOKs) {
 		dlog.Printf("Committing (crtInstance=%d)\n", r.crtInstance)
 		inst = r.instanceSpace[areply.Instance]
 		inst.status = COMMITTED
+		r.Trace.Event(trace.Slot(areply.Instance), "commit")
+		r.proposeTime.Observe(time.Since(lb.proposed).Seconds())
 		r.recordInstanceMetadata(r.instanceSpace[areply.Instance])
 		r.sync() //is this necessary?
 
@@ -733,7 +962,7 @@ func (r *Replica) handleAcceptReply(areply *AcceptReply) {
 					TRUE,
 					lb.clientProposals[i].CommandId,
 					state.NIL(),
-					lb.clientProposals[i].Timestamp}
+					lb.clientProposals[i].Timestamp, 0}
 				r.ReplyProposeTS(propreply, lb.clientProposals[i].Reply, lb.clientProposals[i].Mutex)
 			}
 		}
@@ -743,6 +972,8 @@ func (r *Replica) handleAcceptReply(areply *AcceptReply) {
 }
 
 func (r *Replica) recover(instance int32) {
+	r.recoveries.Inc()
+	r.Trace.Event(trace.Slot(instance), "recovery")
 	if r.instanceSpace[instance] == nil {
 		r.instanceSpace[instance] = &Instance{
 			nil,
@@ -754,7 +985,7 @@ func (r *Replica) recover(instance int32) {
 	}
 
 	if r.instanceSpace[instance].lb == nil {
-		r.instanceSpace[instance].lb = &LeaderBookkeeping{nil, 0, 0, 0, -1, nil, -1}
+		r.instanceSpace[instance].lb = &LeaderBookkeeping{nil, 0, 0, 0, -1, nil, -1, time.Time{}, time.Now()}
 	}
 
 	r.makeBallot(instance)
@@ -767,6 +998,7 @@ func (r *Replica) executeCommands() {
 
 	for !r.Shutdown {
 		executed := false
+		lag := atomic.LoadInt32(&r.proposed) - r.executedUpTo
 
 		// FIXME idempotence
 		for i := r.executedUpTo + 1; i <= r.crtInstance; i++ {
@@ -780,14 +1012,18 @@ func (r *Replica) executeCommands() {
 							TRUE,
 							inst.lb.clientProposals[j].CommandId,
 							val,
-							inst.lb.clientProposals[j].Timestamp}
+							inst.lb.clientProposals[j].Timestamp, 0}
 						r.ReplyProposeTS(propreply, inst.lb.clientProposals[j].Reply, inst.lb.clientProposals[j].Mutex)
-					} else if inst.cmds[j].Op == state.PUT {
+					} else if state.IsWrite(&inst.cmds[j]) {
 						inst.cmds[j].Execute(r.State)
+					} else {
+						r.State.Skip()
 					}
 				}
+				r.Trace.Event(trace.Slot(i), "execute")
 				executed = true
 				r.executedUpTo++
+				atomic.StoreInt32(&r.executed, r.executedUpTo)
 				dlog.Printf("Executed up to %d (crtInstance=%d)", r.executedUpTo, r.crtInstance)
 			} else {
 				if i == problemInstance {
@@ -808,10 +1044,36 @@ func (r *Replica) executeCommands() {
 			}
 		}
 
-		if !executed {
+		if executed {
+			r.lags.Observe(float64(lag))
+		} else {
 			r.M.Lock()
 			r.M.Unlock() // FIXME for cache coherence
 			time.Sleep(SLEEP_TIME_NS)
 		}
 	}
 }
+
+func (m *Prepare) TraceIds(f func(trace.Id)) {
+	f(trace.Slot(m.Instance))
+}
+
+func (m *PrepareReply) TraceIds(f func(trace.Id)) {
+	f(trace.Slot(m.Instance))
+}
+
+func (m *Accept) TraceIds(f func(trace.Id)) {
+	f(trace.Slot(m.Instance))
+}
+
+func (m *AcceptReply) TraceIds(f func(trace.Id)) {
+	f(trace.Slot(m.Instance))
+}
+
+func (m *Commit) TraceIds(f func(trace.Id)) {
+	f(trace.Slot(m.Instance))
+}
+
+func (m *CommitShort) TraceIds(f func(trace.Id)) {
+	f(trace.Slot(m.Instance))
+}
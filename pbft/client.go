@@ -0,0 +1,94 @@
+package pbft
+
+import (
+	"flag"
+	"log"
+	"strings"
+
+	"github.com/vonaka/shreplic/client/base"
+	"github.com/vonaka/shreplic/server/smr"
+)
+
+type Client struct {
+	*base.SimpleClient
+
+	replies chan *replyFrom
+}
+
+type replyFrom struct {
+	replica int
+	rep     *smr.ProposeReplyTS
+}
+
+// NewClient returns a client that sends its commands to every
+// replica and waits for f+1 matching replies
+func NewClient(maddr, collocated string, mport, reqNum, writes, psize, conflict int,
+	fast, lread, leaderless, verbose bool, logger *log.Logger, args string) *Client {
+
+	// args may be of the form "-maxfailures <f>", with the f of the replicas,
+	// by default the largest f that n replicas tolerate, which is safe for any
+	// f of the replicas as the client then waits for more matching replies
+	fs := flag.NewFlagSet("custom PBFT arguments", flag.ExitOnError)
+	maxfailures := fs.Int("maxfailures", -1, "Maximum number of byzantine replicas")
+	fs.Parse(strings.Fields(args))
+
+	c := &Client{
+		SimpleClient: base.NewSimpleClient(maddr, collocated, mport, reqNum, writes,
+			psize, conflict, true, false, false, verbose, logger),
+
+		replies: nil,
+	}
+
+	c.WaitResponse = func() error {
+		if c.replies == nil {
+			c.listen()
+		}
+
+		f := *maxfailures
+		if f < 0 {
+			f = (c.N - 1) / 3
+		}
+		votes := make(map[string]map[int]struct{})
+		for {
+			r := <-c.replies
+			if r.rep.CommandId != c.Seqnum || r.rep.OK != smr.TRUE {
+				continue
+			}
+			v := string(r.rep.Value)
+			if votes[v] == nil {
+				votes[v] = make(map[int]struct{})
+			}
+			votes[v][r.replica] = struct{}{}
+			if len(votes[v]) >= f+1 {
+				c.Println("Returning:", r.rep.Value.String())
+				c.ResChan <- r.rep.Value
+				return nil
+			}
+		}
+	}
+
+	return c
+}
+
+// listen reads the replies of every replica
+func (c *Client) listen() {
+	c.replies = make(chan *replyFrom, c.N)
+	for i := 0; i < c.N; i++ {
+		if !c.Connected(i) {
+			continue
+		}
+		go func(i int) {
+			for {
+				rep, err := c.ProposeReplyFrom(i)
+				if err != nil {
+					c.Println("Connection to", i, "lost:", err)
+					return
+				}
+				c.replies <- &replyFrom{
+					replica: i,
+					rep:     rep,
+				}
+			}
+		}(i)
+	}
+}
@@ -0,0 +1,90 @@
+package pbft
+
+import (
+	"fmt"
+
+	"github.com/vonaka/shreplic/state"
+	"github.com/vonaka/shreplic/tools/fastrpc"
+)
+
+type CommandId struct {
+	ClientId int32
+	SeqNum   int32
+}
+
+func (cmdId CommandId) String() string {
+	return fmt.Sprintf("%v,%v", cmdId.ClientId, cmdId.SeqNum)
+}
+
+type Entry struct {
+	CmdId CommandId
+	Cmd   state.Command
+}
+
+// MPrePrepare assigns the sequence number Seq to a batch of Entries
+type MPrePrepare struct {
+	Replica int32
+	View    int32
+	Seq     int32
+	Entries []Entry
+}
+
+type MPrepare struct {
+	Replica int32
+	View    int32
+	Seq     int32
+	Digest  []byte
+}
+
+type MCommit struct {
+	Replica int32
+	View    int32
+	Seq     int32
+	Digest  []byte
+}
+
+// MCheckpoint tells that the history of batches executed
+// up to Seq has the digest Digest
+type MCheckpoint struct {
+	Replica int32
+	Seq     int32
+	Digest  []byte
+}
+
+// MViewChange carries the proofs that the checkpoint Stable is
+// stable and, for every batch prepared after Stable, its pre-prepare
+// and the matching prepares
+type MViewChange struct {
+	Replica int32
+	View    int32
+	Stable  int32
+	Proofs  []fastrpc.Signed
+}
+
+type MNewView struct {
+	Replica     int32
+	View        int32
+	ViewChanges []fastrpc.Signed
+}
+
+// MStateRequest asks for the state of the last stable
+// checkpoint of a replica, which must not be below Seq
+type MStateRequest struct {
+	Replica int32
+	Seq     int32
+}
+
+// MState is the state once the batches up to Seq are executed:
+// the position of the last command executed, the digest of their
+// history, the last command executed for each client and the content
+// of the store ordered by key. Proofs are the checkpoints showing
+// that Seq is stable.
+type MState struct {
+	Replica  int32
+	Seq      int32
+	Version  int64
+	History  []byte
+	LastExec []CommandId
+	Data     []state.Command
+	Proofs   []fastrpc.Signed
+}
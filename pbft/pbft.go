@@ -0,0 +1,1129 @@
+package pbft
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vonaka/shreplic/server/smr"
+	"github.com/vonaka/shreplic/state"
+	"github.com/vonaka/shreplic/tools/dlog"
+	"github.com/vonaka/shreplic/tools/fastrpc"
+)
+
+// MAX_BATCH is the maximal number of entries carried by an MPrePrepare
+const MAX_BATCH = 1024
+
+var BAD_KEY = errors.New("Invalid key")
+
+// Replica of PBFT.
+//
+// The messages exchanged by replicas are authenticated either with
+// ed25519 signatures or with vectors of MACs. The keys are read from
+// the directory given by -keys: replica-<i>.key is the PEM encoded
+// private key of replica i and replica-<i>.pub its public key, while
+// mac-<i>-<j>.key holds the hex encoded key shared by i < j.
+// Clients are not authenticated, they send their commands to every
+// replica and wait for f+1 matching replies.
+//
+// A replica that lags behind a stable checkpoint fetches the
+// state of this checkpoint from f+1 replicas that agree on it.
+type Replica struct {
+	*smr.Replica
+
+	view      int32
+	active    bool
+	seq       int32
+	instances map[int32]*instance
+	expected  map[int32][]byte
+
+	executed     int32
+	history      []byte
+	lastExec     map[int32]int32
+	lastReply    map[int32]state.Value
+	stable       int32
+	stableProofs []fastrpc.Signed
+	stableDigest []byte
+	stableVer    state.Version
+	versions     map[int32]state.Version
+	checkpoints  map[int32]map[int32]*vote
+
+	fetching  int32
+	lastFetch time.Time
+	states    map[int32]*MState
+	digests   map[int32][]byte
+
+	proposes map[CommandId]*smr.GPropose
+	queue    []Entry
+
+	viewChanges map[int32]map[int32]*viewChange
+
+	period       int32
+	window       int32
+	timeout      time.Duration
+	viewTimeout  time.Duration
+	lastProgress time.Time
+	tickChan     chan struct{}
+
+	auth fastrpc.Authenticator
+	msgs *fastrpc.Table
+
+	sender smr.Sender
+	cs     CommunicationSupply
+}
+
+type instance struct {
+	view       int32
+	digest     []byte
+	entries    []Entry
+	prePrepare *fastrpc.Signed
+	prepares   map[int32]*vote
+	commits    map[int32]*vote
+	committed  bool
+
+	// cert is made of the pre-prepare and
+	// the prepares of the view certView
+	cert     []fastrpc.Signed
+	certView int32
+}
+
+type vote struct {
+	view   int32
+	digest []byte
+	env    *fastrpc.Signed
+}
+
+// viewChange is a valid MViewChange
+type viewChange struct {
+	env      *fastrpc.Signed
+	stable   int32
+	digest   []byte
+	proofs   []fastrpc.Signed
+	prepared map[int32]*certificate
+}
+
+type certificate struct {
+	view    int32
+	digest  []byte
+	entries []Entry
+}
+
+type CommunicationSupply struct {
+	maxLatency time.Duration
+
+	signedChan chan fastrpc.Serializable
+
+	signedRPC       uint8
+	prePrepareRPC   uint8
+	prepareRPC      uint8
+	commitRPC       uint8
+	checkpointRPC   uint8
+	viewChangeRPC   uint8
+	newViewRPC      uint8
+	stateRequestRPC uint8
+	stateRPC        uint8
+}
+
+func NewReplica(rid int, addrs []string, exec, dr bool,
+	f int, args string, ps map[string]struct{}) *Replica {
+
+	fs := flag.NewFlagSet("custom PBFT arguments", flag.ExitOnError)
+	scheme := fs.String("auth", "sig", "Authentication of messages: sig (ed25519) or mac (HMAC-SHA256)")
+	keys := fs.String("keys", "keys", "Directory containing the keys")
+	period := fs.Int("checkpoint", 128, "Number of batches between two checkpoints")
+	timeout := fs.Int("timeout", 1000, "Milliseconds without progress before a view change")
+	fs.Parse(strings.Fields(args))
+
+	r := &Replica{
+		Replica: smr.NewReplica(rid, f, addrs, false, exec, false, dr, ps),
+
+		view:      0,
+		active:    true,
+		seq:       1,
+		instances: make(map[int32]*instance),
+		expected:  make(map[int32][]byte),
+
+		executed:     0,
+		history:      []byte{},
+		lastExec:     make(map[int32]int32),
+		lastReply:    make(map[int32]state.Value),
+		stable:       0,
+		stableProofs: []fastrpc.Signed{},
+		stableDigest: nil,
+		stableVer:    state.NO_VERSION,
+		versions:     make(map[int32]state.Version),
+		checkpoints:  make(map[int32]map[int32]*vote),
+
+		fetching: 0,
+		states:   make(map[int32]*MState),
+		digests:  make(map[int32][]byte),
+
+		proposes: make(map[CommandId]*smr.GPropose),
+		queue:    []Entry{},
+
+		viewChanges: make(map[int32]map[int32]*viewChange),
+
+		period:      int32(*period),
+		window:      2 * int32(*period),
+		timeout:     time.Duration(*timeout) * time.Millisecond,
+		viewTimeout: time.Duration(*timeout) * time.Millisecond,
+		tickChan:    make(chan struct{}, 1),
+
+		msgs: fastrpc.NewTable(),
+	}
+
+	if r.N < 3*r.F+1 {
+		log.Fatalf("PBFT needs at least %d replicas to tolerate %d failures", 3*r.F+1, r.F)
+	}
+	auth, err := newAuthenticator(r.Id, r.N, *scheme, *keys)
+	if err != nil {
+		log.Fatal("Cannot load the keys: ", err)
+	}
+	r.auth = auth
+
+	r.sender = smr.NewSender(r.Replica)
+	initCs(&r.cs, r.RPC, r.msgs)
+
+	go r.run()
+
+	return r
+}
+
+// Messages registers in t the messages of the protocol
+func Messages(t *fastrpc.Table) {
+	initCs(new(CommunicationSupply), t, fastrpc.NewTable())
+}
+
+// initCs registers the signed envelope in t, the
+// messages it carries are registered in msgs
+func initCs(cs *CommunicationSupply, t, msgs *fastrpc.Table) {
+	cs.maxLatency = 0
+
+	cs.signedChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+
+	cs.signedRPC = t.Register(new(fastrpc.Signed), cs.signedChan)
+	cs.prePrepareRPC = msgs.Register(new(MPrePrepare), nil)
+	cs.prepareRPC = msgs.Register(new(MPrepare), nil)
+	cs.commitRPC = msgs.Register(new(MCommit), nil)
+	cs.checkpointRPC = msgs.Register(new(MCheckpoint), nil)
+	cs.viewChangeRPC = msgs.Register(new(MViewChange), nil)
+	cs.newViewRPC = msgs.Register(new(MNewView), nil)
+	cs.stateRequestRPC = msgs.Register(new(MStateRequest), nil)
+	cs.stateRPC = msgs.Register(new(MState), nil)
+}
+
+func newAuthenticator(id int32, n int, scheme, dir string) (fastrpc.Authenticator, error) {
+	switch scheme {
+	case "sig":
+		a := &fastrpc.Ed25519{
+			Public: make([]ed25519.PublicKey, n),
+		}
+		for i := 0; i < n; i++ {
+			k, err := readPublicKey(filepath.Join(dir, fmt.Sprintf("replica-%d.pub", i)))
+			if err != nil {
+				return nil, err
+			}
+			a.Public[i] = k
+		}
+		k, err := readPrivateKey(filepath.Join(dir, fmt.Sprintf("replica-%d.key", id)))
+		if err != nil {
+			return nil, err
+		}
+		a.Private = k
+		return a, nil
+	case "mac":
+		a := &fastrpc.MACs{
+			Id:   id,
+			Keys: make([][]byte, n),
+		}
+		for i := int32(0); i < int32(n); i++ {
+			lo, hi := id, i
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			f := filepath.Join(dir, fmt.Sprintf("mac-%d-%d.key", lo, hi))
+			data, err := os.ReadFile(f)
+			if err != nil {
+				return nil, err
+			}
+			k, err := hex.DecodeString(strings.TrimSpace(string(data)))
+			if err != nil || len(k) == 0 {
+				return nil, fmt.Errorf("%s: %v", f, BAD_KEY)
+			}
+			a.Keys[i] = k
+		}
+		return a, nil
+	}
+	return nil, errors.New("Unknown authentication scheme: " + scheme)
+}
+
+func readPEM(file string) ([]byte, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: %v", file, BAD_KEY)
+	}
+	return block.Bytes, nil
+}
+
+func readPrivateKey(file string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(file)
+	if err != nil {
+		return nil, err
+	}
+	k, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	private, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: %v", file, BAD_KEY)
+	}
+	return private, nil
+}
+
+func readPublicKey(file string) (ed25519.PublicKey, error) {
+	der, err := readPEM(file)
+	if err != nil {
+		return nil, err
+	}
+	k, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	public, ok := k.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: %v", file, BAD_KEY)
+	}
+	return public, nil
+}
+
+func (r *Replica) run() {
+	r.ConnectToPeers()
+	latencies := r.ComputeClosestPeers()
+	for _, l := range latencies {
+		d := time.Duration(l*1000*1000) * time.Nanosecond
+		if d > r.cs.maxLatency {
+			r.cs.maxLatency = d
+		}
+	}
+
+	go r.WaitForClientConnections()
+	r.lastProgress = time.Now()
+	go r.clock()
+
+	for !r.Shutdown {
+		select {
+		case propose := <-r.ProposeChan:
+			r.handlePropose(propose)
+
+		case m := <-r.cs.signedChan:
+			env := m.(*fastrpc.Signed)
+			r.handleSigned(env)
+
+		case <-r.tickChan:
+			if r.fetching > r.executed && time.Since(r.lastFetch) >= r.timeout {
+				r.requestState()
+			}
+			if (r.active && len(r.proposes) == 0) ||
+				time.Since(r.lastProgress) < r.viewTimeout {
+				break
+			}
+			if !r.active {
+				r.viewTimeout *= 2
+			}
+			r.startViewChange(r.view + 1)
+		}
+	}
+}
+
+func (r *Replica) clock() {
+	for !r.Shutdown {
+		time.Sleep(r.timeout / 10)
+		r.tickChan <- struct{}{}
+	}
+}
+
+func (r *Replica) handleSigned(env *fastrpc.Signed) {
+	msg, err := env.Open(r.msgs, r.auth)
+	if err != nil {
+		dlog.Printf("Dropping a message from %v: %v\n", env.Sender, err)
+		return
+	}
+
+	switch m := msg.(type) {
+	case *MPrePrepare:
+		if m.Replica == env.Sender {
+			r.handlePrePrepare(env, m)
+		}
+	case *MPrepare:
+		if m.Replica == env.Sender {
+			r.handlePrepare(env, m)
+		}
+	case *MCommit:
+		if m.Replica == env.Sender {
+			r.handleCommit(env, m)
+		}
+	case *MCheckpoint:
+		if m.Replica == env.Sender {
+			r.handleCheckpoint(env, m)
+		}
+	case *MViewChange:
+		if m.Replica == env.Sender {
+			r.handleViewChange(env, m)
+		}
+	case *MNewView:
+		if m.Replica == env.Sender {
+			r.handleNewView(env, m)
+		}
+	case *MStateRequest:
+		if m.Replica == env.Sender {
+			r.handleStateRequest(m)
+		}
+	case *MState:
+		if m.Replica == env.Sender {
+			r.handleState(m)
+		}
+		// kept until f+1 replicas send the same state
+		return
+	}
+	fastrpc.Free(msg)
+}
+
+func (r *Replica) broadcast(code uint8, msg fastrpc.Serializable) *fastrpc.Signed {
+	env := fastrpc.Sign(r.Id, code, msg, r.auth)
+	r.sender.SendToAll(env, r.cs.signedRPC)
+	return env
+}
+
+func (r *Replica) handlePropose(propose *smr.GPropose) {
+	if len(r.proposes) == 0 {
+		r.lastProgress = time.Now()
+	}
+
+	batchSize := len(r.ProposeChan) + 1
+	for i := 0; i < batchSize; i++ {
+		if i > 0 {
+			propose = <-r.ProposeChan
+		}
+		cmdId := CommandId{
+			ClientId: propose.ClientId,
+			SeqNum:   propose.CommandId,
+		}
+		// the command might be executed before its propose arrives
+		if last, exists := r.lastExec[cmdId.ClientId]; exists && cmdId.SeqNum <= last {
+			if v, exists := r.lastReply[cmdId.ClientId]; exists && cmdId.SeqNum == last {
+				r.reply(propose, v)
+			}
+			continue
+		}
+		r.proposes[cmdId] = propose
+		if r.active && r.primary(r.view) == r.Id {
+			r.queue = append(r.queue, Entry{
+				CmdId: cmdId,
+				Cmd:   propose.Command,
+			})
+		}
+	}
+	r.proposeQueue()
+}
+
+// proposeQueue assigns sequence numbers to the queued entries
+// as long as they fall into the window of the primary
+func (r *Replica) proposeQueue() {
+	if !r.active || r.primary(r.view) != r.Id {
+		return
+	}
+
+	for len(r.queue) > 0 && r.inWindow(r.seq) {
+		n := len(r.queue)
+		if n > MAX_BATCH {
+			n = MAX_BATCH
+		}
+		entries := make([]Entry, n)
+		copy(entries, r.queue)
+		r.queue = r.queue[n:]
+
+		pp := &MPrePrepare{
+			Replica: r.Id,
+			View:    r.view,
+			Seq:     r.seq,
+			Entries: entries,
+		}
+		r.seq++
+		r.handlePrePrepare(r.broadcast(r.cs.prePrepareRPC, pp), pp)
+	}
+}
+
+func (r *Replica) handlePrePrepare(env *fastrpc.Signed, msg *MPrePrepare) {
+	if !r.active || msg.View != r.view ||
+		msg.Replica != r.primary(msg.View) || !r.inWindow(msg.Seq) {
+		return
+	}
+	digest := digestOf(msg.Entries)
+	if d, exists := r.expected[msg.Seq]; exists && !bytes.Equal(d, digest) {
+		return
+	}
+	inst := r.instance(msg.Seq)
+	if inst.prePrepare != nil && inst.view == msg.View {
+		return
+	}
+
+	inst.view = msg.View
+	inst.digest = digest
+	inst.entries = msg.Entries
+	inst.prePrepare = env
+
+	if r.Id != msg.Replica {
+		p := &MPrepare{
+			Replica: r.Id,
+			View:    msg.View,
+			Seq:     msg.Seq,
+			Digest:  digest,
+		}
+		r.handlePrepare(r.broadcast(r.cs.prepareRPC, p), p)
+	} else {
+		r.checkPrepared(msg.Seq, inst)
+	}
+}
+
+func (r *Replica) handlePrepare(env *fastrpc.Signed, msg *MPrepare) {
+	if msg.View != r.view || msg.Replica == r.primary(msg.View) ||
+		!r.inWindow(msg.Seq) {
+		return
+	}
+
+	inst := r.instance(msg.Seq)
+	inst.prepares[msg.Replica] = &vote{
+		view:   msg.View,
+		digest: msg.Digest,
+		env:    env,
+	}
+	r.checkPrepared(msg.Seq, inst)
+}
+
+func (r *Replica) checkPrepared(seq int32, inst *instance) {
+	if inst.view != r.view || inst.prePrepare == nil ||
+		(inst.cert != nil && inst.certView == inst.view) {
+		return
+	}
+
+	cert := []fastrpc.Signed{*inst.prePrepare}
+	for _, v := range inst.prepares {
+		if v.view == inst.view && bytes.Equal(v.digest, inst.digest) {
+			cert = append(cert, *v.env)
+		}
+	}
+	if len(cert) < r.ByzantineQuorumSize() {
+		return
+	}
+	inst.cert = cert
+	inst.certView = inst.view
+
+	c := &MCommit{
+		Replica: r.Id,
+		View:    inst.view,
+		Seq:     seq,
+		Digest:  inst.digest,
+	}
+	r.handleCommit(r.broadcast(r.cs.commitRPC, c), c)
+}
+
+func (r *Replica) handleCommit(env *fastrpc.Signed, msg *MCommit) {
+	if msg.View != r.view || !r.inWindow(msg.Seq) {
+		return
+	}
+
+	inst := r.instance(msg.Seq)
+	inst.commits[msg.Replica] = &vote{
+		view:   msg.View,
+		digest: msg.Digest,
+		env:    env,
+	}
+	r.checkCommitted(inst)
+}
+
+func (r *Replica) checkCommitted(inst *instance) {
+	if inst.committed || inst.view != r.view ||
+		inst.cert == nil || inst.certView != inst.view {
+		return
+	}
+
+	count := 0
+	for _, v := range inst.commits {
+		if v.view == inst.view && bytes.Equal(v.digest, inst.digest) {
+			count++
+		}
+	}
+	if count >= r.ByzantineQuorumSize() {
+		inst.committed = true
+		r.execute()
+	}
+}
+
+func (r *Replica) execute() {
+	for {
+		inst, exists := r.instances[r.executed+1]
+		if !exists || !inst.committed {
+			return
+		}
+		r.executed++
+		r.lastProgress = time.Now()
+
+		for _, e := range inst.entries {
+			if last, exists := r.lastExec[e.CmdId.ClientId]; exists && e.CmdId.SeqNum <= last {
+				continue
+			}
+			r.lastExec[e.CmdId.ClientId] = e.CmdId.SeqNum
+
+			v := state.NIL()
+			if r.Exec {
+				dlog.Printf("Executing " + e.Cmd.String())
+				v = e.Cmd.Execute(r.State)
+			}
+			r.lastReply[e.CmdId.ClientId] = v
+			if p, exists := r.proposes[e.CmdId]; exists {
+				r.reply(p, v)
+				delete(r.proposes, e.CmdId)
+			}
+		}
+
+		h := sha256.New()
+		h.Write(r.history)
+		h.Write(inst.digest)
+		r.history = h.Sum(nil)
+
+		if r.executed%r.period == 0 {
+			r.versions[r.executed] = r.State.Version()
+			c := &MCheckpoint{
+				Replica: r.Id,
+				Seq:     r.executed,
+				Digest:  r.history,
+			}
+			r.handleCheckpoint(r.broadcast(r.cs.checkpointRPC, c), c)
+		}
+	}
+}
+
+func (r *Replica) reply(p *smr.GPropose, v state.Value) {
+	if !r.Dreply {
+		v = state.NIL()
+	}
+	rep := &smr.ProposeReplyTS{
+		OK:        smr.TRUE,
+		CommandId: p.CommandId,
+		Value:     v,
+		Timestamp: p.Timestamp,
+	}
+	r.ReplyProposeTS(rep, p.Reply, p.Mutex)
+}
+
+func (r *Replica) handleCheckpoint(env *fastrpc.Signed, msg *MCheckpoint) {
+	if msg.Seq <= r.stable {
+		return
+	}
+	if r.checkpoints[msg.Seq] == nil {
+		r.checkpoints[msg.Seq] = make(map[int32]*vote)
+	}
+	r.checkpoints[msg.Seq][msg.Replica] = &vote{
+		view:   -1,
+		digest: msg.Digest,
+		env:    env,
+	}
+	r.checkStable(msg.Seq)
+}
+
+// checkStable makes seq the stable checkpoint if its digest is
+// the one of the local history and ByzantineQuorumSize replicas agree
+func (r *Replica) checkStable(seq int32) {
+	if seq <= r.stable {
+		return
+	}
+	if seq > r.executed {
+		// fetch the state if the replica lags too far behind
+		// a checkpoint that is stable at the others
+		if seq <= r.executed+r.period || r.fetching > r.executed {
+			return
+		}
+		count := make(map[string]int)
+		for _, v := range r.checkpoints[seq] {
+			count[string(v.digest)]++
+			if count[string(v.digest)] >= r.ByzantineQuorumSize() {
+				r.fetchState(seq)
+				return
+			}
+		}
+		return
+	}
+	own, exists := r.checkpoints[seq][r.Id]
+	if !exists {
+		return
+	}
+
+	proofs := []fastrpc.Signed{}
+	for _, v := range r.checkpoints[seq] {
+		if bytes.Equal(v.digest, own.digest) {
+			proofs = append(proofs, *v.env)
+		}
+	}
+	if len(proofs) >= r.ByzantineQuorumSize() {
+		r.makeStable(seq, own.digest, proofs)
+	}
+}
+
+func (r *Replica) makeStable(seq int32, digest []byte, proofs []fastrpc.Signed) {
+	r.stable = seq
+	r.stableProofs = proofs
+	r.stableDigest = digest
+	r.stableVer = r.versions[seq]
+	for s := range r.versions {
+		if s < seq {
+			delete(r.versions, s)
+		}
+	}
+	for s := range r.instances {
+		if s <= seq {
+			delete(r.instances, s)
+		}
+	}
+	for s := range r.checkpoints {
+		if s <= seq {
+			delete(r.checkpoints, s)
+		}
+	}
+	r.proposeQueue()
+}
+
+func (r *Replica) fetchState(seq int32) {
+	log.Println("Fetching the state up to", seq)
+	r.fetching = seq
+	r.states = make(map[int32]*MState)
+	r.digests = make(map[int32][]byte)
+	r.requestState()
+}
+
+func (r *Replica) requestState() {
+	r.lastFetch = time.Now()
+	r.broadcast(r.cs.stateRequestRPC, &MStateRequest{
+		Replica: r.Id,
+		Seq:     r.fetching,
+	})
+}
+
+func (r *Replica) handleStateRequest(msg *MStateRequest) {
+	if r.stable == 0 || r.stable < msg.Seq {
+		return
+	}
+
+	data := make([]state.Command, 0)
+	err := r.State.Range(r.stableVer, func(k state.Key, v state.Value) bool {
+		data = append(data, state.Command{
+			Op: state.PUT,
+			K:  k,
+			V:  v,
+		})
+		return true
+	})
+	if err != nil {
+		log.Println("Cannot read the state up to", r.stable, ":", err)
+		return
+	}
+	sort.Slice(data, func(i, j int) bool {
+		return data[i].K < data[j].K
+	})
+	lastExec := make([]CommandId, 0, len(r.lastExec))
+	for c, s := range r.lastExec {
+		lastExec = append(lastExec, CommandId{
+			ClientId: c,
+			SeqNum:   s,
+		})
+	}
+	sort.Slice(lastExec, func(i, j int) bool {
+		return lastExec[i].ClientId < lastExec[j].ClientId
+	})
+
+	st := &MState{
+		Replica:  r.Id,
+		Seq:      r.stable,
+		Version:  int64(r.stableVer),
+		History:  r.stableDigest,
+		LastExec: lastExec,
+		Data:     data,
+		Proofs:   r.stableProofs,
+	}
+	env := fastrpc.Sign(r.Id, r.cs.stateRPC, st, r.auth)
+	r.sender.SendTo(msg.Replica, env, r.cs.signedRPC)
+}
+
+// handleState installs the state carried by msg once
+// f+1 replicas have sent the same state
+func (r *Replica) handleState(msg *MState) {
+	if r.fetching <= r.executed || msg.Seq < r.fetching ||
+		msg.Seq <= r.executed || !r.checkCheckpoint(msg.Seq, msg.History, msg.Proofs) {
+		return
+	}
+
+	digest := stateDigest(msg)
+	r.states[msg.Replica] = msg
+	r.digests[msg.Replica] = digest
+	count := 0
+	for _, d := range r.digests {
+		if bytes.Equal(d, digest) {
+			count++
+		}
+	}
+	if count < r.F+1 {
+		return
+	}
+
+	log.Println("Installing the state up to", msg.Seq)
+	r.State.Install(state.Version(msg.Version), msg.Data)
+	r.executed = msg.Seq
+	r.history = msg.History
+	r.lastExec = make(map[int32]int32)
+	r.lastReply = make(map[int32]state.Value)
+	for _, c := range msg.LastExec {
+		r.lastExec[c.ClientId] = c.SeqNum
+	}
+	r.versions[msg.Seq] = r.State.Version()
+	r.states = make(map[int32]*MState)
+	r.digests = make(map[int32][]byte)
+	r.lastProgress = time.Now()
+
+	// the commands executed by the others are answered by them
+	for cmdId := range r.proposes {
+		if last, exists := r.lastExec[cmdId.ClientId]; exists && cmdId.SeqNum <= last {
+			delete(r.proposes, cmdId)
+		}
+	}
+	if r.seq <= msg.Seq {
+		r.seq = msg.Seq + 1
+	}
+	if msg.Seq > r.stable {
+		r.makeStable(msg.Seq, msg.History, msg.Proofs)
+	}
+	r.execute()
+}
+
+// checkCheckpoint tells whether proofs are ByzantineQuorumSize
+// checkpoints of seq with the digest digest
+func (r *Replica) checkCheckpoint(seq int32, digest []byte, proofs []fastrpc.Signed) bool {
+	ids := make(map[int32]struct{})
+	for i := range proofs {
+		p := &proofs[i]
+		m, err := p.Open(r.msgs, r.auth)
+		if err != nil {
+			return false
+		}
+		c, ok := m.(*MCheckpoint)
+		if !ok || c.Replica != p.Sender || c.Seq != seq ||
+			!bytes.Equal(c.Digest, digest) {
+			return false
+		}
+		ids[c.Replica] = struct{}{}
+	}
+	return len(ids) >= r.ByzantineQuorumSize()
+}
+
+func (r *Replica) startViewChange(view int32) {
+	log.Println("Starting view change to view", view)
+	r.view = view
+	r.active = false
+	r.lastProgress = time.Now()
+
+	proofs := make([]fastrpc.Signed, len(r.stableProofs))
+	copy(proofs, r.stableProofs)
+	for s, inst := range r.instances {
+		if s > r.stable && inst.cert != nil {
+			proofs = append(proofs, inst.cert...)
+		}
+	}
+
+	vc := &MViewChange{
+		Replica: r.Id,
+		View:    view,
+		Stable:  r.stable,
+		Proofs:  proofs,
+	}
+	r.handleViewChange(r.broadcast(r.cs.viewChangeRPC, vc), vc)
+}
+
+func (r *Replica) handleViewChange(env *fastrpc.Signed, msg *MViewChange) {
+	if msg.View < r.view || (msg.View == r.view && r.active) {
+		return
+	}
+	vc := r.checkViewChange(msg)
+	if vc == nil {
+		dlog.Printf("Invalid view change from %v\n", msg.Replica)
+		return
+	}
+	vc.env = env
+	if r.viewChanges[msg.View] == nil {
+		r.viewChanges[msg.View] = make(map[int32]*viewChange)
+	}
+	r.viewChanges[msg.View][msg.Replica] = vc
+
+	if msg.View > r.view {
+		// join the view change if f+1 replicas are ahead
+		ahead := make(map[int32]struct{})
+		next := msg.View
+		for v, vcs := range r.viewChanges {
+			if v <= r.view {
+				continue
+			}
+			for id := range vcs {
+				ahead[id] = struct{}{}
+			}
+			if v < next {
+				next = v
+			}
+		}
+		if len(ahead) >= r.F+1 {
+			r.startViewChange(next)
+		}
+		return
+	}
+
+	vcs := r.viewChanges[r.view]
+	if _, exists := vcs[r.Id]; !exists || r.primary(r.view) != r.Id ||
+		len(vcs) < r.ByzantineQuorumSize() {
+		return
+	}
+	nv := &MNewView{
+		Replica:     r.Id,
+		View:        r.view,
+		ViewChanges: make([]fastrpc.Signed, 0, len(vcs)),
+	}
+	for _, vc := range vcs {
+		nv.ViewChanges = append(nv.ViewChanges, *vc.env)
+	}
+	r.handleNewView(r.broadcast(r.cs.newViewRPC, nv), nv)
+}
+
+// checkViewChange returns nil if the proofs carried by msg are invalid
+func (r *Replica) checkViewChange(msg *MViewChange) *viewChange {
+	vc := &viewChange{
+		stable:   msg.Stable,
+		prepared: make(map[int32]*certificate),
+	}
+	checkpoints := make(map[int32]struct{})
+	var digest []byte
+	prepares := make(map[int32][]*MPrepare)
+
+	for i := range msg.Proofs {
+		p := &msg.Proofs[i]
+		m, err := p.Open(r.msgs, r.auth)
+		if err != nil {
+			return nil
+		}
+		switch m := m.(type) {
+		case *MCheckpoint:
+			if m.Replica != p.Sender || m.Seq != msg.Stable ||
+				(digest != nil && !bytes.Equal(digest, m.Digest)) {
+				return nil
+			}
+			digest = m.Digest
+			checkpoints[m.Replica] = struct{}{}
+			vc.proofs = append(vc.proofs, *p)
+		case *MPrePrepare:
+			if m.Replica != p.Sender || m.Replica != r.primary(m.View) ||
+				m.View >= msg.View || m.Seq <= msg.Stable ||
+				m.Seq > msg.Stable+r.window || vc.prepared[m.Seq] != nil {
+				return nil
+			}
+			vc.prepared[m.Seq] = &certificate{
+				view:    m.View,
+				digest:  digestOf(m.Entries),
+				entries: m.Entries,
+			}
+		case *MPrepare:
+			if m.Replica != p.Sender {
+				return nil
+			}
+			prepares[m.Seq] = append(prepares[m.Seq], m)
+		default:
+			return nil
+		}
+	}
+
+	if msg.Stable > 0 && len(checkpoints) < r.ByzantineQuorumSize() {
+		return nil
+	}
+	vc.digest = digest
+	for s, c := range vc.prepared {
+		ids := make(map[int32]struct{})
+		for _, p := range prepares[s] {
+			if p.View == c.view && bytes.Equal(p.Digest, c.digest) &&
+				p.Replica != r.primary(c.view) {
+				ids[p.Replica] = struct{}{}
+			}
+		}
+		if len(ids) < r.ByzantineQuorumSize()-1 {
+			return nil
+		}
+	}
+	return vc
+}
+
+func (r *Replica) handleNewView(env *fastrpc.Signed, msg *MNewView) {
+	if msg.Replica != r.primary(msg.View) || msg.View < r.view ||
+		(msg.View == r.view && r.active) {
+		return
+	}
+
+	vcs := make(map[int32]*viewChange)
+	for i := range msg.ViewChanges {
+		p := &msg.ViewChanges[i]
+		m, err := p.Open(r.msgs, r.auth)
+		if err != nil {
+			return
+		}
+		vcm, ok := m.(*MViewChange)
+		if !ok || vcm.Replica != p.Sender || vcm.View != msg.View {
+			return
+		}
+		vc := r.checkViewChange(vcm)
+		if vc == nil {
+			return
+		}
+		vcs[vcm.Replica] = vc
+	}
+	if len(vcs) < r.ByzantineQuorumSize() {
+		return
+	}
+
+	var minS *viewChange
+	for _, vc := range vcs {
+		if minS == nil || vc.stable > minS.stable {
+			minS = vc
+		}
+	}
+	maxS := minS.stable
+	chosen := make(map[int32]*certificate)
+	for _, vc := range vcs {
+		for s, c := range vc.prepared {
+			if s <= minS.stable {
+				continue
+			}
+			if cur, exists := chosen[s]; !exists || c.view > cur.view {
+				chosen[s] = c
+			}
+			if s > maxS {
+				maxS = s
+			}
+		}
+	}
+
+	r.view = msg.View
+	r.active = true
+	r.viewTimeout = r.timeout
+	r.lastProgress = time.Now()
+	r.expected = make(map[int32][]byte)
+	for v := range r.viewChanges {
+		if v <= r.view {
+			delete(r.viewChanges, v)
+		}
+	}
+	log.Println("Entering view", r.view)
+
+	if minS.stable > r.stable {
+		if minS.stable > r.executed {
+			if r.fetching <= r.executed {
+				r.fetchState(minS.stable)
+			}
+		} else {
+			r.makeStable(minS.stable, minS.digest, minS.proofs)
+		}
+	}
+
+	// the batches that are not prepared anywhere are replaced by no-ops
+	entries := make(map[int32][]Entry)
+	for s := minS.stable + 1; s <= maxS; s++ {
+		entries[s] = []Entry{}
+		r.expected[s] = digestOf(entries[s])
+		if c, exists := chosen[s]; exists {
+			entries[s] = c.entries
+			r.expected[s] = c.digest
+		}
+	}
+
+	if r.primary(r.view) != r.Id {
+		return
+	}
+	r.seq = maxS + 1
+	if r.seq <= r.stable {
+		r.seq = r.stable + 1
+	}
+	for s := minS.stable + 1; s <= maxS; s++ {
+		pp := &MPrePrepare{
+			Replica: r.Id,
+			View:    r.view,
+			Seq:     s,
+			Entries: entries[s],
+		}
+		r.handlePrePrepare(r.broadcast(r.cs.prePrepareRPC, pp), pp)
+	}
+	r.queue = []Entry{}
+	for cmdId, p := range r.proposes {
+		r.queue = append(r.queue, Entry{
+			CmdId: cmdId,
+			Cmd:   p.Command,
+		})
+	}
+	r.proposeQueue()
+}
+
+func (r *Replica) instance(seq int32) *instance {
+	inst, exists := r.instances[seq]
+	if !exists {
+		inst = &instance{
+			view:     -1,
+			prepares: make(map[int32]*vote),
+			commits:  make(map[int32]*vote),
+			certView: -1,
+		}
+		r.instances[seq] = inst
+	}
+	return inst
+}
+
+func (r *Replica) inWindow(seq int32) bool {
+	return seq > r.stable && seq <= r.stable+r.window
+}
+
+func (r *Replica) primary(view int32) int32 {
+	return view % int32(r.N)
+}
+
+func digestOf(entries []Entry) []byte {
+	h := sha256.New()
+	for i := range entries {
+		entries[i].Marshal(h)
+	}
+	return h.Sum(nil)
+}
+
+// stateDigest is the digest of msg without its sender and proofs
+func stateDigest(msg *MState) []byte {
+	st := *msg
+	st.Replica = 0
+	st.Proofs = nil
+	h := sha256.New()
+	st.Marshal(h)
+	return h.Sum(nil)
+}
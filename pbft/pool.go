@@ -0,0 +1,207 @@
+package pbft
+
+import (
+	"sync"
+
+	"github.com/vonaka/shreplic/tools/fastrpc"
+)
+
+var mPrePreparePool = sync.Pool{
+	New: func() interface{} {
+		return new(MPrePrepare)
+	},
+}
+
+// GetMPrePrepare returns an empty MPrePrepare taken from its pool
+func GetMPrePrepare() *MPrePrepare {
+	return mPrePreparePool.Get().(*MPrePrepare)
+}
+
+// PutMPrePrepare empties m and returns it to its pool
+func PutMPrePrepare(m *MPrePrepare) {
+	*m = MPrePrepare{}
+	mPrePreparePool.Put(m)
+}
+
+func (m *MPrePrepare) Free() {
+	PutMPrePrepare(m)
+}
+
+func (m *MPrePrepare) New() fastrpc.Serializable {
+	return GetMPrePrepare()
+}
+
+var mPreparePool = sync.Pool{
+	New: func() interface{} {
+		return new(MPrepare)
+	},
+}
+
+// GetMPrepare returns an empty MPrepare taken from its pool
+func GetMPrepare() *MPrepare {
+	return mPreparePool.Get().(*MPrepare)
+}
+
+// PutMPrepare empties m and returns it to its pool
+func PutMPrepare(m *MPrepare) {
+	*m = MPrepare{}
+	mPreparePool.Put(m)
+}
+
+func (m *MPrepare) Free() {
+	PutMPrepare(m)
+}
+
+func (m *MPrepare) New() fastrpc.Serializable {
+	return GetMPrepare()
+}
+
+var mCommitPool = sync.Pool{
+	New: func() interface{} {
+		return new(MCommit)
+	},
+}
+
+// GetMCommit returns an empty MCommit taken from its pool
+func GetMCommit() *MCommit {
+	return mCommitPool.Get().(*MCommit)
+}
+
+// PutMCommit empties m and returns it to its pool
+func PutMCommit(m *MCommit) {
+	*m = MCommit{}
+	mCommitPool.Put(m)
+}
+
+func (m *MCommit) Free() {
+	PutMCommit(m)
+}
+
+func (m *MCommit) New() fastrpc.Serializable {
+	return GetMCommit()
+}
+
+var mCheckpointPool = sync.Pool{
+	New: func() interface{} {
+		return new(MCheckpoint)
+	},
+}
+
+// GetMCheckpoint returns an empty MCheckpoint taken from its pool
+func GetMCheckpoint() *MCheckpoint {
+	return mCheckpointPool.Get().(*MCheckpoint)
+}
+
+// PutMCheckpoint empties m and returns it to its pool
+func PutMCheckpoint(m *MCheckpoint) {
+	*m = MCheckpoint{}
+	mCheckpointPool.Put(m)
+}
+
+func (m *MCheckpoint) Free() {
+	PutMCheckpoint(m)
+}
+
+func (m *MCheckpoint) New() fastrpc.Serializable {
+	return GetMCheckpoint()
+}
+
+var mViewChangePool = sync.Pool{
+	New: func() interface{} {
+		return new(MViewChange)
+	},
+}
+
+// GetMViewChange returns an empty MViewChange taken from its pool
+func GetMViewChange() *MViewChange {
+	return mViewChangePool.Get().(*MViewChange)
+}
+
+// PutMViewChange empties m and returns it to its pool
+func PutMViewChange(m *MViewChange) {
+	*m = MViewChange{}
+	mViewChangePool.Put(m)
+}
+
+func (m *MViewChange) Free() {
+	PutMViewChange(m)
+}
+
+func (m *MViewChange) New() fastrpc.Serializable {
+	return GetMViewChange()
+}
+
+var mNewViewPool = sync.Pool{
+	New: func() interface{} {
+		return new(MNewView)
+	},
+}
+
+// GetMNewView returns an empty MNewView taken from its pool
+func GetMNewView() *MNewView {
+	return mNewViewPool.Get().(*MNewView)
+}
+
+// PutMNewView empties m and returns it to its pool
+func PutMNewView(m *MNewView) {
+	*m = MNewView{}
+	mNewViewPool.Put(m)
+}
+
+func (m *MNewView) Free() {
+	PutMNewView(m)
+}
+
+func (m *MNewView) New() fastrpc.Serializable {
+	return GetMNewView()
+}
+
+var mStateRequestPool = sync.Pool{
+	New: func() interface{} {
+		return new(MStateRequest)
+	},
+}
+
+// GetMStateRequest returns an empty MStateRequest taken from its pool
+func GetMStateRequest() *MStateRequest {
+	return mStateRequestPool.Get().(*MStateRequest)
+}
+
+// PutMStateRequest empties m and returns it to its pool
+func PutMStateRequest(m *MStateRequest) {
+	*m = MStateRequest{}
+	mStateRequestPool.Put(m)
+}
+
+func (m *MStateRequest) Free() {
+	PutMStateRequest(m)
+}
+
+func (m *MStateRequest) New() fastrpc.Serializable {
+	return GetMStateRequest()
+}
+
+var mStatePool = sync.Pool{
+	New: func() interface{} {
+		return new(MState)
+	},
+}
+
+// GetMState returns an empty MState taken from its pool
+func GetMState() *MState {
+	return mStatePool.Get().(*MState)
+}
+
+// PutMState empties m and returns it to its pool
+func PutMState(m *MState) {
+	*m = MState{}
+	mStatePool.Put(m)
+}
+
+func (m *MState) Free() {
+	PutMState(m)
+}
+
+func (m *MState) New() fastrpc.Serializable {
+	return GetMState()
+}
@@ -0,0 +1,71 @@
+package raft
+
+import (
+	"fmt"
+
+	"github.com/vonaka/shreplic/state"
+)
+
+// role
+const (
+	FOLLOWER = iota
+	CANDIDATE
+	LEADER
+)
+
+type CommandId struct {
+	ClientId int32
+	SeqNum   int32
+}
+
+func (cmdId CommandId) String() string {
+	return fmt.Sprintf("%v,%v", cmdId.ClientId, cmdId.SeqNum)
+}
+
+type Entry struct {
+	Term  int32
+	CmdId CommandId
+	Cmd   state.Command
+}
+
+type MRequestVote struct {
+	Replica   int32
+	Term      int32
+	LastIndex int32
+	LastTerm  int32
+}
+
+type MVote struct {
+	Replica int32
+	Term    int32
+	Granted uint8
+}
+
+type MAppendEntries struct {
+	Replica   int32
+	Term      int32
+	PrevIndex int32
+	PrevTerm  int32
+	Commit    int32
+	Entries   []Entry
+}
+
+// MAppendReply answers both MAppendEntries and MInstallSnapshot.
+// On success Index is the last index known to match the log of the
+// leader, otherwise it is the index from which the leader must retry.
+type MAppendReply struct {
+	Replica int32
+	Term    int32
+	Success uint8
+	Index   int32
+}
+
+// MInstallSnapshot carries the content of the state machine
+// once every entry up to Index has been applied
+type MInstallSnapshot struct {
+	Replica  int32
+	Term     int32
+	Index    int32
+	LastTerm int32
+	Data     []state.Command
+}
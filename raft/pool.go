@@ -0,0 +1,132 @@
+package raft
+
+import (
+	"sync"
+
+	"github.com/vonaka/shreplic/tools/fastrpc"
+)
+
+var mRequestVotePool = sync.Pool{
+	New: func() interface{} {
+		return new(MRequestVote)
+	},
+}
+
+// GetMRequestVote returns an empty MRequestVote taken from its pool
+func GetMRequestVote() *MRequestVote {
+	return mRequestVotePool.Get().(*MRequestVote)
+}
+
+// PutMRequestVote empties m and returns it to its pool
+func PutMRequestVote(m *MRequestVote) {
+	*m = MRequestVote{}
+	mRequestVotePool.Put(m)
+}
+
+func (m *MRequestVote) Free() {
+	PutMRequestVote(m)
+}
+
+func (m *MRequestVote) New() fastrpc.Serializable {
+	return GetMRequestVote()
+}
+
+var mVotePool = sync.Pool{
+	New: func() interface{} {
+		return new(MVote)
+	},
+}
+
+// GetMVote returns an empty MVote taken from its pool
+func GetMVote() *MVote {
+	return mVotePool.Get().(*MVote)
+}
+
+// PutMVote empties m and returns it to its pool
+func PutMVote(m *MVote) {
+	*m = MVote{}
+	mVotePool.Put(m)
+}
+
+func (m *MVote) Free() {
+	PutMVote(m)
+}
+
+func (m *MVote) New() fastrpc.Serializable {
+	return GetMVote()
+}
+
+var mAppendEntriesPool = sync.Pool{
+	New: func() interface{} {
+		return new(MAppendEntries)
+	},
+}
+
+// GetMAppendEntries returns an empty MAppendEntries taken from its pool
+func GetMAppendEntries() *MAppendEntries {
+	return mAppendEntriesPool.Get().(*MAppendEntries)
+}
+
+// PutMAppendEntries empties m and returns it to its pool
+func PutMAppendEntries(m *MAppendEntries) {
+	*m = MAppendEntries{}
+	mAppendEntriesPool.Put(m)
+}
+
+func (m *MAppendEntries) Free() {
+	PutMAppendEntries(m)
+}
+
+func (m *MAppendEntries) New() fastrpc.Serializable {
+	return GetMAppendEntries()
+}
+
+var mAppendReplyPool = sync.Pool{
+	New: func() interface{} {
+		return new(MAppendReply)
+	},
+}
+
+// GetMAppendReply returns an empty MAppendReply taken from its pool
+func GetMAppendReply() *MAppendReply {
+	return mAppendReplyPool.Get().(*MAppendReply)
+}
+
+// PutMAppendReply empties m and returns it to its pool
+func PutMAppendReply(m *MAppendReply) {
+	*m = MAppendReply{}
+	mAppendReplyPool.Put(m)
+}
+
+func (m *MAppendReply) Free() {
+	PutMAppendReply(m)
+}
+
+func (m *MAppendReply) New() fastrpc.Serializable {
+	return GetMAppendReply()
+}
+
+var mInstallSnapshotPool = sync.Pool{
+	New: func() interface{} {
+		return new(MInstallSnapshot)
+	},
+}
+
+// GetMInstallSnapshot returns an empty MInstallSnapshot taken from its pool
+func GetMInstallSnapshot() *MInstallSnapshot {
+	return mInstallSnapshotPool.Get().(*MInstallSnapshot)
+}
+
+// PutMInstallSnapshot empties m and returns it to its pool
+func PutMInstallSnapshot(m *MInstallSnapshot) {
+	*m = MInstallSnapshot{}
+	mInstallSnapshotPool.Put(m)
+}
+
+func (m *MInstallSnapshot) Free() {
+	PutMInstallSnapshot(m)
+}
+
+func (m *MInstallSnapshot) New() fastrpc.Serializable {
+	return GetMInstallSnapshot()
+}
@@ -0,0 +1,663 @@
+package raft
+
+import (
+	"flag"
+	"log"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/vonaka/shreplic/server/smr"
+	"github.com/vonaka/shreplic/state"
+	"github.com/vonaka/shreplic/tools/dlog"
+	"github.com/vonaka/shreplic/tools/fastrpc"
+	"github.com/vonaka/shreplic/tools/metrics"
+)
+
+// MAX_ENTRIES is the maximal number of entries carried by an MAppendEntries
+const MAX_ENTRIES = 1024
+
+type Replica struct {
+	*smr.Replica
+
+	term     int32
+	votedFor int32
+	role     int
+	leader   int32
+	votes    map[int32]struct{}
+
+	// log[0] is the last entry included in the snapshot, its index is base
+	log         []Entry
+	base        int32
+	commitIndex int32
+	lastApplied int32
+	nextIndex   []int32
+	matchIndex  []int32
+
+	proposes map[CommandId]*smr.GPropose
+	// proposed maps the last entry of each batch
+	// proposed by the leader to its proposal time
+	proposed map[int32]time.Time
+
+	heartbeat    time.Duration
+	election     time.Duration
+	deadline     time.Duration
+	lastHeard    time.Time
+	snapshotSize int32
+	tickChan     chan struct{}
+	leaderChan   chan struct{}
+
+	elections   *metrics.Counter
+	lag         *metrics.Gauge
+	lags        *metrics.Histogram
+	proposeTime *metrics.Histogram
+
+	sender smr.Sender
+	cs     CommunicationSupply
+}
+
+type CommunicationSupply struct {
+	maxLatency time.Duration
+
+	requestVoteChan     chan fastrpc.Serializable
+	voteChan            chan fastrpc.Serializable
+	appendEntriesChan   chan fastrpc.Serializable
+	appendReplyChan     chan fastrpc.Serializable
+	installSnapshotChan chan fastrpc.Serializable
+
+	requestVoteRPC     uint8
+	voteRPC            uint8
+	appendEntriesRPC   uint8
+	appendReplyRPC     uint8
+	installSnapshotRPC uint8
+}
+
+func NewReplica(rid int, addrs []string, exec, dr bool,
+	f int, args string, ps map[string]struct{}) *Replica {
+
+	fs := flag.NewFlagSet("custom Raft arguments", flag.ExitOnError)
+	heartbeat := fs.Int("heartbeat", 50, "Milliseconds between two heartbeats of the leader")
+	election := fs.Int("election", 300, "Minimal election timeout in milliseconds")
+	snapshot := fs.Int("snapshot", 100000, "Number of applied entries after which the log is compacted")
+	fs.Parse(strings.Fields(args))
+
+	r := &Replica{
+		Replica: smr.NewReplica(rid, f, addrs, false, exec, false, dr, ps),
+
+		term:     0,
+		votedFor: -1,
+		role:     FOLLOWER,
+		leader:   -1,
+		votes:    make(map[int32]struct{}),
+
+		log: []Entry{{
+			Term: 0,
+			CmdId: CommandId{
+				ClientId: -1,
+				SeqNum:   -1,
+			},
+			Cmd: state.NOOP()[0],
+		}},
+		base:        0,
+		commitIndex: 0,
+		lastApplied: 0,
+
+		proposes: make(map[CommandId]*smr.GPropose),
+		proposed: make(map[int32]time.Time),
+
+		heartbeat:    time.Duration(*heartbeat) * time.Millisecond,
+		election:     time.Duration(*election) * time.Millisecond,
+		snapshotSize: int32(*snapshot),
+		tickChan:     make(chan struct{}, 1),
+		leaderChan:   make(chan struct{}, 1),
+	}
+
+	r.nextIndex = make([]int32, r.N)
+	r.matchIndex = make([]int32, r.N)
+	r.resetElectionTimer()
+
+	r.elections = r.Metrics().Counter("shr_raft_elections_total", "Elections started by the replica")
+	r.lag = r.Metrics().Gauge("shr_execution_lag", "Committed entries not applied yet")
+	r.lags = r.Metrics().Histogram("shr_execution_lag_entries",
+		"Committed entries not applied yet, each time some are applied", metrics.CountBuckets)
+	r.proposeTime = r.Metrics().Histogram("shr_raft_proposal_seconds",
+		"Time to commit the entries proposed by the leader", metrics.DefBuckets)
+
+	r.sender = smr.NewSender(r.Replica)
+	initCs(&r.cs, r.RPC)
+
+	go r.run()
+
+	return r
+}
+
+// Messages registers in t the messages of the protocol
+func Messages(t *fastrpc.Table) {
+	initCs(new(CommunicationSupply), t)
+}
+
+func initCs(cs *CommunicationSupply, t *fastrpc.Table) {
+	cs.maxLatency = 0
+
+	cs.requestVoteChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.voteChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.appendEntriesChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.appendReplyChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.installSnapshotChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+
+	cs.requestVoteRPC = t.Register(new(MRequestVote), cs.requestVoteChan)
+	cs.voteRPC = t.Register(new(MVote), cs.voteChan)
+	cs.appendEntriesRPC = t.Register(new(MAppendEntries), cs.appendEntriesChan)
+	cs.appendReplyRPC = t.Register(new(MAppendReply), cs.appendReplyChan)
+	cs.installSnapshotRPC = t.Register(new(MInstallSnapshot), cs.installSnapshotChan)
+}
+
+// BeTheLeader makes the replica start an election. The master
+// considers it as the leader, which is true unless the election
+// is lost, in which case clients are told to contact someone else.
+func (r *Replica) BeTheLeader(args *smr.BeTheLeaderArgs, reply *smr.BeTheLeaderReply) error {
+	r.leaderChan <- struct{}{}
+	reply.Leader = r.Id
+	if reply.Leader == 0 {
+		// see smr.BeTheLeaderReply
+		reply.Leader = smr.ZERO_ID
+	}
+	return nil
+}
+
+func (r *Replica) run() {
+	r.ConnectToPeers()
+	latencies := r.ComputeClosestPeers()
+	for _, l := range latencies {
+		d := time.Duration(l*1000*1000) * time.Nanosecond
+		if d > r.cs.maxLatency {
+			r.cs.maxLatency = d
+		}
+	}
+
+	go r.WaitForClientConnections()
+	r.lastHeard = time.Now()
+	go r.clock()
+
+	for !r.Shutdown {
+		select {
+		case propose := <-r.ProposeChan:
+			r.handlePropose(propose)
+
+		case m := <-r.cs.requestVoteChan:
+			rv := m.(*MRequestVote)
+			r.handleRequestVote(rv)
+
+		case m := <-r.cs.voteChan:
+			vote := m.(*MVote)
+			r.handleVote(vote)
+
+		case m := <-r.cs.appendEntriesChan:
+			ae := m.(*MAppendEntries)
+			r.handleAppendEntries(ae)
+			ae.Free()
+
+		case m := <-r.cs.appendReplyChan:
+			rep := m.(*MAppendReply)
+			r.handleAppendReply(rep)
+			rep.Free()
+
+		case m := <-r.cs.installSnapshotChan:
+			is := m.(*MInstallSnapshot)
+			r.handleInstallSnapshot(is)
+
+		case <-r.tickChan:
+			if r.role == LEADER {
+				for i := int32(0); i < int32(r.N); i++ {
+					if i != r.Id {
+						r.sendAppend(i)
+					}
+				}
+			} else if time.Since(r.lastHeard) >= r.deadline {
+				r.startElection()
+			}
+
+		case <-r.leaderChan:
+			if r.role != LEADER {
+				r.startElection()
+			}
+		}
+
+		r.lag.Set(float64(r.commitIndex - r.lastApplied))
+	}
+}
+
+func (r *Replica) clock() {
+	for !r.Shutdown {
+		time.Sleep(r.heartbeat)
+		r.tickChan <- struct{}{}
+	}
+}
+
+func (r *Replica) handlePropose(propose *smr.GPropose) {
+	if r.role != LEADER {
+		dlog.Printf("Not the leader, cannot propose %v\n", propose.CommandId)
+		preply := &smr.ProposeReplyTS{
+			OK:        smr.FALSE,
+			CommandId: -1,
+			Value:     state.NIL(),
+			Timestamp: 0,
+		}
+		r.ReplyProposeTS(preply, propose.Reply, propose.Mutex)
+		return
+	}
+
+	batchSize := len(r.ProposeChan) + 1
+	for i := 0; i < batchSize; i++ {
+		if i > 0 {
+			propose = <-r.ProposeChan
+		}
+		cmdId := CommandId{
+			ClientId: propose.ClientId,
+			SeqNum:   propose.CommandId,
+		}
+		r.proposes[cmdId] = propose
+		r.log = append(r.log, Entry{
+			Term:  r.term,
+			CmdId: cmdId,
+			Cmd:   propose.Command,
+		})
+	}
+	r.matchIndex[r.Id] = r.lastIndex()
+	r.proposed[r.lastIndex()] = time.Now()
+
+	for i := int32(0); i < int32(r.N); i++ {
+		if i != r.Id {
+			r.sendAppend(i)
+		}
+	}
+	r.advanceCommit()
+}
+
+func (r *Replica) startElection() {
+	r.elections.Inc()
+	r.term++
+	r.role = CANDIDATE
+	r.votedFor = r.Id
+	r.leader = -1
+	r.votes = map[int32]struct{}{
+		r.Id: {},
+	}
+	r.resetElectionTimer()
+	log.Println("Starting election for term", r.term)
+
+	r.sender.SendToAll(&MRequestVote{
+		Replica:   r.Id,
+		Term:      r.term,
+		LastIndex: r.lastIndex(),
+		LastTerm:  r.termAt(r.lastIndex()),
+	}, r.cs.requestVoteRPC)
+
+	if len(r.votes) >= r.N/2+1 {
+		r.becomeLeader()
+	}
+}
+
+func (r *Replica) handleRequestVote(msg *MRequestVote) {
+	if msg.Term > r.term {
+		r.stepDown(msg.Term)
+	}
+
+	lastIndex := r.lastIndex()
+	lastTerm := r.termAt(lastIndex)
+	upToDate := msg.LastTerm > lastTerm ||
+		(msg.LastTerm == lastTerm && msg.LastIndex >= lastIndex)
+
+	vote := &MVote{
+		Replica: r.Id,
+		Term:    r.term,
+		Granted: smr.FALSE,
+	}
+	if msg.Term == r.term && upToDate &&
+		(r.votedFor == -1 || r.votedFor == msg.Replica) {
+		r.votedFor = msg.Replica
+		r.resetElectionTimer()
+		vote.Granted = smr.TRUE
+	}
+	r.sender.SendTo(msg.Replica, vote, r.cs.voteRPC)
+}
+
+func (r *Replica) handleVote(msg *MVote) {
+	if msg.Term > r.term {
+		r.stepDown(msg.Term)
+		return
+	}
+	if r.role != CANDIDATE || msg.Term != r.term || msg.Granted != smr.TRUE {
+		return
+	}
+
+	r.votes[msg.Replica] = struct{}{}
+	if len(r.votes) >= r.N/2+1 {
+		r.becomeLeader()
+	}
+}
+
+func (r *Replica) becomeLeader() {
+	r.role = LEADER
+	r.leader = r.Id
+	log.Println("I am the leader of term", r.term)
+
+	// entries of the previous terms are committed
+	// together with the first entry of this term
+	r.log = append(r.log, Entry{
+		Term: r.term,
+		CmdId: CommandId{
+			ClientId: -1,
+			SeqNum:   -1,
+		},
+		Cmd: state.NOOP()[0],
+	})
+	for i := range r.nextIndex {
+		r.nextIndex[i] = r.lastIndex()
+		r.matchIndex[i] = 0
+	}
+	r.matchIndex[r.Id] = r.lastIndex()
+
+	for i := int32(0); i < int32(r.N); i++ {
+		if i != r.Id {
+			r.sendAppend(i)
+		}
+	}
+	r.advanceCommit()
+}
+
+// sendAppend sends to the follower i the entries it is missing.
+// nextIndex is advanced optimistically, so that entries are pipelined.
+func (r *Replica) sendAppend(i int32) {
+	prev := r.nextIndex[i] - 1
+	if prev < r.base {
+		r.sendSnapshot(i)
+		return
+	}
+
+	last := r.lastIndex()
+	if last-prev > MAX_ENTRIES {
+		last = prev + MAX_ENTRIES
+	}
+	entries := make([]Entry, last-prev)
+	copy(entries, r.log[prev+1-r.base:last+1-r.base])
+
+	r.sender.SendTo(i, &MAppendEntries{
+		Replica:   r.Id,
+		Term:      r.term,
+		PrevIndex: prev,
+		PrevTerm:  r.termAt(prev),
+		Commit:    r.commitIndex,
+		Entries:   entries,
+	}, r.cs.appendEntriesRPC)
+	r.nextIndex[i] = last + 1
+}
+
+func (r *Replica) sendSnapshot(i int32) {
+	data := make([]state.Command, 0)
+	err := r.State.Range(r.State.Version(), func(k state.Key, v state.Value) bool {
+		data = append(data, state.Command{
+			Op: state.PUT,
+			K:  k,
+			V:  v,
+		})
+		return true
+	})
+	if err != nil {
+		log.Println("Cannot take a snapshot:", err)
+		return
+	}
+
+	r.sender.SendTo(i, &MInstallSnapshot{
+		Replica:  r.Id,
+		Term:     r.term,
+		Index:    r.lastApplied,
+		LastTerm: r.termAt(r.lastApplied),
+		Data:     data,
+	}, r.cs.installSnapshotRPC)
+	r.nextIndex[i] = r.lastApplied + 1
+}
+
+func (r *Replica) handleAppendEntries(msg *MAppendEntries) {
+	reply := GetMAppendReply()
+	reply.Replica = r.Id
+	reply.Term = r.term
+	reply.Success = smr.FALSE
+	if msg.Term < r.term {
+		r.sender.SendToAndFree(msg.Replica, reply, r.cs.appendReplyRPC, nil)
+		return
+	}
+	if msg.Term > r.term || r.role != FOLLOWER {
+		r.stepDown(msg.Term)
+	}
+	r.leader = msg.Replica
+	r.resetElectionTimer()
+	reply.Term = r.term
+
+	// entries that are already in the snapshot are committed
+	prev, prevTerm, entries := msg.PrevIndex, msg.PrevTerm, msg.Entries
+	if prev < r.base {
+		skip := r.base - prev
+		if skip > int32(len(entries)) {
+			skip = int32(len(entries))
+		}
+		entries = entries[skip:]
+		prev = r.base
+		prevTerm = r.termAt(r.base)
+	}
+
+	if prev > r.lastIndex() {
+		reply.Index = r.lastIndex() + 1
+		r.sender.SendToAndFree(msg.Replica, reply, r.cs.appendReplyRPC, nil)
+		return
+	}
+	if t := r.termAt(prev); t != prevTerm {
+		// skip the whole conflicting term
+		i := prev
+		for i > r.base+1 && r.termAt(i-1) == t {
+			i--
+		}
+		if i <= r.commitIndex {
+			i = r.commitIndex + 1
+		}
+		reply.Index = i
+		r.sender.SendToAndFree(msg.Replica, reply, r.cs.appendReplyRPC, nil)
+		return
+	}
+
+	for j, e := range entries {
+		i := prev + 1 + int32(j)
+		if i <= r.lastIndex() {
+			if r.termAt(i) == e.Term {
+				continue
+			}
+			r.log = r.log[:i-r.base]
+		}
+		r.log = append(r.log, e)
+	}
+
+	// only the entries known to match the leader can be committed,
+	// and commitIndex never decreases
+	match := prev + int32(len(entries))
+	commit := msg.Commit
+	if commit > match {
+		commit = match
+	}
+	if commit > r.commitIndex {
+		r.commitIndex = commit
+	}
+	reply.Success = smr.TRUE
+	reply.Index = match
+	r.sender.SendToAndFree(msg.Replica, reply, r.cs.appendReplyRPC, nil)
+	r.apply()
+}
+
+func (r *Replica) handleAppendReply(msg *MAppendReply) {
+	if msg.Term > r.term {
+		r.stepDown(msg.Term)
+		return
+	}
+	if r.role != LEADER || msg.Term != r.term {
+		return
+	}
+
+	if msg.Success == smr.TRUE {
+		if msg.Index > r.matchIndex[msg.Replica] {
+			r.matchIndex[msg.Replica] = msg.Index
+		}
+		if msg.Index+1 > r.nextIndex[msg.Replica] {
+			r.nextIndex[msg.Replica] = msg.Index + 1
+		}
+		r.advanceCommit()
+		return
+	}
+
+	if msg.Index <= r.matchIndex[msg.Replica] {
+		// a reordered reply
+		return
+	}
+	r.nextIndex[msg.Replica] = msg.Index
+	r.sendAppend(msg.Replica)
+}
+
+func (r *Replica) handleInstallSnapshot(msg *MInstallSnapshot) {
+	reply := &MAppendReply{
+		Replica: r.Id,
+		Term:    r.term,
+		Success: smr.FALSE,
+		Index:   0,
+	}
+	if msg.Term < r.term {
+		r.sender.SendTo(msg.Replica, reply, r.cs.appendReplyRPC)
+		return
+	}
+	if msg.Term > r.term || r.role != FOLLOWER {
+		r.stepDown(msg.Term)
+	}
+	r.leader = msg.Replica
+	r.resetElectionTimer()
+	reply.Term = r.term
+	reply.Success = smr.TRUE
+
+	if msg.Index <= r.commitIndex {
+		reply.Index = r.commitIndex
+		r.sender.SendTo(msg.Replica, reply, r.cs.appendReplyRPC)
+		return
+	}
+
+	// the entry i of the log is executed at the position i-1
+	r.State.Install(state.Version(msg.Index-1), msg.Data)
+	if msg.Index <= r.lastIndex() && r.termAt(msg.Index) == msg.LastTerm {
+		r.log = r.log[msg.Index-r.base:]
+	} else {
+		r.log = []Entry{{
+			Term: msg.LastTerm,
+			CmdId: CommandId{
+				ClientId: -1,
+				SeqNum:   -1,
+			},
+			Cmd: state.NOOP()[0],
+		}}
+	}
+	r.base = msg.Index
+	r.commitIndex = msg.Index
+	r.lastApplied = msg.Index
+
+	reply.Index = msg.Index
+	r.sender.SendTo(msg.Replica, reply, r.cs.appendReplyRPC)
+}
+
+// advanceCommit commits the entries of the current
+// term that are replicated at a majority of replicas
+func (r *Replica) advanceCommit() {
+	for n := r.lastIndex(); n > r.commitIndex && r.termAt(n) == r.term; n-- {
+		count := 0
+		for _, m := range r.matchIndex {
+			if m >= n {
+				count++
+			}
+		}
+		if count >= r.N/2+1 {
+			r.commitIndex = n
+			break
+		}
+	}
+	for i, t := range r.proposed {
+		if i <= r.commitIndex {
+			r.proposeTime.Observe(time.Since(t).Seconds())
+			delete(r.proposed, i)
+		}
+	}
+	r.apply()
+}
+
+func (r *Replica) apply() {
+	if r.lastApplied < r.commitIndex {
+		r.lags.Observe(float64(r.commitIndex - r.lastApplied))
+	}
+	for r.lastApplied < r.commitIndex {
+		r.lastApplied++
+		e := &r.log[r.lastApplied-r.base]
+
+		v := state.NIL()
+		if r.Exec {
+			dlog.Printf("Executing " + e.Cmd.String())
+			v = e.Cmd.Execute(r.State)
+		}
+		if p, exists := r.proposes[e.CmdId]; exists {
+			if !r.Dreply {
+				v = state.NIL()
+			}
+			rep := &smr.ProposeReplyTS{
+				OK:        smr.TRUE,
+				CommandId: p.CommandId,
+				Value:     v,
+				Timestamp: p.Timestamp,
+			}
+			r.ReplyProposeTS(rep, p.Reply, p.Mutex)
+			delete(r.proposes, e.CmdId)
+		}
+	}
+
+	if r.lastApplied-r.base >= r.snapshotSize {
+		r.log = r.log[r.lastApplied-r.base:]
+		r.base = r.lastApplied
+	}
+}
+
+func (r *Replica) stepDown(term int32) {
+	if term > r.term {
+		r.term = term
+		r.votedFor = -1
+	}
+	r.role = FOLLOWER
+	r.proposed = make(map[int32]time.Time)
+
+	// the new leader might overwrite their entries,
+	// their clients are told that they have failed
+	for cmdId, p := range r.proposes {
+		r.ReplyProposeTS(&smr.ProposeReplyTS{
+			OK:        smr.FALSE,
+			CommandId: p.CommandId,
+			Value:     state.NIL(),
+			Timestamp: p.Timestamp,
+		}, p.Reply, p.Mutex)
+		delete(r.proposes, cmdId)
+	}
+}
+
+func (r *Replica) resetElectionTimer() {
+	r.lastHeard = time.Now()
+	r.deadline = r.election + time.Duration(rand.Int63n(int64(r.election)))
+}
+
+func (r *Replica) lastIndex() int32 {
+	return r.base + int32(len(r.log)) - 1
+}
+
+func (r *Replica) termAt(i int32) int32 {
+	if i < r.base || i > r.lastIndex() {
+		return -1
+	}
+	return r.log[i-r.base].Term
+}
@@ -5,26 +5,43 @@ import (
 	"flag"
 	"fmt"
 	"log"
-	"net"
 	"net/http"
 	"net/rpc"
 	"os"
 	"os/signal"
 	"runtime/pprof"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/vonaka/shreplic/atlas"
+	"github.com/vonaka/shreplic/chain"
 	"github.com/vonaka/shreplic/curp"
 	"github.com/vonaka/shreplic/epaxos"
+	"github.com/vonaka/shreplic/fastpaxos"
+	"github.com/vonaka/shreplic/hermes"
 	"github.com/vonaka/shreplic/master/defs"
+	"github.com/vonaka/shreplic/mencius"
 	"github.com/vonaka/shreplic/n2paxos"
 	"github.com/vonaka/shreplic/paxoi"
 	"github.com/vonaka/shreplic/paxos"
+	"github.com/vonaka/shreplic/pbft"
+	"github.com/vonaka/shreplic/raft"
+	"github.com/vonaka/shreplic/server/smr"
+	"github.com/vonaka/shreplic/state"
+	"github.com/vonaka/shreplic/tempo"
+	"github.com/vonaka/shreplic/tools/metrics"
+	"github.com/vonaka/shreplic/tools/mtls"
+	"github.com/vonaka/shreplic/tools/trace"
+	"github.com/vonaka/shreplic/tools/transport"
 	"github.com/vonaka/shreplic/unistore"
+	"github.com/vonaka/shreplic/vr"
 )
 
 var (
 	portnum     = flag.Int("port", 7070, "Port # to listen on")
+	groups      = flag.String("groups", "0", "Comma-separated list of the groups served by this process (the i-th one listens on port+i)")
 	masterAddr  = flag.String("maddr", "", "Master address")
 	masterPort  = flag.Int("mport", 7087, "Master port")
 	myAddr      = flag.String("addr", "", "Server address (this machine)")
@@ -33,7 +50,16 @@ var (
 	doN2paxos   = flag.Bool("n2paxos", false, "Use n²Paxos as the replication protocol")
 	doCurp      = flag.Bool("curp", false, "Use CURP as the replication protocol")
 	doOptCurp   = flag.Bool("curpOpt", false, "Use optimized CURP as the replication protocol")
-	doUnistore = flag.Bool("unistore", false, "Use unistore as the replication protocol")
+	doUnistore  = flag.Bool("unistore", false, "Use unistore as the replication protocol")
+	doRaft      = flag.Bool("raft", false, "Use Raft as the replication protocol")
+	doMencius   = flag.Bool("mencius", false, "Use Mencius as the replication protocol")
+	doFastpaxos = flag.Bool("fastpaxos", false, "Use Fast Paxos as the replication protocol")
+	doAtlas     = flag.Bool("atlas", false, "Use Atlas as the replication protocol")
+	doTempo     = flag.Bool("tempo", false, "Use Tempo as the replication protocol")
+	doChain     = flag.Bool("chain", false, "Use chain replication as the replication protocol")
+	doVR        = flag.Bool("vr", false, "Use Viewstamped Replication as the replication protocol")
+	doPBFT      = flag.Bool("pbft", false, "Use PBFT as the replication protocol")
+	doHermes    = flag.Bool("hermes", false, "Use Hermes as the replication protocol")
 	cpuprofile  = flag.String("cpuprofile", "", "Cpu profile")
 	thrifty     = flag.Bool("thrifty", false, "Use only as many messages as strictly required")
 	exec        = flag.Bool("exec", true, "Execute commands")
@@ -45,17 +71,34 @@ var (
 	durable     = flag.Bool("durable", false, "Log to a stable store")
 	batchWait   = flag.Int("batchwait", 0, "Milliseconds to wait before sending a batch")
 	tConf       = flag.Bool("tconf", true, "Conflict relation is transitive")
+	conflict    = flag.String("conflict", state.DEFAULT_CONFLICT, "Conflict relation (key, range, rw, all or user-defined)")
 	proxy       = flag.String("proxy", "", "File with the list of clients IPs for this server")
 	qfile       = flag.String("qfile", "", "Quorum config file")
+	fquorums    = flag.String("fquorums", "", "Flexible Paxos quorums: \"<q1>,<q2>\", \"grid:<rows>x<cols>\" or \"qfile\"")
+	lease       = flag.Int("lease", 0, "Milliseconds of the leader lease, 0 disables local reads at the leader (only for Paxos and n²Paxos)")
+	drift       = flag.Int("drift", 10, "Bound on the clock drift in milliseconds over a leader lease")
 	descNum     = flag.Int("desc", 100, "Number of command descriptors (only for Paxoi and n²Paxos)")
 	poolLevel   = flag.Int("pool", 1, "Level of pool usage from 0 to 2 (only for Paxoi and n²Paxos)")
 	AQreconf    = flag.Bool("AQreconf", true, "Automatically reconfigure Paxoi's slow active quorum")
 	args        = flag.String("args", "", "Custom arguments")
+	certFile    = flag.String("cert", "", "Certificate of the replicas served by this process (enables TLS)")
+	keyFile     = flag.String("key", "", "Private key of the certificate")
+	caFile      = flag.String("ca", "", "Certificate of the CA that signs the certificates of all nodes")
+	traceFile   = flag.String("trace", "", "File to export the spans of the commands to (OpenTelemetry JSON)")
+	captureDir  = flag.String("capture", "", "Directory to record the messages of each link in (see shr-dump)")
+	netemFile   = flag.String("netem", "", "File of the delays between replicas to emulate (see README)")
+	coalesce    = flag.Int("coalesce", 0, "Time in microseconds the writes to the peers may wait to be flushed together (0 flushes each message)")
+	compress    = flag.Int("compress", 0, "Size in bytes from which the messages to the peers are compressed (0 disables compression)")
+	transp      = flag.String("transport", "tcp", "Transport of the links with the peers and the clients: tcp, udp, unix or unix:<dir>")
 )
 
 func main() {
 	flag.Parse()
 
+	if err := state.SetConflictRelation(*conflict); err != nil {
+		log.Fatalf("%v: %s (available: %v)", err, *conflict, state.ConflictRelations())
+	}
+
 	ps := make(map[string]struct{})
 	if *proxy != "" {
 		f, err := os.Open(*proxy)
@@ -81,79 +124,168 @@ func main() {
 		go catchKill(interrupt)
 	}
 
-	log.Printf("Server starting on port %d", *portnum)
+	gs, err := parseGroups(*groups)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	smr.TLS, err = mtls.Load(*certFile, *keyFile, *caFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	smr.Transport, err = transport.Get(*transp)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	smr.Traces, err = trace.Open(*traceFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	smr.Capture = *captureDir
+	smr.Netem = *netemFile
+	smr.Coalesce = time.Duration(*coalesce) * time.Microsecond
+	smr.Compress = *compress
+
+	paxoi.MaxDescRoutines = *descNum
+	n2paxos.MaxDescRoutines = *descNum
+	curp.MaxDescRoutines = *descNum
+
+	for i, g := range gs {
+		go startGroup(g, *portnum+i, ps)
+	}
+
+	select {}
+}
+
+// replica is implemented by the replicas of every protocol
+type replica interface {
+	Metrics() *metrics.Registry
+}
+
+// startGroup runs the replica of group g that listens on port,
+// and on port+1000 for RPCs from the master
+func startGroup(g, port int, ps map[string]struct{}) {
+	log.Printf("Server of group %d starting on port %d", g, port)
 	fullAddr := fmt.Sprintf("%s:%d", *masterAddr, *masterPort)
-	replicaId, nodeList, isLeader, err := registerWithMaster(fullAddr, 10, 100)
+	replicaId, nodeList, isLeader, err := registerWithMaster(fullAddr, g, port, 10, 100)
 	if err != nil {
 		log.Fatal("Couldn't connect to master, aborting")
 		return
 	}
 
-	if *maxfailures == -1 {
-		*maxfailures = (len(nodeList) - 1) / 2
+	f := *maxfailures
+	if f == -1 {
+		f = (len(nodeList) - 1) / 2
+		if *doPBFT {
+			f = (len(nodeList) - 1) / 3
+		}
 	}
-	log.Printf("Tolerating %d max. failures", *maxfailures)
+	log.Printf("Tolerating %d max. failures", f)
+	smr.SetGroup(nodeList[replicaId], g)
 
+	var rep replica
 	if *doEpaxos {
 		log.Println("Starting Egalitarian Paxos replica...")
-		rep := epaxos.NewReplica(replicaId, nodeList, *thrifty, *exec, *lread,
-			*dreply, *beacon, *durable, *batchWait, *tConf, *maxfailures, ps)
-		rpc.Register(rep)
+		rep = epaxos.NewReplica(replicaId, nodeList, *thrifty, *exec, *lread,
+			*dreply, *beacon, *durable, *batchWait, *tConf, f, ps)
 	} else if *doUnistore {
 		log.Println("Starting Unistore replica...")
-		rep := unistore.NewReplica(replicaId, nodeList, *maxfailures, *exec, *dreply, *args, ps)
-		rpc.Register(rep)
+		rep = unistore.NewReplica(replicaId, nodeList, f, *exec, *dreply, *args, ps)
+	} else if *doRaft {
+		log.Println("Starting Raft replica...")
+		rep = raft.NewReplica(replicaId, nodeList, *exec, *dreply, f, *args, ps)
+	} else if *doMencius {
+		log.Println("Starting Mencius replica...")
+		rep = mencius.NewReplica(replicaId, nodeList, *exec, *dreply, f, *args, ps)
+	} else if *doFastpaxos {
+		log.Println("Starting Fast Paxos replica...")
+		rep = fastpaxos.NewReplica(replicaId, nodeList, *exec, *dreply, f, *args, ps)
+	} else if *doAtlas {
+		log.Println("Starting Atlas replica...")
+		rep = atlas.NewReplica(replicaId, nodeList, *exec, *dreply, f, *args, ps)
+	} else if *doTempo {
+		log.Println("Starting Tempo replica...")
+		rep = tempo.NewReplica(replicaId, nodeList, *exec, *dreply, f, *args, ps)
+	} else if *doChain {
+		log.Println("Starting chain replication replica...")
+		rep = chain.NewReplica(replicaId, nodeList, *exec, *dreply, f, *qfile, *args, ps)
+	} else if *doVR {
+		log.Println("Starting VR replica...")
+		rep = vr.NewReplica(replicaId, nodeList, *exec, *dreply, f, *args, ps)
+	} else if *doPBFT {
+		log.Println("Starting PBFT replica...")
+		rep = pbft.NewReplica(replicaId, nodeList, *exec, *dreply, f, *args, ps)
+	} else if *doHermes {
+		log.Println("Starting Hermes replica...")
+		rep = hermes.NewReplica(replicaId, nodeList, *exec, *dreply, f, *args, ps)
 	} else if *doPaxoi {
 		log.Println("Starting Paxoi replica...")
-		paxoi.MaxDescRoutines = *descNum
-		rep := paxoi.NewReplica(replicaId, nodeList, *exec, *lread,
-			*dreply, *optExec, *AQreconf, *poolLevel, *maxfailures, *qfile, ps)
-		rpc.Register(rep)
+		rep = paxoi.NewReplica(replicaId, nodeList, *exec, *lread,
+			*dreply, *optExec, *AQreconf, *poolLevel, f, *qfile, ps)
 	} else if *doN2paxos {
 		log.Println("Starting n²Paxos replica...")
-		n2paxos.MaxDescRoutines = *descNum
-		rep := n2paxos.NewReplica(replicaId, nodeList, *exec,
-			*dreply, *optExec, *poolLevel, *maxfailures, *qfile, ps)
-		rpc.Register(rep)
+		rep = n2paxos.NewReplica(replicaId, nodeList, *exec,
+			*dreply, *optExec, *poolLevel, f, *qfile, *fquorums, *lease, *drift, ps)
 	} else if *doCurp {
 		log.Println("Starting CURP replica...")
-		curp.MaxDescRoutines = *descNum
-		rep := curp.NewReplica(replicaId, nodeList, *exec,
-			*dreply, *poolLevel, *maxfailures, *qfile, false, ps)
-		rpc.Register(rep)
+		rep = curp.NewReplica(replicaId, nodeList, *exec,
+			*dreply, *poolLevel, f, *qfile, false, ps)
 	} else if *doOptCurp {
 		log.Println("Starting optimized CURP replica...")
-		curp.MaxDescRoutines = *descNum
-		rep := curp.NewReplica(replicaId, nodeList, *exec,
-			*dreply, *poolLevel, *maxfailures, *qfile, true, ps)
-		rpc.Register(rep)
+		rep = curp.NewReplica(replicaId, nodeList, *exec,
+			*dreply, *poolLevel, f, *qfile, true, ps)
 	} else {
 		log.Println("Starting Paxos replica...")
-		rep := paxos.NewReplica(replicaId, nodeList, isLeader, *thrifty, *exec,
-			*lread, *dreply, *durable, *batchWait, *maxfailures, ps)
-		rpc.Register(rep)
+		rep = paxos.NewReplica(replicaId, nodeList, isLeader, *thrifty, *exec,
+			*lread, *dreply, *durable, *batchWait, f, *qfile, *fquorums, *lease, *drift, ps)
 	}
 
-	rpc.HandleHTTP()
-	l, err := net.Listen("tcp", fmt.Sprintf(":%d", *portnum+1000))
+	// replicas of different groups might share the process,
+	// hence, each of them has its own RPC server, whose
+	// calls (leader election, shard map, ...) only the master makes
+	srv := rpc.NewServer()
+	srv.Register(rep)
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath, smr.TLS.Only(srv, mtls.MASTER))
+	mux.Handle("/metrics", rep.Metrics())
+
+	l, err := smr.TLS.Listen(transport.TCP, fmt.Sprintf(":%d", port+1000))
 	if err != nil {
 		log.Fatal("listen error:", err)
 	}
 
-	http.Serve(l, nil)
+	http.Serve(l, mux)
 }
 
-func registerWithMaster(masterAddr string, retries int, backoff_ms int) (replicaId int, nodeList []string, isLeader bool, exit_err error) {
+func parseGroups(s string) ([]int, error) {
+	gs := []int{}
+	for _, g := range strings.Split(s, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(g))
+		if err != nil {
+			return nil, err
+		}
+		gs = append(gs, id)
+	}
+	return gs, nil
+}
+
+func registerWithMaster(masterAddr string, group, port, retries int, backoff_ms int) (replicaId int, nodeList []string, isLeader bool, exit_err error) {
 	var reply defs.RegisterReply
 	args := &defs.RegisterArgs{
-		Addr: *myAddr,
-		Port: *portnum,
+		Addr:  *myAddr,
+		Port:  port,
+		Group: group,
 	}
 	log.Printf("connecting to: %v", masterAddr)
 
 	current_retry := 0
 	for {
-		mcli, err := rpc.DialHTTP("tcp", masterAddr)
+		mcli, err := smr.TLS.DialHTTP(masterAddr, mtls.MASTER)
+		if err == nil {
+			args.Rtt, err = masterRtt(mcli)
+		}
 		if err == nil {
 			for {
 				// TODO: This is an active wait, not cool.
@@ -183,6 +315,20 @@ func registerWithMaster(masterAddr string, retries int, backoff_ms int) (replica
 	}
 }
 
+// masterRtt returns the mean round-trip time
+// to the master of mcli in milliseconds
+func masterRtt(mcli *rpc.Client) (float64, error) {
+	const pings = 3
+	start := time.Now()
+	for i := 0; i < pings; i++ {
+		err := mcli.Call("Master.Ping", new(smr.PingArgs), new(smr.PingReply))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return float64(time.Since(start)) / float64(pings*time.Millisecond), nil
+}
+
 func catchKill(interrupt chan os.Signal) {
 	<-interrupt
 	if *cpuprofile != "" {
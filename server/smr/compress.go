@@ -0,0 +1,71 @@
+package smr
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// MAX_COMPRESSED_SIZE bounds the size of a compressed
+// message, both before and after decompression
+const MAX_COMPRESSED_SIZE = 1 << 28
+
+var TOO_LARGE = errors.New("Compressed message is too large")
+
+// compressor compresses the large messages sent by a Sender.
+// A compressed message is sent as
+//
+//	COMPRESSED | code uint8 | size uint32 | deflate(message)
+//
+// where size, in little endian, is the size of the deflated message.
+type compressor struct {
+	buf bytes.Buffer
+	fw  *flate.Writer
+}
+
+// compress returns the compressed form of payload, the marshaled
+// message code, without the leading COMPRESSED code
+func (c *compressor) compress(code uint8, payload []byte) []byte {
+	c.buf.Reset()
+	c.buf.Write([]byte{code, 0, 0, 0, 0})
+	if c.fw == nil {
+		c.fw, _ = flate.NewWriter(&c.buf, flate.BestSpeed)
+	} else {
+		c.fw.Reset(&c.buf)
+	}
+	c.fw.Write(payload)
+	c.fw.Close()
+	b := c.buf.Bytes()
+	binary.LittleEndian.PutUint32(b[1:], uint32(len(b)-5))
+	return b
+}
+
+// uncompress reads a compressed message from r
+// and returns its code and its marshaled form
+func uncompress(r io.Reader) (uint8, []byte, error) {
+	var b [5]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.LittleEndian.Uint32(b[1:])
+	if size > MAX_COMPRESSED_SIZE {
+		return 0, nil, TOO_LARGE
+	}
+	z := make([]byte, size)
+	if _, err := io.ReadFull(r, z); err != nil {
+		return 0, nil, err
+	}
+	fr := flate.NewReader(bytes.NewReader(z))
+	defer fr.Close()
+	payload, err := ioutil.ReadAll(io.LimitReader(fr, MAX_COMPRESSED_SIZE+1))
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(payload) > MAX_COMPRESSED_SIZE {
+		return 0, nil, TOO_LARGE
+	}
+	return b[0], payload, nil
+}
@@ -0,0 +1,98 @@
+package smr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/vonaka/shreplic/tools/fastrpc"
+)
+
+// blob is a message made of raw bytes
+type blob []byte
+
+func (m *blob) New() fastrpc.Serializable {
+	return new(blob)
+}
+
+func (m *blob) Marshal(w io.Writer) {
+	w.Write(*m)
+}
+
+func (m *blob) Unmarshal(r io.Reader) error {
+	return nil
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	var z compressor
+	for i, payload := range [][]byte{
+		{},
+		[]byte("a"),
+		bytes.Repeat([]byte("abcd"), 10000),
+		[]byte("the compressor is reused"),
+	} {
+		frame := z.compress(uint8(i), payload)
+		r := bytes.NewReader(append(frame, 0xff))
+		code, got, err := uncompress(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != uint8(i) || !bytes.Equal(got, payload) {
+			t.Fatalf("got %d %q, want %d %q", code, got, i, payload)
+		}
+		// a frame is read up to its end, not beyond
+		if r.Len() != 1 {
+			t.Fatalf("%d bytes left after the frame, want 1", r.Len())
+		}
+	}
+}
+
+func TestUncompressMalformed(t *testing.T) {
+	var z compressor
+	frame := z.compress(7, bytes.Repeat([]byte("abcd"), 1000))
+	for n := 0; n < len(frame); n++ {
+		if _, _, err := uncompress(bytes.NewReader(frame[:n])); err == nil {
+			t.Fatalf("%d of %d bytes uncompressed", n, len(frame))
+		}
+	}
+
+	var b [5]byte
+	binary.LittleEndian.PutUint32(b[1:], MAX_COMPRESSED_SIZE+1)
+	if _, _, err := uncompress(bytes.NewReader(b[:])); err != TOO_LARGE {
+		t.Fatalf("got %v, want %v", err, TOO_LARGE)
+	}
+
+	bad := append([]byte{7, 4, 0, 0, 0}, 0xff, 0xff, 0xff, 0xff)
+	if _, _, err := uncompress(bytes.NewReader(bad)); err == nil {
+		t.Fatal("invalid deflate stream uncompressed")
+	}
+}
+
+func TestBatchCompress(t *testing.T) {
+	defer func(c int) {
+		Compress = c
+	}(Compress)
+	Compress = 100
+
+	b := &batch{}
+	small := blob("small")
+	b.marshal(&small, 3)
+	if b.code != 3 || !bytes.Equal(b.data, append([]byte{3}, small...)) {
+		t.Fatalf("small message sent as %d %q", b.code, b.data)
+	}
+
+	large := blob(bytes.Repeat([]byte("x"), 1000))
+	b.marshal(&large, 3)
+	if b.code != COMPRESSED || len(b.data) >= len(large) {
+		t.Fatalf("large message sent as %d of %d bytes", b.code, len(b.data))
+	}
+	code, payload, err := uncompress(bytes.NewReader(b.data))
+	if err != nil || code != 3 || !bytes.Equal(payload, large) {
+		t.Fatalf("got %d %d bytes (%v)", code, len(payload), err)
+	}
+	// the payload is what captures record
+	if !bytes.Equal(b.payload, large) {
+		t.Fatal("payload differs from the marshaled message")
+	}
+}
@@ -0,0 +1,101 @@
+package smr
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vonaka/shreplic/state"
+)
+
+// LOCAL_TIMEOUT is the time ProposeCommand waits for the reply
+const LOCAL_TIMEOUT = 5 * time.Second
+
+var (
+	OVERLOADED = errors.New("Too many proposals are waiting")
+	NO_REPLY   = errors.New("Command was not answered in time")
+)
+
+type ProposeCommandArgs struct {
+	Command state.Command
+}
+
+type ProposeCommandReply struct {
+	OK    uint8
+	Value state.Value
+}
+
+type AbandonedTxsArgs struct{}
+
+type AbandonedTxsReply struct {
+	Txs []*state.Tx
+}
+
+// proposeLocal proposes cmd on behalf of the master, as the client
+// -1-r.Id. The reply is written to w. The proposal might be lost,
+// e.g., if the replica is not the leader of its group.
+func (r *Replica) proposeLocal(cmd state.Command, w io.Writer) error {
+	select {
+	case r.ProposeChan <- &GPropose{
+		Propose: &Propose{
+			CommandId: atomic.AddInt32(&r.localId, 1),
+			ClientId:  -1 - r.Id,
+			Command:   cmd,
+			Timestamp: time.Now().UnixNano(),
+		},
+		Reply: bufio.NewWriter(w),
+		Mutex: new(sync.Mutex),
+	}:
+		return nil
+	default:
+		return OVERLOADED
+	}
+}
+
+// ProposeCommand proposes args.Command and waits for its reply
+func (r *Replica) ProposeCommand(args *ProposeCommandArgs, reply *ProposeCommandReply) error {
+	rw := &replyWriter{
+		c: make(chan *ProposeReplyTS, 1),
+	}
+	if err := r.proposeLocal(args.Command, rw); err != nil {
+		return err
+	}
+	select {
+	case rep := <-rw.c:
+		reply.OK = rep.OK
+		reply.Value = rep.Value
+		return nil
+	case <-time.After(LOCAL_TIMEOUT):
+		return NO_REPLY
+	}
+}
+
+// AbandonedTxs returns the transactions prepared by the group of the
+// replica that are older than state.TX_TIMEOUT
+func (r *Replica) AbandonedTxs(args *AbandonedTxsArgs, reply *AbandonedTxsReply) error {
+	reply.Txs = r.State.Abandoned()
+	return nil
+}
+
+// replyWriter receives the replies to the commands proposed locally
+type replyWriter struct {
+	buf bytes.Buffer
+	c   chan *ProposeReplyTS
+}
+
+func (w *replyWriter) Write(b []byte) (int, error) {
+	w.buf.Write(b)
+	rep := &ProposeReplyTS{}
+	if rep.Unmarshal(bytes.NewReader(w.buf.Bytes())) == nil {
+		w.buf.Reset()
+		select {
+		case w.c <- rep:
+		default:
+		}
+	}
+	return len(b), nil
+}
@@ -0,0 +1,225 @@
+package smr
+
+import (
+	"bufio"
+	"errors"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CLIENTS stands for the links with the clients in LinkArgs
+const CLIENTS = -1
+
+var (
+	BAD_NETEM    = errors.New("Malformed link emulation file")
+	NO_SUCH_LINK = errors.New("No such link")
+)
+
+// LinkArgs sets the link from the replica Peer, or from the clients
+// if Peer is CLIENTS, to the replica receiving the call. Delay and
+// Jitter are in milliseconds, Loss is a percentage of messages.
+type LinkArgs struct {
+	Peer   int32
+	Delay  float64
+	Jitter float64
+	Loss   float64
+}
+
+type LinkReply struct{}
+
+type link struct {
+	delay  time.Duration
+	jitter time.Duration
+	loss   float64
+}
+
+// netem emulates the links with the replica. A message received on a
+// link is handed to the protocol once the delay of the link (plus or
+// minus the jitter) has elapsed, unless the link loses it.
+type netem struct {
+	mu    sync.RWMutex
+	links []link // links[r.N] is the link with the clients
+}
+
+func newNetem(n int) *netem {
+	return &netem{
+		links: make([]link, n+1),
+	}
+}
+
+// load reads the delays of the links with replica id from the file
+// path. The file holds one row of one-way delays in milliseconds per
+// replica, the j-th value of the i-th row being the delay from i to j,
+// and optionally the lines "jitter <ms>", "loss <percent>" and
+// "client <ms>" (the delay from the clients).
+func (ne *netem) load(path string, id int32) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ne.mu.Lock()
+	defer ne.mu.Unlock()
+
+	n := len(ne.links) - 1
+	row := 0
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line == "" {
+			continue
+		}
+		fs := strings.Fields(line)
+
+		switch fs[0] {
+		case "jitter", "loss", "client":
+			if len(fs) != 2 {
+				return BAD_NETEM
+			}
+			v, err := strconv.ParseFloat(fs[1], 64)
+			if err != nil {
+				return BAD_NETEM
+			}
+			for i := range ne.links {
+				switch {
+				case fs[0] == "jitter":
+					ne.links[i].jitter = ms(v)
+				case fs[0] == "loss":
+					ne.links[i].loss = v / 100
+				case i == n:
+					ne.links[i].delay = ms(v)
+				}
+			}
+		default:
+			if len(fs) != n || row >= n {
+				return BAD_NETEM
+			}
+			v, err := strconv.ParseFloat(fs[id], 64)
+			if err != nil {
+				return BAD_NETEM
+			}
+			ne.links[row].delay = ms(v)
+			row++
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	if row != n {
+		return BAD_NETEM
+	}
+	return nil
+}
+
+func (ne *netem) set(args *LinkArgs) error {
+	i := int(args.Peer)
+	if args.Peer == CLIENTS {
+		i = len(ne.links) - 1
+	} else if i < 0 || i >= len(ne.links)-1 {
+		return NO_SUCH_LINK
+	}
+
+	ne.mu.Lock()
+	defer ne.mu.Unlock()
+	ne.links[i] = link{
+		delay:  ms(args.Delay),
+		jitter: ms(args.Jitter),
+		loss:   args.Loss / 100,
+	}
+	return nil
+}
+
+// next returns the delay of the next message received
+// from peer, or false if the link loses this message
+func (ne *netem) next(peer int) (time.Duration, bool) {
+	if peer == CLIENTS {
+		peer = len(ne.links) - 1
+	}
+	ne.mu.RLock()
+	l := ne.links[peer]
+	ne.mu.RUnlock()
+
+	if l.loss > 0 && rand.Float64() < l.loss {
+		return 0, false
+	}
+	d := l.delay
+	if l.jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(2*l.jitter)+1)) - l.jitter
+		if d < 0 {
+			d = 0
+		}
+	}
+	return d, true
+}
+
+func ms(v float64) time.Duration {
+	return time.Duration(v * float64(time.Millisecond))
+}
+
+// lane hands the messages received on a connection
+// to the replica once they have crossed their link
+type lane struct {
+	ne   *netem
+	peer int
+	c    chan delayed // nil until a message is delayed
+}
+
+type delayed struct {
+	at time.Time
+	f  func()
+}
+
+func (r *Replica) newLane(peer int) *lane {
+	return &lane{
+		ne:   r.netem,
+		peer: peer,
+	}
+}
+
+// emulate calls f once the message received on l has crossed its link,
+// or never if the link loses it. The messages of l are handled in the
+// order they are received, and only by the caller if none is delayed.
+func (l *lane) emulate(f func()) {
+	d, ok := l.ne.next(l.peer)
+	if !ok {
+		return
+	}
+	if l.c == nil {
+		if d == 0 {
+			f()
+			return
+		}
+		l.c = make(chan delayed, QUEUE_SIZE)
+		go l.run()
+	}
+	l.c <- delayed{
+		at: time.Now().Add(d),
+		f:  f,
+	}
+}
+
+func (l *lane) run() {
+	for m := range l.c {
+		time.Sleep(time.Until(m.at))
+		m.f()
+	}
+}
+
+func (l *lane) close() {
+	if l.c != nil {
+		close(l.c)
+	}
+}
+
+// SetLink changes the emulated link from args.Peer to the replica
+func (r *Replica) SetLink(args *LinkArgs, reply *LinkReply) error {
+	return r.netem.set(args)
+}
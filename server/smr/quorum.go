@@ -3,6 +3,7 @@ package smr
 import (
 	"bufio"
 	"errors"
+	"fmt"
 	"os"
 	"sort"
 	"strings"
@@ -41,6 +42,17 @@ func (m ThreeQuarters) Contains(int32) bool {
 	return true
 }
 
+// AnyOf is made of any Size() replicas
+type AnyOf int
+
+func (m AnyOf) Size() int {
+	return int(m)
+}
+
+func (m AnyOf) Contains(int32) bool {
+	return true
+}
+
 type Quorum map[int32]struct{}
 
 type QuorumsOfLeader map[int32]Quorum
@@ -48,8 +60,10 @@ type QuorumsOfLeader map[int32]Quorum
 type QuorumSet map[int32]QuorumsOfLeader
 
 var (
-	NO_QUORUM_FILE = errors.New("Quorum file is not provided")
-	THREE_QUARTERS = errors.New("ThreeQuarters")
+	NO_QUORUM_FILE    = errors.New("Quorum file is not provided")
+	THREE_QUARTERS    = errors.New("ThreeQuarters")
+	BAD_FLEXIBLE_SPEC = errors.New("Invalid flexible quorums")
+	NO_INTERSECTION   = errors.New("Phase-1 and phase-2 quorums do not intersect")
 )
 
 func NewQuorum(size int) Quorum {
@@ -172,7 +186,6 @@ func NewQuorumsFromFile(qfile string, r *Replica) ([]Quorum, []int32, error) {
 	AQs := []Quorum{NewQuorum(r.N/2 + 1)}
 	s := bufio.NewScanner(f)
 	for s.Scan() {
-		id := int32(-1)
 		isLeader := false
 		addr := ""
 
@@ -193,15 +206,7 @@ func NewQuorumsFromFile(qfile string, r *Replica) ([]Quorum, []int32, error) {
 			addr = data[1]
 		}
 
-		for rid := int32(0); rid < int32(r.N); rid++ {
-			paddr := strings.Split(r.PeerAddrList[rid], ":")[0]
-			if addr == paddr {
-				id = rid
-				break
-			}
-		}
-
-		if id != -1 {
+		if id := replicaOf(addr, r); id != -1 {
 			AQs[i][id] = struct{}{}
 			if isLeader {
 				leaders[i] = id
@@ -215,6 +220,169 @@ func NewQuorumsFromFile(qfile string, r *Replica) ([]Quorum, []int32, error) {
 	return AQs, leaders, err
 }
 
+// NewChainFromFile orders the replicas as the first quorum of qfile
+// lists them, the replicas it does not list come next by their ids
+func NewChainFromFile(qfile string, r *Replica) ([]int32, error) {
+	chain := make([]int32, 0, r.N)
+	listed := make(map[int32]struct{}, r.N)
+	add := func(id int32) {
+		if _, exists := listed[id]; !exists && id != -1 {
+			listed[id] = struct{}{}
+			chain = append(chain, id)
+		}
+	}
+
+	var err error
+	if qfile == "" {
+		err = NO_QUORUM_FILE
+	} else if f, ferr := os.Open(qfile); ferr != nil {
+		err = ferr
+	} else {
+		defer f.Close()
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			data := strings.Split(s.Text(), " ")
+			if data[0] == "---" {
+				break
+			} else if data[0] == "3/4" {
+				continue
+			}
+			add(replicaOf(data[len(data)-1], r))
+		}
+		err = s.Err()
+	}
+
+	for id := int32(0); id < int32(r.N); id++ {
+		add(id)
+	}
+	return chain, err
+}
+
+func replicaOf(addr string, r *Replica) int32 {
+	for rid := int32(0); rid < int32(r.N); rid++ {
+		paddr := strings.Split(r.PeerAddrList[rid], ":")[0]
+		if addr == paddr {
+			return rid
+		}
+	}
+	return -1
+}
+
+// FlexibleQuorums are the quorums of the two phases of Paxos.
+// Every phase-1 quorum must intersect every phase-2 quorum.
+type FlexibleQuorums struct {
+	q1   QuorumI
+	q2   QuorumI
+	rows int
+	cols int
+}
+
+// NewFlexibleQuorums returns the quorums described by spec. The
+// default spec "" uses any N-F replicas in phase 1 and any F+1 in
+// phase 2. "<q1>,<q2>" uses any q1 replicas in phase 1 and any q2 in
+// phase 2. "grid:<rows>x<cols>" lays out the replicas row by row and
+// the leader uses its row in phase 1 and its column in phase 2.
+// "qfile" uses the first quorum of qfile in phase 2 and the second
+// one in phase 1.
+func NewFlexibleQuorums(spec, qfile string, r *Replica) (*FlexibleQuorums, error) {
+	fq := &FlexibleQuorums{
+		q1:   AnyOf(r.N - r.F),
+		q2:   AnyOf(r.F + 1),
+		rows: 0,
+		cols: 0,
+	}
+
+	switch {
+	case spec == "":
+	case spec == "qfile":
+		AQs, _, err := NewQuorumsFromFile(qfile, r)
+		if err != nil && err != THREE_QUARTERS {
+			return nil, err
+		}
+		if len(AQs) < 2 {
+			return nil, BAD_FLEXIBLE_SPEC
+		}
+		fq.q2, fq.q1 = AQs[0], AQs[1]
+	case strings.HasPrefix(spec, "grid:"):
+		_, err := fmt.Sscanf(spec, "grid:%dx%d", &fq.rows, &fq.cols)
+		if err != nil || fq.rows < 1 || fq.cols < 1 || fq.rows*fq.cols != r.N {
+			return nil, BAD_FLEXIBLE_SPEC
+		}
+	default:
+		var q1, q2 int
+		_, err := fmt.Sscanf(spec, "%d,%d", &q1, &q2)
+		if err != nil || q1 < 1 || q2 < 1 || q1 > r.N || q2 > r.N {
+			return nil, BAD_FLEXIBLE_SPEC
+		}
+		fq.q1, fq.q2 = AnyOf(q1), AnyOf(q2)
+	}
+
+	for l1 := int32(0); l1 < int32(r.N); l1++ {
+		for l2 := int32(0); l2 < int32(r.N); l2++ {
+			if !Intersect(fq.Phase1(l1), fq.Phase2(l2), r.N) {
+				return nil, NO_INTERSECTION
+			}
+		}
+	}
+	return fq, nil
+}
+
+// Phase1 returns the phase-1 quorum of leader
+func (fq *FlexibleQuorums) Phase1(leader int32) QuorumI {
+	if fq.rows == 0 {
+		return fq.q1
+	}
+	q := NewQuorum(fq.cols)
+	row := int(leader) / fq.cols
+	for c := 0; c < fq.cols; c++ {
+		q[int32(row*fq.cols+c)] = struct{}{}
+	}
+	return q
+}
+
+// Phase2 returns the phase-2 quorum of leader
+func (fq *FlexibleQuorums) Phase2(leader int32) QuorumI {
+	if fq.rows == 0 {
+		return fq.q2
+	}
+	q := NewQuorum(fq.rows)
+	col := int(leader) % fq.cols
+	for row := 0; row < fq.rows; row++ {
+		q[int32(row*fq.cols+col)] = struct{}{}
+	}
+	return q
+}
+
+// Intersect tells whether any quorum of q1 intersects any quorum
+// of q2, a quorum of q being any q.Size() replicas q contains
+func Intersect(q1, q2 QuorumI, n int) bool {
+	only1, only2, both := 0, 0, 0
+	for id := int32(0); id < int32(n); id++ {
+		c1, c2 := q1.Contains(id), q2.Contains(id)
+		if c1 && c2 {
+			both++
+		} else if c1 {
+			only1++
+		} else if c2 {
+			only2++
+		}
+	}
+	if q1.Size() > only1+both || q2.Size() > only2+both {
+		// there is no such quorum
+		return false
+	}
+
+	// replicas of both are used only once the others are exhausted
+	need1, need2 := q1.Size()-only1, q2.Size()-only2
+	if need1 < 0 {
+		need1 = 0
+	}
+	if need2 < 0 {
+		need2 = 0
+	}
+	return need1+need2 > both
+}
+
 func NewQuorumsOfLeader() QuorumsOfLeader {
 	return make(map[int32]Quorum)
 }
@@ -0,0 +1,95 @@
+package smr
+
+import (
+	"bufio"
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	// RTT_PROBE is the period of the beacons sent to each peer
+	RTT_PROBE = 500 * time.Millisecond
+	// RTT_SORT is the number of probes between two
+	// updates of PreferredPeerOrder
+	RTT_SORT = 20
+	// RTT_ALPHA is the weight of a new round-trip time in Ewma
+	RTT_ALPHA = 0.1
+)
+
+// probe measures the round-trip time to the peers until shutdown and
+// keeps PreferredPeerOrder sorted by increasing round-trip time
+func (r *Replica) probe() {
+	for n := 1; !r.Shutdown; n++ {
+		for i := int32(0); i < int32(r.N); i++ {
+			if i == r.Id {
+				continue
+			}
+			r.M.Lock()
+			alive := r.Alive[i]
+			r.M.Unlock()
+			if alive {
+				r.SendBeacon(i)
+			}
+		}
+		time.Sleep(RTT_PROBE)
+		if n%RTT_SORT == 0 {
+			r.sortPeers()
+		}
+	}
+}
+
+// observeRTT records the reply from rid to the beacon sent at ts
+func (r *Replica) observeRTT(rid int, ts int64) {
+	rtt := time.Now().UnixNano() - ts
+
+	r.M.Lock()
+	defer r.M.Unlock()
+	r.Latencies[rid] = rtt
+	if r.Ewma[rid] == 0 {
+		r.Ewma[rid] = float64(rtt)
+	} else {
+		r.Ewma[rid] = (1-RTT_ALPHA)*r.Ewma[rid] + RTT_ALPHA*float64(rtt)
+	}
+}
+
+// RTT returns the round-trip time to peer, or math.MaxInt64
+// if peer is down or has not answered any beacon yet
+func (r *Replica) RTT(peer int32) time.Duration {
+	r.M.Lock()
+	defer r.M.Unlock()
+	if !r.Alive[peer] || r.Ewma[peer] == 0 {
+		return math.MaxInt64
+	}
+	return time.Duration(r.Ewma[peer])
+}
+
+func (r *Replica) sortPeers() {
+	peers := make([]int32, 0, r.N-1)
+	rtts := make([]time.Duration, r.N)
+	for i := int32(0); i < int32(r.N); i++ {
+		if i != r.Id {
+			peers = append(peers, i)
+			rtts[i] = r.RTT(i)
+		}
+	}
+	sort.SliceStable(peers, func(i, j int) bool {
+		return rtts[peers[i]] < rtts[peers[j]]
+	})
+	r.UpdatePreferredPeerOrder(peers)
+}
+
+// replyClientBeacon lets the client of w measure its round-trip time
+func (r *Replica) replyClientBeacon(beacon *Beacon, w *bufio.Writer) {
+	r.M.Lock()
+	defer r.M.Unlock()
+
+	w.WriteByte(GENERIC_SMR_BEACON_REPLY)
+	marshal(w, r.clientCaps[w], GENERIC_SMR_BEACON_REPLY, &BeaconReply{
+		Timestamp: beacon.Timestamp,
+	})
+	if err := w.Flush(); err != nil {
+		log.Println("Cannot reply to client beacon:", err)
+	}
+}
@@ -1,6 +1,14 @@
 package smr
 
-import "github.com/vonaka/shreplic/tools/fastrpc"
+import (
+	"bytes"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/vonaka/shreplic/tools/capture"
+	"github.com/vonaka/shreplic/tools/fastrpc"
+)
 
 const (
 	SEND_ALL = iota
@@ -12,7 +20,9 @@ const (
 
 type SendType int32
 
-const ARGS_NUM = CHAN_BUFFER_SIZE
+// ARGS_NUM bounds the messages waiting to be sent, the
+// protocol blocks on its Sender once they are that many
+const ARGS_NUM = QUEUE_SIZE
 
 type SendArg struct {
 	msg      fastrpc.Serializable
@@ -21,6 +31,7 @@ type SendArg struct {
 	sendType SendType
 	id       int32
 	free     func()
+	release  bool
 }
 
 type Sender chan SendArg
@@ -29,22 +40,28 @@ func NewSender(r *Replica) Sender {
 	s := Sender(make(chan SendArg, ARGS_NUM))
 
 	go func() {
+		b := newBatch(r)
 		for !r.Shutdown {
-			arg := <-s
+			arg := b.next(s)
 			switch arg.sendType {
 			case SEND_ALL:
-				sendToAll(r, arg.msg, arg.rpc)
+				b.sendExcept(nil, arg.msg, arg.rpc)
 			case SEND_QUORUM:
-				sendToQuorum(r, arg.quorum, arg.msg, arg.rpc)
+				b.sendToQuorum(arg.quorum, arg.msg, arg.rpc)
 			case SEND_EXCEPT:
-				sendExcept(r, arg.quorum, arg.msg, arg.rpc)
+				b.sendExcept(arg.quorum, arg.msg, arg.rpc)
 			case SEND_CLIENT:
 				r.SendClientMsg(arg.id, arg.rpc, arg.msg)
 			case SEND_SINGLE:
-				r.SendMsg(arg.id, arg.rpc, arg.msg)
+				b.send(arg.id, arg.msg, arg.rpc)
 			}
 			if arg.free != nil {
 				arg.free()
+			} else if arg.release {
+				fastrpc.Free(arg.msg)
+			}
+			if Coalesce == 0 || time.Since(b.since) >= Coalesce {
+				b.flush()
 			}
 		}
 	}()
@@ -52,6 +69,9 @@ func NewSender(r *Replica) Sender {
 	return s
 }
 
+// SendToAllAndFree sends msg to all replicas, then calls free or, if
+// free is nil, returns msg to its pool (see fastrpc.Pooled). So do the
+// other *AndFree variants.
 func (s Sender) SendToAllAndFree(msg fastrpc.Serializable,
 	rpc uint8, free func()) {
 	s <- SendArg{
@@ -59,6 +79,7 @@ func (s Sender) SendToAllAndFree(msg fastrpc.Serializable,
 		rpc:      rpc,
 		sendType: SEND_ALL,
 		free:     free,
+		release:  true,
 	}
 }
 
@@ -70,6 +91,7 @@ func (s Sender) SendToQuorumAndFree(q Quorum,
 		quorum:   q,
 		sendType: SEND_QUORUM,
 		free:     free,
+		release:  true,
 	}
 }
 
@@ -81,6 +103,7 @@ func (s Sender) SendExceptAndFree(q Quorum,
 		quorum:   q,
 		sendType: SEND_EXCEPT,
 		free:     free,
+		release:  true,
 	}
 }
 
@@ -92,6 +115,7 @@ func (s Sender) SendToClientAndFree(cid int32,
 		id:       cid,
 		sendType: SEND_CLIENT,
 		free:     free,
+		release:  true,
 	}
 }
 
@@ -103,69 +127,183 @@ func (s Sender) SendToAndFree(id int32,
 		id:       id,
 		sendType: SEND_SINGLE,
 		free:     free,
+		release:  true,
 	}
 }
 
 func (s Sender) SendToAll(msg fastrpc.Serializable, rpc uint8) {
-	s.SendToAllAndFree(msg, rpc, nil)
+	s <- SendArg{
+		msg:      msg,
+		rpc:      rpc,
+		sendType: SEND_ALL,
+	}
 }
 
 func (s Sender) SendToQuorum(q Quorum, msg fastrpc.Serializable, rpc uint8) {
-	s.SendToQuorumAndFree(q, msg, rpc, nil)
+	s <- SendArg{
+		msg:      msg,
+		rpc:      rpc,
+		quorum:   q,
+		sendType: SEND_QUORUM,
+	}
 }
 
 func (s Sender) SendExcept(q Quorum, msg fastrpc.Serializable, rpc uint8) {
-	s.SendExceptAndFree(q, msg, rpc, nil)
+	s <- SendArg{
+		msg:      msg,
+		rpc:      rpc,
+		quorum:   q,
+		sendType: SEND_EXCEPT,
+	}
 }
 
 func (s Sender) SendToClient(cid int32, msg fastrpc.Serializable, rpc uint8) {
-	s.SendToClientAndFree(cid, msg, rpc, nil)
+	s <- SendArg{
+		msg:      msg,
+		rpc:      rpc,
+		id:       cid,
+		sendType: SEND_CLIENT,
+	}
 }
 
 func (s Sender) SendTo(id int32, msg fastrpc.Serializable, rpc uint8) {
-	s.SendToAndFree(id, msg, rpc, nil)
+	s <- SendArg{
+		msg:      msg,
+		rpc:      rpc,
+		id:       id,
+		sendType: SEND_SINGLE,
+	}
 }
 
-func sendToAll(r *Replica, msg fastrpc.Serializable, rpc uint8) {
-	for p := int32(0); p < int32(r.N); p++ {
-		r.M.Lock()
-		if r.Alive[p] {
-			r.M.Unlock()
-			r.SendMsg(p, rpc, msg)
-			r.M.Lock()
-		}
-		r.M.Unlock()
+// batch writes the messages of a Sender to the peers. A message is
+// marshaled once whatever the number of peers it is sent to, and the
+// writes are flushed only once the Sender has no more messages to
+// send or Coalesce after the first write that has not been flushed.
+type batch struct {
+	r     *Replica
+	buf   bytes.Buffer
+	z     compressor
+	dirty []bool
+	up    []bool
+	since time.Time
+
+	code    uint8
+	payload []byte
+	data    []byte
+}
+
+func newBatch(r *Replica) *batch {
+	return &batch{
+		r:     r,
+		dirty: make([]bool, r.N),
+		up:    make([]bool, r.N),
 	}
 }
 
-func sendToQuorum(r *Replica, q Quorum,
-	msg fastrpc.Serializable, rpc uint8) {
-	for p := int32(0); p < int32(r.N); p++ {
-		if !q.Contains(p) {
-			continue
+// next returns the next message to send, flushing
+// the pending writes if there is none yet
+func (b *batch) next(s Sender) SendArg {
+	select {
+	case arg := <-s:
+		return arg
+	default:
+	}
+	if d := Coalesce - time.Since(b.since); d > 0 && !b.since.IsZero() {
+		t := time.NewTimer(d)
+		select {
+		case arg := <-s:
+			t.Stop()
+			return arg
+		case <-t.C:
 		}
-		r.M.Lock()
-		if r.Alive[p] {
-			r.M.Unlock()
-			r.SendMsg(p, rpc, msg)
-			r.M.Lock()
+	}
+	b.flush()
+	return <-s
+}
+
+// marshal prepares msg to be written to the peers
+func (b *batch) marshal(msg fastrpc.Serializable, rpc uint8) {
+	b.buf.Reset()
+	b.buf.WriteByte(rpc)
+	msg.Marshal(&b.buf)
+	b.payload = b.buf.Bytes()[1:]
+	b.code, b.data = rpc, b.buf.Bytes()
+	if Compress > 0 && len(b.payload) >= Compress {
+		b.code, b.data = COMPRESSED, b.z.compress(rpc, b.payload)
+	}
+}
+
+// write writes the message prepared by marshal to peer
+func (b *batch) write(peer int32, msg fastrpc.Serializable, rpc uint8) {
+	r := b.r
+	r.peerLocks[peer].Lock()
+	defer r.peerLocks[peer].Unlock()
+
+	w := r.PeerWriters[peer]
+	if w == nil {
+		log.Printf("Connection to %d lost!", peer)
+		return
+	}
+	if b.code == COMPRESSED {
+		w.WriteByte(COMPRESSED)
+	}
+	w.Write(b.data)
+	r.peerCaps[peer].Frame(capture.SEND, rpc, b.payload)
+	r.traceMsg("send", rpc, msg, "shr.peer", strconv.Itoa(int(peer)))
+
+	if b.since.IsZero() {
+		b.since = time.Now()
+	}
+	b.dirty[peer] = true
+}
+
+func (b *batch) send(peer int32, msg fastrpc.Serializable, rpc uint8) {
+	b.marshal(msg, rpc)
+	b.write(peer, msg, rpc)
+}
+
+// alive returns the peers that are alive, read under M,
+// which is not held while writing to them
+func (b *batch) alive() []bool {
+	b.r.M.Lock()
+	defer b.r.M.Unlock()
+	copy(b.up, b.r.Alive)
+	return b.up
+}
+
+func (b *batch) sendToQuorum(q Quorum, msg fastrpc.Serializable, rpc uint8) {
+	b.marshal(msg, rpc)
+	for p, up := range b.alive() {
+		if up && q.Contains(int32(p)) {
+			b.write(int32(p), msg, rpc)
 		}
-		r.M.Unlock()
 	}
 }
 
-func sendExcept(r *Replica, q Quorum,
-	msg fastrpc.Serializable, rpc uint8) {
-	for p := int32(0); p < int32(r.N); p++ {
-		if q.Contains(p) {
-			continue
+// sendExcept sends msg to the alive peers
+// that are not in q, which may be nil
+func (b *batch) sendExcept(q Quorum, msg fastrpc.Serializable, rpc uint8) {
+	b.marshal(msg, rpc)
+	for p, up := range b.alive() {
+		if up && !q.Contains(int32(p)) {
+			b.write(int32(p), msg, rpc)
 		}
-		r.M.Lock()
-		if r.Alive[p] {
-			r.M.Unlock()
-			r.SendMsg(p, rpc, msg)
-			r.M.Lock()
+	}
+}
+
+func (b *batch) flush() {
+	if b.since.IsZero() {
+		return
+	}
+	for p, dirty := range b.dirty {
+		if dirty {
+			b.r.peerLocks[p].Lock()
+			if b.r.PeerWriters[p] != nil {
+				b.r.PeerWriters[p].Flush()
+			}
+			b.r.peerLocks[p].Unlock()
 		}
-		r.M.Unlock()
+		b.dirty[p] = false
 	}
+	b.since = time.Time{}
 }
@@ -0,0 +1,115 @@
+package smr
+
+import (
+	"errors"
+	"io/ioutil"
+
+	"github.com/vonaka/shreplic/shard"
+	"github.com/vonaka/shreplic/state"
+)
+
+var NOT_FROZEN = errors.New("Range is not frozen yet")
+
+type SetShardMapArgs struct {
+	Group int
+	Map   shard.Map
+}
+
+type SetShardMapReply struct{}
+
+type FreezeRangeArgs struct {
+	Map   shard.Map
+	Range shard.Range
+}
+
+type FreezeRangeReply struct{}
+
+type ExportRangeArgs struct {
+	Map   shard.Map
+	Range shard.Range
+}
+
+type ExportRangeReply struct {
+	Version state.Version
+	Keys    []state.Key
+	Values  []state.Value
+}
+
+type ownership struct {
+	group int
+	m     *shard.Map
+}
+
+// SetShardMap tells the replica to which group it belongs and which
+// keys are served by this group. Maps older than the current one are
+// ignored.
+func (r *Replica) SetShardMap(args *SetShardMapArgs, reply *SetShardMapReply) error {
+	r.M.Lock()
+	defer r.M.Unlock()
+
+	if o, _ := r.shards.Load().(*ownership); o == nil || o.m.Epoch < args.Map.Epoch {
+		r.shards.Store(&ownership{
+			group: args.Group,
+			m:     args.Map.Copy(),
+		})
+	}
+	return nil
+}
+
+// FreezeRange proposes to freeze a range that moves to another group,
+// so that the commands ordered after the freeze are rejected (see
+// state.FreezeCommand). The proposal might be lost (see proposeLocal).
+func (r *Replica) FreezeRange(args *FreezeRangeArgs, reply *FreezeRangeReply) error {
+	return r.proposeLocal(args.Map.Freeze(args.Range), ioutil.Discard)
+}
+
+// ExportRange returns the content of a range as it is in the most
+// recent snapshot of the state, or NOT_FROZEN if the freeze of the
+// range has not been executed yet
+func (r *Replica) ExportRange(args *ExportRangeArgs, reply *ExportRangeReply) error {
+	if !r.State.Frozen(args.Range.Lo, args.Range.Hi, buckets(&args.Map)) {
+		return NOT_FROZEN
+	}
+	reply.Version = r.State.Version()
+	reply.Keys = make([]state.Key, 0)
+	reply.Values = make([]state.Value, 0)
+	return r.State.Range(reply.Version, func(k state.Key, v state.Value) bool {
+		if args.Map.Within(args.Range, k) {
+			reply.Keys = append(reply.Keys, k)
+			reply.Values = append(reply.Values, v)
+		}
+		return true
+	})
+}
+
+// Owns tells whether k is served by the group of the replica.
+// Without a partition map the replica serves every key.
+func (r *Replica) Owns(k state.Key) bool {
+	o, _ := r.shards.Load().(*ownership)
+	return o == nil || o.m.Lookup(k) == o.group
+}
+
+// OwnsAll tells whether every key accessed by cmd is served by the group
+func (r *Replica) OwnsAll(cmd *state.Command) bool {
+	if cmd.Op == state.SCAN {
+		o, _ := r.shards.Load().(*ownership)
+		if o == nil {
+			return true
+		}
+		lo, hi := state.KeyRange(cmd)
+		return o.m.Serves(o.group, lo, hi)
+	}
+	for _, k := range state.Keys(cmd) {
+		if !r.Owns(k) {
+			return false
+		}
+	}
+	return true
+}
+
+func buckets(m *shard.Map) int64 {
+	if !m.Hash {
+		return 0
+	}
+	return m.Buckets
+}
@@ -2,21 +2,28 @@ package smr
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
-	"math"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/vonaka/shreplic/state"
+	"github.com/vonaka/shreplic/tools/capture"
 	"github.com/vonaka/shreplic/tools/dlog"
 	"github.com/vonaka/shreplic/tools/fastrpc"
+	"github.com/vonaka/shreplic/tools/metrics"
+	"github.com/vonaka/shreplic/tools/mtls"
+	"github.com/vonaka/shreplic/tools/trace"
+	"github.com/vonaka/shreplic/tools/transport"
 )
 
 type GPropose struct {
@@ -32,10 +39,11 @@ type GBeacon struct {
 }
 
 type Replica struct {
-	M  sync.Mutex
-	N  int
-	F  int
-	Id int32
+	M     sync.Mutex
+	N     int
+	F     int
+	Id    int32
+	Group int
 
 	PeerAddrList       []string
 	Peers              []net.Conn
@@ -47,6 +55,7 @@ type Replica struct {
 	PreferredPeerOrder []int32
 
 	State       *state.State
+	shards      atomic.Value // *ownership
 	RPC         *fastrpc.Table
 	StableStore *os.File
 	Stats       *Stats
@@ -62,27 +71,81 @@ type Replica struct {
 	Beacon  bool
 	Durable bool
 
+	// Ewma is the moving average of the round-trip time to each peer
+	// and Latencies the last one measured, in nanoseconds
 	Ewma      []float64
 	Latencies []int64
+	probing   sync.Once
+
+	metrics   *metrics.Registry
+	proposals *metrics.Counter
+	rejected  *metrics.Counter
+	reads     *metrics.Counter
+	stalls    *metrics.Counter
+
+	Trace    *trace.Tracer
+	clientOf map[*bufio.Writer]int32
+
+	// peerLocks serialize the writes to each peer, which are made
+	// without M so that a blocked peer does not block the others
+	peerLocks  []sync.Mutex
+	peerCaps   []*capture.Link
+	clientCaps map[*bufio.Writer]*capture.Link
+
+	netem *netem
+
+	// id of the last command proposed by proposeLocal
+	localId int32
 }
 
 const (
 	CHAN_BUFFER_SIZE = 2000000
-	TRUE             = uint8(1)
-	FALSE            = uint8(0)
+	// QUEUE_SIZE bounds the messages of each type waiting to be handled.
+	// Once a queue is full, the listeners stop reading their connection.
+	QUEUE_SIZE = 1 << 16
+	// PROPOSE_QUEUE_SIZE bounds the proposals waiting to be handled,
+	// the proposals received beyond are rejected with BUSY
+	PROPOSE_QUEUE_SIZE = 1 << 14
+	// RETRY_AFTER is the time a client rejected with BUSY is asked to wait
+	RETRY_AFTER = 10 * time.Millisecond
+	// WRITE_BUFFER_SIZE is the size of the write buffers of the peers,
+	// the coalesced writes are flushed once it is reached
+	WRITE_BUFFER_SIZE = 64 << 10
+	TRUE              = uint8(1)
+	FALSE             = uint8(0)
 )
 
 var (
 	Storage      = ""
 	StoreFilname = "stable_store"
+
+	// TLS secures the connections of replicas, nil means plaintext
+	TLS *mtls.Config = nil
+	// Transport carries the links with the peers and the clients
+	Transport = transport.TCP
+	// Traces is where the spans of commands are exported, nil means no tracing
+	Traces *trace.File = nil
+	// Capture is the directory the messages of each link are recorded in,
+	// empty means no capture
+	Capture = ""
+	// Netem is the file of the delays of the links to emulate (see netem.load),
+	// empty means no emulation
+	Netem = ""
+	// Coalesce is the time the writes of a Sender may wait to be flushed
+	// with the next ones, 0 means that each message is flushed
+	Coalesce time.Duration = 0
+	// Compress is the size from which the messages sent by a Sender
+	// are compressed, 0 means no compression
+	Compress = 0
 )
 
 func NewReplica(id, f int, addrs []string, thrifty, exec, lread, drep bool, ps map[string]struct{}) *Replica {
 	n := len(addrs)
 	r := &Replica{
-		N:  n,
-		F:  f,
-		Id: int32(id),
+		N:     n,
+		F:     f,
+		Id:    int32(id),
+		Group: groupOf(addrs[id]),
 
 		PeerAddrList:       addrs,
 		Peers:              make([]net.Conn, n),
@@ -99,7 +162,8 @@ func NewReplica(id, f int, addrs []string, thrifty, exec, lread, drep bool, ps m
 		Stats:       &Stats{make(map[string]int)},
 		Shutdown:    false,
 		Listener:    nil,
-		ProposeChan: make(chan *GPropose, CHAN_BUFFER_SIZE),
+		// room is left for the proposals sent again by the protocol
+		ProposeChan: make(chan *GPropose, 2*PROPOSE_QUEUE_SIZE),
 		BeaconChan:  make(chan *GBeacon, CHAN_BUFFER_SIZE),
 
 		Thrifty: thrifty,
@@ -111,13 +175,29 @@ func NewReplica(id, f int, addrs []string, thrifty, exec, lread, drep bool, ps m
 
 		Ewma:      make([]float64, n),
 		Latencies: make([]int64, n),
+
+		metrics: metrics.NewRegistry(),
+
+		Trace:    Traces.Tracer(fmt.Sprintf("replica-%d", id), int32(id)),
+		clientOf: make(map[*bufio.Writer]int32),
+
+		peerLocks:  make([]sync.Mutex, n),
+		peerCaps:   make([]*capture.Link, n),
+		clientCaps: make(map[*bufio.Writer]*capture.Link),
+
+		netem: newNetem(n),
 	}
 
 	var err error
-	r.StableStore, err = os.Create(storeFullFileName(id))
+	r.StableStore, err = os.Create(storeFullFileName(id, addrs[id]))
 	if err != nil {
 		log.Fatal(err)
 	}
+	if Netem != "" {
+		if err := r.netem.load(Netem, r.Id); err != nil {
+			log.Fatal(Netem, ": ", err)
+		}
+	}
 
 	for i := 0; i < r.N; i++ {
 		r.PreferredPeerOrder[i] = int32((int(r.Id) + 1 + i) % r.N)
@@ -125,9 +205,106 @@ func NewReplica(id, f int, addrs []string, thrifty, exec, lread, drep bool, ps m
 		r.Latencies[i] = 0
 	}
 
+	r.initMetrics()
+
 	return r
 }
 
+func (r *Replica) initMetrics() {
+	r.proposals = r.metrics.Counter("shr_proposals_total",
+		"Commands proposed by the clients of the replica")
+	r.rejected = r.metrics.Counter("shr_proposals_rejected_total",
+		"Proposals rejected because too many proposals were pending")
+	r.reads = r.metrics.Counter("shr_local_reads_total",
+		"Reads served from the local state without being ordered")
+	r.stalls = r.metrics.Counter("shr_queue_stalls_total",
+		"Messages whose queue was full, stopping the reading of their connection")
+
+	r.metrics.GaugeFunc("shr_propose_channel_depth",
+		"Proposals waiting to be handled", func(set metrics.Setter) {
+			set(float64(len(r.ProposeChan)))
+		})
+	r.metrics.GaugeFunc("shr_channel_depth",
+		"Messages waiting to be handled", func(set metrics.Setter) {
+			r.RPC.Each(func(_ uint8, p fastrpc.Pair) {
+				set(float64(len(p.Chan)), "message", typeName(p.Obj))
+			})
+		})
+	r.metrics.GaugeFunc("shr_channel_capacity",
+		"Messages that can wait to be handled", func(set metrics.Setter) {
+			r.RPC.Each(func(_ uint8, p fastrpc.Pair) {
+				set(float64(cap(p.Chan)), "message", typeName(p.Obj))
+			})
+		})
+	r.metrics.GaugeFunc("shr_peer_rtt_seconds",
+		"Moving average of the round-trip time of beacons to each peer", func(set metrics.Setter) {
+			for i, rtt := range r.Ewma {
+				if int32(i) != r.Id {
+					set(rtt/1e9, "peer", strconv.Itoa(i))
+				}
+			}
+		})
+}
+
+// Metrics returns the registry of the metrics of the replica
+func (r *Replica) Metrics() *metrics.Registry {
+	return r.metrics
+}
+
+// traceMsg records the event name of each command msg concerns
+func (r *Replica) traceMsg(name string, code uint8,
+	msg fastrpc.Serializable, attrs ...string) {
+
+	c, ok := msg.(trace.Carrier)
+	if r.Trace == nil || !ok {
+		return
+	}
+	if p, exists := r.RPC.Get(code); exists {
+		name += " " + typeName(p.Obj)
+	}
+	attrs = append(attrs, "shr.code", strconv.Itoa(int(code)))
+	c.TraceIds(func(id trace.Id) {
+		r.Trace.Event(id, name, attrs...)
+	})
+}
+
+func typeName(obj fastrpc.Serializable) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", obj), "*")
+}
+
+// openCapture creates the capture file of the link
+func (r *Replica) openCapture(link string) *capture.Link {
+	if Capture == "" {
+		return nil
+	}
+	names := make(map[uint8]string)
+	r.RPC.Each(func(code uint8, p fastrpc.Pair) {
+		names[code] = typeName(p.Obj)
+	})
+	port := r.PeerAddrList[r.Id][strings.LastIndex(r.PeerAddrList[r.Id], ":")+1:]
+	path := fmt.Sprintf("%v/r%d-%v-%v.cap", Capture, r.Id, port, link)
+	l, err := capture.Create(path, r.Id, names)
+	if err != nil {
+		log.Println("Capture error:", err)
+		return nil
+	}
+	return l
+}
+
+// marshal writes msg to w and records it on l as the message code
+func marshal(w *bufio.Writer, l *capture.Link, code uint8,
+	msg interface{ Marshal(io.Writer) }) {
+
+	if l == nil {
+		msg.Marshal(w)
+		return
+	}
+	var b bytes.Buffer
+	msg.Marshal(&b)
+	w.Write(b.Bytes())
+	l.Frame(capture.SEND, code, b.Bytes())
+}
+
 func (r *Replica) Ping(args *PingArgs, reply *PingReply) error {
 	return nil
 }
@@ -136,6 +313,10 @@ func (r *Replica) BeTheLeader(args *BeTheLeaderArgs, reply *BeTheLeaderReply) er
 	return nil
 }
 
+func (r *Replica) Reconfigure(args *ReconfigureArgs, reply *ReconfigureReply) error {
+	return nil
+}
+
 func (r *Replica) FastQuorumSize() int {
 	return r.F + (r.F+1)/2
 }
@@ -148,6 +329,13 @@ func (r *Replica) WriteQuorumSize() int {
 	return r.F + 1
 }
 
+// ByzantineQuorumSize is the size of the quorums when F out of N
+// replicas can be byzantine: ceil((N+F+1)/2), so that any two quorums
+// intersect in at least F+1 replicas, one of which is correct
+func (r *Replica) ByzantineQuorumSize() int {
+	return (r.N + r.F + 2) / 2
+}
+
 func (r *Replica) ReadQuorumSize() int {
 	return r.N - r.F
 }
@@ -161,7 +349,8 @@ func (r *Replica) ConnectToPeers() {
 
 	for i := 0; i < int(r.Id); i++ {
 		for {
-			if conn, err := net.Dial("tcp", r.PeerAddrList[i]); err == nil {
+			conn, err := TLS.Dial(Transport, r.PeerAddrList[i], mtls.ReplicaName(r.Group, int32(i)), 0)
+			if err == nil {
 				r.Peers[i] = conn
 				break
 			}
@@ -174,7 +363,7 @@ func (r *Replica) ConnectToPeers() {
 		}
 		r.Alive[i] = true
 		r.PeerReaders[i] = bufio.NewReader(r.Peers[i])
-		r.PeerWriters[i] = bufio.NewWriter(r.Peers[i])
+		r.PeerWriters[i] = bufio.NewWriterSize(r.Peers[i], WRITE_BUFFER_SIZE)
 		log.Printf("OUT Connected to %d", i)
 	}
 	<-done
@@ -185,6 +374,7 @@ func (r *Replica) ConnectToPeers() {
 		if int32(rid) == r.Id {
 			continue
 		}
+		r.peerCaps[rid] = r.openCapture("peer" + strconv.Itoa(rid))
 		go r.replicaListener(rid, reader)
 	}
 }
@@ -203,8 +393,8 @@ func (r *Replica) WaitForClientConnections() {
 }
 
 func (r *Replica) SendMsg(peerId int32, code uint8, msg fastrpc.Serializable) {
-	r.M.Lock()
-	defer r.M.Unlock()
+	r.peerLocks[peerId].Lock()
+	defer r.peerLocks[peerId].Unlock()
 
 	w := r.PeerWriters[peerId]
 	if w == nil {
@@ -212,8 +402,9 @@ func (r *Replica) SendMsg(peerId int32, code uint8, msg fastrpc.Serializable) {
 		return
 	}
 	w.WriteByte(code)
-	msg.Marshal(w)
+	marshal(w, r.peerCaps[peerId], code, msg)
 	w.Flush()
+	r.traceMsg("send", code, msg, "shr.peer", strconv.Itoa(int(peerId)))
 }
 
 func (r *Replica) SendClientMsg(id int32, code uint8, msg fastrpc.Serializable) {
@@ -226,13 +417,14 @@ func (r *Replica) SendClientMsg(id int32, code uint8, msg fastrpc.Serializable)
 		return
 	}
 	w.WriteByte(code)
-	msg.Marshal(w)
+	marshal(w, r.clientCaps[w], code, msg)
 	w.Flush()
+	r.traceMsg("send", code, msg, "shr.client", strconv.Itoa(int(id)))
 }
 
 func (r *Replica) SendMsgNoFlush(peerId int32, code uint8, msg fastrpc.Serializable) {
-	r.M.Lock()
-	defer r.M.Unlock()
+	r.peerLocks[peerId].Lock()
+	defer r.peerLocks[peerId].Unlock()
 
 	w := r.PeerWriters[peerId]
 	if w == nil {
@@ -240,20 +432,43 @@ func (r *Replica) SendMsgNoFlush(peerId int32, code uint8, msg fastrpc.Serializa
 		return
 	}
 	w.WriteByte(code)
-	msg.Marshal(w)
+	marshal(w, r.peerCaps[peerId], code, msg)
+	r.traceMsg("send", code, msg, "shr.peer", strconv.Itoa(int(peerId)))
 }
 
 func (r *Replica) ReplyProposeTS(reply *ProposeReplyTS, w *bufio.Writer, lock *sync.Mutex) {
 	r.M.Lock()
 	defer r.M.Unlock()
 
-	reply.Marshal(w)
+	// some protocols reuse the same reply, which is thus copied
+	if reply.OK == TRUE && state.Rejected(reply.Value) {
+		// ordered after the freeze of its range
+		rep := *reply
+		rep.OK = WRONG_GROUP
+		rep.Value = state.NIL()
+		reply = &rep
+	} else if reply.OK == TRUE && state.Locked(reply.Value) {
+		rep := *reply
+		rep.OK = BUSY
+		rep.Value = state.NIL()
+		rep.RetryAfter = int64(RETRY_AFTER)
+		reply = &rep
+	}
+
+	var s *trace.Span
+	if r.Trace != nil {
+		s = r.Trace.Start(trace.Command(r.clientOf[w], reply.CommandId), "reply",
+			"shr.ok", strconv.Itoa(int(reply.OK)))
+	}
+	// replies are sent without code
+	marshal(w, r.clientCaps[w], PROPOSE_REPLY, reply)
 	w.Flush()
+	s.End()
 }
 
 func (r *Replica) SendBeacon(peerId int32) {
-	r.M.Lock()
-	defer r.M.Unlock()
+	r.peerLocks[peerId].Lock()
+	defer r.peerLocks[peerId].Unlock()
 
 	w := r.PeerWriters[peerId]
 	if w == nil {
@@ -264,7 +479,7 @@ func (r *Replica) SendBeacon(peerId int32) {
 	beacon := &Beacon{
 		Timestamp: time.Now().UnixNano(),
 	}
-	beacon.Marshal(w)
+	marshal(w, r.peerCaps[peerId], GENERIC_SMR_BEACON, beacon)
 	w.Flush()
 	dlog.Println("send beacon", beacon.Timestamp, "to", peerId)
 }
@@ -272,8 +487,8 @@ func (r *Replica) SendBeacon(peerId int32) {
 func (r *Replica) ReplyBeacon(beacon *GBeacon) {
 	dlog.Println("replying beacon to", beacon.Rid)
 
-	r.M.Lock()
-	defer r.M.Unlock()
+	r.peerLocks[beacon.Rid].Lock()
+	defer r.peerLocks[beacon.Rid].Unlock()
 
 	w := r.PeerWriters[beacon.Rid]
 	if w == nil {
@@ -284,7 +499,7 @@ func (r *Replica) ReplyBeacon(beacon *GBeacon) {
 	rb := &BeaconReply{
 		Timestamp: beacon.Timestamp,
 	}
-	rb.Marshal(w)
+	marshal(w, r.peerCaps[beacon.Rid], GENERIC_SMR_BEACON_REPLY, rb)
 	w.Flush()
 }
 
@@ -318,48 +533,21 @@ func (r *Replica) UpdatePreferredPeerOrder(quorum []int32) {
 	r.M.Unlock()
 }
 
+// ComputeClosestPeers starts measuring the round-trip time to the
+// peers and returns it, in milliseconds, once PreferredPeerOrder
+// is sorted. PreferredPeerOrder is then kept sorted.
 func (r *Replica) ComputeClosestPeers() []float64 {
-	npings := 20
-
-	for j := 0; j < npings; j++ {
-		for i := int32(0); i < int32(r.N); i++ {
-			if i == r.Id {
-				continue
-			}
-			r.M.Lock()
-			if r.Alive[i] {
-				r.M.Unlock()
-				r.SendBeacon(i)
-			} else {
-				r.Latencies[i] = math.MaxInt64
-				r.M.Unlock()
-			}
-		}
-		time.Sleep(500 * time.Millisecond)
-	}
-
-	quorum := make([]int32, r.N)
-
-	r.M.Lock()
-	for i := int32(0); i < int32(r.N); i++ {
-		pos := 0
-		for j := int32(0); j < int32(r.N); j++ {
-			if (r.Latencies[j] < r.Latencies[i]) ||
-				((r.Latencies[j] == r.Latencies[i]) && (j < i)) {
-				pos++
-			}
-		}
-		quorum[pos] = int32(i)
-	}
-	r.M.Unlock()
-
-	r.UpdatePreferredPeerOrder(quorum)
+	r.probing.Do(func() {
+		go r.probe()
+	})
+	time.Sleep(RTT_SORT * RTT_PROBE)
+	r.sortPeers()
 
 	latencies := make([]float64, r.N-1)
 
 	for i := 0; i < r.N-1; i++ {
 		node := r.PreferredPeerOrder[i]
-		lat := float64(r.Latencies[node]) / float64(npings*1000000)
+		lat := float64(r.RTT(node)) / float64(time.Millisecond)
 		log.Println(node, "->", lat, "ms")
 		latencies[i] = lat
 	}
@@ -372,12 +560,14 @@ func (r *Replica) waitForPeerConnections(done chan bool) {
 	bs := b[:4]
 
 	port := strings.Split(r.PeerAddrList[r.Id], ":")[1]
-	l, err := net.Listen("tcp", "0.0.0.0:"+port)
+	l, err := TLS.Listen(Transport, "0.0.0.0:"+port)
 	if err != nil {
 		log.Fatal(r.PeerAddrList[r.Id], err)
 	}
 	r.Listener = l
-	for i := r.Id + 1; i < int32(r.N); i++ {
+	// the replicas with a greater id connect to this one,
+	// a connection that fails to identify one of them is not counted
+	for i := r.Id + 1; i < int32(r.N); {
 		conn, err := r.Listener.Accept()
 		if err != nil {
 			log.Println("Accept error:", err)
@@ -385,14 +575,26 @@ func (r *Replica) waitForPeerConnections(done chan bool) {
 		}
 		if _, err := io.ReadFull(conn, bs); err != nil {
 			log.Println("Connection establish error:", err)
+			conn.Close()
 			continue
 		}
 		id := int32(binary.LittleEndian.Uint32(bs))
+		if id <= r.Id || id >= int32(r.N) || r.Peers[id] != nil {
+			log.Println("Unexpected replica", id)
+			conn.Close()
+			continue
+		}
+		if err := TLS.Identify(conn, mtls.ReplicaName(r.Group, id)); err != nil {
+			log.Println("Replica", id, "identification error:", err)
+			conn.Close()
+			continue
+		}
 		r.Peers[id] = conn
 		r.PeerReaders[id] = bufio.NewReader(conn)
-		r.PeerWriters[id] = bufio.NewWriter(conn)
+		r.PeerWriters[id] = bufio.NewWriterSize(conn, WRITE_BUFFER_SIZE)
 		r.Alive[id] = true
 		log.Printf("IN Connected to %d", id)
+		i++
 	}
 
 	done <- true
@@ -404,8 +606,18 @@ func (r *Replica) replicaListener(rid int, reader *bufio.Reader) {
 		err          error = nil
 		gbeacon      Beacon
 		gbeaconReply BeaconReply
+
+		link = r.peerCaps[rid]
+		cr   *capture.Reader
+		in   io.Reader = reader
+		ln             = r.newLane(rid)
 	)
 
+	if link != nil {
+		cr = capture.NewReader(reader)
+		in = cr
+	}
+
 	for err == nil && !r.Shutdown {
 		if msgType, err = reader.ReadByte(); err != nil {
 			break
@@ -414,43 +626,76 @@ func (r *Replica) replicaListener(rid int, reader *bufio.Reader) {
 		switch uint8(msgType) {
 
 		case GENERIC_SMR_BEACON:
-			if err = gbeacon.Unmarshal(reader); err != nil {
+			if err = gbeacon.Unmarshal(in); err != nil {
 				break
 			}
-			r.ReplyBeacon(&GBeacon{
+			cr.Frame(link, msgType)
+			beacon := &GBeacon{
 				Rid:       int32(rid),
 				Timestamp: gbeacon.Timestamp,
+			}
+			ln.emulate(func() {
+				r.ReplyBeacon(beacon)
 			})
 			break
 
 		case GENERIC_SMR_BEACON_REPLY:
-			if err = gbeaconReply.Unmarshal(reader); err != nil {
+			if err = gbeaconReply.Unmarshal(in); err != nil {
 				break
 			}
-			dlog.Println("receive beacon", gbeaconReply.Timestamp, "reply from", rid)
-			r.M.Lock()
-			r.Latencies[rid] += time.Now().UnixNano() - gbeaconReply.Timestamp
-			r.M.Unlock()
-			now := time.Now().UnixNano()
-			r.Ewma[rid] = 0.99*r.Ewma[rid] + 0.01*float64(now-gbeaconReply.Timestamp)
+			cr.Frame(link, msgType)
+			ts := gbeaconReply.Timestamp
+			ln.emulate(func() {
+				dlog.Println("receive beacon", ts, "reply from", rid)
+				r.observeRTT(rid, ts)
+			})
+			break
+
+		case COMPRESSED:
+			var (
+				code    uint8
+				payload []byte
+			)
+			if code, payload, err = uncompress(in); err != nil {
+				break
+			}
+			// the uncompressed message is recorded
+			cr.Reset()
+			link.Frame(capture.RECV, code, payload)
+			p, exists := r.RPC.Get(code)
+			if !exists {
+				log.Fatal("Error: received unknown compressed message type ", code, " from ", rid)
+			}
+			obj := p.Obj.New()
+			if err = obj.Unmarshal(bytes.NewReader(payload)); err != nil {
+				break
+			}
+			r.traceMsg("recv", code, obj, "shr.peer", strconv.Itoa(rid))
+			ln.emulate(func() {
+				r.deliver(p.Chan, obj)
+			})
 			break
 
 		default:
 			p, exists := r.RPC.Get(msgType)
 			if exists {
 				obj := p.Obj.New()
-				if err = obj.Unmarshal(reader); err != nil {
+				if err = obj.Unmarshal(in); err != nil {
 					break
 				}
-				go func(obj fastrpc.Serializable) {
-					p.Chan <- obj
-				}(obj)
+				cr.Frame(link, msgType)
+				r.traceMsg("recv", msgType, obj, "shr.peer", strconv.Itoa(rid))
+				ln.emulate(func() {
+					r.deliver(p.Chan, obj)
+				})
 			} else {
 				log.Fatal("Error: received unknown message type ", msgType, " from ", rid)
 			}
 		}
 	}
 
+	ln.close()
+
 	r.M.Lock()
 	r.Alive[rid] = false
 	r.M.Unlock()
@@ -463,10 +708,24 @@ func (r *Replica) clientListener(conn net.Conn) {
 	var (
 		msgType byte
 		err     error
+
+		link = r.openCapture("client-" +
+			strings.Replace(conn.RemoteAddr().String(), ":", "-", -1))
+		cr *capture.Reader
+		in io.Reader = reader
+		ln           = r.newLane(CLIENTS)
 	)
 
+	if link != nil {
+		cr = capture.NewReader(reader)
+		in = cr
+	}
+
 	r.M.Lock()
 	log.Println("Client up", conn.RemoteAddr(), "(", r.LRead, ")")
+	if link != nil {
+		r.clientCaps[writer] = link
+	}
 	r.M.Unlock()
 
 	addr := strings.Split(conn.RemoteAddr().String(), ":")[0]
@@ -482,46 +741,52 @@ func (r *Replica) clientListener(conn net.Conn) {
 		switch uint8(msgType) {
 		case PROPOSE:
 			propose := &Propose{}
-			if err = propose.Unmarshal(reader); err != nil {
+			if err = propose.Unmarshal(in); err != nil {
 				break
 			}
+			cr.Frame(link, msgType)
 			r.M.Lock()
 			r.ClientWriters[propose.ClientId] = writer
-			r.M.Unlock()
-			op := propose.Command.Op
-			if r.LRead && (op == state.GET || op == state.SCAN) {
-				r.ReplyProposeTS(&ProposeReplyTS{
-					OK:        TRUE,
-					CommandId: propose.CommandId,
-					Value:     propose.Command.Execute(r.State),
-					Timestamp: propose.Timestamp,
-				}, writer, mutex)
-			} else {
-				go func(propose *GPropose) {
-					r.ProposeChan <- propose
-				}(&GPropose{
-					Propose:    propose,
-					Reply:      writer,
-					Mutex:      mutex,
-					Collocated: isProxy,
-				})
+			if r.Trace != nil {
+				r.clientOf[writer] = propose.ClientId
 			}
+			r.M.Unlock()
+			r.Trace.Event(trace.Command(propose.ClientId, propose.CommandId),
+				"propose", "shr.op", strconv.Itoa(int(propose.Command.Op)),
+				"shr.key", propose.Command.K.String())
+			r.proposals.Inc()
+			ln.emulate(func() {
+				r.handleClientPropose(propose, writer, mutex, isProxy)
+			})
 			break
 
 		case READ:
 			// TODO: do something with this
 			read := &Read{}
-			if err = read.Unmarshal(reader); err != nil {
+			if err = read.Unmarshal(in); err != nil {
 				break
 			}
+			cr.Frame(link, msgType)
 			break
 
 		case PROPOSE_AND_READ:
 			// TODO: do something with this
 			pr := &ProposeAndRead{}
-			if err = pr.Unmarshal(reader); err != nil {
+			if err = pr.Unmarshal(in); err != nil {
+				break
+			}
+			cr.Frame(link, msgType)
+			break
+
+		case GENERIC_SMR_BEACON:
+			beacon := &Beacon{}
+			if err = beacon.Unmarshal(in); err != nil {
 				break
 			}
+			cr.Frame(link, msgType)
+			ln.emulate(func() {
+				r.replyClientBeacon(beacon, writer)
+			})
 			break
 
 		case STATS:
@@ -535,28 +800,111 @@ func (r *Replica) clientListener(conn net.Conn) {
 			p, exists := r.RPC.Get(msgType)
 			if exists {
 				obj := p.Obj.New()
-				if err = obj.Unmarshal(reader); err != nil {
+				if err = obj.Unmarshal(in); err != nil {
 					break
 				}
-				go func(obj fastrpc.Serializable) {
-					p.Chan <- obj
-				}(obj)
+				cr.Frame(link, msgType)
+				r.traceMsg("recv", msgType, obj)
+				ln.emulate(func() {
+					r.deliver(p.Chan, obj)
+				})
 			} else {
 				log.Fatal("Error: received unknown client message ", msgType)
 			}
 		}
 	}
 
+	ln.close()
+
+	r.M.Lock()
+	delete(r.clientOf, writer)
+	delete(r.clientCaps, writer)
+	r.M.Unlock()
+	link.Close()
+
 	conn.Close()
 	log.Println("Client down", conn.RemoteAddr())
 }
 
-func storeFullFileName(repId int) string {
+func (r *Replica) handleClientPropose(propose *Propose,
+	writer *bufio.Writer, mutex *sync.Mutex, isProxy bool) {
+
+	if !r.OwnsAll(&propose.Command) {
+		r.ReplyProposeTS(&ProposeReplyTS{
+			OK:        WRONG_GROUP,
+			CommandId: propose.CommandId,
+			Value:     state.NIL(),
+			Timestamp: propose.Timestamp,
+		}, writer, mutex)
+		return
+	}
+	op := propose.Command.Op
+	if r.LRead && (op == state.GET || op == state.SCAN) {
+		val, rerr := propose.Command.ReadAt(r.State, r.State.Version())
+		if rerr != nil {
+			val = propose.Command.Read(r.State)
+		}
+		r.reads.Inc()
+		r.ReplyProposeTS(&ProposeReplyTS{
+			OK:        TRUE,
+			CommandId: propose.CommandId,
+			Value:     val,
+			Timestamp: propose.Timestamp,
+		}, writer, mutex)
+	} else if len(r.ProposeChan) >= PROPOSE_QUEUE_SIZE {
+		r.rejected.Inc()
+		r.ReplyProposeTS(&ProposeReplyTS{
+			OK:         BUSY,
+			CommandId:  propose.CommandId,
+			Value:      state.NIL(),
+			Timestamp:  propose.Timestamp,
+			RetryAfter: int64(RETRY_AFTER),
+		}, writer, mutex)
+	} else {
+		r.ProposeChan <- &GPropose{
+			Propose:    propose,
+			Reply:      writer,
+			Mutex:      mutex,
+			Collocated: isProxy,
+		}
+	}
+}
+
+// deliver hands obj to the protocol, waiting while its queue is full
+func (r *Replica) deliver(c chan fastrpc.Serializable, obj fastrpc.Serializable) {
+	select {
+	case c <- obj:
+	default:
+		r.stalls.Inc()
+		c <- obj
+	}
+}
+
+// groups maps the address of each replica
+// served by the process to its group
+var groups sync.Map
+
+// SetGroup tells that the replica of address addr belongs to group g,
+// it must be called before the creation of the replica
+func SetGroup(addr string, g int) {
+	groups.Store(addr, g)
+}
+
+func groupOf(addr string) int {
+	if g, exists := groups.Load(addr); exists {
+		return g.(int)
+	}
+	return 0
+}
+
+func storeFullFileName(repId int, addr string) string {
 	s := Storage
 	if s == "" {
 		s = "~"
 	}
-	return fmt.Sprintf("%v/%v-r%d", s, StoreFilname, repId)
+	// replicas of different groups may run in the same process
+	port := addr[strings.LastIndex(addr, ":")+1:]
+	return fmt.Sprintf("%v/%v-r%d-%v", s, StoreFilname, repId, port)
 }
 
 func Leader(ballot int32, repNum int) int32 {
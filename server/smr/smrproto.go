@@ -17,6 +17,15 @@ const (
 	GENERIC_SMR_BEACON
 	GENERIC_SMR_BEACON_REPLY
 	STATS
+	// WRONG_GROUP is sent as the OK field of a ProposeReplyTS,
+	// hence, clients reading the RPC table see it as a message code
+	WRONG_GROUP
+	// BUSY is sent as the OK field of a ProposeReplyTS when the replica
+	// has too many pending proposals, its RetryAfter being the time
+	// to wait before proposing again, in nanoseconds
+	BUSY
+	// COMPRESSED precedes a message compressed by a Sender
+	COMPRESSED
 	RPC_TABLE
 )
 
@@ -33,10 +42,11 @@ type ProposeReply struct {
 }
 
 type ProposeReplyTS struct {
-	OK        uint8
-	CommandId int32
-	Value     state.Value
-	Timestamp int64
+	OK         uint8
+	CommandId  int32
+	Value      state.Value
+	Timestamp  int64
+	RetryAfter int64
 }
 
 type Read struct {
@@ -69,19 +79,28 @@ type BeaconReply struct {
 	Timestamp int64
 }
 
+// PingArgs carries the Epoch of the group as known by the master
 type PingArgs struct {
 	ActAsLeader uint8
+	Epoch       int32
 }
 
 type PingReply struct{}
 
 type BeTheLeaderArgs struct{}
 
+// BeTheLeaderReply tells the master which replica is the leader and
+// which one should be the next, -1 meaning unknown. As gob does not
+// send the fields equal to zero, which would then keep the default -1
+// of NewBeTheLeaderReply, the replica 0 is sent as ZERO_ID and turned
+// back into 0 by UpdateBeTheLeaderReply.
 type BeTheLeaderReply struct {
 	Leader     int32
 	NextLeader int32
 }
 
+const ZERO_ID = int32(-2)
+
 func NewBeTheLeaderReply() *BeTheLeaderReply {
 	return &BeTheLeaderReply{
 		Leader:     -1,
@@ -90,10 +109,10 @@ func NewBeTheLeaderReply() *BeTheLeaderReply {
 }
 
 func UpdateBeTheLeaderReply(btlr *BeTheLeaderReply) {
-	if btlr.Leader == -2 {
+	if btlr.Leader == ZERO_ID {
 		btlr.Leader = 0
 	}
-	if btlr.NextLeader == -2 {
+	if btlr.NextLeader == ZERO_ID {
 		btlr.NextLeader = 0
 	}
 }
@@ -102,6 +121,17 @@ func (r *BeTheLeaderReply) IsDefault() bool {
 	return r.Leader == -1 && r.NextLeader == -1
 }
 
+// ReconfigureArgs is sent by the master to the alive replicas whenever
+// one of them is detected to be dead or answers again after being dead
+// (Joined). Epoch is incremented at each reconfiguration of the group.
+type ReconfigureArgs struct {
+	Epoch  int32
+	Alive  []bool
+	Joined []bool
+}
+
+type ReconfigureReply struct{}
+
 type Stats struct {
 	M map[string]int `json:"stats"`
 }
@@ -113,7 +143,7 @@ type Stats struct {
 ///////////////////////////////////////////////////////////////////////////////
 
 func (t *PingArgs) BinarySize() (nbytes int, sizeKnown bool) {
-	return 1, true
+	return 5, true
 }
 
 type PingArgsCache struct {
@@ -146,21 +176,27 @@ func (p *PingArgsCache) Put(t *PingArgs) {
 	p.mu.Unlock()
 }
 func (t *PingArgs) Marshal(wire io.Writer) {
-	var b [1]byte
+	var b [5]byte
 	var bs []byte
-	bs = b[:1]
+	bs = b[:5]
 	bs[0] = byte(t.ActAsLeader)
+	tmp32 := t.Epoch
+	bs[1] = byte(tmp32)
+	bs[2] = byte(tmp32 >> 8)
+	bs[3] = byte(tmp32 >> 16)
+	bs[4] = byte(tmp32 >> 24)
 	wire.Write(bs)
 }
 
 func (t *PingArgs) Unmarshal(wire io.Reader) error {
-	var b [1]byte
+	var b [5]byte
 	var bs []byte
-	bs = b[:1]
-	if _, err := io.ReadAtLeast(wire, bs, 1); err != nil {
+	bs = b[:5]
+	if _, err := io.ReadAtLeast(wire, bs, 5); err != nil {
 		return err
 	}
 	t.ActAsLeader = uint8(bs[0])
+	t.Epoch = int32((uint32(bs[1]) | (uint32(bs[2]) << 8) | (uint32(bs[3]) << 16) | (uint32(bs[4]) << 24)))
 	return nil
 }
 
@@ -400,6 +436,16 @@ func (t *ProposeReplyTS) Marshal(wire io.Writer) {
 	bs[6] = byte(tmp64 >> 48)
 	bs[7] = byte(tmp64 >> 56)
 	wire.Write(bs)
+	tmp64 = t.RetryAfter
+	bs[0] = byte(tmp64)
+	bs[1] = byte(tmp64 >> 8)
+	bs[2] = byte(tmp64 >> 16)
+	bs[3] = byte(tmp64 >> 24)
+	bs[4] = byte(tmp64 >> 32)
+	bs[5] = byte(tmp64 >> 40)
+	bs[6] = byte(tmp64 >> 48)
+	bs[7] = byte(tmp64 >> 56)
+	wire.Write(bs)
 }
 
 func (t *ProposeReplyTS) Unmarshal(wire io.Reader) error {
@@ -417,6 +463,10 @@ func (t *ProposeReplyTS) Unmarshal(wire io.Reader) error {
 		return err
 	}
 	t.Timestamp = int64((uint64(bs[0]) | (uint64(bs[1]) << 8) | (uint64(bs[2]) << 16) | (uint64(bs[3]) << 24) | (uint64(bs[4]) << 32) | (uint64(bs[5]) << 40) | (uint64(bs[6]) << 48) | (uint64(bs[7]) << 56)))
+	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+		return err
+	}
+	t.RetryAfter = int64((uint64(bs[0]) | (uint64(bs[1]) << 8) | (uint64(bs[2]) << 16) | (uint64(bs[3]) << 24) | (uint64(bs[4]) << 32) | (uint64(bs[5]) << 40) | (uint64(bs[6]) << 48) | (uint64(bs[7]) << 56)))
 	return nil
 }
 
@@ -0,0 +1,239 @@
+package shard
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/vonaka/shreplic/state"
+)
+
+const (
+	RANGE = "range"
+	HASH  = "hash"
+)
+
+// MOVING is the group of a range that is being transferred
+// from one group to another. Such a range is served by nobody.
+const MOVING = -1
+
+var (
+	UNKNOWN_PARTITION = errors.New("Unknown partitioning scheme")
+	NO_SUCH_GROUP     = errors.New("No such group")
+	BAD_SPLIT         = errors.New("Split point is already a range boundary")
+	SAME_GROUP        = errors.New("Range already belongs to this group")
+)
+
+// Range is a set of consecutive points [Lo, Hi] owned by a group.
+//
+// With range partitioning a point is a key. With hash partitioning
+// a point is a bucket, i.e., the hash of a key modulo Buckets.
+type Range struct {
+	Lo    state.Key
+	Hi    state.Key
+	Group int
+}
+
+// Map is the partition map of a sharded deployment. Every change
+// of the map increments its epoch.
+type Map struct {
+	Epoch   int64
+	Groups  int
+	Hash    bool
+	Buckets int64
+	Ranges  []Range
+}
+
+// NewMap returns a map that splits the domain of points evenly
+// between the given number of groups
+func NewMap(partitioning string, groups int, buckets int64) (*Map, error) {
+	if groups < 1 {
+		return nil, NO_SUCH_GROUP
+	}
+
+	m := &Map{
+		Epoch:  0,
+		Groups: groups,
+		Ranges: make([]Range, groups),
+	}
+
+	var lo, width uint64
+	switch partitioning {
+	case RANGE:
+		lo = uint64(math.MaxUint64)/2 + 1 // as a Key it is math.MinInt64
+		width = uint64(math.MaxUint64)/uint64(groups) + 1
+	case HASH:
+		if buckets < int64(groups) {
+			buckets = int64(groups)
+		}
+		m.Hash = true
+		m.Buckets = buckets
+		width = uint64(buckets) / uint64(groups)
+	default:
+		return nil, UNKNOWN_PARTITION
+	}
+
+	for g := range m.Ranges {
+		m.Ranges[g].Lo = state.Key(lo + uint64(g)*width)
+		m.Ranges[g].Hi = state.Key(lo + uint64(g+1)*width - 1)
+		m.Ranges[g].Group = g
+	}
+	if m.Hash {
+		m.Ranges[groups-1].Hi = state.Key(buckets - 1)
+	} else {
+		m.Ranges[groups-1].Hi = state.Key(math.MaxInt64)
+	}
+
+	return m, nil
+}
+
+// Point returns the point of the domain to which k belongs
+func (m *Map) Point(k state.Key) state.Key {
+	if !m.Hash {
+		return k
+	}
+	return state.Point(k, m.Buckets)
+}
+
+func (m *Map) find(p state.Key) int {
+	lo, hi := 0, len(m.Ranges)-1
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if m.Ranges[mid].Hi < p {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
+
+// Lookup returns the group that serves k
+func (m *Map) Lookup(k state.Key) int {
+	return m.Ranges[m.find(m.Point(k))].Group
+}
+
+// RangeOf returns the range that contains k
+func (m *Map) RangeOf(k state.Key) Range {
+	return m.Ranges[m.find(m.Point(k))]
+}
+
+// Serves tells whether every key of [lo, hi] is served by the group g
+func (m *Map) Serves(g int, lo, hi state.Key) bool {
+	if m.Hash {
+		for k := lo; ; k++ {
+			if m.Lookup(k) != g {
+				return false
+			}
+			if k == hi {
+				return true
+			}
+		}
+	}
+	for i := m.find(lo); ; i++ {
+		if m.Ranges[i].Group != g {
+			return false
+		}
+		if m.Ranges[i].Hi >= hi {
+			return true
+		}
+	}
+}
+
+// Cut divides the keys [lo, hi] into consecutive
+// parts that are each served by a single group
+func (m *Map) Cut(lo, hi state.Key) [][2]state.Key {
+	parts := make([][2]state.Key, 0, 1)
+	start, g := lo, m.Lookup(lo)
+	if !m.Hash {
+		for i := m.find(lo); m.Ranges[i].Hi < hi; i++ {
+			if next := m.Ranges[i+1]; next.Group != g {
+				parts = append(parts, [2]state.Key{start, next.Lo - 1})
+				start, g = next.Lo, next.Group
+			}
+		}
+		return append(parts, [2]state.Key{start, hi})
+	}
+	for k := lo; k != hi; k++ {
+		if h := m.Lookup(k + 1); h != g {
+			parts = append(parts, [2]state.Key{start, k})
+			start, g = k+1, h
+		}
+	}
+	return append(parts, [2]state.Key{start, hi})
+}
+
+// Within tells whether k belongs to rg
+func (m *Map) Within(rg Range, k state.Key) bool {
+	p := m.Point(k)
+	return rg.Lo <= p && p <= rg.Hi
+}
+
+// Freeze returns the command that makes the group of rg reject
+// the commands ordered after it on rg (see state.FreezeCommand)
+func (m *Map) Freeze(rg Range) state.Command {
+	return state.FreezeCommand(rg.Lo, rg.Hi, m.buckets())
+}
+
+// Thaw returns the command that lets the group
+// that executes it serve rg again after Freeze
+func (m *Map) Thaw(rg Range) state.Command {
+	return state.ThawCommand(rg.Lo, rg.Hi, m.buckets())
+}
+
+func (m *Map) buckets() int64 {
+	if !m.Hash {
+		return 0
+	}
+	return m.Buckets
+}
+
+// Split divides the range that contains k so that the point of k
+// becomes the lower bound of a new range. Both halves are kept by
+// the group that owned the range.
+func (m *Map) Split(k state.Key) error {
+	p := m.Point(k)
+	i := m.find(p)
+	if m.Ranges[i].Lo == p {
+		return BAD_SPLIT
+	}
+
+	left := m.Ranges[i]
+	left.Hi = p - 1
+	m.Ranges[i].Lo = p
+	m.Ranges = append(m.Ranges, Range{})
+	copy(m.Ranges[i+1:], m.Ranges[i:])
+	m.Ranges[i] = left
+	m.Epoch++
+	return nil
+}
+
+// Assign gives the range that contains k to the group g
+// (or marks it as MOVING) and returns the updated range
+func (m *Map) Assign(k state.Key, g int) (Range, error) {
+	if g != MOVING && (g < 0 || g >= m.Groups) {
+		return Range{}, NO_SUCH_GROUP
+	}
+	i := m.find(m.Point(k))
+	if m.Ranges[i].Group == g {
+		return m.Ranges[i], SAME_GROUP
+	}
+	m.Ranges[i].Group = g
+	m.Epoch++
+	return m.Ranges[i], nil
+}
+
+func (m *Map) Copy() *Map {
+	c := *m
+	c.Ranges = make([]Range, len(m.Ranges))
+	copy(c.Ranges, m.Ranges)
+	return &c
+}
+
+func (m *Map) String() string {
+	s := fmt.Sprintf("epoch %d:", m.Epoch)
+	for _, rg := range m.Ranges {
+		s += fmt.Sprintf(" [%d, %d]->%d", int64(rg.Lo), int64(rg.Hi), rg.Group)
+	}
+	return s
+}
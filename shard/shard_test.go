@@ -0,0 +1,140 @@
+package shard
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/vonaka/shreplic/state"
+)
+
+func TestRangeLookup(t *testing.T) {
+	m, err := NewMap(RANGE, 4, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Ranges[0].Lo != math.MinInt64 || m.Ranges[3].Hi != math.MaxInt64 {
+		t.Fatalf("the ranges do not cover every key: %v", m)
+	}
+	for i := 1; i < len(m.Ranges); i++ {
+		if m.Ranges[i].Lo != m.Ranges[i-1].Hi+1 {
+			t.Fatalf("ranges %d and %d are not consecutive: %v", i-1, i, m)
+		}
+	}
+
+	for _, c := range []struct {
+		k state.Key
+		g int
+	}{
+		{math.MinInt64, 0},
+		{-1 << 62, 1},
+		{-1, 1},
+		{0, 2},
+		{1 << 62, 3},
+		{math.MaxInt64, 3},
+	} {
+		if g := m.Lookup(c.k); g != c.g {
+			t.Errorf("Lookup(%d) = %d, want %d", c.k, g, c.g)
+		}
+		if !m.Within(m.RangeOf(c.k), c.k) {
+			t.Errorf("%d is not within its range", c.k)
+		}
+	}
+}
+
+func TestHashLookup(t *testing.T) {
+	m, err := NewMap(HASH, 3, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Ranges[0].Lo != 0 || m.Ranges[2].Hi != 15 {
+		t.Fatalf("the ranges do not cover every bucket: %v", m)
+	}
+	for k := state.Key(-100); k < 100; k++ {
+		p := m.Point(k)
+		if p < 0 || p >= 16 {
+			t.Fatalf("point of %d out of the buckets: %d", k, p)
+		}
+		rg := m.RangeOf(k)
+		if p < rg.Lo || p > rg.Hi || m.Lookup(k) != rg.Group {
+			t.Fatalf("key %d of point %d found in %v", k, p, rg)
+		}
+	}
+
+	if m, _ := NewMap(HASH, 4, 2); m.Buckets != 4 {
+		t.Fatalf("%d buckets for 4 groups", m.Buckets)
+	}
+	if _, err := NewMap("other", 1, 0); err != UNKNOWN_PARTITION {
+		t.Fatalf("got %v, want %v", err, UNKNOWN_PARTITION)
+	}
+}
+
+func TestSplitAndAssign(t *testing.T) {
+	m, _ := NewMap(RANGE, 2, 0)
+	if err := m.Split(100); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Split(100); err != BAD_SPLIT {
+		t.Fatalf("split twice: got %v, want %v", err, BAD_SPLIT)
+	}
+	if m.Epoch != 1 || len(m.Ranges) != 3 {
+		t.Fatalf("after the split: %v", m)
+	}
+
+	c := m.Copy()
+	rg, err := m.Assign(100, MOVING)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rg.Lo != 100 || rg.Group != MOVING || m.Epoch != 2 {
+		t.Fatalf("after the assignment of %v: %v", rg, m)
+	}
+	if c.Lookup(100) != 1 {
+		t.Fatalf("the copy changed: %v", c)
+	}
+
+	// a MOVING range is served by nobody
+	if g := m.Lookup(200); g != MOVING {
+		t.Fatalf("Lookup(200) = %d, want %d", g, MOVING)
+	}
+	if m.Serves(1, 0, 200) || m.Serves(1, 100, 100) {
+		t.Fatalf("a MOVING range is served: %v", m)
+	}
+	if !m.Serves(1, 0, 99) {
+		t.Fatalf("[0, 99] is not served by 1: %v", m)
+	}
+
+	if _, err := m.Assign(100, 2); err != NO_SUCH_GROUP {
+		t.Fatalf("got %v, want %v", err, NO_SUCH_GROUP)
+	}
+	if _, err := m.Assign(100, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Assign(100, 0); err != SAME_GROUP {
+		t.Fatalf("got %v, want %v", err, SAME_GROUP)
+	}
+	if g := m.Lookup(math.MaxInt64); g != 0 {
+		t.Fatalf("Lookup(max) = %d, want 0", g)
+	}
+}
+
+func TestCut(t *testing.T) {
+	m, _ := NewMap(RANGE, 2, 0)
+	m.Split(-10)
+	m.Split(10)
+	m.Assign(-10, 1)
+
+	// [-10, -1], [0, 9] and [10, max] all belong to 1
+	parts := m.Cut(-20, 20)
+	want := [][2]state.Key{{-20, -11}, {-10, 20}}
+	if !reflect.DeepEqual(parts, want) {
+		t.Fatalf("got %v, want %v", parts, want)
+	}
+
+	m, _ = NewMap(HASH, 2, 4)
+	for _, part := range m.Cut(0, 50) {
+		if g := m.Lookup(part[0]); !m.Serves(g, part[0], part[1]) {
+			t.Fatalf("%v is not served by a single group", part)
+		}
+	}
+}
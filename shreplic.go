@@ -58,6 +58,7 @@ func main() {
 		defsFile    = *shpath + "/user/" + *pname + "/defs.go"
 		protoFile   = *shpath + "/user/" + *pname + "/proto.go"
 		replicaFile = *shpath + "/user/" + *pname + "/" + *pname + ".go"
+		poolFile    = *shpath + "/user/" + *pname + "/pool.go"
 	)
 
 	if *install {
@@ -114,6 +115,15 @@ func main() {
 	}
 	printer.Fprint(&buf, fset, f)
 	replica = buf.String()
+	pool := pools(*pname, ms)
+	f, err = parser.ParseFile(fset, "", pool, parser.ParseComments)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	buf.Reset()
+	printer.Fprint(&buf, fset, f)
+	pool = buf.String()
 
 	err = ioutil.WriteFile(defsFile, []byte(defs), 0644)
 	if err != nil {
@@ -130,6 +140,11 @@ func main() {
 		fmt.Println(err)
 		return
 	}
+	err = ioutil.WriteFile(poolFile, []byte(pool), 0644)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 	make := "all:\n"
 	make = make + "\tmake -C " + *shpath + "\n"
 	make = make + "\tln -fs " + *shpath + "/bin ./\n"
@@ -190,7 +205,7 @@ func protocol(name string, msgs []string) string {
 	p = p + "cs: CommunicationSupply{\n"
 	p = p + "maxLatency: 0,\n\n"
 	for _, msg := range msgs {
-		p = p + msg + "Chan: make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE),\n"
+		p = p + msg + "Chan: make(chan fastrpc.Serializable, smr.QUEUE_SIZE),\n"
 	}
 	p = p + "},\n"
 	p = p + "}\n\n"
@@ -203,6 +218,13 @@ func protocol(name string, msgs []string) string {
 	p = p + "return r\n"
 	p = p + "}\n\n"
 
+	p = p + "// Messages registers in t the messages of the protocol\n"
+	p = p + "func Messages(t *fastrpc.Table) {\n"
+	for _, msg := range msgs {
+		p = p + "t.Register(new(" + msg + "), nil)\n"
+	}
+	p = p + "}\n\n"
+
 	p = p + "func (r *Replica) run() {\n"
 	p = p + "r.ConnectToPeers()\n"
 	p = p + "latencies := r.ComputeClosestPeers()\n"
@@ -236,9 +258,39 @@ func protocol(name string, msgs []string) string {
 		p = p + "}\n"
 	}
 
+	return p
+}
+
+// pools returns the pools recycling the messages msgs
+func pools(name string, msgs []string) string {
+	p := "package " + name + "\n\n"
+
+	p = p + "import (\n"
+	p = p + "\"sync\"\n\n"
+	p = p + "\"github.com/vonaka/shreplic/tools/fastrpc\"\n"
+	p = p + ")\n"
+
 	for _, msg := range msgs {
+		pool := strings.ToLower(msg[:1]) + msg[1:] + "Pool"
+		p = p + "\nvar " + pool + " = sync.Pool{\n"
+		p = p + "New: func() interface{} {\n"
+		p = p + "return new(" + msg + ")\n"
+		p = p + "},\n"
+		p = p + "}\n"
+		p = p + "\n// Get" + msg + " returns an empty " + msg + " taken from its pool\n"
+		p = p + "func Get" + msg + "() *" + msg + " {\n"
+		p = p + "return " + pool + ".Get().(*" + msg + ")\n"
+		p = p + "}\n"
+		p = p + "\n// Put" + msg + " empties m and returns it to its pool\n"
+		p = p + "func Put" + msg + "(m *" + msg + ") {\n"
+		p = p + "*m = " + msg + "{}\n"
+		p = p + pool + ".Put(m)\n"
+		p = p + "}\n"
+		p = p + "\nfunc (m *" + msg + ") Free() {\n"
+		p = p + "Put" + msg + "(m)\n"
+		p = p + "}\n"
 		p = p + "\nfunc (m *" + msg + ") New() fastrpc.Serializable {\n"
-		p = p + "\treturn new(" + msg + ")\n"
+		p = p + "return Get" + msg + "()\n"
 		p = p + "}\n"
 	}
 
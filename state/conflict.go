@@ -0,0 +1,195 @@
+package state
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// ConflictRelation describes which commands do not commute.
+//
+// Protocols that track dependencies per key index every command
+// under the keys returned by KeysOf: two commands can conflict only
+// if they share at least one such key. If ReadsCommute is true, then
+// two commands that are both read-only never conflict.
+type ConflictRelation struct {
+	Conflict     func(gamma, delta *Command) bool
+	KeysOf       func(cmd *Command) []Key
+	ReadsCommute bool
+}
+
+const (
+	KEY_CONFLICT   = "key"
+	RANGE_CONFLICT = "range"
+	RW_CONFLICT    = "rw"
+	ALL_CONFLICT   = "all"
+
+	DEFAULT_CONFLICT = RW_CONFLICT
+)
+
+// ALL_KEY is the key under which every command is indexed
+// when the conflict relation does not provide KeysOf
+const ALL_KEY = Key(0)
+
+var UNKNOWN_CONFLICT = errors.New("Unknown conflict relation")
+
+var (
+	relationsM sync.Mutex
+	relations  = map[string]*ConflictRelation{
+		KEY_CONFLICT: {
+			Conflict: func(gamma, delta *Command) bool {
+				return gamma.K == delta.K
+			},
+			KeysOf: func(cmd *Command) []Key {
+				return []Key{cmd.K}
+			},
+			ReadsCommute: false,
+		},
+		RANGE_CONFLICT: {
+			Conflict:     overlap,
+			KeysOf:       keysInRange,
+			ReadsCommute: false,
+		},
+		RW_CONFLICT: {
+			Conflict: func(gamma, delta *Command) bool {
+				return (gamma.Op == PUT || delta.Op == PUT) && overlap(gamma, delta)
+			},
+			KeysOf:       keysInRange,
+			ReadsCommute: true,
+		},
+		ALL_CONFLICT: {
+			Conflict: func(_, _ *Command) bool {
+				return true
+			},
+			KeysOf: func(_ *Command) []Key {
+				return []Key{ALL_KEY}
+			},
+			ReadsCommute: false,
+		},
+	}
+	relation = relations[DEFAULT_CONFLICT]
+)
+
+// RegisterConflictRelation makes a user-defined relation
+// available to SetConflictRelation under the given name
+func RegisterConflictRelation(name string, cr *ConflictRelation) {
+	relationsM.Lock()
+	defer relationsM.Unlock()
+
+	if cr.KeysOf == nil {
+		cr.KeysOf = func(_ *Command) []Key {
+			return []Key{ALL_KEY}
+		}
+	}
+	relations[name] = cr
+}
+
+// SetConflictRelation must be called before any replica starts
+func SetConflictRelation(name string) error {
+	relationsM.Lock()
+	defer relationsM.Unlock()
+
+	cr, exists := relations[name]
+	if !exists {
+		return UNKNOWN_CONFLICT
+	}
+	relation = cr
+	return nil
+}
+
+func ConflictRelations() []string {
+	relationsM.Lock()
+	defer relationsM.Unlock()
+
+	names := make([]string, 0, len(relations))
+	for name := range relations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func Conflict(gamma *Command, delta *Command) bool {
+	if IsBarrier(gamma) || IsBarrier(delta) {
+		return true
+	}
+	if IsTx(gamma) || IsTx(delta) {
+		for _, g := range asWrites(gamma) {
+			for _, d := range asWrites(delta) {
+				if relation.Conflict(&g, &d) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	if relation.ReadsCommute && ReadOnly(gamma) && ReadOnly(delta) {
+		return false
+	}
+	return relation.Conflict(gamma, delta)
+}
+
+func ConflictBatch(batch1 []Command, batch2 []Command) bool {
+	for i := 0; i < len(batch1); i++ {
+		for j := 0; j < len(batch2); j++ {
+			if Conflict(&batch1[i], &batch2[j]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ConflictKeys returns the keys under which cmd must be indexed
+func ConflictKeys(cmd *Command) []Key {
+	if !IsTx(cmd) {
+		return relation.KeysOf(cmd)
+	}
+	ks := make([]Key, 0)
+	for _, w := range asWrites(cmd) {
+		ks = append(ks, relation.KeysOf(&w)...)
+	}
+	return ks
+}
+
+// ReadOnly tells whether cmd commutes with
+// any other read-only command on the same key
+func ReadOnly(cmd *Command) bool {
+	return relation.ReadsCommute && (cmd.Op == GET || cmd.Op == SCAN)
+}
+
+// asWrites returns the commands against which the conflicts of cmd
+// are evaluated: a transactional command behaves as a PUT on each of
+// its keys (a decision as a PUT on the key of the coordinator)
+func asWrites(cmd *Command) []Command {
+	if !IsTx(cmd) {
+		return []Command{*cmd}
+	}
+	ks := Keys(cmd)
+	ws := make([]Command, len(ks))
+	for i, k := range ks {
+		ws[i] = Command{
+			Op: PUT,
+			K:  k,
+			V:  NIL(),
+		}
+	}
+	return ws
+}
+
+func overlap(gamma, delta *Command) bool {
+	glb, gub := KeyRange(gamma)
+	dlb, dub := KeyRange(delta)
+	return glb <= dub && dlb <= gub
+}
+
+func keysInRange(cmd *Command) []Key {
+	lb, ub := KeyRange(cmd)
+	ks := make([]Key, 0, ub-lb+1)
+	for k := lb; ; k++ {
+		ks = append(ks, k)
+		if k == ub {
+			return ks
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package state
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/fnv"
+)
+
+// frozenRange is a range of points [lo, hi] of a partition
+// with the given number of buckets (see Point)
+type frozenRange struct {
+	lo      Key
+	hi      Key
+	buckets int64
+}
+
+// rejected is returned by Execute for the commands on frozen keys
+var rejected = Value("rejected")
+
+// MAX_INSTALL is the size from which the content of a range
+// is split among several INSTALL commands
+const MAX_INSTALL = 32 << 10
+
+// Point returns the point of k in a partition of the keys in buckets,
+// which is k itself if buckets is 0 (range partitioning)
+func Point(k Key, buckets int64) Key {
+	if buckets == 0 {
+		return k
+	}
+	var bs [8]byte
+	binary.LittleEndian.PutUint64(bs[:], uint64(k))
+	h := fnv.New64a()
+	h.Write(bs[:])
+	return Key(h.Sum64() % uint64(buckets))
+}
+
+// FreezeCommand stops the execution of the commands on the points
+// [lo, hi] of a partition with the given number of buckets. It is a
+// barrier: the commands ordered before it are executed as usual, those
+// ordered after it are rejected until Thaw is called.
+func FreezeCommand(lo, hi Key, buckets int64) Command {
+	return rangeCommand(FREEZE, lo, hi, buckets)
+}
+
+// ThawCommand lets the commands on the points [lo, hi] of
+// a partition with the given number of buckets be executed again
+func ThawCommand(lo, hi Key, buckets int64) Command {
+	return rangeCommand(THAW, lo, hi, buckets)
+}
+
+func rangeCommand(op Operation, lo, hi Key, buckets int64) Command {
+	v := make([]byte, 16)
+	binary.LittleEndian.PutUint64(v, uint64(hi))
+	binary.LittleEndian.PutUint64(v[8:], uint64(buckets))
+	return Command{
+		Op: op,
+		K:  lo,
+		V:  v,
+	}
+}
+
+// InstallCommands writes ks and vs, the content of a range
+// exported by another group, at the log position of each command
+func InstallCommands(ks []Key, vs []Value) []Command {
+	cmds := make([]Command, 0)
+	var b bytes.Buffer
+	first := 0
+	flush := func(next int) {
+		if b.Len() > 0 {
+			cmds = append(cmds, Command{
+				Op: INSTALL,
+				K:  ks[first],
+				V:  append(Value(nil), b.Bytes()...),
+			})
+			b.Reset()
+		}
+		first = next
+	}
+	for i := range ks {
+		if b.Len()+12+len(vs[i]) > MAX_INSTALL {
+			flush(i)
+		}
+		ks[i].Marshal(&b)
+		vs[i].Marshal(&b)
+	}
+	flush(len(ks))
+	return cmds
+}
+
+// IsBarrier tells whether cmd changes the keys served by a group,
+// it is then ordered with respect to every other command
+func IsBarrier(cmd *Command) bool {
+	return cmd.Op == FREEZE || cmd.Op == THAW || cmd.Op == INSTALL
+}
+
+// Rejected tells whether v is the result of a command that
+// was not executed because it accesses a frozen key
+func Rejected(v Value) bool {
+	return len(v) == len(rejected) && len(v) > 0 && &v[0] == &rejected[0]
+}
+
+// Frozen tells whether a FREEZE of [lo, hi] has been executed
+// and no prepared transaction holds a lock in this range
+func (st *State) Frozen(lo, hi Key, buckets int64) bool {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	for _, f := range st.frozen {
+		if f.lo == lo && f.hi == hi && f.buckets == buckets {
+			for k := range st.txs.locks {
+				if f.contains(k) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func decodeRange(c *Command) (frozenRange, bool) {
+	if len(c.V) != 16 {
+		return frozenRange{}, false
+	}
+	return frozenRange{
+		lo:      c.K,
+		hi:      Key(binary.LittleEndian.Uint64(c.V)),
+		buckets: int64(binary.LittleEndian.Uint64(c.V[8:])),
+	}, true
+}
+
+func (st *State) thaw(c *Command) {
+	t, ok := decodeRange(c)
+	if !ok {
+		return
+	}
+	fs := st.frozen[:0]
+	for _, f := range st.frozen {
+		if f.buckets != t.buckets || f.hi < t.lo || t.hi < f.lo {
+			fs = append(fs, f)
+		}
+	}
+	st.frozen = fs
+}
+
+func (st *State) install(c *Command, ver Version) {
+	r := bytes.NewReader(c.V)
+	for r.Len() > 0 {
+		var k Key
+		var v Value
+		if k.Unmarshal(r) != nil || v.Unmarshal(r) != nil {
+			return
+		}
+		st.store.put(k, ver, v)
+	}
+}
+
+func (st *State) freeze(c *Command) {
+	f, ok := decodeRange(c)
+	if !ok {
+		return
+	}
+	for _, g := range st.frozen {
+		if g == f {
+			return
+		}
+	}
+	st.frozen = append(st.frozen, f)
+}
+
+func (f *frozenRange) contains(k Key) bool {
+	p := Point(k, f.buckets)
+	return f.lo <= p && p <= f.hi
+}
+
+// rejects tells whether c accesses a frozen key. The decisions and
+// the ends of transactions are never rejected, as their keys were
+// locked before the freeze.
+func (st *State) rejects(c *Command) bool {
+	if len(st.frozen) == 0 {
+		return false
+	}
+
+	var ks []Key
+	switch c.Op {
+	case PUT, GET:
+		ks = []Key{c.K}
+	case SCAN:
+		lo, hi := KeyRange(c)
+		for _, f := range st.frozen {
+			if f.buckets == 0 && f.lo <= hi && lo <= f.hi {
+				return true
+			}
+		}
+		for k := lo; ; k++ {
+			ks = append(ks, k)
+			if k == hi {
+				break
+			}
+		}
+	case TX_PREPARE:
+		ks = Keys(c)
+	}
+
+	for _, k := range ks {
+		for i := range st.frozen {
+			if st.frozen[i].contains(k) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,213 @@
+package state
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Version is the position of a command in the log of executed commands.
+// Every command executed against a State, reads and no-ops included,
+// takes the next position, hence, PUT operations are tagged with their
+// log position and replicas that execute the same log agree on it.
+type Version int64
+
+const NO_VERSION = Version(-1)
+
+// GCWindow is the number of versions kept behind the last applied
+// version. A non-positive value disables the automatic advance of
+// the horizon.
+var GCWindow = Version(100000)
+
+// GCPeriod is the advance of the horizon after which the old versions
+// of every key are collected, not only those of the keys written again
+var GCPeriod = Version(10000)
+
+var TOO_OLD = errors.New("Snapshot is older than the GC horizon")
+
+type version struct {
+	ver   Version
+	val   Value
+	older atomic.Value // *version
+}
+
+func (v *version) next() *version {
+	o, _ := v.older.Load().(*version)
+	return o
+}
+
+type chain struct {
+	head atomic.Value // *version
+}
+
+func (c *chain) newest() *version {
+	h, _ := c.head.Load().(*version)
+	return h
+}
+
+// at returns the value of the newest version that
+// is not newer than ver
+func (c *chain) at(ver Version) (Value, bool) {
+	for v := c.newest(); v != nil; v = v.next() {
+		if v.ver <= ver {
+			return v.val, true
+		}
+	}
+	return nil, false
+}
+
+// put must be called with the mutex of the store held
+func (c *chain) put(ver Version, val Value, horizon Version) {
+	v := &version{
+		ver: ver,
+		val: val,
+	}
+	if h := c.newest(); h != nil {
+		v.older.Store(h)
+	}
+	c.head.Store(v)
+	c.trim(horizon)
+}
+
+// trim keeps the newest version that is not newer than the horizon,
+// it is the one visible to the oldest allowed snapshot
+func (c *chain) trim(horizon Version) {
+	for v := c.newest(); v != nil; v = v.next() {
+		if v.ver <= horizon {
+			var none *version
+			v.older.Store(none)
+			return
+		}
+	}
+}
+
+type versionedStore struct {
+	keys    sync.Map // Key -> *chain
+	nkeys   int64
+	applied int64
+	horizon int64
+	swept   Version
+}
+
+func newVersionedStore() *versionedStore {
+	return &versionedStore{
+		nkeys:   0,
+		applied: int64(NO_VERSION),
+		horizon: int64(NO_VERSION),
+		swept:   NO_VERSION,
+	}
+}
+
+func (s *versionedStore) version() Version {
+	return Version(atomic.LoadInt64(&s.applied))
+}
+
+func (s *versionedStore) gcHorizon() Version {
+	return Version(atomic.LoadInt64(&s.horizon))
+}
+
+func (s *versionedStore) setHorizon(h Version) {
+	for {
+		old := atomic.LoadInt64(&s.horizon)
+		if int64(h) <= old || int64(h) > atomic.LoadInt64(&s.applied) {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&s.horizon, old, int64(h)) {
+			return
+		}
+	}
+}
+
+// put must be called with the mutex of the store held
+func (s *versionedStore) put(k Key, ver Version, val Value) {
+	c, exists := s.keys.Load(k)
+	if !exists {
+		c = &chain{}
+		s.keys.Store(k, c)
+		atomic.AddInt64(&s.nkeys, 1)
+	}
+	c.(*chain).put(ver, val, s.gcHorizon())
+}
+
+// publish must be called with the mutex of the store held
+func (s *versionedStore) publish(ver Version) {
+	atomic.StoreInt64(&s.applied, int64(ver))
+	if GCWindow > 0 {
+		s.setHorizon(ver - GCWindow)
+	}
+	if h := s.gcHorizon(); GCPeriod > 0 && h-s.swept >= GCPeriod {
+		s.sweep(h)
+	}
+}
+
+// sweep must be called with the mutex of the store held
+func (s *versionedStore) sweep(horizon Version) {
+	s.swept = horizon
+	s.keys.Range(func(_, c interface{}) bool {
+		c.(*chain).trim(horizon)
+		return true
+	})
+}
+
+func (s *versionedStore) get(k Key, ver Version) (Value, bool) {
+	c, exists := s.keys.Load(k)
+	if !exists {
+		return nil, false
+	}
+	return c.(*chain).at(ver)
+}
+
+func (s *versionedStore) scan(from Key, count uint64, ver Version) Value {
+	found := make([]Value, 0)
+	to := scanEnd(from, count)
+
+	if count < uint64(atomic.LoadInt64(&s.nkeys)) {
+		for k := from; ; k++ {
+			if v, exists := s.get(k, ver); exists {
+				found = append(found, v)
+			}
+			if k == to {
+				break
+			}
+		}
+		return concat(found)
+	}
+
+	ks := make([]Key, 0)
+	s.keys.Range(func(k, _ interface{}) bool {
+		key := k.(Key)
+		if key >= from && key <= to {
+			ks = append(ks, key)
+		}
+		return true
+	})
+	sort.Slice(ks, func(i, j int) bool {
+		return ks[i] < ks[j]
+	})
+	for _, k := range ks {
+		if v, exists := s.get(k, ver); exists {
+			found = append(found, v)
+		}
+	}
+	return concat(found)
+}
+
+// scanEnd returns the last key of the range of a SCAN of count keys
+// from from, which is math.MaxInt64 if the range goes beyond it
+func scanEnd(from Key, count uint64) Key {
+	if count >= uint64(math.MaxInt64)-uint64(from) {
+		return math.MaxInt64
+	}
+	return from + Key(count)
+}
+
+func (s *versionedStore) each(ver Version, f func(Key, Value) bool) {
+	s.keys.Range(func(k, c interface{}) bool {
+		if v, exists := c.(*chain).at(ver); exists {
+			return f(k.(Key), v)
+		}
+		return true
+	})
+}
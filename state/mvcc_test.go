@@ -0,0 +1,118 @@
+package state
+
+import (
+	"strconv"
+	"testing"
+)
+
+// withGC runs f with the GC window and period set to window and period
+func withGC(window, period Version, f func()) {
+	w, p := GCWindow, GCPeriod
+	GCWindow, GCPeriod = window, period
+	defer func() {
+		GCWindow, GCPeriod = w, p
+	}()
+	f()
+}
+
+func put(st *State, k Key, v string) Version {
+	c := Command{PUT, k, Value(v)}
+	c.Execute(st)
+	return st.Version()
+}
+
+func getAt(t *testing.T, st *State, k Key, ver Version) string {
+	t.Helper()
+	c := Command{GET, k, NIL()}
+	v, err := c.ReadAt(st, ver)
+	if err != nil {
+		t.Fatalf("GET %d at %d: %v", k, ver, err)
+	}
+	return string(v)
+}
+
+func TestReadAtSnapshots(t *testing.T) {
+	withGC(0, 0, func() {
+		st := InitState()
+		vers := make([]Version, 5)
+		for i := range vers {
+			vers[i] = put(st, 1, strconv.Itoa(i))
+		}
+		for i, ver := range vers {
+			if got := getAt(t, st, 1, ver); got != strconv.Itoa(i) {
+				t.Fatalf("at %d: got %q, want %q", ver, got, strconv.Itoa(i))
+			}
+		}
+		if got := getAt(t, st, 2, st.Version()); got != "" {
+			t.Fatalf("absent key: got %q", got)
+		}
+	})
+}
+
+func TestReadAtHorizon(t *testing.T) {
+	withGC(4, 0, func() {
+		st := InitState()
+		first := put(st, 1, "old")
+		for i := 0; i < 10; i++ {
+			put(st, 2, strconv.Itoa(i))
+		}
+		h := st.Horizon()
+		if h != st.Version()-4 {
+			t.Fatalf("horizon %d, want %d", h, st.Version()-4)
+		}
+
+		c := Command{GET, 1, NIL()}
+		if _, err := c.ReadAt(st, h-1); err != TOO_OLD {
+			t.Fatalf("below the horizon: got %v, want %v", err, TOO_OLD)
+		}
+		// the version of key 1 is older than the horizon,
+		// but it is still the one visible at the horizon
+		if got := getAt(t, st, 1, h); got != "old" {
+			t.Fatalf("at the horizon: got %q, want %q", got, "old")
+		}
+		if got := getAt(t, st, 2, h); got != strconv.Itoa(int(h-first-1)) {
+			t.Fatalf("at the horizon: got %q, want %q", got, strconv.Itoa(int(h-first-1)))
+		}
+	})
+}
+
+func TestSetHorizon(t *testing.T) {
+	withGC(0, 0, func() {
+		st := InitState()
+		for i := 0; i < 5; i++ {
+			put(st, 1, strconv.Itoa(i))
+		}
+		st.SetHorizon(st.Version() + 1)
+		if h := st.Horizon(); h != NO_VERSION {
+			t.Fatalf("horizon beyond the last version: %d", h)
+		}
+		st.SetHorizon(2)
+		st.SetHorizon(1)
+		if h := st.Horizon(); h != 2 {
+			t.Fatalf("horizon %d, want 2", h)
+		}
+	})
+}
+
+func TestSweep(t *testing.T) {
+	withGC(2, 1, func() {
+		st := InitState()
+		put(st, 1, "a")
+		put(st, 1, "b")
+		for i := 0; i < 10; i++ {
+			put(st, 2, strconv.Itoa(i))
+		}
+		// key 1 is not written again, only the sweep collects "a"
+		c, _ := st.store.keys.Load(Key(1))
+		n := 0
+		for v := c.(*chain).newest(); v != nil; v = v.next() {
+			n++
+		}
+		if n != 1 {
+			t.Fatalf("%d versions of key 1 kept, want 1", n)
+		}
+		if got := getAt(t, st, 1, st.Horizon()); got != "b" {
+			t.Fatalf("got %q, want %q", got, "b")
+		}
+	})
+}
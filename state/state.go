@@ -7,8 +7,6 @@ import (
 	"io"
 	"strconv"
 	"sync"
-
-	"github.com/emirpasic/gods/maps/treemap"
 )
 
 type Operation uint8
@@ -18,6 +16,13 @@ const (
 	PUT
 	GET
 	SCAN
+	TX_PREPARE
+	TX_DECIDE
+	TX_COMMIT
+	TX_ABORT
+	FREEZE
+	THAW
+	INSTALL
 )
 
 type Value []byte
@@ -26,6 +31,14 @@ func NIL() Value { return Value([]byte{}) }
 
 type Key int64
 
+// MAX_SCAN bounds the number of keys read by a SCAN
+// after its first one, larger counts are truncated
+const MAX_SCAN = 1 << 16
+
+// MAX_VALUE is the size of the largest Value,
+// whose length is marshaled on 16 bits
+const MAX_VALUE = 1<<16 - 1
+
 type Command struct {
 	Op Operation
 	K  Key
@@ -38,8 +51,10 @@ type Phase int8
 func NOOP() []Command { return []Command{{NONE, 0, NIL()}} }
 
 type State struct {
-	mutex *sync.Mutex
-	Store *treemap.Map
+	mutex  *sync.Mutex
+	store  *versionedStore
+	txs    *txState
+	frozen []frozenRange
 }
 
 func KeyComparator(a, b interface{}) int {
@@ -69,82 +84,185 @@ func concat(slices []Value) Value {
 }
 
 func InitState() *State {
-	return &State{new(sync.Mutex), treemap.NewWith(KeyComparator)}
+	return &State{new(sync.Mutex), newVersionedStore(), newTxState(), nil}
 }
 
-func Conflict(gamma *Command, delta *Command) bool {
-	key := gamma.K
-	lb := delta.K
-	ub := delta.K
+// Version returns the log position of the last executed command,
+// reads can be performed at it without synchronizing with the
+// apply path (see ReadAt)
+func (st *State) Version() Version {
+	return st.store.version()
+}
 
-	if gamma.Op == SCAN && delta.Op == SCAN {
-		return false
-	}
+// Skip takes the next log position without executing a command,
+// for the replicas that do not answer the reads they order
+func (st *State) Skip() {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.store.publish(st.store.version() + 1)
+}
 
-	if gamma.Op == SCAN {
-		key = delta.K
-		lb = gamma.K
-		ub = gamma.K + Key(binary.LittleEndian.Uint64(gamma.V))
-	} else if delta.Op == SCAN {
-		ub = delta.K + Key(binary.LittleEndian.Uint64(delta.V))
-	}
+// Install applies the PUTs data, a copy of the state of another
+// replica whose last executed position is ver, and moves to ver.
+// A replica never goes back: nothing is done if ver is not newer
+// than the current version.
+func (st *State) Install(ver Version, data []Command) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
 
-	if key >= lb && key <= ub {
-		if gamma.Op == PUT || delta.Op == PUT {
-			return true
+	if ver <= st.store.version() {
+		return
+	}
+	for i := range data {
+		if data[i].Op == PUT {
+			st.store.put(data[i].K, ver, data[i].V)
 		}
 	}
-	return false
+	st.store.publish(ver)
 }
 
-func ConflictBatch(batch1 []Command, batch2 []Command) bool {
-	for i := 0; i < len(batch1); i++ {
-		for j := 0; j < len(batch2); j++ {
-			if Conflict(&batch1[i], &batch2[j]) {
-				return true
-			}
-		}
+// Horizon returns the oldest version that can still be read
+func (st *State) Horizon() Version {
+	return st.store.gcHorizon()
+}
+
+// SetHorizon allows to collect the versions older than h.
+// The horizon never goes backward nor beyond the last applied version.
+func (st *State) SetHorizon(h Version) {
+	st.store.setHorizon(h)
+}
+
+// Range calls f on every key that exists at the snapshot ver,
+// in no particular order, until f returns false
+func (st *State) Range(ver Version, f func(Key, Value) bool) error {
+	if ver < st.store.gcHorizon() {
+		return TOO_OLD
 	}
-	return false
+	st.store.each(ver, f)
+	if ver < st.store.gcHorizon() {
+		return TOO_OLD
+	}
+	return nil
 }
 
 func IsRead(command *Command) bool {
 	return command.Op == GET
 }
 
+// IsWrite tells whether the execution of command modifies the state
+func IsWrite(command *Command) bool {
+	return command.Op == PUT || IsTx(command) || IsBarrier(command)
+}
+
 func (c *Command) Execute(st *State) Value {
 
 	st.mutex.Lock()
 	defer st.mutex.Unlock()
 
+	// rejected and locked commands take a position as well,
+	// as every replica rejects them
+	ver := st.store.version() + 1
+	defer st.store.publish(ver)
+
+	if st.rejects(c) {
+		return rejected
+	}
+	if st.blocked(c) {
+		return locked
+	}
+
 	switch c.Op {
+	case GET, SCAN:
+		return st.read(c, ver)
+
 	case PUT:
-		st.Store.Put(c.K, c.V)
+		st.store.put(c.K, ver, c.V)
+
+	case TX_PREPARE:
+		return st.prepare(c)
+
+	case TX_DECIDE:
+		return st.decide(c)
+
+	case TX_COMMIT, TX_ABORT:
+		return st.finish(c, ver)
+
+	case FREEZE:
+		st.freeze(c)
 
+	case THAW:
+		st.thaw(c)
+
+	case INSTALL:
+		st.install(c, ver)
+	}
+
+	return NIL()
+}
+
+// ReadAt executes a GET or a SCAN against the snapshot ver
+// without taking the lock of the apply path. It returns
+// TOO_OLD if ver is older than the GC horizon.
+func (c *Command) ReadAt(st *State, ver Version) (Value, error) {
+	if ver < st.store.gcHorizon() {
+		return NIL(), TOO_OLD
+	}
+
+	v := st.read(c, ver)
+
+	// versions might have been collected while reading
+	if ver < st.store.gcHorizon() {
+		return NIL(), TOO_OLD
+	}
+	return v, nil
+}
+
+// Read executes the GET or SCAN c at the last executed position
+// without taking a new one, for the reads served outside of the log
+func (c *Command) Read(st *State) Value {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if st.rejects(c) {
+		return rejected
+	}
+	if st.blocked(c) {
+		return locked
+	}
+	return st.read(c, st.store.version())
+}
+
+func (st *State) read(c *Command, ver Version) Value {
+	switch c.Op {
 	case GET:
-		if value, present := st.Store.Get(c.K); present {
-			valAsserted := value.(Value)
-			return valAsserted
+		if value, present := st.store.get(c.K, ver); present {
+			return value
 		}
 
 	case SCAN:
-		found := make([]Value, 0)
-		count := binary.LittleEndian.Uint64(c.V)
-		it := st.Store.Select(func(index interface{}, value interface{}) bool {
-			keyAsserted := index.(Key)
-			return keyAsserted >= c.K && keyAsserted <= c.K+Key(count)
-		}).Iterator()
-		for it.Next() {
-			valAsserted := it.Value().(Value)
-			found = append(found, valAsserted)
-		}
-		ret := concat(found)
-		return ret
+		return st.store.scan(c.K, scanCount(c), ver)
 	}
-
 	return NIL()
 }
 
+// KeyRange returns the first and the last key accessed by cmd
+func KeyRange(cmd *Command) (Key, Key) {
+	if cmd.Op == SCAN {
+		return cmd.K, scanEnd(cmd.K, scanCount(cmd))
+	}
+	return cmd.K, cmd.K
+}
+
+// scanCount returns the number of keys read by the SCAN cmd
+// after its first one, which is at most MAX_SCAN
+func scanCount(cmd *Command) uint64 {
+	count := binary.LittleEndian.Uint64(cmd.V)
+	if count > MAX_SCAN {
+		return MAX_SCAN
+	}
+	return count
+}
+
 func (t *Value) String() string {
 	return hex.EncodeToString(*t)
 }
@@ -162,6 +280,25 @@ func (t *Command) String() string {
 	} else if t.Op == SCAN {
 		count := binary.LittleEndian.Uint64(t.V)
 		ret = "SCAN( " + t.K.String() + " , " + fmt.Sprint(count) + " )"
+	} else if t.Op == TX_DECIDE {
+		ret = "TX_DECIDE( " + t.K.String() + " , " + t.V.String() + " )"
+	} else if t.Op == FREEZE {
+		ret = "FREEZE( " + t.K.String() + " )"
+	} else if t.Op == THAW {
+		ret = "THAW( " + t.K.String() + " )"
+	} else if t.Op == INSTALL {
+		ret = "INSTALL( " + t.K.String() + " , " + fmt.Sprint(len(t.V)) + " )"
+	} else if IsTx(t) {
+		names := map[Operation]string{
+			TX_PREPARE: "TX_PREPARE",
+			TX_COMMIT:  "TX_COMMIT",
+			TX_ABORT:   "TX_ABORT",
+		}
+		id := "?"
+		if tx, err := DecodeTx(t.V); err == nil {
+			id = strconv.FormatInt(int64(tx.Id), 16)
+		}
+		ret = names[t.Op] + "( " + t.K.String() + " , " + id + " )"
 	} else {
 		ret = "UNKNOWN( " + t.V.String() + " , " + t.K.String() + " )"
 	}
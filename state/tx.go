@@ -0,0 +1,344 @@
+package state
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+// TX_TIMEOUT is the age after which a prepared transaction
+// is considered as abandoned by its coordinator
+var TX_TIMEOUT = 5 * time.Second
+
+// locked is returned by Execute for the commands
+// on keys locked by a prepared transaction
+var locked = Value("locked")
+
+// TxId identifies a transaction that spans several groups
+type TxId int64
+
+const (
+	TX_NO  = byte(0)
+	TX_YES = byte(1)
+)
+
+var (
+	BAD_TX       = errors.New("Malformed transaction record")
+	TX_TOO_LARGE = errors.New("Transaction does not fit in a command")
+)
+
+// Tx is the part of a transaction handled by one group.
+//
+// Keys and Values are the writes of the transaction performed by this
+// group. Coord is the key of the group that records the decision and
+// All holds every key written by the transaction, so that anyone can
+// finish the transaction if its coordinator fails.
+type Tx struct {
+	Id     TxId
+	Coord  Key
+	Keys   []Key
+	Values []Value
+	All    []Key
+}
+
+// txState is the replicated part of two-phase commit:
+// the locks and the pending writes of prepared transactions
+// and, at the coordinator group, the decisions. The local time
+// at which a transaction is prepared is not replicated, it only
+// tells which transactions are abandoned.
+type txState struct {
+	locks     map[Key]*Tx
+	pending   map[TxId]*Tx
+	decisions map[TxId]byte
+	prepared  map[TxId]time.Time
+}
+
+func newTxState() *txState {
+	return &txState{
+		locks:     make(map[Key]*Tx),
+		pending:   make(map[TxId]*Tx),
+		decisions: make(map[TxId]byte),
+		prepared:  make(map[TxId]time.Time),
+	}
+}
+
+func IsTx(cmd *Command) bool {
+	return cmd.Op >= TX_PREPARE && cmd.Op <= TX_ABORT
+}
+
+// Keys returns the keys of the transaction if cmd is
+// a transactional command and cmd.K otherwise
+func Keys(cmd *Command) []Key {
+	switch cmd.Op {
+	case TX_PREPARE, TX_COMMIT, TX_ABORT:
+		if t, err := DecodeTx(cmd.V); err == nil {
+			return t.Keys
+		}
+	}
+	return []Key{cmd.K}
+}
+
+// PrepareCommand asks a group to lock the keys of t and to keep
+// its writes until the transaction is decided. It returns
+// TX_TOO_LARGE if t does not fit in the value of a command.
+func PrepareCommand(t *Tx) (Command, error) {
+	v := t.Encode()
+	if len(v) > MAX_VALUE {
+		return Command{}, TX_TOO_LARGE
+	}
+	return Command{
+		Op: TX_PREPARE,
+		K:  t.Keys[0],
+		V:  v,
+	}, nil
+}
+
+// DecideCommand records the decision of the transaction id at the group
+// of coord. Only the first decision counts, the reply contains it.
+func DecideCommand(id TxId, coord Key, commit bool) Command {
+	v := make([]byte, 9)
+	binary.LittleEndian.PutUint64(v, uint64(id))
+	v[8] = TX_NO
+	if commit {
+		v[8] = TX_YES
+	}
+	return Command{
+		Op: TX_DECIDE,
+		K:  coord,
+		V:  v,
+	}
+}
+
+// FinishCommand applies (if commit is true) or drops the writes
+// of t and releases its locks
+func FinishCommand(t *Tx, commit bool) Command {
+	op := TX_ABORT
+	if commit {
+		op = TX_COMMIT
+	}
+	f := &Tx{
+		Id:   t.Id,
+		Keys: t.Keys,
+	}
+	return Command{
+		Op: op,
+		K:  t.Keys[0],
+		V:  f.Encode(),
+	}
+}
+
+// Vote decodes the reply to a PrepareCommand. If the group refused to
+// prepare, it also returns the transaction that holds the lock.
+func Vote(v Value) (bool, *Tx) {
+	if len(v) == 0 {
+		return false, nil
+	}
+	if v[0] == TX_YES {
+		return true, nil
+	}
+	t, err := DecodeTx(v[1:])
+	if err != nil {
+		return false, nil
+	}
+	return false, t
+}
+
+// Decision decodes the reply to a DecideCommand
+func Decision(v Value) bool {
+	return len(v) > 0 && v[0] == TX_YES
+}
+
+// Locked tells whether v is the result of a command that was not
+// executed because a prepared transaction locks one of its keys.
+// Such a command can be proposed again once the lock is released.
+func Locked(v Value) bool {
+	return len(v) == len(locked) && len(v) > 0 && &v[0] == &locked[0]
+}
+
+// Abandoned returns the transactions prepared
+// locally for longer than TX_TIMEOUT
+func (st *State) Abandoned() []*Tx {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	ts := make([]*Tx, 0)
+	for _, t := range st.txs.pending {
+		if time.Since(st.txs.prepared[t.Id]) > TX_TIMEOUT {
+			ts = append(ts, &Tx{
+				Id:    t.Id,
+				Coord: t.Coord,
+				All:   t.All,
+			})
+		}
+	}
+	return ts
+}
+
+// blocked tells whether c reads or writes a key
+// that is locked by a prepared transaction
+func (st *State) blocked(c *Command) bool {
+	if len(st.txs.locks) == 0 {
+		return false
+	}
+	switch c.Op {
+	case PUT, GET:
+		_, isLocked := st.txs.locks[c.K]
+		return isLocked
+	case SCAN:
+		lo, hi := KeyRange(c)
+		for k := range st.txs.locks {
+			if lo <= k && k <= hi {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (st *State) prepare(c *Command) Value {
+	t, err := DecodeTx(c.V)
+	if err != nil || len(t.Keys) != len(t.Values) {
+		return Value{TX_NO}
+	}
+	if _, exists := st.txs.pending[t.Id]; exists {
+		return Value{TX_YES}
+	}
+	for _, k := range t.Keys {
+		if l, locked := st.txs.locks[k]; locked && l.Id != t.Id {
+			blocker := &Tx{
+				Id:    l.Id,
+				Coord: l.Coord,
+				All:   l.All,
+			}
+			return append(Value{TX_NO}, blocker.Encode()...)
+		}
+	}
+	for _, k := range t.Keys {
+		st.txs.locks[k] = t
+	}
+	st.txs.pending[t.Id] = t
+	st.txs.prepared[t.Id] = time.Now()
+	return Value{TX_YES}
+}
+
+func (st *State) decide(c *Command) Value {
+	if len(c.V) != 9 {
+		return Value{TX_NO}
+	}
+	id := TxId(binary.LittleEndian.Uint64(c.V))
+	d, exists := st.txs.decisions[id]
+	if !exists {
+		d = c.V[8]
+		st.txs.decisions[id] = d
+	}
+	return Value{d}
+}
+
+func (st *State) finish(c *Command, ver Version) Value {
+	f, err := DecodeTx(c.V)
+	if err != nil {
+		return NIL()
+	}
+	t, exists := st.txs.pending[f.Id]
+	if !exists {
+		return NIL()
+	}
+	for i, k := range t.Keys {
+		if c.Op == TX_COMMIT {
+			st.store.put(k, ver, t.Values[i])
+		}
+		delete(st.txs.locks, k)
+	}
+	delete(st.txs.pending, t.Id)
+	delete(st.txs.prepared, t.Id)
+	return NIL()
+}
+
+func (t *Tx) Encode() Value {
+	var b bytes.Buffer
+	t.Marshal(&b)
+	return b.Bytes()
+}
+
+func DecodeTx(v Value) (*Tx, error) {
+	t := &Tx{}
+	if err := t.Unmarshal(bytes.NewReader(v)); err != nil {
+		return nil, BAD_TX
+	}
+	return t, nil
+}
+
+func (t *Tx) Marshal(w io.Writer) {
+	bs := make([]byte, 8)
+	binary.LittleEndian.PutUint64(bs, uint64(t.Id))
+	w.Write(bs)
+	t.Coord.Marshal(w)
+	marshalKeys(w, t.Keys)
+	binary.LittleEndian.PutUint32(bs, uint32(len(t.Values)))
+	w.Write(bs[:4])
+	for i := range t.Values {
+		t.Values[i].Marshal(w)
+	}
+	marshalKeys(w, t.All)
+}
+
+func (t *Tx) Unmarshal(r io.Reader) error {
+	bs := make([]byte, 8)
+	if _, err := io.ReadFull(r, bs); err != nil {
+		return err
+	}
+	t.Id = TxId(binary.LittleEndian.Uint64(bs))
+	if err := t.Coord.Unmarshal(r); err != nil {
+		return err
+	}
+	var err error
+	if t.Keys, err = unmarshalKeys(r); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(r, bs[:4]); err != nil {
+		return err
+	}
+	// a Tx fits in a Value, in which a Value takes at least 4 bytes
+	n := binary.LittleEndian.Uint32(bs)
+	if n > MAX_VALUE/4 {
+		return BAD_TX
+	}
+	t.Values = make([]Value, n)
+	for i := range t.Values {
+		if err := t.Values[i].Unmarshal(r); err != nil {
+			return err
+		}
+	}
+	t.All, err = unmarshalKeys(r)
+	return err
+}
+
+func marshalKeys(w io.Writer, ks []Key) {
+	bs := make([]byte, 4)
+	binary.LittleEndian.PutUint32(bs, uint32(len(ks)))
+	w.Write(bs)
+	for i := range ks {
+		ks[i].Marshal(w)
+	}
+}
+
+func unmarshalKeys(r io.Reader) ([]Key, error) {
+	bs := make([]byte, 4)
+	if _, err := io.ReadFull(r, bs); err != nil {
+		return nil, err
+	}
+	// a Tx fits in a Value, in which a Key takes 8 bytes
+	n := binary.LittleEndian.Uint32(bs)
+	if n > MAX_VALUE/8 {
+		return nil, BAD_TX
+	}
+	ks := make([]Key, n)
+	for i := range ks {
+		if err := ks[i].Unmarshal(r); err != nil {
+			return nil, err
+		}
+	}
+	return ks, nil
+}
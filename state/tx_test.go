@@ -0,0 +1,79 @@
+package state
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func testTx() *Tx {
+	return &Tx{
+		Id:     42,
+		Coord:  7,
+		Keys:   []Key{1, 2, 3},
+		Values: []Value{Value("a"), NIL(), Value("ccc")},
+		All:    []Key{1, 2, 3, 7, 8},
+	}
+}
+
+func TestTxRoundTrip(t *testing.T) {
+	tx := testTx()
+	got, err := DecodeTx(tx.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, tx) {
+		t.Fatalf("got %+v, want %+v", got, tx)
+	}
+}
+
+func TestTxTruncated(t *testing.T) {
+	v := testTx().Encode()
+	for n := 0; n < len(v); n++ {
+		if _, err := DecodeTx(v[:n]); err != BAD_TX {
+			t.Fatalf("%d of %d bytes: got %v, want %v", n, len(v), err, BAD_TX)
+		}
+	}
+}
+
+func TestTxTooManyEntries(t *testing.T) {
+	var b bytes.Buffer
+	bs := make([]byte, 8)
+	b.Write(bs)                 // Id
+	b.Write(bs)                 // Coord
+	b.Write([]byte{0, 0, 0, 0}) // Keys
+	binary.LittleEndian.PutUint32(bs, MAX_VALUE)
+	b.Write(bs[:4]) // Values
+	if err := (&Tx{}).Unmarshal(&b); err != BAD_TX {
+		t.Fatalf("too many values: got %v, want %v", err, BAD_TX)
+	}
+
+	b.Reset()
+	b.Write(make([]byte, 16))
+	binary.LittleEndian.PutUint32(bs, 0xffffffff)
+	b.Write(bs[:4]) // Keys
+	if err := (&Tx{}).Unmarshal(&b); err != BAD_TX {
+		t.Fatalf("too many keys: got %v, want %v", err, BAD_TX)
+	}
+}
+
+func TestPrepareTooLarge(t *testing.T) {
+	tx := &Tx{
+		Id:     1,
+		Keys:   []Key{1, 2},
+		Values: []Value{make(Value, MAX_VALUE/2), make(Value, MAX_VALUE/2)},
+	}
+	if _, err := PrepareCommand(tx); err != TX_TOO_LARGE {
+		t.Fatalf("got %v, want %v", err, TX_TOO_LARGE)
+	}
+
+	tx.Values = []Value{Value("a"), Value("b")}
+	c, err := PrepareCommand(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Op != TX_PREPARE || c.K != 1 {
+		t.Fatalf("got %v", &c)
+	}
+}
@@ -0,0 +1,91 @@
+package tempo
+
+import (
+	"fmt"
+
+	"github.com/vonaka/shreplic/state"
+)
+
+// Dot identifies the Seq-th command coordinated by Replica
+type Dot struct {
+	Replica int32
+	Seq     int32
+}
+
+func (dot Dot) String() string {
+	return fmt.Sprintf("%v.%v", dot.Replica, dot.Seq)
+}
+
+// MPropose is sent by the coordinator of Dot to every replica, those
+// of the fast Quorum propose a timestamp for Cmd not lower than Ts
+type MPropose struct {
+	Replica int32
+	Dot     Dot
+	Cmd     state.Command
+	Quorum  []int32
+	Ts      int64
+}
+
+type MProposeAck struct {
+	Replica int32
+	Dot     Dot
+	Ts      int64
+}
+
+type MConsensus struct {
+	Replica int32
+	Dot     Dot
+	Ballot  int32
+	Cmd     state.Command
+	Ts      int64
+}
+
+type MConsensusAck struct {
+	Replica int32
+	Dot     Dot
+	Ballot  int32
+}
+
+type MCommit struct {
+	Replica int32
+	Dot     Dot
+	Cmd     state.Command
+	Ts      int64
+}
+
+// MRec starts the recovery of Dot, Cmd and Quorum
+// are meaningful only if Payload is TRUE
+type MRec struct {
+	Replica int32
+	Dot     Dot
+	Ballot  int32
+	Payload uint8
+	Cmd     state.Command
+	Quorum  []int32
+}
+
+type MRecAck struct {
+	Replica int32
+	Dot     Dot
+	Ballot  int32
+	ABallot int32
+	Phase   uint8
+	Cmd     state.Command
+	Quorum  []int32
+	Ts      int64
+}
+
+// Attached is the timestamp proposed for Dot
+type Attached struct {
+	Dot Dot
+	Ts  int64
+}
+
+// MPromises tells that Replica will not propose any timestamp up to
+// Clock anymore. The Attached ones are only valid once their command
+// is committed.
+type MPromises struct {
+	Replica  int32
+	Clock    int64
+	Attached []Attached
+}
@@ -0,0 +1,207 @@
+package tempo
+
+import (
+	"sync"
+
+	"github.com/vonaka/shreplic/tools/fastrpc"
+)
+
+var mProposePool = sync.Pool{
+	New: func() interface{} {
+		return new(MPropose)
+	},
+}
+
+// GetMPropose returns an empty MPropose taken from its pool
+func GetMPropose() *MPropose {
+	return mProposePool.Get().(*MPropose)
+}
+
+// PutMPropose empties m and returns it to its pool
+func PutMPropose(m *MPropose) {
+	*m = MPropose{}
+	mProposePool.Put(m)
+}
+
+func (m *MPropose) Free() {
+	PutMPropose(m)
+}
+
+func (m *MPropose) New() fastrpc.Serializable {
+	return GetMPropose()
+}
+
+var mProposeAckPool = sync.Pool{
+	New: func() interface{} {
+		return new(MProposeAck)
+	},
+}
+
+// GetMProposeAck returns an empty MProposeAck taken from its pool
+func GetMProposeAck() *MProposeAck {
+	return mProposeAckPool.Get().(*MProposeAck)
+}
+
+// PutMProposeAck empties m and returns it to its pool
+func PutMProposeAck(m *MProposeAck) {
+	*m = MProposeAck{}
+	mProposeAckPool.Put(m)
+}
+
+func (m *MProposeAck) Free() {
+	PutMProposeAck(m)
+}
+
+func (m *MProposeAck) New() fastrpc.Serializable {
+	return GetMProposeAck()
+}
+
+var mConsensusPool = sync.Pool{
+	New: func() interface{} {
+		return new(MConsensus)
+	},
+}
+
+// GetMConsensus returns an empty MConsensus taken from its pool
+func GetMConsensus() *MConsensus {
+	return mConsensusPool.Get().(*MConsensus)
+}
+
+// PutMConsensus empties m and returns it to its pool
+func PutMConsensus(m *MConsensus) {
+	*m = MConsensus{}
+	mConsensusPool.Put(m)
+}
+
+func (m *MConsensus) Free() {
+	PutMConsensus(m)
+}
+
+func (m *MConsensus) New() fastrpc.Serializable {
+	return GetMConsensus()
+}
+
+var mConsensusAckPool = sync.Pool{
+	New: func() interface{} {
+		return new(MConsensusAck)
+	},
+}
+
+// GetMConsensusAck returns an empty MConsensusAck taken from its pool
+func GetMConsensusAck() *MConsensusAck {
+	return mConsensusAckPool.Get().(*MConsensusAck)
+}
+
+// PutMConsensusAck empties m and returns it to its pool
+func PutMConsensusAck(m *MConsensusAck) {
+	*m = MConsensusAck{}
+	mConsensusAckPool.Put(m)
+}
+
+func (m *MConsensusAck) Free() {
+	PutMConsensusAck(m)
+}
+
+func (m *MConsensusAck) New() fastrpc.Serializable {
+	return GetMConsensusAck()
+}
+
+var mCommitPool = sync.Pool{
+	New: func() interface{} {
+		return new(MCommit)
+	},
+}
+
+// GetMCommit returns an empty MCommit taken from its pool
+func GetMCommit() *MCommit {
+	return mCommitPool.Get().(*MCommit)
+}
+
+// PutMCommit empties m and returns it to its pool
+func PutMCommit(m *MCommit) {
+	*m = MCommit{}
+	mCommitPool.Put(m)
+}
+
+func (m *MCommit) Free() {
+	PutMCommit(m)
+}
+
+func (m *MCommit) New() fastrpc.Serializable {
+	return GetMCommit()
+}
+
+var mRecPool = sync.Pool{
+	New: func() interface{} {
+		return new(MRec)
+	},
+}
+
+// GetMRec returns an empty MRec taken from its pool
+func GetMRec() *MRec {
+	return mRecPool.Get().(*MRec)
+}
+
+// PutMRec empties m and returns it to its pool
+func PutMRec(m *MRec) {
+	*m = MRec{}
+	mRecPool.Put(m)
+}
+
+func (m *MRec) Free() {
+	PutMRec(m)
+}
+
+func (m *MRec) New() fastrpc.Serializable {
+	return GetMRec()
+}
+
+var mRecAckPool = sync.Pool{
+	New: func() interface{} {
+		return new(MRecAck)
+	},
+}
+
+// GetMRecAck returns an empty MRecAck taken from its pool
+func GetMRecAck() *MRecAck {
+	return mRecAckPool.Get().(*MRecAck)
+}
+
+// PutMRecAck empties m and returns it to its pool
+func PutMRecAck(m *MRecAck) {
+	*m = MRecAck{}
+	mRecAckPool.Put(m)
+}
+
+func (m *MRecAck) Free() {
+	PutMRecAck(m)
+}
+
+func (m *MRecAck) New() fastrpc.Serializable {
+	return GetMRecAck()
+}
+
+var mPromisesPool = sync.Pool{
+	New: func() interface{} {
+		return new(MPromises)
+	},
+}
+
+// GetMPromises returns an empty MPromises taken from its pool
+func GetMPromises() *MPromises {
+	return mPromisesPool.Get().(*MPromises)
+}
+
+// PutMPromises empties m and returns it to its pool
+func PutMPromises(m *MPromises) {
+	*m = MPromises{}
+	mPromisesPool.Put(m)
+}
+
+func (m *MPromises) Free() {
+	PutMPromises(m)
+}
+
+func (m *MPromises) New() fastrpc.Serializable {
+	return GetMPromises()
+}
@@ -0,0 +1,793 @@
+package tempo
+
+import (
+	"flag"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vonaka/shreplic/server/smr"
+	"github.com/vonaka/shreplic/state"
+	"github.com/vonaka/shreplic/tools/dlog"
+	"github.com/vonaka/shreplic/tools/fastrpc"
+)
+
+// phases of a command at a replica
+const (
+	NONE uint8 = iota
+	START
+	PROPOSE
+	RECOVER
+	COMMITTED
+	EXECUTED
+)
+
+// Replica of Tempo.
+//
+// The coordinator of a command sends it to a fast quorum of n/2+f
+// replicas, each of them proposes a timestamp higher than the ones it
+// has proposed so far. The command is committed at once with the highest
+// proposal if at least f replicas proposed it, otherwise the highest
+// proposal is agreed upon by f+1 replicas.
+//
+// A replica promises every timestamp up to its clock, a timestamp
+// attached to a command only counts once the command is committed.
+// A timestamp is stable once a majority of replicas promised every
+// timestamp up to it, and then committed commands are executed in
+// the order of their timestamps, without a dependency graph.
+type Replica struct {
+	*smr.Replica
+
+	FQ   smr.Quorum
+	Slow smr.AnyOf
+	Rec  smr.AnyOf
+
+	fqSize   int
+	fq       []int32
+	seq      int32
+	clock    int64
+	cmds     map[Dot]*cmdDesc
+	waiting  map[Dot]time.Time
+	toExec   []*cmdDesc
+	attached []Attached
+	sent     int64
+
+	// promises of each replica
+	promised  []int64
+	blocking  []map[int64]Dot
+	blockedBy map[Dot][]int32
+
+	timeout  time.Duration
+	interval time.Duration
+	tickChan chan struct{}
+
+	sender smr.Sender
+	cs     CommunicationSupply
+}
+
+type cmdDesc struct {
+	dot    Dot
+	phase  uint8
+	cmd    state.Command
+	quorum []int32
+	ts     int64
+
+	// acceptor
+	bal  int32
+	abal int32
+	acmd state.Command
+	ats  int64
+
+	// coordinator or recovery
+	propose    *smr.GPropose
+	pbal       int32
+	proposeSet *smr.MsgSet
+	acceptSet  *smr.MsgSet
+	recSet     *smr.MsgSet
+}
+
+type CommunicationSupply struct {
+	maxLatency time.Duration
+
+	proposeChan      chan fastrpc.Serializable
+	proposeAckChan   chan fastrpc.Serializable
+	consensusChan    chan fastrpc.Serializable
+	consensusAckChan chan fastrpc.Serializable
+	commitChan       chan fastrpc.Serializable
+	recChan          chan fastrpc.Serializable
+	recAckChan       chan fastrpc.Serializable
+	promisesChan     chan fastrpc.Serializable
+
+	proposeRPC      uint8
+	proposeAckRPC   uint8
+	consensusRPC    uint8
+	consensusAckRPC uint8
+	commitRPC       uint8
+	recRPC          uint8
+	recAckRPC       uint8
+	promisesRPC     uint8
+}
+
+func NewReplica(rid int, addrs []string, exec, dr bool,
+	f int, args string, ps map[string]struct{}) *Replica {
+
+	fs := flag.NewFlagSet("custom Tempo arguments", flag.ExitOnError)
+	timeout := fs.Int("timeout", 1000, "Milliseconds to wait for the commit of a command before recovering it")
+	interval := fs.Int("promises", 5, "Milliseconds between two broadcasts of promises")
+	fs.Parse(strings.Fields(args))
+
+	r := &Replica{
+		Replica: smr.NewReplica(rid, f, addrs, false, exec, false, dr, ps),
+
+		seq:      0,
+		clock:    0,
+		cmds:     make(map[Dot]*cmdDesc),
+		waiting:  make(map[Dot]time.Time),
+		toExec:   make([]*cmdDesc, 0),
+		attached: make([]Attached, 0),
+		sent:     0,
+
+		promised:  make([]int64, len(addrs)),
+		blocking:  make([]map[int64]Dot, len(addrs)),
+		blockedBy: make(map[Dot][]int32),
+
+		timeout:  time.Duration(*timeout) * time.Millisecond,
+		interval: time.Duration(*interval) * time.Millisecond,
+		tickChan: make(chan struct{}, 1),
+	}
+
+	if r.N < 2*r.F+1 {
+		log.Fatalf("Tempo cannot tolerate %d failures with %d replicas", r.F, r.N)
+	}
+	r.fqSize = r.N/2 + r.F
+	r.Slow = smr.AnyOf(r.F + 1)
+	r.Rec = smr.AnyOf(r.N - r.F)
+	log.Println("Fast quorum size:", r.fqSize)
+
+	for q := 0; q < r.N; q++ {
+		r.blocking[q] = make(map[int64]Dot)
+	}
+
+	r.sender = smr.NewSender(r.Replica)
+	initCs(&r.cs, r.RPC)
+
+	go r.run()
+
+	return r
+}
+
+// Messages registers in t the messages of the protocol
+func Messages(t *fastrpc.Table) {
+	initCs(new(CommunicationSupply), t)
+}
+
+func initCs(cs *CommunicationSupply, t *fastrpc.Table) {
+	cs.maxLatency = 0
+
+	cs.proposeChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.proposeAckChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.consensusChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.consensusAckChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.commitChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.recChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.recAckChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.promisesChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+
+	cs.proposeRPC = t.Register(new(MPropose), cs.proposeChan)
+	cs.proposeAckRPC = t.Register(new(MProposeAck), cs.proposeAckChan)
+	cs.consensusRPC = t.Register(new(MConsensus), cs.consensusChan)
+	cs.consensusAckRPC = t.Register(new(MConsensusAck), cs.consensusAckChan)
+	cs.commitRPC = t.Register(new(MCommit), cs.commitChan)
+	cs.recRPC = t.Register(new(MRec), cs.recChan)
+	cs.recAckRPC = t.Register(new(MRecAck), cs.recAckChan)
+	cs.promisesRPC = t.Register(new(MPromises), cs.promisesChan)
+}
+
+func (r *Replica) run() {
+	r.ConnectToPeers()
+	latencies := r.ComputeClosestPeers()
+	for _, l := range latencies {
+		d := time.Duration(l*1000*1000) * time.Nanosecond
+		if d > r.cs.maxLatency {
+			r.cs.maxLatency = d
+		}
+	}
+
+	// the fast quorum of the replica is made of the closest ones
+	r.fq = []int32{r.Id}
+	for _, q := range r.PreferredPeerOrder {
+		if len(r.fq) == r.fqSize {
+			break
+		}
+		if q != r.Id {
+			r.fq = append(r.fq, q)
+		}
+	}
+	r.FQ = smr.NewQuorum(r.fqSize)
+	for _, q := range r.fq {
+		r.FQ[q] = struct{}{}
+	}
+
+	go r.WaitForClientConnections()
+	go r.tick()
+
+	for !r.Shutdown {
+		select {
+		case propose := <-r.ProposeChan:
+			r.handlePropose(propose)
+
+		case m := <-r.cs.proposeChan:
+			propose := m.(*MPropose)
+			r.handleMPropose(propose)
+			propose.Free()
+
+		case m := <-r.cs.proposeAckChan:
+			ack := m.(*MProposeAck)
+			r.handleProposeAck(ack)
+
+		case m := <-r.cs.consensusChan:
+			consensus := m.(*MConsensus)
+			r.handleConsensus(consensus)
+			consensus.Free()
+
+		case m := <-r.cs.consensusAckChan:
+			ack := m.(*MConsensusAck)
+			r.handleConsensusAck(ack)
+
+		case m := <-r.cs.commitChan:
+			commit := m.(*MCommit)
+			r.handleCommit(commit)
+			commit.Free()
+
+		case m := <-r.cs.recChan:
+			rec := m.(*MRec)
+			r.handleRec(rec)
+			rec.Free()
+
+		case m := <-r.cs.recAckChan:
+			ack := m.(*MRecAck)
+			r.handleRecAck(ack)
+
+		case m := <-r.cs.promisesChan:
+			promises := m.(*MPromises)
+			r.handlePromises(promises)
+			promises.Free()
+
+		case <-r.tickChan:
+			r.sendPromises()
+			r.checkTimeouts()
+		}
+	}
+}
+
+func (r *Replica) tick() {
+	for !r.Shutdown {
+		time.Sleep(r.interval)
+		r.tickChan <- struct{}{}
+	}
+}
+
+func (r *Replica) handlePropose(propose *smr.GPropose) {
+	dot := Dot{
+		Replica: r.Id,
+		Seq:     r.seq,
+	}
+	r.seq++
+
+	desc := r.desc(dot)
+	desc.propose = propose
+	desc.cmd = propose.Command
+	desc.quorum = r.fq
+	desc.ts = r.proposal(dot, 0)
+	desc.phase = PROPOSE
+	r.waiting[dot] = time.Now()
+
+	desc.proposeSet = desc.proposeSet.ReinitMsgSet(r.FQ, func(_, _ interface{}) bool {
+		return true
+	}, func(interface{}) {}, r.getProposeHandler(desc))
+
+	msg := &MPropose{
+		Replica: r.Id,
+		Dot:     dot,
+		Cmd:     desc.cmd,
+		Quorum:  desc.quorum,
+		Ts:      desc.ts,
+	}
+	r.sender.SendToAll(msg, r.cs.proposeRPC)
+	r.handleProposeAck(&MProposeAck{
+		Replica: r.Id,
+		Dot:     dot,
+		Ts:      desc.ts,
+	})
+}
+
+func (r *Replica) handleMPropose(msg *MPropose) {
+	desc := r.desc(msg.Dot)
+	if desc.phase >= COMMITTED {
+		return
+	}
+	if desc.phase == NONE {
+		desc.phase = START
+		desc.cmd = msg.Cmd
+		desc.quorum = msg.Quorum
+		r.wait(msg.Dot)
+	}
+	if desc.phase != START || desc.bal != 0 || !inQuorum(r.Id, msg.Quorum) {
+		return
+	}
+
+	desc.ts = r.proposal(msg.Dot, msg.Ts)
+	desc.phase = PROPOSE
+
+	ack := &MProposeAck{
+		Replica: r.Id,
+		Dot:     msg.Dot,
+		Ts:      desc.ts,
+	}
+	r.sender.SendTo(msg.Replica, ack, r.cs.proposeAckRPC)
+}
+
+func (r *Replica) handleProposeAck(msg *MProposeAck) {
+	desc := r.desc(msg.Dot)
+	if desc.phase != PROPOSE || desc.bal != 0 || desc.proposeSet == nil {
+		return
+	}
+	desc.proposeSet.Add(msg.Replica, false, msg)
+}
+
+func (r *Replica) getProposeHandler(desc *cmdDesc) smr.MsgSetHandler {
+	return func(_ interface{}, msgs []interface{}) {
+		if desc.phase != PROPOSE || desc.bal != 0 {
+			return
+		}
+
+		ts := int64(0)
+		for _, m := range msgs {
+			if t := m.(*MProposeAck).Ts; t > ts {
+				ts = t
+			}
+		}
+
+		// fast path: the highest proposal is made by f replicas
+		n := 0
+		for _, m := range msgs {
+			if m.(*MProposeAck).Ts == ts {
+				n++
+			}
+		}
+
+		if n >= r.F {
+			r.commit(desc.dot, desc.cmd, ts)
+		} else {
+			r.startConsensus(desc, r.Id+1, desc.cmd, ts)
+		}
+	}
+}
+
+func (r *Replica) startConsensus(desc *cmdDesc, ballot int32, cmd state.Command, ts int64) {
+	desc.pbal = ballot
+	desc.acceptSet = desc.acceptSet.ReinitMsgSet(r.Slow, func(_, _ interface{}) bool {
+		return true
+	}, func(interface{}) {}, r.getConsensusHandler(desc, ballot, cmd, ts))
+
+	consensus := &MConsensus{
+		Replica: r.Id,
+		Dot:     desc.dot,
+		Ballot:  ballot,
+		Cmd:     cmd,
+		Ts:      ts,
+	}
+	r.sender.SendToAll(consensus, r.cs.consensusRPC)
+	r.handleConsensus(consensus)
+}
+
+func (r *Replica) handleConsensus(msg *MConsensus) {
+	desc := r.desc(msg.Dot)
+	if desc.phase >= COMMITTED || msg.Ballot < desc.bal {
+		return
+	}
+	desc.bal = msg.Ballot
+	desc.abal = msg.Ballot
+	desc.acmd = msg.Cmd
+	desc.ats = msg.Ts
+	r.wait(msg.Dot)
+
+	ack := &MConsensusAck{
+		Replica: r.Id,
+		Dot:     msg.Dot,
+		Ballot:  msg.Ballot,
+	}
+	if msg.Replica == r.Id {
+		r.handleConsensusAck(ack)
+	} else {
+		r.sender.SendTo(msg.Replica, ack, r.cs.consensusAckRPC)
+	}
+}
+
+func (r *Replica) handleConsensusAck(msg *MConsensusAck) {
+	desc := r.desc(msg.Dot)
+	if desc.phase >= COMMITTED || msg.Ballot != desc.pbal || desc.acceptSet == nil {
+		return
+	}
+	desc.acceptSet.Add(msg.Replica, false, msg)
+}
+
+func (r *Replica) getConsensusHandler(desc *cmdDesc, ballot int32,
+	cmd state.Command, ts int64) smr.MsgSetHandler {
+	return func(_ interface{}, _ []interface{}) {
+		if desc.phase >= COMMITTED || desc.pbal != ballot {
+			return
+		}
+		r.commit(desc.dot, cmd, ts)
+	}
+}
+
+func (r *Replica) commit(dot Dot, cmd state.Command, ts int64) {
+	commit := &MCommit{
+		Replica: r.Id,
+		Dot:     dot,
+		Cmd:     cmd,
+		Ts:      ts,
+	}
+	r.sender.SendToAll(commit, r.cs.commitRPC)
+	r.handleCommit(commit)
+}
+
+func (r *Replica) handleCommit(msg *MCommit) {
+	desc := r.desc(msg.Dot)
+	if desc.phase >= COMMITTED {
+		return
+	}
+	desc.phase = COMMITTED
+	desc.cmd = msg.Cmd
+	desc.ts = msg.Ts
+	delete(r.waiting, msg.Dot)
+
+	// the attached promises of the command become valid
+	for _, q := range r.blockedBy[msg.Dot] {
+		for t, dot := range r.blocking[q] {
+			if dot == msg.Dot {
+				delete(r.blocking[q], t)
+			}
+		}
+	}
+	delete(r.blockedBy, msg.Dot)
+
+	r.bump(msg.Ts)
+	i := sort.Search(len(r.toExec), func(i int) bool {
+		return before(desc, r.toExec[i])
+	})
+	r.toExec = append(r.toExec, nil)
+	copy(r.toExec[i+1:], r.toExec[i:])
+	r.toExec[i] = desc
+	r.execute()
+}
+
+// proposal returns the timestamp proposed for dot, which is not lower
+// than min, and promises every timestamp up to it
+func (r *Replica) proposal(dot Dot, min int64) int64 {
+	ts := r.clock + 1
+	if min > ts {
+		ts = min
+	}
+	r.clock = ts
+	r.attached = append(r.attached, Attached{
+		Dot: dot,
+		Ts:  ts,
+	})
+	r.addPromises(r.Id, ts, []Attached{{dot, ts}})
+	return ts
+}
+
+func (r *Replica) bump(ts int64) {
+	if ts > r.clock {
+		r.clock = ts
+		r.addPromises(r.Id, ts, nil)
+	}
+}
+
+func (r *Replica) sendPromises() {
+	if r.clock == r.sent && len(r.attached) == 0 {
+		return
+	}
+	promises := &MPromises{
+		Replica:  r.Id,
+		Clock:    r.clock,
+		Attached: r.attached,
+	}
+	r.sender.SendToAll(promises, r.cs.promisesRPC)
+	r.sent = r.clock
+	r.attached = make([]Attached, 0)
+}
+
+func (r *Replica) handlePromises(msg *MPromises) {
+	r.addPromises(msg.Replica, msg.Clock, msg.Attached)
+	r.execute()
+}
+
+func (r *Replica) addPromises(q int32, clock int64, attached []Attached) {
+	for _, a := range attached {
+		if desc := r.desc(a.Dot); desc.phase < COMMITTED {
+			r.blocking[q][a.Ts] = a.Dot
+			r.blockedBy[a.Dot] = append(r.blockedBy[a.Dot], q)
+			r.wait(a.Dot)
+		}
+	}
+	if clock > r.promised[q] {
+		r.promised[q] = clock
+	}
+}
+
+// stable returns the highest timestamp up to which
+// a majority of replicas promised every timestamp
+func (r *Replica) stable() int64 {
+	ws := make([]int64, r.N)
+	for q := range ws {
+		ws[q] = r.promised[q]
+		for t := range r.blocking[q] {
+			if t-1 < ws[q] {
+				ws[q] = t - 1
+			}
+		}
+	}
+	sort.Slice(ws, func(i, j int) bool {
+		return ws[i] > ws[j]
+	})
+	return ws[r.N/2]
+}
+
+func (r *Replica) execute() {
+	if len(r.toExec) == 0 {
+		return
+	}
+	s := r.stable()
+	again := make([]*smr.GPropose, 0)
+
+	i := 0
+	for ; i < len(r.toExec) && r.toExec[i].ts <= s; i++ {
+		r.executeCommand(r.toExec[i], &again)
+	}
+	r.toExec = r.toExec[i:]
+
+	for _, p := range again {
+		r.handlePropose(p)
+	}
+}
+
+func (r *Replica) executeCommand(desc *cmdDesc, again *[]*smr.GPropose) {
+	desc.phase = EXECUTED
+
+	v := state.NIL()
+	if r.Exec && desc.cmd.Op != state.NONE {
+		dlog.Printf("Executing " + desc.cmd.String())
+		v = desc.cmd.Execute(r.State)
+	}
+
+	p := desc.propose
+	if p == nil {
+		return
+	}
+	desc.propose = nil
+	if desc.cmd.Op == state.NONE && p.Command.Op != state.NONE {
+		// the command has been replaced by a no-op during recovery
+		*again = append(*again, p)
+		return
+	}
+	if !r.Dreply {
+		v = state.NIL()
+	}
+	rep := &smr.ProposeReplyTS{
+		OK:        smr.TRUE,
+		CommandId: p.CommandId,
+		Value:     v,
+		Timestamp: p.Timestamp,
+	}
+	r.ReplyProposeTS(rep, p.Reply, p.Mutex)
+}
+
+// checkTimeouts recovers the commands that are not committed in time.
+// The coordinator of a command is the first to try.
+func (r *Replica) checkTimeouts() {
+	now := time.Now()
+	for dot, t := range r.waiting {
+		timeout := r.timeout
+		if dot.Replica != r.Id {
+			timeout *= 2
+		}
+		if now.Sub(t) >= timeout {
+			r.waiting[dot] = now
+			r.recover(r.desc(dot))
+		}
+	}
+}
+
+func (r *Replica) recover(desc *cmdDesc) {
+	ballot := r.nextBallot(desc.bal)
+	log.Printf("Recovering %v with ballot %d", desc.dot, ballot)
+
+	desc.pbal = ballot
+	desc.recSet = desc.recSet.ReinitMsgSet(r.Rec, func(_, _ interface{}) bool {
+		return true
+	}, func(interface{}) {}, r.getRecHandler(desc, ballot))
+
+	rec := &MRec{
+		Replica: r.Id,
+		Dot:     desc.dot,
+		Ballot:  ballot,
+		Payload: smr.FALSE,
+		Cmd:     state.NOOP()[0],
+		Quorum:  []int32{},
+	}
+	if desc.phase != NONE {
+		rec.Payload = smr.TRUE
+		rec.Cmd = desc.cmd
+		rec.Quorum = desc.quorum
+	}
+	r.sender.SendToAll(rec, r.cs.recRPC)
+	r.handleRec(rec)
+}
+
+func (r *Replica) handleRec(msg *MRec) {
+	desc := r.desc(msg.Dot)
+	if desc.phase < COMMITTED {
+		if msg.Ballot <= desc.bal {
+			return
+		}
+		desc.bal = msg.Ballot
+		if desc.phase == NONE && msg.Payload == smr.TRUE {
+			desc.phase = START
+			desc.cmd = msg.Cmd
+			desc.quorum = msg.Quorum
+		}
+		if desc.phase == START {
+			desc.ts = r.proposal(msg.Dot, 0)
+			desc.phase = RECOVER
+		}
+		r.wait(msg.Dot)
+	}
+
+	ack := &MRecAck{
+		Replica: r.Id,
+		Dot:     msg.Dot,
+		Ballot:  msg.Ballot,
+		ABallot: desc.abal,
+		Phase:   desc.phase,
+		Cmd:     desc.cmd,
+		Quorum:  desc.quorum,
+		Ts:      desc.ts,
+	}
+	if desc.phase == EXECUTED {
+		ack.Phase = COMMITTED
+	}
+	if desc.phase < COMMITTED && desc.abal > 0 {
+		ack.Cmd = desc.acmd
+		ack.Ts = desc.ats
+	}
+	if ack.Quorum == nil {
+		ack.Quorum = []int32{}
+	}
+
+	if msg.Replica == r.Id {
+		r.handleRecAck(ack)
+	} else {
+		r.sender.SendTo(msg.Replica, ack, r.cs.recAckRPC)
+	}
+}
+
+func (r *Replica) handleRecAck(msg *MRecAck) {
+	desc := r.desc(msg.Dot)
+	if desc.phase >= COMMITTED || msg.Ballot != desc.pbal || desc.recSet == nil {
+		return
+	}
+	desc.recSet.Add(msg.Replica, false, msg)
+}
+
+func (r *Replica) getRecHandler(desc *cmdDesc, ballot int32) smr.MsgSetHandler {
+	done := false
+	return func(_ interface{}, msgs []interface{}) {
+		if done || desc.phase >= COMMITTED || desc.pbal != ballot {
+			return
+		}
+		done = true
+
+		var (
+			accepted *MRecAck
+			payload  *MRecAck
+		)
+		for _, m := range msgs {
+			ack := m.(*MRecAck)
+			if ack.Phase >= COMMITTED {
+				r.commit(desc.dot, ack.Cmd, ack.Ts)
+				return
+			}
+			if ack.ABallot > 0 && (accepted == nil || ack.ABallot > accepted.ABallot) {
+				accepted = ack
+			}
+			if ack.Phase != NONE && payload == nil {
+				payload = ack
+			}
+		}
+
+		if accepted != nil {
+			r.startConsensus(desc, ballot, accepted.Cmd, accepted.Ts)
+			return
+		}
+		if payload == nil {
+			// the command cannot have been committed
+			r.startConsensus(desc, ballot, state.NOOP()[0], 0)
+			return
+		}
+
+		// unless the fast path is known to be impossible, only the
+		// proposals of the fast quorum are considered
+		all := false
+		for _, m := range msgs {
+			ack := m.(*MRecAck)
+			all = all || ack.Replica == desc.dot.Replica ||
+				(ack.Phase == RECOVER && inQuorum(ack.Replica, payload.Quorum))
+		}
+		ts := r.highest(msgs, all, payload.Quorum)
+		if ts == 0 {
+			ts = r.highest(msgs, true, payload.Quorum)
+		}
+		r.startConsensus(desc, ballot, payload.Cmd, ts)
+	}
+}
+
+// highest returns the highest timestamp proposed by the replicas
+// of the fast quorum q, or by all of them
+func (r *Replica) highest(msgs []interface{}, all bool, q []int32) int64 {
+	ts := int64(0)
+	for _, m := range msgs {
+		ack := m.(*MRecAck)
+		if (ack.Phase == PROPOSE || ack.Phase == RECOVER) &&
+			(all || inQuorum(ack.Replica, q)) && ack.Ts > ts {
+			ts = ack.Ts
+		}
+	}
+	return ts
+}
+
+func (r *Replica) desc(dot Dot) *cmdDesc {
+	desc, exists := r.cmds[dot]
+	if !exists {
+		desc = &cmdDesc{
+			dot:   dot,
+			phase: NONE,
+			bal:   0,
+			abal:  0,
+			pbal:  -1,
+		}
+		r.cmds[dot] = desc
+	}
+	return desc
+}
+
+func (r *Replica) wait(dot Dot) {
+	if _, exists := r.waiting[dot]; !exists {
+		r.waiting[dot] = time.Now()
+	}
+}
+
+// nextBallot returns the smallest ballot of the replica above b.
+// Ballot q+1 is reserved to the coordinator q of a command.
+func (r *Replica) nextBallot(b int32) int32 {
+	n := int32(r.N)
+	return (b/n+1)*n + r.Id + 1
+}
+
+func inQuorum(rid int32, q []int32) bool {
+	for _, id := range q {
+		if id == rid {
+			return true
+		}
+	}
+	return false
+}
+
+func before(d1, d2 *cmdDesc) bool {
+	return d1.ts < d2.ts || (d1.ts == d2.ts &&
+		(d1.dot.Replica < d2.dot.Replica ||
+			(d1.dot.Replica == d2.dot.Replica && d1.dot.Seq < d2.dot.Seq)))
+}
@@ -0,0 +1,204 @@
+// Package capture records the raw messages exchanged on a link and
+// reads them back.
+//
+// A capture file starts with a header holding the id of the replica
+// and the types of the messages of its RPC table, followed by one
+// frame per message:
+//
+//	timestamp int64 | direction uint8 | code uint8 | size uint32 | payload
+//
+// All integers are little endian. The payload is the output of the
+// Marshal method of the message, without its code.
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	RECV = uint8(0)
+	SEND = uint8(1)
+
+	MAGIC = "shrcap1\n"
+)
+
+var BAD_MAGIC = errors.New("Not a capture file")
+
+// Link is the capture file of a link. A nil Link records nothing.
+type Link struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *bufio.Writer
+}
+
+// Create creates the capture file path of a link of replica,
+// whose RPC table is described by names
+func Create(path string, replica int32, names map[uint8]string) (*Link, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	l := &Link{
+		f: f,
+		w: bufio.NewWriter(f),
+	}
+
+	var b [4]byte
+	l.w.WriteString(MAGIC)
+	binary.LittleEndian.PutUint32(b[:], uint32(replica))
+	l.w.Write(b[:])
+	l.w.WriteByte(uint8(len(names)))
+	for code, name := range names {
+		l.w.WriteByte(code)
+		l.w.WriteByte(uint8(len(name)))
+		l.w.WriteString(name)
+	}
+	return l, l.w.Flush()
+}
+
+// Frame records the message code whose marshaled form is payload
+func (l *Link) Frame(dir, code uint8, payload []byte) {
+	if l == nil {
+		return
+	}
+	var b [14]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(time.Now().UnixNano()))
+	b[8] = dir
+	b[9] = code
+	binary.LittleEndian.PutUint32(b[10:], uint32(len(payload)))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(b[:])
+	l.w.Write(payload)
+	l.w.Flush()
+}
+
+func (l *Link) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Flush()
+	return l.f.Close()
+}
+
+// Reader records the bytes read from r
+type Reader struct {
+	r   *bufio.Reader
+	buf bytes.Buffer
+}
+
+func NewReader(r *bufio.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+func (cr *Reader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.buf.Write(p[:n])
+	return n, err
+}
+
+func (cr *Reader) ReadByte() (byte, error) {
+	c, err := cr.r.ReadByte()
+	if err == nil {
+		cr.buf.WriteByte(c)
+	}
+	return c, err
+}
+
+// Reset forgets the bytes read so far
+func (cr *Reader) Reset() {
+	if cr == nil {
+		return
+	}
+	cr.buf.Reset()
+}
+
+// Frame records the bytes read since the last
+// reset as the message code received on l
+func (cr *Reader) Frame(l *Link, code uint8) {
+	if cr == nil {
+		return
+	}
+	l.Frame(RECV, code, cr.buf.Bytes())
+	cr.buf.Reset()
+}
+
+// File is a capture file being read
+type File struct {
+	Replica int32
+	Names   map[uint8]string
+
+	r *bufio.Reader
+}
+
+// Frame is a message read from a capture file
+type Frame struct {
+	Time    time.Time
+	Dir     uint8
+	Code    uint8
+	Payload []byte
+}
+
+func Open(r io.Reader) (*File, error) {
+	f := &File{
+		Names: make(map[uint8]string),
+		r:     bufio.NewReader(r),
+	}
+
+	var b [8]byte
+	if _, err := io.ReadFull(f.r, b[:]); err != nil {
+		return nil, err
+	}
+	if string(b[:]) != MAGIC {
+		return nil, BAD_MAGIC
+	}
+	if _, err := io.ReadFull(f.r, b[:4]); err != nil {
+		return nil, err
+	}
+	f.Replica = int32(binary.LittleEndian.Uint32(b[:4]))
+	if _, err := io.ReadFull(f.r, b[:1]); err != nil {
+		return nil, err
+	}
+	for n := int(b[0]); n > 0; n-- {
+		if _, err := io.ReadFull(f.r, b[:2]); err != nil {
+			return nil, err
+		}
+		name := make([]byte, b[1])
+		if _, err := io.ReadFull(f.r, name); err != nil {
+			return nil, err
+		}
+		f.Names[b[0]] = string(name)
+	}
+	return f, nil
+}
+
+// Next returns the next frame of f, or io.EOF
+func (f *File) Next() (*Frame, error) {
+	var b [14]byte
+	if _, err := io.ReadFull(f.r, b[:]); err != nil {
+		return nil, err
+	}
+	fr := &Frame{
+		Time:    time.Unix(0, int64(binary.LittleEndian.Uint64(b[:]))),
+		Dir:     b[8],
+		Code:    b[9],
+		Payload: make([]byte, binary.LittleEndian.Uint32(b[10:])),
+	}
+	if _, err := io.ReadFull(f.r, fr.Payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return fr, nil
+}
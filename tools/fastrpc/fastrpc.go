@@ -5,6 +5,8 @@ import "io"
 type Serializable interface {
 	Marshal(io.Writer)
 	Unmarshal(io.Reader) error
+	// New returns the empty message a received message of the same
+	// type is unmarshaled into, taken from its pool if it is Pooled
 	New() Serializable
 }
 
@@ -46,3 +48,10 @@ func (t *Table) Get(id uint8) (Pair, bool) {
 	p, exists := t.pairs[id]
 	return p, exists
 }
+
+// Each calls f on every registered message
+func (t *Table) Each(f func(id uint8, p Pair)) {
+	for id, p := range t.pairs {
+		f(id, p)
+	}
+}
@@ -0,0 +1,15 @@
+package fastrpc
+
+// Pooled is a message recycled through a pool. Once freed,
+// a message is reused and must not be accessed anymore.
+type Pooled interface {
+	Serializable
+	Free()
+}
+
+// Free returns msg to its pool, if it has one
+func Free(msg Serializable) {
+	if p, ok := msg.(Pooled); ok {
+		p.Free()
+	}
+}
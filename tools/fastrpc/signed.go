@@ -0,0 +1,190 @@
+package fastrpc
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var (
+	BAD_SIGNATURE = errors.New("Invalid signature")
+	UNKNOWN_CODE  = errors.New("Unknown message code")
+	TOO_LARGE     = errors.New("Signed message is too large")
+)
+
+// MAX_SIGNED_SIZE bounds the size of the content of a Signed message
+const MAX_SIGNED_SIZE = 1 << 28
+
+// Authenticator produces and checks the signatures of Signed messages
+type Authenticator interface {
+	Sign(data []byte) []byte
+	Verify(sender int32, data, sig []byte) bool
+}
+
+// Signed is an envelope carrying the message of code Code sent
+// by Sender. Data is the marshalled message and Sig authenticates
+// both the sender, the code and the message.
+type Signed struct {
+	Sender int32
+	Code   uint8
+	Data   []byte
+	Sig    []byte
+}
+
+// Sign wraps msg into a Signed message
+func Sign(sender int32, code uint8, msg Serializable, a Authenticator) *Signed {
+	var buf bytes.Buffer
+	msg.Marshal(&buf)
+	m := &Signed{
+		Sender: sender,
+		Code:   code,
+		Data:   buf.Bytes(),
+	}
+	m.Sig = a.Sign(m.content())
+	return m
+}
+
+// Open checks the signature of m and returns the message it carries,
+// t gives the type of the message from its code
+func (m *Signed) Open(t *Table, a Authenticator) (Serializable, error) {
+	if !a.Verify(m.Sender, m.content(), m.Sig) {
+		return nil, BAD_SIGNATURE
+	}
+	p, exists := t.Get(m.Code)
+	if !exists {
+		return nil, UNKNOWN_CODE
+	}
+	msg := p.Obj.New()
+	if err := msg.Unmarshal(bytes.NewReader(m.Data)); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (m *Signed) content() []byte {
+	c := make([]byte, 5+len(m.Data))
+	binary.LittleEndian.PutUint32(c, uint32(m.Sender))
+	c[4] = m.Code
+	copy(c[5:], m.Data)
+	return c
+}
+
+func (m *Signed) New() Serializable {
+	return new(Signed)
+}
+
+func (m *Signed) Marshal(wire io.Writer) {
+	var b [5 + 2*binary.MaxVarintLen64]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(m.Sender))
+	b[4] = m.Code
+	n := 5 + binary.PutUvarint(b[5:], uint64(len(m.Data)))
+	wire.Write(b[:n])
+	wire.Write(m.Data)
+	n = binary.PutUvarint(b[:], uint64(len(m.Sig)))
+	wire.Write(b[:n])
+	wire.Write(m.Sig)
+}
+
+func (m *Signed) Unmarshal(rr io.Reader) error {
+	wire, ok := rr.(interface {
+		io.Reader
+		io.ByteReader
+	})
+	if !ok {
+		wire = exactReader{rr}
+	}
+
+	var b [5]byte
+	if _, err := io.ReadFull(wire, b[:]); err != nil {
+		return err
+	}
+	m.Sender = int32(binary.LittleEndian.Uint32(b[:]))
+	m.Code = b[4]
+
+	var err error
+	if m.Data, err = readBytes(wire); err != nil {
+		return err
+	}
+	m.Sig, err = readBytes(wire)
+	return err
+}
+
+func readBytes(wire interface {
+	io.Reader
+	io.ByteReader
+}) ([]byte, error) {
+	l, err := binary.ReadUvarint(wire)
+	if err != nil {
+		return nil, err
+	}
+	if l > MAX_SIGNED_SIZE {
+		return nil, TOO_LARGE
+	}
+	bs := make([]byte, l)
+	_, err = io.ReadFull(wire, bs)
+	return bs, err
+}
+
+// exactReader reads the bytes of a reader that is not an io.ByteReader
+// one at a time, so that nothing is read beyond the end of the message
+type exactReader struct {
+	io.Reader
+}
+
+func (r exactReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(r.Reader, b[:])
+	return b[0], err
+}
+
+// Ed25519 signs messages with the private key of the
+// local node and checks them with the public keys of others
+type Ed25519 struct {
+	Private ed25519.PrivateKey
+	Public  []ed25519.PublicKey
+}
+
+func (a *Ed25519) Sign(data []byte) []byte {
+	return ed25519.Sign(a.Private, data)
+}
+
+func (a *Ed25519) Verify(sender int32, data, sig []byte) bool {
+	if sender < 0 || int(sender) >= len(a.Public) {
+		return false
+	}
+	return ed25519.Verify(a.Public[sender], data, sig)
+}
+
+// MACs authenticates messages with a vector of HMAC-SHA256, one for
+// each node. Keys[i] is the key shared by the local node Id and i.
+type MACs struct {
+	Id   int32
+	Keys [][]byte
+}
+
+func (a *MACs) Sign(data []byte) []byte {
+	sig := make([]byte, 0, len(a.Keys)*sha256.Size)
+	for _, k := range a.Keys {
+		sig = append(sig, mac(k, data)...)
+	}
+	return sig
+}
+
+func (a *MACs) Verify(sender int32, data, sig []byte) bool {
+	if sender < 0 || int(sender) >= len(a.Keys) ||
+		len(sig) < int(a.Id+1)*sha256.Size {
+		return false
+	}
+	m := sig[int(a.Id)*sha256.Size : int(a.Id+1)*sha256.Size]
+	return hmac.Equal(m, mac(a.Keys[sender], data))
+}
+
+func mac(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
@@ -0,0 +1,163 @@
+package fastrpc
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// number is a message that carries a single integer
+type number struct {
+	n uint64
+}
+
+func (m *number) New() Serializable {
+	return new(number)
+}
+
+func (m *number) Marshal(w io.Writer) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], m.n)
+	w.Write(b[:])
+}
+
+func (m *number) Unmarshal(r io.Reader) error {
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return err
+	}
+	m.n = binary.LittleEndian.Uint64(b[:])
+	return nil
+}
+
+// onlyReader hides the io.ByteReader of a reader
+type onlyReader struct {
+	io.Reader
+}
+
+func authenticators(t *testing.T) (Authenticator, Authenticator) {
+	pub0, priv0, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub1, priv1, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := []ed25519.PublicKey{pub0, pub1}
+	return &Ed25519{priv0, public}, &Ed25519{priv1, public}
+}
+
+func macs() (Authenticator, Authenticator) {
+	k := []byte("shared by 0 and 1")
+	k0, k1 := []byte("of 0"), []byte("of 1")
+	return &MACs{0, [][]byte{k0, k}}, &MACs{1, [][]byte{k, k1}}
+}
+
+func encode(m *Signed) []byte {
+	var b bytes.Buffer
+	m.Marshal(&b)
+	return b.Bytes()
+}
+
+func TestSignedRoundTrip(t *testing.T) {
+	tb := NewTable()
+	code := tb.Register(new(number), nil)
+
+	e0, e1 := authenticators(t)
+	m0, m1 := macs()
+	for _, a := range [][2]Authenticator{{e0, e1}, {m0, m1}} {
+		from, to := a[0], a[1]
+		wire := encode(Sign(0, code, &number{42}, from))
+
+		for _, r := range []io.Reader{bytes.NewReader(wire), onlyReader{bytes.NewReader(wire)}} {
+			m := &Signed{}
+			if err := m.Unmarshal(r); err != nil {
+				t.Fatal(err)
+			}
+			msg, err := m.Open(tb, to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.(*number).n != 42 {
+				t.Fatalf("got %d, want 42", msg.(*number).n)
+			}
+		}
+	}
+}
+
+func TestSignedTampered(t *testing.T) {
+	tb := NewTable()
+	code := tb.Register(new(number), nil)
+	from, to := authenticators(t)
+
+	for _, tamper := range []func(*Signed){
+		func(m *Signed) { m.Sender = 1 },
+		func(m *Signed) { m.Sender = 2 },
+		func(m *Signed) { m.Code++ },
+		func(m *Signed) { m.Data[0]++ },
+		func(m *Signed) { m.Sig = m.Sig[1:] },
+	} {
+		m := Sign(0, code, &number{42}, from)
+		tamper(m)
+		if _, err := m.Open(tb, to); err != BAD_SIGNATURE {
+			t.Fatalf("got %v, want %v", err, BAD_SIGNATURE)
+		}
+	}
+
+	m := Sign(0, code+1, &number{42}, from)
+	if _, err := m.Open(tb, to); err != UNKNOWN_CODE {
+		t.Fatalf("got %v, want %v", err, UNKNOWN_CODE)
+	}
+	m = &Signed{Sender: 0, Code: code, Data: make([]byte, 7)}
+	m.Sig = from.Sign(m.content())
+	if _, err := m.Open(tb, to); err == nil {
+		t.Fatal("truncated content opened")
+	}
+}
+
+func TestSignedTruncated(t *testing.T) {
+	from, _ := authenticators(t)
+	wire := encode(Sign(0, 0, &number{42}, from))
+	for n := 0; n < len(wire); n++ {
+		m := &Signed{}
+		if err := m.Unmarshal(bytes.NewReader(wire[:n])); err == nil {
+			t.Fatalf("%d of %d bytes unmarshaled", n, len(wire))
+		}
+		m = &Signed{}
+		if err := m.Unmarshal(onlyReader{bytes.NewReader(wire[:n])}); err == nil {
+			t.Fatalf("%d of %d bytes unmarshaled without io.ByteReader", n, len(wire))
+		}
+	}
+}
+
+func TestSignedTooLarge(t *testing.T) {
+	var b [5 + binary.MaxVarintLen64]byte
+	n := 5 + binary.PutUvarint(b[5:], MAX_SIGNED_SIZE+1)
+	m := &Signed{}
+	if err := m.Unmarshal(bytes.NewReader(b[:n])); err != TOO_LARGE {
+		t.Fatalf("got %v, want %v", err, TOO_LARGE)
+	}
+}
+
+// a Signed message read from a reader that is not an
+// io.ByteReader leaves the following bytes unread
+func TestSignedExact(t *testing.T) {
+	from, _ := authenticators(t)
+	wire := encode(Sign(0, 0, &number{1}, from))
+	wire = append(wire, encode(Sign(0, 0, &number{2}, from))...)
+
+	r := onlyReader{bytes.NewReader(wire)}
+	for i := uint64(1); i <= 2; i++ {
+		m := &Signed{}
+		if err := m.Unmarshal(r); err != nil {
+			t.Fatal(err)
+		}
+		var msg number
+		if err := msg.Unmarshal(bytes.NewReader(m.Data)); err != nil || msg.n != i {
+			t.Fatalf("message %d: got %d (%v)", i, msg.n, err)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+// Package metrics exposes counters, gauges and histograms
+// in the text format of Prometheus.
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefBuckets are the default buckets of a latency histogram, in seconds
+var DefBuckets = []float64{
+	.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5,
+}
+
+// CountBuckets are the buckets of a histogram of numbers of entries
+var CountBuckets = []float64{
+	0, 1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 10000,
+}
+
+// Registry holds the metrics of a replica
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+	byName   map[string]*family
+}
+
+type family struct {
+	name    string
+	help    string
+	typ     string
+	metrics map[string]metric
+	collect func(Setter)
+}
+
+type metric interface {
+	write(b *strings.Builder, name, labels string)
+}
+
+// Setter sets the value of the gauge with the given labels,
+// labels being a list of name, value pairs
+type Setter func(v float64, labels ...string)
+
+func NewRegistry() *Registry {
+	return &Registry{
+		families: nil,
+		byName:   make(map[string]*family),
+	}
+}
+
+// Counter returns the counter name with the given labels
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	return r.metric(name, help, "counter", labels, func() metric {
+		return &Counter{}
+	}).(*Counter)
+}
+
+// Gauge returns the gauge name with the given labels
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	return r.metric(name, help, "gauge", labels, func() metric {
+		return &Gauge{}
+	}).(*Gauge)
+}
+
+// Histogram returns the histogram name with the given labels
+func (r *Registry) Histogram(name, help string, buckets []float64,
+	labels ...string) *Histogram {
+
+	return r.metric(name, help, "histogram", labels, func() metric {
+		return &Histogram{
+			buckets: buckets,
+			counts:  make([]uint64, len(buckets)),
+		}
+	}).(*Histogram)
+}
+
+// GaugeFunc registers the gauges name, whose values are
+// set by f each time the metrics are collected
+func (r *Registry) GaugeFunc(name, help string, f func(Setter)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	fam := r.family(name, help, "gauge")
+	fam.collect = f
+}
+
+func (r *Registry) metric(name, help, typ string,
+	labels []string, newMetric func() metric) metric {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	fam := r.family(name, help, typ)
+	ls := formatLabels(labels)
+	m, exists := fam.metrics[ls]
+	if !exists {
+		m = newMetric()
+		fam.metrics[ls] = m
+	}
+	return m
+}
+
+func (r *Registry) family(name, help, typ string) *family {
+	fam, exists := r.byName[name]
+	if !exists {
+		fam = &family{
+			name:    name,
+			help:    help,
+			typ:     typ,
+			metrics: make(map[string]metric),
+			collect: nil,
+		}
+		r.byName[name] = fam
+		r.families = append(r.families, fam)
+	}
+	return fam
+}
+
+// ServeHTTP writes all the metrics of r
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	var b strings.Builder
+
+	r.mu.Lock()
+	families := make([]*family, len(r.families))
+	copy(families, r.families)
+	r.mu.Unlock()
+
+	for _, fam := range families {
+		fmt.Fprintf(&b, "# HELP %s %s\n", fam.name, fam.help)
+		fmt.Fprintf(&b, "# TYPE %s %s\n", fam.name, fam.typ)
+		if fam.collect != nil {
+			fam.collect(func(v float64, labels ...string) {
+				b.WriteString(fam.name)
+				b.WriteString(formatLabels(labels))
+				b.WriteString(" " + formatFloat(v) + "\n")
+			})
+			continue
+		}
+
+		for _, l := range fam.sortedLabels(&r.mu) {
+			r.mu.Lock()
+			m := fam.metrics[l]
+			r.mu.Unlock()
+			m.write(&b, fam.name, l)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
+
+func (fam *family) sortedLabels(mu *sync.Mutex) []string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	ls := make([]string, 0, len(fam.metrics))
+	for l := range fam.metrics {
+		ls = append(ls, l)
+	}
+	sort.Strings(ls)
+	return ls
+}
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	v uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+func (c *Counter) write(b *strings.Builder, name, labels string) {
+	fmt.Fprintf(b, "%s%s %d\n", name, labels, atomic.LoadUint64(&c.v))
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	bits uint64
+}
+
+func (g *Gauge) Set(v float64) {
+	atomic.StoreUint64(&g.bits, math.Float64bits(v))
+}
+
+func (g *Gauge) write(b *strings.Builder, name, labels string) {
+	v := math.Float64frombits(atomic.LoadUint64(&g.bits))
+	fmt.Fprintf(b, "%s%s %s\n", name, labels, formatFloat(v))
+}
+
+// Histogram counts observations in buckets
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, ub := range h.buckets {
+		if v <= ub {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *Histogram) write(b *strings.Builder, name, labels string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, ub := range h.buckets {
+		fmt.Fprintf(b, "%s_bucket%s %d\n", name,
+			withLabel(labels, "le", formatFloat(ub)), h.counts[i])
+	}
+	fmt.Fprintf(b, "%s_bucket%s %d\n", name, withLabel(labels, "le", "+Inf"), h.count)
+	fmt.Fprintf(b, "%s_sum%s %s\n", name, labels, formatFloat(h.sum))
+	fmt.Fprintf(b, "%s_count%s %d\n", name, labels, h.count)
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	ls := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		ls = append(ls, labels[i]+"="+strconv.Quote(labels[i+1]))
+	}
+	return "{" + strings.Join(ls, ",") + "}"
+}
+
+func withLabel(labels, name, value string) string {
+	l := name + "=" + strconv.Quote(value)
+	if labels == "" {
+		return "{" + l + "}"
+	}
+	return labels[:len(labels)-1] + "," + l + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
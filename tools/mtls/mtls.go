@@ -0,0 +1,192 @@
+// Package mtls secures the links between replicas, clients and the
+// master with TLS and mutual certificate verification.
+//
+// The certificate of a node binds its identity as a DNS name: replica
+// i of group g is "replica-g-i" and the master is "master". A process
+// serving replicas of several groups carries the names of all of them.
+// The RPCs that reconfigure the replicas are only served to the master,
+// and those of the master that reconfigure the system to the master
+// or to an administrator, named "admin".
+package mtls
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/rpc"
+	"time"
+
+	"github.com/vonaka/shreplic/tools/transport"
+)
+
+var (
+	BAD_CA         = errors.New("Cannot parse the CA certificates")
+	NO_CERTIFICATE = errors.New("Peer has no certificate")
+	WRONG_IDENTITY = errors.New("Peer certificate does not match its identity")
+	NO_RPC         = errors.New("Unexpected HTTP response to CONNECT")
+	NOT_AUTHORIZED = errors.New("Peer is not authorized")
+)
+
+const (
+	MASTER = "master"
+	ADMIN  = "admin"
+)
+
+// ReplicaName is the identity of replica id of group g in certificates
+func ReplicaName(g int, id int32) string {
+	return fmt.Sprintf("replica-%d-%d", g, id)
+}
+
+// Config holds the certificate of the local node and the CAs the
+// certificates of the others must be signed by. A nil Config stands
+// for plaintext connections.
+type Config struct {
+	tls *tls.Config
+}
+
+// Load returns the Config of the node, or nil if certFile is empty
+func Load(certFile, keyFile, caFile string) (*Config, error) {
+	if certFile == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	cas := x509.NewCertPool()
+	if !cas.AppendCertsFromPEM(pem) {
+		return nil, BAD_CA
+	}
+
+	return &Config{
+		tls: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      cas,
+			ClientCAs:    cas,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			MinVersion:   tls.VersionTLS12,
+		},
+	}, nil
+}
+
+// Listen accepts the connections of nodes with a valid certificate
+// to the local address addr of transport t
+func (c *Config) Listen(t transport.Transport, addr string) (net.Listener, error) {
+	l, err := t.Listen(addr)
+	if err != nil || c == nil {
+		return l, err
+	}
+	return tls.NewListener(l, c.tls), nil
+}
+
+// Dial connects to the node at addr over transport t, whose
+// certificate must be the one of name. A zero timeout means
+// no timeout.
+func (c *Config) Dial(t transport.Transport, addr, name string, timeout time.Duration) (net.Conn, error) {
+	conn, err := t.Dial(addr, timeout)
+	if err != nil || c == nil {
+		return conn, err
+	}
+	conf := c.tls.Clone()
+	conf.ServerName = name
+	tconn := tls.Client(conn, conf)
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := tconn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tconn, nil
+}
+
+// Identify checks that the certificate presented on
+// the accepted connection conn is the one of name
+func (c *Config) Identify(conn net.Conn, name string) error {
+	if c == nil {
+		return nil
+	}
+	tconn, ok := conn.(*tls.Conn)
+	if !ok {
+		return NO_CERTIFICATE
+	}
+	if err := tconn.Handshake(); err != nil {
+		return err
+	}
+	certs := tconn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return NO_CERTIFICATE
+	}
+	if certs[0].VerifyHostname(name) != nil {
+		return WRONG_IDENTITY
+	}
+	return nil
+}
+
+// Authorized tells whether the certificate of the
+// peer that sent req is the one of one of names
+func (c *Config) Authorized(req *http.Request, names ...string) bool {
+	if c == nil {
+		return true
+	}
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return false
+	}
+	for _, name := range names {
+		if req.TLS.PeerCertificates[0].VerifyHostname(name) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Only serves with h the requests of the peers
+// whose certificate is the one of one of names
+func (c *Config) Only(h http.Handler, names ...string) http.Handler {
+	if c == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !c.Authorized(req, names...) {
+			http.Error(w, NOT_AUTHORIZED.Error(), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// DialHTTP is rpc.DialHTTP over a connection to name
+func (c *Config) DialHTTP(addr, name string) (*rpc.Client, error) {
+	if c == nil {
+		return rpc.DialHTTP("tcp", addr)
+	}
+
+	conn, err := c.Dial(transport.TCP, addr, name, 0)
+	if err != nil {
+		return nil, err
+	}
+	io.WriteString(conn, "CONNECT "+rpc.DefaultRPCPath+" HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{
+		Method: "CONNECT",
+	})
+	if err == nil && resp.Status != "200 Connected to Go RPC" {
+		err = NO_RPC
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
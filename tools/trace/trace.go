@@ -0,0 +1,302 @@
+// Package trace records the spans of the commands handled by the
+// replicas and exports them in the JSON encoding of OpenTelemetry
+// (OTLP), one export request per line.
+//
+// The trace of a command is keyed by its client and command ids, so
+// the spans recorded by every replica of the cluster end up in the same
+// trace. Protocols that order instances rather than commands record the
+// messages of an instance in the trace of the instance, which the
+// command leader links to the trace of each command of the instance.
+package trace
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	COMMAND  = byte(1)
+	INSTANCE = byte(2)
+	SLOT     = byte(3)
+
+	FLUSH_PERIOD = time.Second
+	BATCH_SIZE   = 1024
+)
+
+// Id is the trace id of a command or of an instance
+type Id [16]byte
+
+func Command(clientId, commandId int32) Id {
+	return newId(COMMAND, clientId, commandId)
+}
+
+func Instance(replica, instance int32) Id {
+	return newId(INSTANCE, replica, instance)
+}
+
+// Slot is the trace id of a slot of a single log
+func Slot(slot int32) Id {
+	return newId(SLOT, 0, slot)
+}
+
+func newId(kind byte, a, b int32) Id {
+	var id Id
+	id[0] = kind
+	binary.BigEndian.PutUint32(id[8:], uint32(a))
+	binary.BigEndian.PutUint32(id[12:], uint32(b))
+	return id
+}
+
+// Carrier is a message that concerns some commands or instances
+type Carrier interface {
+	TraceIds(f func(Id))
+}
+
+// File is the file the spans of all the replicas
+// of the process are exported to
+type File struct {
+	mu     sync.Mutex
+	w      *bufio.Writer
+	f      *os.File
+	spans  map[string][]span
+	nspans int
+}
+
+// Open starts exporting spans to path, or returns nil if path is empty
+func Open(path string) (*File, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	file := &File{
+		w:     bufio.NewWriter(f),
+		f:     f,
+		spans: make(map[string][]span),
+	}
+	go func() {
+		for range time.Tick(FLUSH_PERIOD) {
+			file.Flush()
+		}
+	}()
+	return file, nil
+}
+
+// Tracer returns the tracer of the replica service
+func (file *File) Tracer(service string, replica int32) *Tracer {
+	if file == nil {
+		return nil
+	}
+	return &Tracer{
+		file:    file,
+		service: service,
+		prefix:  uint64(uint16(replica)) << 48,
+		next:    uint64(time.Now().UnixNano()),
+	}
+}
+
+// Flush writes the spans recorded so far
+func (file *File) Flush() {
+	if file == nil {
+		return
+	}
+	file.mu.Lock()
+	defer file.mu.Unlock()
+
+	if file.nspans == 0 {
+		return
+	}
+	req := exportRequest{}
+	for service, spans := range file.spans {
+		req.ResourceSpans = append(req.ResourceSpans, resourceSpans{
+			Resource: resource{
+				Attributes: []attribute{newAttribute("service.name", service)},
+			},
+			ScopeSpans: []scopeSpans{{
+				Scope: scope{Name: "shreplic"},
+				Spans: spans,
+			}},
+		})
+	}
+	file.spans = make(map[string][]span)
+	file.nspans = 0
+
+	b, err := json.Marshal(req)
+	if err != nil {
+		return
+	}
+	file.w.Write(b)
+	file.w.WriteByte('\n')
+	file.w.Flush()
+}
+
+func (file *File) add(service string, s span) {
+	file.mu.Lock()
+	file.spans[service] = append(file.spans[service], s)
+	file.nspans++
+	full := file.nspans >= BATCH_SIZE
+	file.mu.Unlock()
+
+	if full {
+		file.Flush()
+	}
+}
+
+// Tracer records the spans of a replica. A nil Tracer records nothing.
+type Tracer struct {
+	file    *File
+	service string
+	prefix  uint64
+	next    uint64
+}
+
+// Span is a span being recorded
+type Span struct {
+	t     *Tracer
+	id    Id
+	name  string
+	start time.Time
+	attrs []string
+}
+
+// Start starts the span name of the trace id, attrs
+// being a list of key, value pairs
+func (t *Tracer) Start(id Id, name string, attrs ...string) *Span {
+	if t == nil {
+		return nil
+	}
+	return &Span{
+		t:     t,
+		id:    id,
+		name:  name,
+		start: time.Now(),
+		attrs: attrs,
+	}
+}
+
+// End records s
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.t.record(s.id, s.t.spanId(), s.name, s.start, time.Now(), s.attrs, nil)
+}
+
+// Event records the instantaneous span name of the trace id
+func (t *Tracer) Event(id Id, name string, attrs ...string) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	t.record(id, t.spanId(), name, now, now, attrs, nil)
+}
+
+// Link links the trace of the command cmd and
+// the one of the instance inst it belongs to
+func (t *Tracer) Link(cmd, inst Id) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	cmdSpan, instSpan := t.spanId(), t.spanId()
+	t.record(cmd, cmdSpan, "instance", now, now, nil, &link{
+		TraceId: hex.EncodeToString(inst[:]),
+		SpanId:  formatSpanId(instSpan),
+	})
+	t.record(inst, instSpan, "command", now, now, nil, &link{
+		TraceId: hex.EncodeToString(cmd[:]),
+		SpanId:  formatSpanId(cmdSpan),
+	})
+}
+
+func (t *Tracer) spanId() uint64 {
+	return t.prefix | (atomic.AddUint64(&t.next, 1) & (1<<48 - 1))
+}
+
+func (t *Tracer) record(id Id, spanId uint64, name string,
+	start, end time.Time, attrs []string, l *link) {
+
+	s := span{
+		TraceId:           hex.EncodeToString(id[:]),
+		SpanId:            formatSpanId(spanId),
+		Name:              name,
+		Kind:              1,
+		StartTimeUnixNano: strconv.FormatInt(start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+	}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		s.Attributes = append(s.Attributes, newAttribute(attrs[i], attrs[i+1]))
+	}
+	if l != nil {
+		s.Links = []link{*l}
+	}
+	t.file.add(t.service, s)
+}
+
+func formatSpanId(id uint64) string {
+	return fmt.Sprintf("%016x", id)
+}
+
+type exportRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resource     `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type resource struct {
+	Attributes []attribute `json:"attributes"`
+}
+
+type scopeSpans struct {
+	Scope scope  `json:"scope"`
+	Spans []span `json:"spans"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type span struct {
+	TraceId           string      `json:"traceId"`
+	SpanId            string      `json:"spanId"`
+	Name              string      `json:"name"`
+	Kind              int         `json:"kind"`
+	StartTimeUnixNano string      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+	Attributes        []attribute `json:"attributes,omitempty"`
+	Links             []link      `json:"links,omitempty"`
+}
+
+type attribute struct {
+	Key   string `json:"key"`
+	Value value  `json:"value"`
+}
+
+type value struct {
+	StringValue string `json:"stringValue"`
+}
+
+type link struct {
+	TraceId string `json:"traceId"`
+	SpanId  string `json:"spanId"`
+}
+
+func newAttribute(key, v string) attribute {
+	return attribute{
+		Key:   key,
+		Value: value{StringValue: v},
+	}
+}
@@ -0,0 +1,90 @@
+// Package transport abstracts the links between replicas and between
+// replicas and clients. Every transport is addressed with "host:port"
+// strings, as listed by the master, and provides reliable and ordered
+// streams:
+//
+//   - TCP is the default.
+//   - Unix maps the port of an address to a socket file in a
+//     directory, which only works when all nodes share the host.
+//   - UDP retransmits the datagrams that are not acknowledged in time.
+package transport
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var UNKNOWN_TRANSPORT = errors.New("Unknown transport")
+
+type Transport interface {
+	// Listen accepts the connections to the local address addr
+	Listen(addr string) (net.Listener, error)
+	// Dial connects to addr. A zero timeout means no timeout.
+	Dial(addr string, timeout time.Duration) (net.Conn, error)
+}
+
+var (
+	TCP Transport = tcp{}
+	UDP Transport = udp{}
+)
+
+// Get returns the transport called name: "tcp", "udp", "unix" or
+// "unix:<dir>" for Unix sockets in the directory dir rather than
+// in the temporary directory
+func Get(name string) (Transport, error) {
+	switch {
+	case name == "tcp":
+		return TCP, nil
+	case name == "udp":
+		return UDP, nil
+	case name == "unix":
+		return Unix(os.TempDir()), nil
+	case strings.HasPrefix(name, "unix:"):
+		return Unix(strings.TrimPrefix(name, "unix:")), nil
+	}
+	return nil, UNKNOWN_TRANSPORT
+}
+
+type tcp struct{}
+
+func (tcp) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+func (tcp) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+// Unix is the directory of the sockets
+type Unix string
+
+// Path returns the socket of addr, which only depends on its port
+func (u Unix) Path(addr string) (string, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(string(u), "shreplic-"+port+".sock"), nil
+}
+
+func (u Unix) Listen(addr string) (net.Listener, error) {
+	path, err := u.Path(addr)
+	if err != nil {
+		return nil, err
+	}
+	// left behind by a process that was killed
+	os.Remove(path)
+	return net.Listen("unix", path)
+}
+
+func (u Unix) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	path, err := u.Path(addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.DialTimeout("unix", path, timeout)
+}
@@ -0,0 +1,645 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// A datagram is
+//
+//	kind uint8 | seq uint32 | payload
+//
+// where seq, in little endian, is the number of a DATA datagram, the
+// number of the next DATA datagram expected by the sender of an ACK,
+// or the id of the connection opened by SYN and SYNACK. The payload of
+// an ACK is the number of DATA datagrams from seq that its sender can
+// still receive, as a uint32. FIN closes a connection and PROBE asks
+// for an ACK once this window is closed.
+const (
+	SYN = uint8(iota)
+	SYNACK
+	DATA
+	ACK
+	FIN
+	PROBE
+
+	HEADER_SIZE = 5
+	// MAX_PAYLOAD keeps the datagrams within a usual MTU
+	MAX_PAYLOAD = 1400
+	// WINDOW is the number of DATA datagrams a
+	// connection can wait the acknowledgment of
+	WINDOW = 1024
+	// RECV_BUFFER is the number of received bytes not read yet
+	// from which a connection drops the new DATA datagrams
+	RECV_BUFFER = 4 << 20
+	// ACCEPT_BACKLOG is the number of connections not accepted yet
+	// from which a listener ignores the new ones
+	ACCEPT_BACKLOG = 128
+
+	// DUP_ACKS is the number of duplicate ACKs
+	// that trigger a retransmission
+	DUP_ACKS = 3
+	// SOCKET_BUFFER is the size requested for the
+	// buffers of the sockets of the kernel
+	SOCKET_BUFFER = 4 << 20
+
+	SYN_RETRY = 100 * time.Millisecond
+	MIN_RTO   = 2 * time.Millisecond
+	MAX_RTO   = time.Second
+	// DEAD_AFTER is the time without any datagram from the peer
+	// after which, if waiting for it, the peer is considered down
+	DEAD_AFTER = 10 * time.Second
+)
+
+var (
+	CLOSED    = errors.New("Use of closed connection")
+	PEER_DOWN = errors.New("Peer does not acknowledge")
+	RESET     = errors.New("Connection reset by peer")
+)
+
+// timeoutError is returned once a deadline is exceeded
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+type udp struct{}
+
+func (udp) Listen(addr string) (net.Listener, error) {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	pc.SetReadBuffer(SOCKET_BUFFER)
+	pc.SetWriteBuffer(SOCKET_BUFFER)
+	l := &udpListener{
+		pc:     pc,
+		conns:  make(map[string]*udpConn),
+		accept: make(chan *udpConn, ACCEPT_BACKLOG),
+		done:   make(chan struct{}),
+	}
+	go l.run()
+	return l, nil
+}
+
+func (udp) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	pc.SetReadBuffer(SOCKET_BUFFER)
+	pc.SetWriteBuffer(SOCKET_BUFFER)
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	// a listener resets the connection it has with the address
+	// of pc once it receives a SYN with another id
+	syn := []byte{SYN, 0, 0, 0, 0}
+	id := uint32(time.Now().UnixNano())
+	binary.LittleEndian.PutUint32(syn[1:], id)
+	b := make([]byte, HEADER_SIZE+MAX_PAYLOAD)
+	for {
+		if _, err = pc.Write(syn); err != nil {
+			break
+		}
+		retry := time.Now().Add(SYN_RETRY)
+		if !deadline.IsZero() && deadline.Before(retry) {
+			retry = deadline
+		}
+		pc.SetReadDeadline(retry)
+		n, e := pc.Read(b)
+		if e == nil && n >= HEADER_SIZE && b[0] == SYNACK &&
+			binary.LittleEndian.Uint32(b[1:]) == id {
+			break
+		}
+		if ne, ok := e.(net.Error); e != nil && !(ok && ne.Timeout()) {
+			// most likely refused, nobody listens to addr
+			err = e
+			break
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			err = timeoutError{}
+			break
+		}
+	}
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	pc.SetReadDeadline(time.Time{})
+
+	c := newUDPConn(pc, nil, nil)
+	c.id = id
+	go func() {
+		for {
+			n, err := pc.Read(b)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Temporary() {
+					continue
+				}
+				c.fail(err)
+				return
+			}
+			c.input(b[:n])
+		}
+	}()
+	return c, nil
+}
+
+// udpListener demultiplexes the datagrams it receives
+// among its connections by their source address
+type udpListener struct {
+	pc     *net.UDPConn
+	m      sync.Mutex
+	conns  map[string]*udpConn
+	accept chan *udpConn
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (l *udpListener) run() {
+	b := make([]byte, HEADER_SIZE+MAX_PAYLOAD)
+	for {
+		n, raddr, err := l.pc.ReadFromUDP(b)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			l.Close()
+			return
+		}
+		if n < HEADER_SIZE {
+			continue
+		}
+
+		key := raddr.String()
+		if b[0] != SYN {
+			l.m.Lock()
+			c := l.conns[key]
+			l.m.Unlock()
+			if c != nil {
+				c.input(b[:n])
+			}
+			continue
+		}
+
+		id := binary.LittleEndian.Uint32(b[1:])
+		l.m.Lock()
+		c := l.conns[key]
+		if c != nil && c.id != id {
+			// the peer dialed again, its previous
+			// connection is gone with its state
+			delete(l.conns, key)
+			l.m.Unlock()
+			c.fail(RESET)
+			l.m.Lock()
+			c = nil
+		}
+		if c == nil {
+			c = newUDPConn(l.pc, raddr, l)
+			c.id = id
+			select {
+			case l.accept <- c:
+				l.conns[key] = c
+			default:
+				l.m.Unlock()
+				continue
+			}
+		}
+		l.m.Unlock()
+		// also if the SYNACK was lost
+		l.pc.WriteToUDP([]byte{SYNACK, b[1], b[2], b[3], b[4]}, raddr)
+	}
+}
+
+func (l *udpListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, CLOSED
+	}
+}
+
+// Close also closes the connections accepted by l
+func (l *udpListener) Close() error {
+	err := CLOSED
+	l.once.Do(func() {
+		close(l.done)
+		err = l.pc.Close()
+		l.m.Lock()
+		conns := l.conns
+		l.conns = map[string]*udpConn{}
+		l.m.Unlock()
+		for _, c := range conns {
+			c.fail(CLOSED)
+		}
+	})
+	return err
+}
+
+func (l *udpListener) Addr() net.Addr {
+	return l.pc.LocalAddr()
+}
+
+type datagram struct {
+	b       []byte
+	sent    time.Time
+	retries int
+}
+
+type deadline struct {
+	t     time.Time
+	timer *time.Timer
+}
+
+func (d *deadline) exceeded() bool {
+	return !d.t.IsZero() && !time.Now().Before(d.t)
+}
+
+// udpConn is a reliable and ordered stream over UDP. The datagrams
+// are numbered, acknowledged cumulatively and retransmitted after
+// a timeout that doubles each time the oldest one is lost.
+type udpConn struct {
+	pc    *net.UDPConn
+	raddr *net.UDPAddr // nil if pc is connected
+	l     *udpListener // nil if dialed
+	id    uint32
+
+	m    sync.Mutex
+	cond *sync.Cond
+	err  error
+	fin  bool
+
+	// sending side
+	next     uint32
+	una      uint32 // number of queue[0]
+	queue    []*datagram
+	srtt     time.Duration
+	rto      time.Duration
+	progress time.Time
+	timer    *time.Timer
+	dups     int
+	wnd      uint32 // advertised by the peer
+
+	// receiving side
+	expect     uint32
+	ahead      map[uint32][]byte
+	rbuf       bytes.Buffer
+	advertised uint32
+
+	rdeadline deadline
+	wdeadline deadline
+}
+
+func newUDPConn(pc *net.UDPConn, raddr *net.UDPAddr, l *udpListener) *udpConn {
+	c := &udpConn{
+		pc:    pc,
+		raddr: raddr,
+		l:     l,
+		rto:   MAX_RTO / 10,
+		wnd:   WINDOW,
+		ahead: make(map[uint32][]byte),
+	}
+	c.cond = sync.NewCond(&c.m)
+	return c
+}
+
+func (c *udpConn) send(b []byte) {
+	if c.raddr == nil {
+		c.pc.Write(b)
+	} else {
+		c.pc.WriteToUDP(b, c.raddr)
+	}
+}
+
+func (c *udpConn) sendAck() {
+	var b [HEADER_SIZE + 4]byte
+	b[0] = ACK
+	binary.LittleEndian.PutUint32(b[1:], c.expect)
+	c.advertised = c.recvWindow()
+	binary.LittleEndian.PutUint32(b[HEADER_SIZE:], c.advertised)
+	c.send(b[:])
+}
+
+// recvWindow is the number of DATA datagrams rbuf can still take
+func (c *udpConn) recvWindow() uint32 {
+	free := RECV_BUFFER - c.rbuf.Len()
+	if free <= 0 {
+		return 0
+	}
+	if w := free / MAX_PAYLOAD; w < WINDOW {
+		return uint32(w)
+	}
+	return WINDOW
+}
+
+func (c *udpConn) input(b []byte) {
+	if len(b) < HEADER_SIZE {
+		return
+	}
+	seq := binary.LittleEndian.Uint32(b[1:])
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.err != nil {
+		return
+	}
+	// the peer is alive, even if it does not take our data
+	now := time.Now()
+	c.progress = now
+
+	switch b[0] {
+	case DATA:
+		d := int32(seq - c.expect)
+		if d == 0 && c.rbuf.Len() < RECV_BUFFER {
+			c.rbuf.Write(b[HEADER_SIZE:])
+			c.expect++
+			for p, ok := c.ahead[c.expect]; ok; p, ok = c.ahead[c.expect] {
+				delete(c.ahead, c.expect)
+				c.rbuf.Write(p)
+				c.expect++
+			}
+			c.cond.Broadcast()
+		} else if d > 0 && d < WINDOW {
+			if _, ok := c.ahead[seq]; !ok {
+				c.ahead[seq] = append([]byte(nil), b[HEADER_SIZE:]...)
+			}
+		}
+		c.sendAck()
+	case ACK:
+		wnd := uint32(WINDOW)
+		if len(b) >= HEADER_SIZE+4 {
+			wnd = binary.LittleEndian.Uint32(b[HEADER_SIZE:])
+		}
+		update := wnd != c.wnd
+		if update {
+			c.wnd = wnd
+			c.cond.Broadcast()
+		}
+		d := int32(seq - c.una)
+		if d == 0 && len(c.queue) > 0 && !update {
+			// fast retransmit once queue[0] is most likely lost
+			if c.dups++; c.dups == DUP_ACKS {
+				c.queue[0].sent = time.Now()
+				c.queue[0].retries++
+				c.send(c.queue[0].b)
+			}
+			return
+		}
+		if d <= 0 || d > int32(len(c.queue)) {
+			return
+		}
+		c.dups = 0
+		for _, dg := range c.queue[:d] {
+			if dg.retries == 0 {
+				// Karn's algorithm
+				c.observe(now.Sub(dg.sent))
+			}
+		}
+		c.queue = c.queue[d:]
+		c.una = seq
+		c.cond.Broadcast()
+	case FIN:
+		c.fin = true
+		c.cond.Broadcast()
+	case PROBE:
+		c.sendAck()
+	}
+}
+
+func (c *udpConn) observe(rtt time.Duration) {
+	if c.srtt == 0 {
+		c.srtt = rtt
+	} else {
+		c.srtt = (7*c.srtt + rtt) / 8
+	}
+	c.rto = 2 * c.srtt
+	if c.rto < MIN_RTO {
+		c.rto = MIN_RTO
+	} else if c.rto > MAX_RTO {
+		c.rto = MAX_RTO
+	}
+}
+
+// retransmit resends the datagrams not acknowledged within rto,
+// or probes the peer while its window is closed
+func (c *udpConn) retransmit() {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.timer = nil
+	if c.err != nil || (len(c.queue) == 0 && c.wnd > 0) {
+		return
+	}
+	now := time.Now()
+	if now.Sub(c.progress) > DEAD_AFTER {
+		c.failLocked(PEER_DOWN)
+		return
+	}
+	if len(c.queue) == 0 {
+		// the ACK that opens the window may be lost
+		c.send([]byte{PROBE, 0, 0, 0, 0})
+		c.backoff()
+		return
+	}
+	rto := c.rto
+	if wait := rto - now.Sub(c.queue[0].sent); wait > 0 {
+		c.timer = time.AfterFunc(wait, c.retransmit)
+		return
+	}
+	for _, dg := range c.queue {
+		if now.Sub(dg.sent) >= rto {
+			dg.sent = now
+			dg.retries++
+			c.send(dg.b)
+		}
+	}
+	c.backoff()
+}
+
+func (c *udpConn) backoff() {
+	c.rto *= 2
+	if c.rto > MAX_RTO {
+		c.rto = MAX_RTO
+	}
+	c.timer = time.AfterFunc(c.rto, c.retransmit)
+}
+
+func (c *udpConn) Read(b []byte) (int, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	for c.rbuf.Len() == 0 && !c.fin && c.err == nil && !c.rdeadline.exceeded() {
+		c.cond.Wait()
+	}
+	switch {
+	case c.rbuf.Len() > 0:
+		n, err := c.rbuf.Read(b)
+		if c.advertised < WINDOW/2 && c.recvWindow() >= WINDOW/2 {
+			// the peer waits for the window to open
+			c.sendAck()
+		}
+		return n, err
+	case c.err != nil:
+		return 0, c.err
+	case c.fin:
+		return 0, io.EOF
+	}
+	return 0, timeoutError{}
+}
+
+func (c *udpConn) Write(b []byte) (int, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	n := 0
+	for n < len(b) {
+		for c.full() && c.err == nil && !c.wdeadline.exceeded() {
+			if c.timer == nil {
+				// the window of the peer is closed
+				c.progress = time.Now()
+				c.timer = time.AfterFunc(c.rto, c.retransmit)
+			}
+			c.cond.Wait()
+		}
+		if c.err != nil {
+			return n, c.err
+		}
+		if c.wdeadline.exceeded() {
+			return n, timeoutError{}
+		}
+
+		size := len(b) - n
+		if size > MAX_PAYLOAD {
+			size = MAX_PAYLOAD
+		}
+		dg := &datagram{
+			b:    make([]byte, HEADER_SIZE+size),
+			sent: time.Now(),
+		}
+		dg.b[0] = DATA
+		binary.LittleEndian.PutUint32(dg.b[1:], c.next)
+		copy(dg.b[HEADER_SIZE:], b[n:n+size])
+		if len(c.queue) == 0 {
+			c.progress = dg.sent
+		}
+		c.queue = append(c.queue, dg)
+		c.next++
+		n += size
+
+		c.send(dg.b)
+		if c.timer == nil {
+			c.timer = time.AfterFunc(c.rto, c.retransmit)
+		}
+	}
+	return n, nil
+}
+
+func (c *udpConn) full() bool {
+	return len(c.queue) >= WINDOW || uint32(len(c.queue)) >= c.wnd
+}
+
+// Close discards the data that is not acknowledged yet
+func (c *udpConn) Close() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.err != nil {
+		return CLOSED
+	}
+	// no retransmission, the peer may not even read anymore
+	for i := 0; i < 3; i++ {
+		c.send([]byte{FIN, 0, 0, 0, 0})
+	}
+	c.failLocked(CLOSED)
+	return nil
+}
+
+func (c *udpConn) fail(err error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.failLocked(err)
+}
+
+func (c *udpConn) failLocked(err error) {
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	c.queue = nil
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	if c.l == nil {
+		c.pc.Close()
+	} else {
+		key := c.raddr.String()
+		c.l.m.Lock()
+		if c.l.conns[key] == c {
+			delete(c.l.conns, key)
+		}
+		c.l.m.Unlock()
+	}
+	c.cond.Broadcast()
+}
+
+func (c *udpConn) LocalAddr() net.Addr {
+	return c.pc.LocalAddr()
+}
+
+func (c *udpConn) RemoteAddr() net.Addr {
+	if c.raddr == nil {
+		return c.pc.RemoteAddr()
+	}
+	return c.raddr
+}
+
+func (c *udpConn) setDeadline(d *deadline, t time.Time) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	d.t = t
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	if !t.IsZero() {
+		d.timer = time.AfterFunc(time.Until(t), func() {
+			c.m.Lock()
+			c.cond.Broadcast()
+			c.m.Unlock()
+		})
+	}
+	c.cond.Broadcast()
+}
+
+func (c *udpConn) SetDeadline(t time.Time) error {
+	c.setDeadline(&c.rdeadline, t)
+	c.setDeadline(&c.wdeadline, t)
+	return nil
+}
+
+func (c *udpConn) SetReadDeadline(t time.Time) error {
+	c.setDeadline(&c.rdeadline, t)
+	return nil
+}
+
+func (c *udpConn) SetWriteDeadline(t time.Time) error {
+	c.setDeadline(&c.wdeadline, t)
+	return nil
+}
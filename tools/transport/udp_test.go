@@ -0,0 +1,204 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+func pair(t *testing.T) (net.Listener, net.Conn, net.Conn) {
+	t.Helper()
+	l, err := UDP.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := UDP.Dial(l.Addr().String(), time.Second)
+	if err != nil {
+		l.Close()
+		t.Fatal(err)
+	}
+	s, err := l.Accept()
+	if err != nil {
+		l.Close()
+		t.Fatal(err)
+	}
+	return l, c, s
+}
+
+func TestUDPStream(t *testing.T) {
+	l, c, s := pair(t)
+	defer l.Close()
+
+	// more than WINDOW datagrams, the writer waits for the reader
+	data := make([]byte, 2*WINDOW*MAX_PAYLOAD+123)
+	rand.Read(data)
+	go func() {
+		c.Write(data)
+		c.Write([]byte("back"))
+	}()
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(s, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("the stream differs from what was written")
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(s, b); err != nil || string(b) != "back" {
+		t.Fatalf("got %q (%v)", b, err)
+	}
+
+	s.Write([]byte("pong"))
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "pong" {
+		t.Fatalf("got %q (%v)", b, err)
+	}
+
+	c.Close()
+	if _, err := s.Read(b); err != io.EOF {
+		t.Fatalf("after FIN: got %v, want %v", err, io.EOF)
+	}
+}
+
+func TestUDPDeadline(t *testing.T) {
+	l, c, _ := pair(t)
+	defer l.Close()
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err := c.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+}
+
+// raw returns a connection with a sink, whose datagrams are discarded
+func raw(t *testing.T) *udpConn {
+	t.Helper()
+	sink, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sink.Close() })
+	pc, err := net.DialUDP("udp", nil, sink.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newUDPConn(pc, nil, nil)
+	t.Cleanup(func() { c.fail(CLOSED) })
+	return c
+}
+
+func frame(kind uint8, seq uint32, payload string) []byte {
+	b := make([]byte, HEADER_SIZE+len(payload))
+	b[0] = kind
+	binary.LittleEndian.PutUint32(b[1:], seq)
+	copy(b[HEADER_SIZE:], payload)
+	return b
+}
+
+func TestUDPInput(t *testing.T) {
+	c := raw(t)
+
+	// truncated, unknown and out of the window datagrams are ignored
+	c.input(nil)
+	c.input([]byte{DATA, 0, 0, 0})
+	c.input(frame(42, 0, "x"))
+	c.input(frame(DATA, WINDOW, "x"))
+	c.input(frame(DATA, ^uint32(0), "x"))
+
+	// reordered and duplicated datagrams
+	c.input(frame(DATA, 2, "c"))
+	c.input(frame(DATA, 1, "b"))
+	c.input(frame(DATA, 1, "B"))
+	c.input(frame(DATA, 0, "a"))
+	c.input(frame(DATA, 0, "A"))
+	c.input(frame(DATA, 3, "d"))
+
+	b := make([]byte, 16)
+	n, err := c.Read(b)
+	if err != nil || string(b[:n]) != "abcd" {
+		t.Fatalf("got %q (%v), want %q", b[:n], err, "abcd")
+	}
+	if c.expect != 4 || len(c.ahead) != 0 {
+		t.Fatalf("expecting %d with %d datagrams ahead", c.expect, len(c.ahead))
+	}
+}
+
+func TestUDPAck(t *testing.T) {
+	c := raw(t)
+	c.Write([]byte("ab"))
+	c.Write([]byte("cd"))
+	if len(c.queue) != 2 {
+		t.Fatalf("%d datagrams queued, want 2", len(c.queue))
+	}
+
+	// an ACK without window advertises a full one,
+	// an ACK beyond what was sent is ignored
+	c.input(frame(ACK, 3, ""))
+	if len(c.queue) != 2 || c.wnd != WINDOW {
+		t.Fatalf("%d datagrams queued with a window of %d", len(c.queue), c.wnd)
+	}
+	c.input(frame(ACK, 1, "\x00\x00\x00\x00"))
+	if len(c.queue) != 1 || c.una != 1 || c.wnd != 0 {
+		t.Fatalf("%d datagrams queued from %d with a window of %d",
+			len(c.queue), c.una, c.wnd)
+	}
+	if !c.full() {
+		t.Fatal("a closed window is not full")
+	}
+	c.input(frame(ACK, 2, ""))
+	if len(c.queue) != 0 || c.full() {
+		t.Fatalf("%d datagrams queued", len(c.queue))
+	}
+}
+
+func TestUDPReset(t *testing.T) {
+	l, err := UDP.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	pc, err := net.DialUDP("udp", nil, l.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	// junk is ignored by the listener
+	pc.Write([]byte{SYN})
+	pc.Write(frame(DATA, 0, "x"))
+
+	syn := func(id uint32) net.Conn {
+		t.Helper()
+		pc.Write(frame(SYN, id, ""))
+		b := make([]byte, HEADER_SIZE)
+		pc.SetReadDeadline(time.Now().Add(time.Second))
+		if n, err := pc.Read(b); err != nil || n != HEADER_SIZE ||
+			b[0] != SYNACK || binary.LittleEndian.Uint32(b[1:]) != id {
+			t.Fatalf("no SYNACK for %d: %v (%v)", id, b, err)
+		}
+		s, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	s1 := syn(1)
+	s2 := syn(2)
+	if s1 == s2 {
+		t.Fatal("the connection is not reset")
+	}
+	if _, err := s1.Read(make([]byte, 1)); err != RESET {
+		t.Fatalf("got %v, want %v", err, RESET)
+	}
+	pc.Write(frame(DATA, 0, "x"))
+	b := make([]byte, 1)
+	if _, err := s2.Read(b); err != nil || b[0] != 'x' {
+		t.Fatalf("got %q (%v)", b, err)
+	}
+}
@@ -0,0 +1,64 @@
+package unistore
+
+import (
+	"flag"
+	"log"
+	"math/rand"
+	"strings"
+
+	"github.com/vonaka/shreplic/client/base"
+	"github.com/vonaka/shreplic/state"
+)
+
+type Client struct {
+	*base.SimpleClient
+
+	strong int
+	level  int64
+}
+
+func NewClient(maddr, collocated string, mport, reqNum, writes, psize, conflict int,
+	fast, lread, leaderless, verbose bool, logger *log.Logger, args string) *Client {
+
+	// args may be of the form "-strong <percentage>"
+	f := flag.NewFlagSet("custom Unistore arguments", flag.ExitOnError)
+	strong := f.Int("strong", 0, "Percentage of strong commands")
+	f.Parse(strings.Fields(args))
+
+	// a session is served by the closest data center
+	c := &Client{
+		SimpleClient: base.NewSimpleClient(maddr, collocated, mport, reqNum, writes,
+			psize, conflict, false, false, true, verbose, logger),
+
+		strong: *strong,
+		level:  -1,
+	}
+
+	c.GetTimestamp = func(cmd *state.Command) int64 {
+		if c.level != -1 {
+			return c.level
+		}
+		if rand.Intn(100) < c.strong {
+			return STRONG
+		}
+		return CAUSAL
+	}
+
+	return c
+}
+
+// Commit writes values to keys in a transaction,
+// which is strong if strong is true and causal otherwise
+func (c *Client) Commit(keys []state.Key, values []state.Value, strong bool) error {
+	cmd, err := TxCommand(keys, values)
+	if err != nil {
+		return err
+	}
+	c.level = CAUSAL
+	if strong {
+		c.level = STRONG
+	}
+	c.Propose(cmd)
+	c.level = -1
+	return nil
+}
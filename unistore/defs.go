@@ -1,16 +1,110 @@
 package unistore
 
-import "github.com/vonaka/shreplic/state"
+import (
+	"fmt"
 
-type MPing struct {
+	"github.com/vonaka/shreplic/state"
+)
+
+// Clients tag the consistency level of a command
+// with the Timestamp field of smr.Propose
+const (
+	CAUSAL = int64(0)
+	STRONG = int64(1)
+)
+
+// TxCommand groups writes in a transaction: they are made
+// visible atomically and, if strong, certified together. It returns
+// state.TX_TOO_LARGE if the writes do not fit in a command.
+func TxCommand(keys []state.Key, values []state.Value) (state.Command, error) {
+	t := &state.Tx{
+		Keys:   keys,
+		Values: values,
+	}
+	v := t.Encode()
+	if len(v) > state.MAX_VALUE {
+		return state.Command{}, state.TX_TOO_LARGE
+	}
+	return state.Command{
+		Op: state.TX_COMMIT,
+		K:  keys[0],
+		V:  v,
+	}, nil
+}
+
+type CommandId struct {
+	ClientId int32
+	SeqNum   int32
+}
+
+func (cmdId CommandId) String() string {
+	return fmt.Sprintf("%v,%v", cmdId.ClientId, cmdId.SeqNum)
+}
+
+// MUpdate propagates a causal write executed at Replica.
+// Ts is its position among the writes of Replica, Clock its
+// Lamport clock and Deps the vector clock of the replica
+// when the write was executed.
+type MUpdate struct {
+	Replica int32
+	Ts      int64
+	Clock   int64
+	Deps    []int64
+	Cmd     state.Command
+}
+
+// MStable announces the vector clock of Replica,
+// which is used to compute the stable cut
+type MStable struct {
+	Replica int32
+	VC      []int64
+}
+
+// MStrong asks the leader to certify a strong command,
+// Clock is the Lamport clock of Replica
+type MStrong struct {
+	Replica int32
+	CmdId   CommandId
+	Clock   int64
+	Cmd     state.Command
+	Deps    []int64
+}
+
+// MAccept orders a strong command. Ok is FALSE if the command
+// failed its certification, and Clock is the Lamport clock
+// of its writes.
+type MAccept struct {
 	Replica int32
 	Ballot  int32
+	Slot    int32
+	Origin  int32
+	CmdId   CommandId
+	Ok      uint8
+	Clock   int64
 	Cmd     state.Command
-	CmdSlot int
+	Deps    []int64
+}
+
+type MAcceptAck struct {
+	Replica int32
+	Ballot  int32
+	Slot    int32
 }
 
-type MPong struct {
+type MCommit struct {
 	Replica int32
 	Ballot  int32
-	CmdSlot int
+	Slot    int32
+}
+
+type MPrepare struct {
+	Replica int32
+	Ballot  int32
+	From    int32
+}
+
+type MPromise struct {
+	Replica  int32
+	Ballot   int32
+	Accepted []MAccept
 }
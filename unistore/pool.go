@@ -0,0 +1,207 @@
+package unistore
+
+import (
+	"sync"
+
+	"github.com/vonaka/shreplic/tools/fastrpc"
+)
+
+var mUpdatePool = sync.Pool{
+	New: func() interface{} {
+		return new(MUpdate)
+	},
+}
+
+// GetMUpdate returns an empty MUpdate taken from its pool
+func GetMUpdate() *MUpdate {
+	return mUpdatePool.Get().(*MUpdate)
+}
+
+// PutMUpdate empties m and returns it to its pool
+func PutMUpdate(m *MUpdate) {
+	*m = MUpdate{}
+	mUpdatePool.Put(m)
+}
+
+func (m *MUpdate) Free() {
+	PutMUpdate(m)
+}
+
+func (m *MUpdate) New() fastrpc.Serializable {
+	return GetMUpdate()
+}
+
+var mStablePool = sync.Pool{
+	New: func() interface{} {
+		return new(MStable)
+	},
+}
+
+// GetMStable returns an empty MStable taken from its pool
+func GetMStable() *MStable {
+	return mStablePool.Get().(*MStable)
+}
+
+// PutMStable empties m and returns it to its pool
+func PutMStable(m *MStable) {
+	*m = MStable{}
+	mStablePool.Put(m)
+}
+
+func (m *MStable) Free() {
+	PutMStable(m)
+}
+
+func (m *MStable) New() fastrpc.Serializable {
+	return GetMStable()
+}
+
+var mStrongPool = sync.Pool{
+	New: func() interface{} {
+		return new(MStrong)
+	},
+}
+
+// GetMStrong returns an empty MStrong taken from its pool
+func GetMStrong() *MStrong {
+	return mStrongPool.Get().(*MStrong)
+}
+
+// PutMStrong empties m and returns it to its pool
+func PutMStrong(m *MStrong) {
+	*m = MStrong{}
+	mStrongPool.Put(m)
+}
+
+func (m *MStrong) Free() {
+	PutMStrong(m)
+}
+
+func (m *MStrong) New() fastrpc.Serializable {
+	return GetMStrong()
+}
+
+var mAcceptPool = sync.Pool{
+	New: func() interface{} {
+		return new(MAccept)
+	},
+}
+
+// GetMAccept returns an empty MAccept taken from its pool
+func GetMAccept() *MAccept {
+	return mAcceptPool.Get().(*MAccept)
+}
+
+// PutMAccept empties m and returns it to its pool
+func PutMAccept(m *MAccept) {
+	*m = MAccept{}
+	mAcceptPool.Put(m)
+}
+
+func (m *MAccept) Free() {
+	PutMAccept(m)
+}
+
+func (m *MAccept) New() fastrpc.Serializable {
+	return GetMAccept()
+}
+
+var mAcceptAckPool = sync.Pool{
+	New: func() interface{} {
+		return new(MAcceptAck)
+	},
+}
+
+// GetMAcceptAck returns an empty MAcceptAck taken from its pool
+func GetMAcceptAck() *MAcceptAck {
+	return mAcceptAckPool.Get().(*MAcceptAck)
+}
+
+// PutMAcceptAck empties m and returns it to its pool
+func PutMAcceptAck(m *MAcceptAck) {
+	*m = MAcceptAck{}
+	mAcceptAckPool.Put(m)
+}
+
+func (m *MAcceptAck) Free() {
+	PutMAcceptAck(m)
+}
+
+func (m *MAcceptAck) New() fastrpc.Serializable {
+	return GetMAcceptAck()
+}
+
+var mCommitPool = sync.Pool{
+	New: func() interface{} {
+		return new(MCommit)
+	},
+}
+
+// GetMCommit returns an empty MCommit taken from its pool
+func GetMCommit() *MCommit {
+	return mCommitPool.Get().(*MCommit)
+}
+
+// PutMCommit empties m and returns it to its pool
+func PutMCommit(m *MCommit) {
+	*m = MCommit{}
+	mCommitPool.Put(m)
+}
+
+func (m *MCommit) Free() {
+	PutMCommit(m)
+}
+
+func (m *MCommit) New() fastrpc.Serializable {
+	return GetMCommit()
+}
+
+var mPreparePool = sync.Pool{
+	New: func() interface{} {
+		return new(MPrepare)
+	},
+}
+
+// GetMPrepare returns an empty MPrepare taken from its pool
+func GetMPrepare() *MPrepare {
+	return mPreparePool.Get().(*MPrepare)
+}
+
+// PutMPrepare empties m and returns it to its pool
+func PutMPrepare(m *MPrepare) {
+	*m = MPrepare{}
+	mPreparePool.Put(m)
+}
+
+func (m *MPrepare) Free() {
+	PutMPrepare(m)
+}
+
+func (m *MPrepare) New() fastrpc.Serializable {
+	return GetMPrepare()
+}
+
+var mPromisePool = sync.Pool{
+	New: func() interface{} {
+		return new(MPromise)
+	},
+}
+
+// GetMPromise returns an empty MPromise taken from its pool
+func GetMPromise() *MPromise {
+	return mPromisePool.Get().(*MPromise)
+}
+
+// PutMPromise empties m and returns it to its pool
+func PutMPromise(m *MPromise) {
+	*m = MPromise{}
+	mPromisePool.Put(m)
+}
+
+func (m *MPromise) Free() {
+	PutMPromise(m)
+}
+
+func (m *MPromise) New() fastrpc.Serializable {
+	return GetMPromise()
+}
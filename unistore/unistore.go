@@ -1,49 +1,192 @@
 package unistore
 
 import (
+	"flag"
+	"log"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/vonaka/shreplic/server/smr"
+	"github.com/vonaka/shreplic/state"
+	"github.com/vonaka/shreplic/tools/dlog"
 	"github.com/vonaka/shreplic/tools/fastrpc"
 )
 
+// Replica is a data center of Unistore.
+//
+// Causal commands are executed at the replica contacted by the client
+// and propagated asynchronously to the other replicas, which make them
+// visible in causal order. The vector clock of a replica has an entry
+// per replica (the number of its causal writes visible locally) and an
+// entry for strong commands (the number of strong commands executed).
+//
+// Each write is versioned by its Lamport clock and the replica that
+// executed it, and a replica applies a write on a key only if it is
+// newer than the last one applied, hence, all replicas converge.
+// A transaction (see TxCommand) makes several writes visible at once.
+//
+// Strong commands are certified by a Paxos-based commit: the leader
+// totally orders them, hence, conflicting strong commands never execute
+// concurrently. A strong write is aborted, and proposed again by its
+// origin, if the leader has applied a conflicting causal write that is
+// not in its causal past. Before being certified a strong command waits
+// until its causal past is in the stable cut, i.e., is visible at f+1
+// replicas, so that it never depends on updates that might be lost.
 type Replica struct {
 	*smr.Replica
-	cs CommunicationSupply
-	//      ...
+
+	ballot    int32
+	isLeader  bool
+	preparing bool
+
+	vc       []int64
+	vcs      [][]int64
+	stableVC []int64
+	clock    int64
+	versions map[state.Key]version
+
+	updates  []*MUpdate
+	waiting  []*strongRequest
+	queued   []*MStrong
+	proposes map[CommandId]*smr.GPropose
+	strongs  map[CommandId]*MStrong
+	executed map[int32]int32
+
+	slots       []*slotDesc
+	base        int32
+	nextSlot    int32
+	prepareFrom int32
+	promises    map[int32]*MPromise
+
+	stableInterval time.Duration
+	tickChan       chan struct{}
+	leaderChan     chan struct{}
+
+	sender smr.Sender
+	cs     CommunicationSupply
+}
+
+type slotDesc struct {
+	acc       *MAccept
+	acks      map[int32]struct{}
+	committed bool
+	cballot   int32
+}
+
+// version orders the writes on a key. The position ts among the
+// writes of replica tells whether a strong command depends on it.
+type version struct {
+	clock   int64
+	replica int32
+	ts      int64
+}
+
+type strongRequest struct {
+	propose *smr.GPropose
+	deps    []int64
 }
 
 type CommunicationSupply struct {
 	maxLatency time.Duration
 
-	pingChan chan fastrpc.Serializable
-	pongChan chan fastrpc.Serializable
+	updateChan    chan fastrpc.Serializable
+	stableChan    chan fastrpc.Serializable
+	strongChan    chan fastrpc.Serializable
+	acceptChan    chan fastrpc.Serializable
+	acceptAckChan chan fastrpc.Serializable
+	commitChan    chan fastrpc.Serializable
+	prepareChan   chan fastrpc.Serializable
+	promiseChan   chan fastrpc.Serializable
 
-	pingRPC uint8
-	pongRPC uint8
+	updateRPC    uint8
+	stableRPC    uint8
+	strongRPC    uint8
+	acceptRPC    uint8
+	acceptAckRPC uint8
+	commitRPC    uint8
+	prepareRPC   uint8
+	promiseRPC   uint8
 }
 
 func NewReplica(replicaId int, addrs []string, f int, exec, drep bool, args string, proxy_addrs map[string]struct{}) *Replica {
+	fs := flag.NewFlagSet("custom Unistore arguments", flag.ExitOnError)
+	stable := fs.Int("stable", 5, "Milliseconds between two announcements of the vector clock")
+	fs.Parse(strings.Fields(args))
+
 	r := &Replica{
 		Replica: smr.NewReplica(replicaId, f, addrs, false, exec, false, drep, proxy_addrs),
-		cs: CommunicationSupply{
-			pingChan: make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE),
-			pongChan: make(chan fastrpc.Serializable, smr.CHAN_BUFFER_SIZE),
 
-			pingRPC: 0,
-			pongRPC: 0,
-		},
-		//...
+		ballot:    0,
+		isLeader:  replicaId == 0,
+		preparing: false,
+
+		updates:  make([]*MUpdate, 0),
+		waiting:  make([]*strongRequest, 0),
+		queued:   make([]*MStrong, 0),
+		proposes: make(map[CommandId]*smr.GPropose),
+		strongs:  make(map[CommandId]*MStrong),
+		executed: make(map[int32]int32),
+		versions: make(map[state.Key]version),
+
+		slots:       make([]*slotDesc, 0),
+		base:        0,
+		nextSlot:    0,
+		prepareFrom: 0,
+		promises:    make(map[int32]*MPromise),
+
+		stableInterval: time.Duration(*stable) * time.Millisecond,
+		tickChan:       make(chan struct{}, 1),
+		leaderChan:     make(chan struct{}, 1),
+	}
+
+	r.vc = make([]int64, r.N+1)
+	r.stableVC = make([]int64, r.N+1)
+	r.vcs = make([][]int64, r.N)
+	for i := range r.vcs {
+		r.vcs[i] = make([]int64, r.N+1)
 	}
 
-	r.cs.pingRPC = r.RPC.Register(new(MPing), r.cs.pingChan)
-	r.cs.pongRPC = r.RPC.Register(new(MPong), r.cs.pongChan)
+	r.sender = smr.NewSender(r.Replica)
+	initCs(&r.cs, r.RPC)
 
 	go r.run()
 
 	return r
 }
 
+// Messages registers in t the messages of the protocol
+func Messages(t *fastrpc.Table) {
+	initCs(new(CommunicationSupply), t)
+}
+
+func initCs(cs *CommunicationSupply, t *fastrpc.Table) {
+	cs.maxLatency = 0
+
+	cs.updateChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.stableChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.strongChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.acceptChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.acceptAckChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.commitChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.prepareChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.promiseChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+
+	cs.updateRPC = t.Register(new(MUpdate), cs.updateChan)
+	cs.stableRPC = t.Register(new(MStable), cs.stableChan)
+	cs.strongRPC = t.Register(new(MStrong), cs.strongChan)
+	cs.acceptRPC = t.Register(new(MAccept), cs.acceptChan)
+	cs.acceptAckRPC = t.Register(new(MAcceptAck), cs.acceptAckChan)
+	cs.commitRPC = t.Register(new(MCommit), cs.commitChan)
+	cs.prepareRPC = t.Register(new(MPrepare), cs.prepareChan)
+	cs.promiseRPC = t.Register(new(MPromise), cs.promiseChan)
+}
+
+func (r *Replica) BeTheLeader(args *smr.BeTheLeaderArgs, reply *smr.BeTheLeaderReply) error {
+	r.leaderChan <- struct{}{}
+	return nil
+}
+
 func (r *Replica) run() {
 	r.ConnectToPeers()
 	latencies := r.ComputeClosestPeers()
@@ -55,39 +198,598 @@ func (r *Replica) run() {
 	}
 
 	go r.WaitForClientConnections()
+	go r.stableClock()
 
 	for !r.Shutdown {
 		select {
 		case propose := <-r.ProposeChan:
 			r.handlePropose(propose)
 
-		case m := <-r.cs.pingChan:
-			ping := m.(*MPing)
-			r.handlePing(ping)
+		case m := <-r.cs.updateChan:
+			update := m.(*MUpdate)
+			r.handleUpdate(update)
+
+		case m := <-r.cs.stableChan:
+			stable := m.(*MStable)
+			r.handleStable(stable)
+			stable.Free()
+
+		case m := <-r.cs.strongChan:
+			strong := m.(*MStrong)
+			r.handleStrong(strong)
+
+		case m := <-r.cs.acceptChan:
+			acc := m.(*MAccept)
+			r.handleAccept(acc)
 
-		case m := <-r.cs.pongChan:
-			pong := m.(*MPong)
-			r.handlePong(pong)
+		case m := <-r.cs.acceptAckChan:
+			ack := m.(*MAcceptAck)
+			r.handleAcceptAck(ack)
+			ack.Free()
+
+		case m := <-r.cs.commitChan:
+			commit := m.(*MCommit)
+			r.handleCommit(commit)
+			commit.Free()
+
+		case m := <-r.cs.prepareChan:
+			prepare := m.(*MPrepare)
+			r.handlePrepare(prepare)
+			prepare.Free()
+
+		case m := <-r.cs.promiseChan:
+			promise := m.(*MPromise)
+			r.handlePromise(promise)
+
+		case <-r.tickChan:
+			r.sender.SendToAll(&MStable{
+				Replica: r.Id,
+				VC:      copyVC(r.vc),
+			}, r.cs.stableRPC)
+			r.updateStable()
+
+		case <-r.leaderChan:
+			r.becomeLeader()
 		}
 	}
 }
 
+func (r *Replica) stableClock() {
+	for !r.Shutdown {
+		time.Sleep(r.stableInterval)
+		r.tickChan <- struct{}{}
+	}
+}
+
 func (r *Replica) handlePropose(propose *smr.GPropose) {
-	//...
+	if propose.Timestamp == STRONG {
+		r.request(propose)
+		return
+	}
+
+	if !state.IsWrite(&propose.Command) {
+		r.reply(propose, propose.Command.Read(r.State))
+		return
+	}
+
+	r.vc[r.Id]++
+	r.clock++
+	update := &MUpdate{
+		Replica: r.Id,
+		Ts:      r.vc[r.Id],
+		Clock:   r.clock,
+		Deps:    copyVC(r.vc),
+		Cmd:     propose.Command,
+	}
+	dlog.Printf("Executing " + propose.Command.String())
+	v := r.apply(&propose.Command, version{
+		clock:   update.Clock,
+		replica: r.Id,
+		ts:      update.Ts,
+	})
+	r.sender.SendToAll(update, r.cs.updateRPC)
+	r.reply(propose, v)
+}
+
+// request submits a strong command once its causal past is stable
+func (r *Replica) request(propose *smr.GPropose) {
+	req := &strongRequest{
+		propose: propose,
+		deps:    copyVC(r.vc),
+	}
+	if r.isStable(req.deps) {
+		r.submit(req)
+	} else {
+		r.waiting = append(r.waiting, req)
+	}
+}
+
+func (r *Replica) handleUpdate(msg *MUpdate) {
+	if msg.Ts <= r.vc[msg.Replica] {
+		return
+	}
+	r.updates = append(r.updates, msg)
+	r.deliver()
+}
+
+// deliver makes visible the remote causal updates and
+// the committed strong commands whose dependencies are met
+func (r *Replica) deliver() {
+	for progress := true; progress; {
+		progress = false
+		for i := 0; i < len(r.updates); i++ {
+			u := r.updates[i]
+			if u.Ts != r.vc[u.Replica]+1 || !r.covers(u.Deps, u.Replica) {
+				continue
+			}
+			dlog.Printf("Executing " + u.Cmd.String())
+			r.apply(&u.Cmd, version{
+				clock:   u.Clock,
+				replica: u.Replica,
+				ts:      u.Ts,
+			})
+			r.vc[u.Replica] = u.Ts
+			r.tick(u.Clock)
+			r.updates = append(r.updates[:i], r.updates[i+1:]...)
+			i--
+			progress = true
+		}
+		for r.executeStrong() {
+			progress = true
+		}
+	}
+}
+
+func (r *Replica) executeStrong() bool {
+	s := int(int32(r.vc[r.N]) - r.base)
+	if s >= len(r.slots) || r.slots[s] == nil {
+		return false
+	}
+	desc := r.slots[s]
+	if !desc.committed || desc.acc == nil || !r.covers(desc.acc.Deps, -1) {
+		return false
+	}
+
+	acc := desc.acc
+	duplicate := r.done(acc.CmdId)
+	var v state.Value
+	if acc.Origin != -1 && acc.Ok == smr.TRUE && !duplicate {
+		dlog.Printf("Executing " + acc.Cmd.String())
+		v = r.apply(&acc.Cmd, version{
+			clock:   acc.Clock,
+			replica: int32(r.N),
+		})
+		r.executed[acc.CmdId.ClientId] = acc.CmdId.SeqNum
+		r.tick(acc.Clock)
+	}
+	r.vc[r.N]++
+
+	if propose, exists := r.proposes[acc.CmdId]; exists && acc.Origin == r.Id && !duplicate {
+		delete(r.proposes, acc.CmdId)
+		delete(r.strongs, acc.CmdId)
+		if acc.Ok == smr.TRUE {
+			r.reply(propose, v)
+		} else {
+			dlog.Printf("Certification of " + acc.Cmd.String() + " failed")
+			r.request(propose)
+		}
+	}
+	return true
+}
+
+// apply executes cmd unless it writes a key whose last
+// applied write is newer than v. The writes of a transaction
+// are applied on the keys where they are the newest.
+func (r *Replica) apply(cmd *state.Command, v version) state.Value {
+	switch cmd.Op {
+	case state.PUT:
+		if !r.newer(cmd.K, v) {
+			return state.NIL()
+		}
+	case state.TX_COMMIT:
+		t, err := state.DecodeTx(cmd.V)
+		if err != nil || len(t.Keys) != len(t.Values) {
+			return state.NIL()
+		}
+		for i, k := range t.Keys {
+			if r.newer(k, v) {
+				put := state.Command{
+					Op: state.PUT,
+					K:  k,
+					V:  t.Values[i],
+				}
+				put.Execute(r.State)
+			}
+		}
+		return state.NIL()
+	}
+	return cmd.Execute(r.State)
+}
+
+// newer records v as the version of k if it is newer than the current one
+func (r *Replica) newer(k state.Key, v version) bool {
+	w, exists := r.versions[k]
+	if exists && (w.clock > v.clock || (w.clock == v.clock && w.replica >= v.replica)) {
+		return false
+	}
+	r.versions[k] = v
+	return true
+}
+
+// certify tells whether no write on the keys of cmd applied locally
+// is a causal write missing from deps
+func (r *Replica) certify(cmd *state.Command, deps []int64) bool {
+	if !state.IsWrite(cmd) {
+		return true
+	}
+	for _, k := range state.Keys(cmd) {
+		if w, exists := r.versions[k]; exists && int(w.replica) < r.N && w.ts > deps[w.replica] {
+			return false
+		}
+	}
+	return true
 }
 
-func (r *Replica) handlePing(msg *MPing) {
-	//...
+func (r *Replica) done(cmdId CommandId) bool {
+	seq, exists := r.executed[cmdId.ClientId]
+	return exists && cmdId.SeqNum <= seq
 }
 
-func (r *Replica) handlePong(msg *MPong) {
-	//...
+func (r *Replica) tick(clock int64) {
+	if clock > r.clock {
+		r.clock = clock
+	}
 }
 
-func (m *MPing) New() fastrpc.Serializable {
-	return new(MPing)
+func (r *Replica) handleStable(msg *MStable) {
+	for k, t := range msg.VC {
+		if t > r.vcs[msg.Replica][k] {
+			r.vcs[msg.Replica][k] = t
+		}
+	}
+	r.updateStable()
+}
+
+// updateStable computes the stable cut: an update is stable
+// once it is visible at f+1 replicas
+func (r *Replica) updateStable() {
+	copy(r.vcs[r.Id], r.vc)
+	ts := make([]int64, r.N)
+	for k := range r.stableVC {
+		for j := range r.vcs {
+			ts[j] = r.vcs[j][k]
+		}
+		sort.Slice(ts, func(i, j int) bool {
+			return ts[i] > ts[j]
+		})
+		r.stableVC[k] = ts[r.F]
+	}
+
+	// the slots executed by every replica are no longer needed
+	low := int32(r.vc[r.N])
+	for _, vc := range r.vcs {
+		if int32(vc[r.N]) < low {
+			low = int32(vc[r.N])
+		}
+	}
+	if n := int(low - r.base); n > 0 && n <= len(r.slots) {
+		for i := 0; i < n; i++ {
+			r.slots[i] = nil
+		}
+		r.slots = r.slots[n:]
+		r.base = low
+	}
+
+	for i := 0; i < len(r.waiting); i++ {
+		req := r.waiting[i]
+		if !r.isStable(req.deps) {
+			continue
+		}
+		r.waiting = append(r.waiting[:i], r.waiting[i+1:]...)
+		i--
+		r.submit(req)
+	}
+}
+
+func (r *Replica) submit(req *strongRequest) {
+	cmdId := CommandId{
+		ClientId: req.propose.ClientId,
+		SeqNum:   req.propose.CommandId,
+	}
+	strong := &MStrong{
+		Replica: r.Id,
+		CmdId:   cmdId,
+		Clock:   r.clock,
+		Cmd:     req.propose.Command,
+		Deps:    req.deps,
+	}
+	r.proposes[cmdId] = req.propose
+	r.strongs[cmdId] = strong
+
+	if r.isLeader {
+		r.handleStrong(strong)
+	} else {
+		r.sender.SendTo(r.leader(), strong, r.cs.strongRPC)
+	}
+}
+
+func (r *Replica) handleStrong(msg *MStrong) {
+	if !r.isLeader {
+		// the origin sends it again once it knows the new leader
+		return
+	}
+	if r.preparing {
+		r.queued = append(r.queued, msg)
+		return
+	}
+	if r.done(msg.CmdId) {
+		return
+	}
+
+	acc := &MAccept{
+		Replica: r.Id,
+		Ballot:  r.ballot,
+		Slot:    r.nextSlot,
+		Origin:  msg.Replica,
+		CmdId:   msg.CmdId,
+		Ok:      smr.TRUE,
+		Cmd:     msg.Cmd,
+		Deps:    msg.Deps,
+	}
+	if !r.certify(&msg.Cmd, msg.Deps) {
+		acc.Ok = smr.FALSE
+	}
+	// the writes of acc are newer than those of its causal past
+	r.tick(msg.Clock)
+	r.clock++
+	acc.Clock = r.clock
+	r.nextSlot++
+	r.sender.SendToAll(acc, r.cs.acceptRPC)
+	r.handleAccept(acc)
+}
+
+func (r *Replica) handleAccept(msg *MAccept) {
+	if msg.Ballot < r.ballot {
+		return
+	}
+	if msg.Ballot > r.ballot {
+		r.adopt(msg.Ballot)
+	}
+
+	desc := r.slot(msg.Slot)
+	if desc == nil || (desc.committed && desc.cballot != msg.Ballot) {
+		return
+	}
+	if desc.acc == nil || desc.acc.Ballot != msg.Ballot {
+		desc.acks = make(map[int32]struct{})
+	}
+	desc.acc = msg
+
+	ack := &MAcceptAck{
+		Replica: r.Id,
+		Ballot:  msg.Ballot,
+		Slot:    msg.Slot,
+	}
+	if msg.Replica == r.Id {
+		r.handleAcceptAck(ack)
+	} else {
+		r.sender.SendTo(msg.Replica, ack, r.cs.acceptAckRPC)
+	}
+	r.deliver()
+}
+
+func (r *Replica) handleAcceptAck(msg *MAcceptAck) {
+	if !r.isLeader || msg.Ballot != r.ballot {
+		return
+	}
+
+	desc := r.slot(msg.Slot)
+	if desc == nil || desc.committed || desc.acc == nil || desc.acc.Ballot != msg.Ballot {
+		return
+	}
+	desc.acks[msg.Replica] = struct{}{}
+	if len(desc.acks) < r.N/2+1 {
+		return
+	}
+
+	commit := &MCommit{
+		Replica: r.Id,
+		Ballot:  r.ballot,
+		Slot:    msg.Slot,
+	}
+	r.sender.SendToAll(commit, r.cs.commitRPC)
+	r.handleCommit(commit)
+}
+
+func (r *Replica) handleCommit(msg *MCommit) {
+	desc := r.slot(msg.Slot)
+	if desc == nil || desc.committed {
+		return
+	}
+	if desc.acc != nil && desc.acc.Ballot != msg.Ballot {
+		// the value will come with the accept of this ballot
+		desc.acc = nil
+	}
+	desc.committed = true
+	desc.cballot = msg.Ballot
+	r.deliver()
+}
+
+func (r *Replica) becomeLeader() {
+	r.ballot = smr.NextBallotOf(r.Id, r.ballot, r.N)
+	r.isLeader = true
+	r.preparing = true
+	r.prepareFrom = int32(r.vc[r.N])
+	r.promises = make(map[int32]*MPromise)
+	log.Println("I am the leader, ballot", r.ballot)
+
+	prepare := &MPrepare{
+		Replica: r.Id,
+		Ballot:  r.ballot,
+		From:    r.prepareFrom,
+	}
+	r.sender.SendToAll(prepare, r.cs.prepareRPC)
+	r.handlePrepare(prepare)
+}
+
+func (r *Replica) handlePrepare(msg *MPrepare) {
+	if msg.Ballot < r.ballot {
+		return
+	}
+	if msg.Ballot > r.ballot {
+		r.adopt(msg.Ballot)
+	}
+
+	promise := &MPromise{
+		Replica:  r.Id,
+		Ballot:   msg.Ballot,
+		Accepted: make([]MAccept, 0),
+	}
+	from := int(msg.From - r.base)
+	if from < 0 {
+		from = 0
+	}
+	for s := from; s < len(r.slots); s++ {
+		if r.slots[s] != nil && r.slots[s].acc != nil {
+			promise.Accepted = append(promise.Accepted, *r.slots[s].acc)
+		}
+	}
+
+	if msg.Replica == r.Id {
+		r.handlePromise(promise)
+	} else {
+		r.sender.SendTo(msg.Replica, promise, r.cs.promiseRPC)
+	}
+}
+
+func (r *Replica) handlePromise(msg *MPromise) {
+	if !r.preparing || msg.Ballot != r.ballot {
+		return
+	}
+
+	r.promises[msg.Replica] = msg
+	if len(r.promises) < r.N/2+1 {
+		return
+	}
+	r.preparing = false
+
+	// adopt for each slot the value accepted with the highest ballot
+	last := r.prepareFrom - 1
+	chosen := make(map[int32]*MAccept)
+	for _, p := range r.promises {
+		for i := range p.Accepted {
+			acc := &p.Accepted[i]
+			if c, exists := chosen[acc.Slot]; !exists || c.Ballot < acc.Ballot {
+				chosen[acc.Slot] = acc
+			}
+			if acc.Slot > last {
+				last = acc.Slot
+			}
+		}
+	}
+
+	r.nextSlot = last + 1
+	for s := r.prepareFrom; s <= last; s++ {
+		acc := &MAccept{
+			Replica: r.Id,
+			Ballot:  r.ballot,
+			Slot:    s,
+			Origin:  -1,
+			Cmd:     state.NOOP()[0],
+			Deps:    make([]int64, r.N+1),
+		}
+		if c, exists := chosen[s]; exists {
+			acc.Origin = c.Origin
+			acc.CmdId = c.CmdId
+			acc.Ok = c.Ok
+			acc.Clock = c.Clock
+			acc.Cmd = c.Cmd
+			acc.Deps = c.Deps
+			r.tick(c.Clock)
+		}
+		r.sender.SendToAll(acc, r.cs.acceptRPC)
+		r.handleAccept(acc)
+	}
+
+	queued := r.queued
+	r.queued = make([]*MStrong, 0)
+	for _, strong := range queued {
+		r.handleStrong(strong)
+	}
+	for _, strong := range r.strongs {
+		r.handleStrong(strong)
+	}
+}
+
+// adopt must be called when a higher ballot is discovered
+func (r *Replica) adopt(ballot int32) {
+	r.ballot = ballot
+	r.isLeader = false
+	r.preparing = false
+
+	// strong commands sent to the previous leader might be lost
+	for _, strong := range r.strongs {
+		r.sender.SendTo(r.leader(), strong, r.cs.strongRPC)
+	}
+}
+
+func (r *Replica) leader() int32 {
+	return smr.Leader(r.ballot, r.N)
+}
+
+// slot returns the descriptor of s, or nil if s has been executed
+// by every replica
+func (r *Replica) slot(s int32) *slotDesc {
+	if s < r.base {
+		return nil
+	}
+	s -= r.base
+	for int32(len(r.slots)) <= s {
+		r.slots = append(r.slots, nil)
+	}
+	if r.slots[s] == nil {
+		r.slots[s] = &slotDesc{
+			acks: make(map[int32]struct{}),
+		}
+	}
+	return r.slots[s]
+}
+
+func (r *Replica) reply(propose *smr.GPropose, v state.Value) {
+	if v == nil {
+		v = state.NIL()
+	}
+	rep := &smr.ProposeReplyTS{
+		OK:        smr.TRUE,
+		CommandId: propose.CommandId,
+		Value:     v,
+		Timestamp: propose.Timestamp,
+	}
+	r.ReplyProposeTS(rep, propose.Reply, propose.Mutex)
+}
+
+// covers tells whether every entry of deps (except
+// the one of the replica skip) is visible locally
+func (r *Replica) covers(deps []int64, skip int32) bool {
+	for k, t := range deps {
+		if int32(k) != skip && t > r.vc[k] {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Replica) isStable(deps []int64) bool {
+	for k := 0; k < r.N; k++ {
+		if deps[k] > r.stableVC[k] {
+			return false
+		}
+	}
+	return true
 }
 
-func (m *MPong) New() fastrpc.Serializable {
-	return new(MPong)
+func copyVC(vc []int64) []int64 {
+	c := make([]int64, len(vc))
+	copy(c, vc)
+	return c
 }
@@ -0,0 +1,92 @@
+package vr
+
+import (
+	"fmt"
+
+	"github.com/vonaka/shreplic/state"
+)
+
+// status
+const (
+	NORMAL = iota
+	VIEWCHANGE
+	RECOVERING
+)
+
+type CommandId struct {
+	ClientId int32
+	SeqNum   int32
+}
+
+func (cmdId CommandId) String() string {
+	return fmt.Sprintf("%v,%v", cmdId.ClientId, cmdId.SeqNum)
+}
+
+type Entry struct {
+	CmdId CommandId
+	Cmd   state.Command
+}
+
+// MPrepare carries the operations of the log that end with Op.
+// It is also the answer to MGetState (the NewState message).
+type MPrepare struct {
+	Replica int32
+	View    int32
+	Op      int32
+	Commit  int32
+	Entries []Entry
+}
+
+type MPrepareOK struct {
+	Replica int32
+	View    int32
+	Op      int32
+}
+
+// MCommit is sent by the primary when it has nothing to prepare
+type MCommit struct {
+	Replica int32
+	View    int32
+	Commit  int32
+}
+
+type MStartViewChange struct {
+	Replica int32
+	View    int32
+}
+
+type MDoViewChange struct {
+	Replica    int32
+	View       int32
+	LastNormal int32
+	Commit     int32
+	Log        []Entry
+}
+
+type MStartView struct {
+	Replica int32
+	View    int32
+	Commit  int32
+	Log     []Entry
+}
+
+// MGetState asks the primary of View for the operations after Op
+type MGetState struct {
+	Replica int32
+	View    int32
+	Op      int32
+}
+
+type MRecovery struct {
+	Replica int32
+	Nonce   int64
+}
+
+// MRecoveryResponse carries a Log only if Replica is the primary of View
+type MRecoveryResponse struct {
+	Replica int32
+	View    int32
+	Nonce   int64
+	Commit  int32
+	Log     []Entry
+}
@@ -0,0 +1,232 @@
+package vr
+
+import (
+	"sync"
+
+	"github.com/vonaka/shreplic/tools/fastrpc"
+)
+
+var mPreparePool = sync.Pool{
+	New: func() interface{} {
+		return new(MPrepare)
+	},
+}
+
+// GetMPrepare returns an empty MPrepare taken from its pool
+func GetMPrepare() *MPrepare {
+	return mPreparePool.Get().(*MPrepare)
+}
+
+// PutMPrepare empties m and returns it to its pool
+func PutMPrepare(m *MPrepare) {
+	*m = MPrepare{}
+	mPreparePool.Put(m)
+}
+
+func (m *MPrepare) Free() {
+	PutMPrepare(m)
+}
+
+func (m *MPrepare) New() fastrpc.Serializable {
+	return GetMPrepare()
+}
+
+var mPrepareOKPool = sync.Pool{
+	New: func() interface{} {
+		return new(MPrepareOK)
+	},
+}
+
+// GetMPrepareOK returns an empty MPrepareOK taken from its pool
+func GetMPrepareOK() *MPrepareOK {
+	return mPrepareOKPool.Get().(*MPrepareOK)
+}
+
+// PutMPrepareOK empties m and returns it to its pool
+func PutMPrepareOK(m *MPrepareOK) {
+	*m = MPrepareOK{}
+	mPrepareOKPool.Put(m)
+}
+
+func (m *MPrepareOK) Free() {
+	PutMPrepareOK(m)
+}
+
+func (m *MPrepareOK) New() fastrpc.Serializable {
+	return GetMPrepareOK()
+}
+
+var mCommitPool = sync.Pool{
+	New: func() interface{} {
+		return new(MCommit)
+	},
+}
+
+// GetMCommit returns an empty MCommit taken from its pool
+func GetMCommit() *MCommit {
+	return mCommitPool.Get().(*MCommit)
+}
+
+// PutMCommit empties m and returns it to its pool
+func PutMCommit(m *MCommit) {
+	*m = MCommit{}
+	mCommitPool.Put(m)
+}
+
+func (m *MCommit) Free() {
+	PutMCommit(m)
+}
+
+func (m *MCommit) New() fastrpc.Serializable {
+	return GetMCommit()
+}
+
+var mStartViewChangePool = sync.Pool{
+	New: func() interface{} {
+		return new(MStartViewChange)
+	},
+}
+
+// GetMStartViewChange returns an empty MStartViewChange taken from its pool
+func GetMStartViewChange() *MStartViewChange {
+	return mStartViewChangePool.Get().(*MStartViewChange)
+}
+
+// PutMStartViewChange empties m and returns it to its pool
+func PutMStartViewChange(m *MStartViewChange) {
+	*m = MStartViewChange{}
+	mStartViewChangePool.Put(m)
+}
+
+func (m *MStartViewChange) Free() {
+	PutMStartViewChange(m)
+}
+
+func (m *MStartViewChange) New() fastrpc.Serializable {
+	return GetMStartViewChange()
+}
+
+var mDoViewChangePool = sync.Pool{
+	New: func() interface{} {
+		return new(MDoViewChange)
+	},
+}
+
+// GetMDoViewChange returns an empty MDoViewChange taken from its pool
+func GetMDoViewChange() *MDoViewChange {
+	return mDoViewChangePool.Get().(*MDoViewChange)
+}
+
+// PutMDoViewChange empties m and returns it to its pool
+func PutMDoViewChange(m *MDoViewChange) {
+	*m = MDoViewChange{}
+	mDoViewChangePool.Put(m)
+}
+
+func (m *MDoViewChange) Free() {
+	PutMDoViewChange(m)
+}
+
+func (m *MDoViewChange) New() fastrpc.Serializable {
+	return GetMDoViewChange()
+}
+
+var mStartViewPool = sync.Pool{
+	New: func() interface{} {
+		return new(MStartView)
+	},
+}
+
+// GetMStartView returns an empty MStartView taken from its pool
+func GetMStartView() *MStartView {
+	return mStartViewPool.Get().(*MStartView)
+}
+
+// PutMStartView empties m and returns it to its pool
+func PutMStartView(m *MStartView) {
+	*m = MStartView{}
+	mStartViewPool.Put(m)
+}
+
+func (m *MStartView) Free() {
+	PutMStartView(m)
+}
+
+func (m *MStartView) New() fastrpc.Serializable {
+	return GetMStartView()
+}
+
+var mGetStatePool = sync.Pool{
+	New: func() interface{} {
+		return new(MGetState)
+	},
+}
+
+// GetMGetState returns an empty MGetState taken from its pool
+func GetMGetState() *MGetState {
+	return mGetStatePool.Get().(*MGetState)
+}
+
+// PutMGetState empties m and returns it to its pool
+func PutMGetState(m *MGetState) {
+	*m = MGetState{}
+	mGetStatePool.Put(m)
+}
+
+func (m *MGetState) Free() {
+	PutMGetState(m)
+}
+
+func (m *MGetState) New() fastrpc.Serializable {
+	return GetMGetState()
+}
+
+var mRecoveryPool = sync.Pool{
+	New: func() interface{} {
+		return new(MRecovery)
+	},
+}
+
+// GetMRecovery returns an empty MRecovery taken from its pool
+func GetMRecovery() *MRecovery {
+	return mRecoveryPool.Get().(*MRecovery)
+}
+
+// PutMRecovery empties m and returns it to its pool
+func PutMRecovery(m *MRecovery) {
+	*m = MRecovery{}
+	mRecoveryPool.Put(m)
+}
+
+func (m *MRecovery) Free() {
+	PutMRecovery(m)
+}
+
+func (m *MRecovery) New() fastrpc.Serializable {
+	return GetMRecovery()
+}
+
+var mRecoveryResponsePool = sync.Pool{
+	New: func() interface{} {
+		return new(MRecoveryResponse)
+	},
+}
+
+// GetMRecoveryResponse returns an empty MRecoveryResponse taken from its pool
+func GetMRecoveryResponse() *MRecoveryResponse {
+	return mRecoveryResponsePool.Get().(*MRecoveryResponse)
+}
+
+// PutMRecoveryResponse empties m and returns it to its pool
+func PutMRecoveryResponse(m *MRecoveryResponse) {
+	*m = MRecoveryResponse{}
+	mRecoveryResponsePool.Put(m)
+}
+
+func (m *MRecoveryResponse) Free() {
+	PutMRecoveryResponse(m)
+}
+
+func (m *MRecoveryResponse) New() fastrpc.Serializable {
+	return GetMRecoveryResponse()
+}
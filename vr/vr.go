@@ -0,0 +1,655 @@
+package vr
+
+import (
+	"flag"
+	"log"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/vonaka/shreplic/server/smr"
+	"github.com/vonaka/shreplic/state"
+	"github.com/vonaka/shreplic/tools/dlog"
+	"github.com/vonaka/shreplic/tools/fastrpc"
+)
+
+// Replica of Viewstamped Replication Revisited.
+//
+// Nothing is written to the stable store. A replica that restarts
+// with `-recover` learns its state from the others instead.
+type Replica struct {
+	*smr.Replica
+
+	view       int32
+	status     int
+	lastNormal int32
+
+	// log[i] is the operation number i+1
+	log      []Entry
+	commit   int32
+	executed int32
+	acked    []int32
+
+	proposes map[CommandId]*smr.GPropose
+
+	startViewChanges map[int32]struct{}
+	doViewChanges    map[int32]*MDoViewChange
+	doViewChangeSent bool
+	waitingState     bool
+
+	nonce     int64
+	responses map[int32]*MRecoveryResponse
+
+	heartbeat  time.Duration
+	timeout    time.Duration
+	lastHeard  time.Time
+	lastSent   time.Time
+	tickChan   chan struct{}
+	leaderChan chan struct{}
+
+	sender smr.Sender
+	cs     CommunicationSupply
+}
+
+type CommunicationSupply struct {
+	maxLatency time.Duration
+
+	prepareChan          chan fastrpc.Serializable
+	prepareOKChan        chan fastrpc.Serializable
+	commitChan           chan fastrpc.Serializable
+	startViewChangeChan  chan fastrpc.Serializable
+	doViewChangeChan     chan fastrpc.Serializable
+	startViewChan        chan fastrpc.Serializable
+	getStateChan         chan fastrpc.Serializable
+	recoveryChan         chan fastrpc.Serializable
+	recoveryResponseChan chan fastrpc.Serializable
+
+	prepareRPC          uint8
+	prepareOKRPC        uint8
+	commitRPC           uint8
+	startViewChangeRPC  uint8
+	doViewChangeRPC     uint8
+	startViewRPC        uint8
+	getStateRPC         uint8
+	recoveryRPC         uint8
+	recoveryResponseRPC uint8
+}
+
+func NewReplica(rid int, addrs []string, exec, dr bool,
+	f int, args string, ps map[string]struct{}) *Replica {
+
+	fs := flag.NewFlagSet("custom VR arguments", flag.ExitOnError)
+	heartbeat := fs.Int("heartbeat", 50, "Milliseconds between two commit messages of an idle primary")
+	timeout := fs.Int("timeout", 300, "Milliseconds without news from the primary before a view change")
+	recovering := fs.Bool("recover", false, "Restart the replica with the recovery protocol")
+	fs.Parse(strings.Fields(args))
+
+	r := &Replica{
+		Replica: smr.NewReplica(rid, f, addrs, false, exec, false, dr, ps),
+
+		view:       0,
+		status:     NORMAL,
+		lastNormal: 0,
+
+		log:      make([]Entry, 0),
+		commit:   0,
+		executed: 0,
+
+		proposes: make(map[CommandId]*smr.GPropose),
+
+		startViewChanges: make(map[int32]struct{}),
+		doViewChanges:    make(map[int32]*MDoViewChange),
+
+		responses: make(map[int32]*MRecoveryResponse),
+
+		heartbeat:  time.Duration(*heartbeat) * time.Millisecond,
+		timeout:    time.Duration(*timeout) * time.Millisecond,
+		tickChan:   make(chan struct{}, 1),
+		leaderChan: make(chan struct{}, 1),
+	}
+
+	r.acked = make([]int32, r.N)
+	if *recovering {
+		r.status = RECOVERING
+	}
+
+	r.sender = smr.NewSender(r.Replica)
+	initCs(&r.cs, r.RPC)
+
+	go r.run()
+
+	return r
+}
+
+// Messages registers in t the messages of the protocol
+func Messages(t *fastrpc.Table) {
+	initCs(new(CommunicationSupply), t)
+}
+
+func initCs(cs *CommunicationSupply, t *fastrpc.Table) {
+	cs.maxLatency = 0
+
+	cs.prepareChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.prepareOKChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.commitChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.startViewChangeChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.doViewChangeChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.startViewChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.getStateChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.recoveryChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+	cs.recoveryResponseChan = make(chan fastrpc.Serializable, smr.QUEUE_SIZE)
+
+	cs.prepareRPC = t.Register(new(MPrepare), cs.prepareChan)
+	cs.prepareOKRPC = t.Register(new(MPrepareOK), cs.prepareOKChan)
+	cs.commitRPC = t.Register(new(MCommit), cs.commitChan)
+	cs.startViewChangeRPC = t.Register(new(MStartViewChange), cs.startViewChangeChan)
+	cs.doViewChangeRPC = t.Register(new(MDoViewChange), cs.doViewChangeChan)
+	cs.startViewRPC = t.Register(new(MStartView), cs.startViewChan)
+	cs.getStateRPC = t.Register(new(MGetState), cs.getStateChan)
+	cs.recoveryRPC = t.Register(new(MRecovery), cs.recoveryChan)
+	cs.recoveryResponseRPC = t.Register(new(MRecoveryResponse), cs.recoveryResponseChan)
+}
+
+// BeTheLeader makes the replica start a view change to the next view
+// it is the primary of. The master considers it as the primary, which
+// is true unless the view change does not succeed.
+func (r *Replica) BeTheLeader(args *smr.BeTheLeaderArgs, reply *smr.BeTheLeaderReply) error {
+	r.leaderChan <- struct{}{}
+	reply.Leader = r.Id
+	if reply.Leader == 0 {
+		// see smr.BeTheLeaderReply
+		reply.Leader = smr.ZERO_ID
+	}
+	return nil
+}
+
+func (r *Replica) run() {
+	r.ConnectToPeers()
+	latencies := r.ComputeClosestPeers()
+	for _, l := range latencies {
+		d := time.Duration(l*1000*1000) * time.Nanosecond
+		if d > r.cs.maxLatency {
+			r.cs.maxLatency = d
+		}
+	}
+
+	go r.WaitForClientConnections()
+	r.lastHeard = time.Now()
+	if r.status == RECOVERING {
+		r.startRecovery()
+	}
+	go r.clock()
+
+	for !r.Shutdown {
+		select {
+		case propose := <-r.ProposeChan:
+			r.handlePropose(propose)
+
+		case m := <-r.cs.prepareChan:
+			prepare := m.(*MPrepare)
+			r.handlePrepare(prepare)
+			prepare.Free()
+
+		case m := <-r.cs.prepareOKChan:
+			ok := m.(*MPrepareOK)
+			r.handlePrepareOK(ok)
+			ok.Free()
+
+		case m := <-r.cs.commitChan:
+			commit := m.(*MCommit)
+			r.handleCommit(commit)
+			commit.Free()
+
+		case m := <-r.cs.startViewChangeChan:
+			svc := m.(*MStartViewChange)
+			r.handleStartViewChange(svc)
+			svc.Free()
+
+		case m := <-r.cs.doViewChangeChan:
+			dvc := m.(*MDoViewChange)
+			r.handleDoViewChange(dvc)
+
+		case m := <-r.cs.startViewChan:
+			sv := m.(*MStartView)
+			r.handleStartView(sv)
+			sv.Free()
+
+		case m := <-r.cs.getStateChan:
+			gs := m.(*MGetState)
+			r.handleGetState(gs)
+			gs.Free()
+
+		case m := <-r.cs.recoveryChan:
+			rec := m.(*MRecovery)
+			r.handleRecovery(rec)
+			rec.Free()
+
+		case m := <-r.cs.recoveryResponseChan:
+			rep := m.(*MRecoveryResponse)
+			r.handleRecoveryResponse(rep)
+
+		case <-r.tickChan:
+			r.handleTick()
+
+		case <-r.leaderChan:
+			if r.status != RECOVERING && r.primary(r.view) != r.Id {
+				v := r.view + 1
+				for r.primary(v) != r.Id {
+					v++
+				}
+				r.startViewChange(v)
+			}
+		}
+	}
+}
+
+func (r *Replica) clock() {
+	for !r.Shutdown {
+		time.Sleep(r.heartbeat)
+		r.tickChan <- struct{}{}
+	}
+}
+
+func (r *Replica) handleTick() {
+	switch {
+	case r.status == RECOVERING:
+		if time.Since(r.lastHeard) >= r.timeout {
+			r.startRecovery()
+		}
+	case r.status == NORMAL && r.primary(r.view) == r.Id:
+		if time.Since(r.lastSent) >= r.heartbeat {
+			r.sender.SendToAll(&MCommit{
+				Replica: r.Id,
+				View:    r.view,
+				Commit:  r.commit,
+			}, r.cs.commitRPC)
+			r.lastSent = time.Now()
+		}
+	case time.Since(r.lastHeard) >= r.timeout:
+		r.startViewChange(r.view + 1)
+	}
+}
+
+func (r *Replica) handlePropose(propose *smr.GPropose) {
+	if r.status != NORMAL || r.primary(r.view) != r.Id {
+		dlog.Printf("Not the primary, cannot propose %v\n", propose.CommandId)
+		preply := &smr.ProposeReplyTS{
+			OK:        smr.FALSE,
+			CommandId: -1,
+			Value:     state.NIL(),
+			Timestamp: 0,
+		}
+		r.ReplyProposeTS(preply, propose.Reply, propose.Mutex)
+		return
+	}
+
+	batchSize := len(r.ProposeChan) + 1
+	entries := make([]Entry, batchSize)
+	for i := 0; i < batchSize; i++ {
+		if i > 0 {
+			propose = <-r.ProposeChan
+		}
+		cmdId := CommandId{
+			ClientId: propose.ClientId,
+			SeqNum:   propose.CommandId,
+		}
+		r.proposes[cmdId] = propose
+		entries[i] = Entry{
+			CmdId: cmdId,
+			Cmd:   propose.Command,
+		}
+	}
+	r.log = append(r.log, entries...)
+	r.acked[r.Id] = r.op()
+
+	r.sender.SendToAll(&MPrepare{
+		Replica: r.Id,
+		View:    r.view,
+		Op:      r.op(),
+		Commit:  r.commit,
+		Entries: entries,
+	}, r.cs.prepareRPC)
+	r.lastSent = time.Now()
+	r.advanceCommit()
+}
+
+func (r *Replica) handlePrepare(msg *MPrepare) {
+	if !r.follow(msg.View) {
+		return
+	}
+	r.lastHeard = time.Now()
+
+	first := msg.Op - int32(len(msg.Entries)) + 1
+	if first > r.op()+1 {
+		r.getState()
+		return
+	}
+	if msg.Op > r.op() {
+		r.log = append(r.log, msg.Entries[r.op()+1-first:]...)
+	}
+	r.waitingState = false
+
+	r.sender.SendTo(msg.Replica, &MPrepareOK{
+		Replica: r.Id,
+		View:    r.view,
+		Op:      r.op(),
+	}, r.cs.prepareOKRPC)
+	r.updateCommit(msg.Commit)
+}
+
+func (r *Replica) handlePrepareOK(msg *MPrepareOK) {
+	if r.status != NORMAL || msg.View != r.view || r.primary(r.view) != r.Id {
+		return
+	}
+	if msg.Op > r.acked[msg.Replica] {
+		r.acked[msg.Replica] = msg.Op
+		r.advanceCommit()
+	}
+}
+
+func (r *Replica) handleCommit(msg *MCommit) {
+	if !r.follow(msg.View) {
+		return
+	}
+	r.lastHeard = time.Now()
+
+	if msg.Commit > r.op() {
+		r.getState()
+	}
+	r.updateCommit(msg.Commit)
+}
+
+// follow tells whether the messages of the primary of
+// view must be processed. If view is newer than the view of
+// the replica, then the replica moves to view and discards
+// the operations that might not survive the view change.
+func (r *Replica) follow(view int32) bool {
+	if r.status == RECOVERING || view < r.view ||
+		(view == r.view && r.status != NORMAL) {
+		return false
+	}
+	if view > r.view {
+		r.log = r.log[:r.commit]
+		r.enterView(view)
+	}
+	return true
+}
+
+func (r *Replica) getState() {
+	if r.waitingState {
+		return
+	}
+	r.waitingState = true
+	r.sender.SendTo(r.primary(r.view), &MGetState{
+		Replica: r.Id,
+		View:    r.view,
+		Op:      r.op(),
+	}, r.cs.getStateRPC)
+}
+
+func (r *Replica) handleGetState(msg *MGetState) {
+	if r.status != NORMAL || msg.View != r.view || msg.Op > r.op() {
+		return
+	}
+
+	entries := make([]Entry, r.op()-msg.Op)
+	copy(entries, r.log[msg.Op:])
+	r.sender.SendTo(msg.Replica, &MPrepare{
+		Replica: r.Id,
+		View:    r.view,
+		Op:      r.op(),
+		Commit:  r.commit,
+		Entries: entries,
+	}, r.cs.prepareRPC)
+}
+
+func (r *Replica) startViewChange(view int32) {
+	log.Println("Starting view change to view", view)
+	r.view = view
+	r.status = VIEWCHANGE
+	r.startViewChanges = map[int32]struct{}{
+		r.Id: {},
+	}
+	r.doViewChanges = make(map[int32]*MDoViewChange)
+	r.doViewChangeSent = false
+	r.waitingState = false
+	r.lastHeard = time.Now()
+
+	r.sender.SendToAll(&MStartViewChange{
+		Replica: r.Id,
+		View:    view,
+	}, r.cs.startViewChangeRPC)
+	r.checkStartViewChanges()
+}
+
+func (r *Replica) handleStartViewChange(msg *MStartViewChange) {
+	if r.status == RECOVERING || msg.View < r.view {
+		return
+	}
+	if msg.View > r.view {
+		r.startViewChange(msg.View)
+	}
+	if r.status != VIEWCHANGE {
+		return
+	}
+	r.startViewChanges[msg.Replica] = struct{}{}
+	r.checkStartViewChanges()
+}
+
+func (r *Replica) checkStartViewChanges() {
+	if r.doViewChangeSent || len(r.startViewChanges) < r.F+1 {
+		return
+	}
+	r.doViewChangeSent = true
+
+	l := make([]Entry, r.op())
+	copy(l, r.log)
+	dvc := &MDoViewChange{
+		Replica:    r.Id,
+		View:       r.view,
+		LastNormal: r.lastNormal,
+		Commit:     r.commit,
+		Log:        l,
+	}
+	if r.primary(r.view) == r.Id {
+		r.handleDoViewChange(dvc)
+	} else {
+		r.sender.SendTo(r.primary(r.view), dvc, r.cs.doViewChangeRPC)
+	}
+}
+
+func (r *Replica) handleDoViewChange(msg *MDoViewChange) {
+	if r.status == RECOVERING || msg.View < r.view {
+		return
+	}
+	if msg.View > r.view {
+		r.startViewChange(msg.View)
+	}
+	if r.status != VIEWCHANGE || r.primary(r.view) != r.Id {
+		return
+	}
+
+	r.doViewChanges[msg.Replica] = msg
+	if _, exists := r.doViewChanges[r.Id]; !exists ||
+		len(r.doViewChanges) < r.F+1 {
+		return
+	}
+
+	var best *MDoViewChange
+	commit := r.commit
+	for _, dvc := range r.doViewChanges {
+		if best == nil || dvc.LastNormal > best.LastNormal ||
+			(dvc.LastNormal == best.LastNormal && len(dvc.Log) > len(best.Log)) {
+			best = dvc
+		}
+		if dvc.Commit > commit {
+			commit = dvc.Commit
+		}
+	}
+	r.log = best.Log
+	r.enterView(r.view)
+	log.Println("I am the primary of view", r.view)
+
+	for i := range r.acked {
+		r.acked[i] = 0
+	}
+	r.acked[r.Id] = r.op()
+
+	l := make([]Entry, r.op())
+	copy(l, r.log)
+	r.sender.SendToAll(&MStartView{
+		Replica: r.Id,
+		View:    r.view,
+		Commit:  commit,
+		Log:     l,
+	}, r.cs.startViewRPC)
+	r.lastSent = time.Now()
+	r.updateCommit(commit)
+}
+
+func (r *Replica) handleStartView(msg *MStartView) {
+	if r.status == RECOVERING || msg.View < r.view ||
+		(msg.View == r.view && r.status == NORMAL) {
+		return
+	}
+
+	r.log = msg.Log
+	r.enterView(msg.View)
+	r.lastHeard = time.Now()
+
+	if msg.Commit < r.op() {
+		r.sender.SendTo(msg.Replica, &MPrepareOK{
+			Replica: r.Id,
+			View:    r.view,
+			Op:      r.op(),
+		}, r.cs.prepareOKRPC)
+	}
+	r.updateCommit(msg.Commit)
+}
+
+func (r *Replica) enterView(view int32) {
+	r.view = view
+	r.status = NORMAL
+	r.lastNormal = view
+	r.waitingState = false
+	r.startViewChanges = make(map[int32]struct{})
+	r.doViewChanges = make(map[int32]*MDoViewChange)
+}
+
+func (r *Replica) startRecovery() {
+	log.Println("Recovering")
+	r.nonce = rand.Int63()
+	r.responses = make(map[int32]*MRecoveryResponse)
+	r.lastHeard = time.Now()
+
+	r.sender.SendToAll(&MRecovery{
+		Replica: r.Id,
+		Nonce:   r.nonce,
+	}, r.cs.recoveryRPC)
+}
+
+func (r *Replica) handleRecovery(msg *MRecovery) {
+	if r.status != NORMAL {
+		return
+	}
+
+	rep := &MRecoveryResponse{
+		Replica: r.Id,
+		View:    r.view,
+		Nonce:   msg.Nonce,
+		Commit:  r.commit,
+		Log:     []Entry{},
+	}
+	if r.primary(r.view) == r.Id {
+		rep.Log = make([]Entry, r.op())
+		copy(rep.Log, r.log)
+	}
+	r.sender.SendTo(msg.Replica, rep, r.cs.recoveryResponseRPC)
+}
+
+func (r *Replica) handleRecoveryResponse(msg *MRecoveryResponse) {
+	if r.status != RECOVERING || msg.Nonce != r.nonce {
+		return
+	}
+
+	r.responses[msg.Replica] = msg
+	if len(r.responses) < r.F+1 {
+		return
+	}
+	view := int32(-1)
+	for _, rep := range r.responses {
+		if rep.View > view {
+			view = rep.View
+		}
+	}
+	rep, exists := r.responses[r.primary(view)]
+	if !exists || rep.View != view {
+		return
+	}
+
+	r.log = rep.Log
+	r.enterView(view)
+	r.lastHeard = time.Now()
+	log.Println("Recovered in view", view)
+	r.updateCommit(rep.Commit)
+}
+
+// advanceCommit commits the operations prepared by a majority of replicas
+func (r *Replica) advanceCommit() {
+	for op := r.op(); op > r.commit; op-- {
+		count := 0
+		for _, a := range r.acked {
+			if a >= op {
+				count++
+			}
+		}
+		if count >= r.F+1 {
+			r.updateCommit(op)
+			return
+		}
+	}
+}
+
+func (r *Replica) updateCommit(commit int32) {
+	if commit > r.op() {
+		commit = r.op()
+	}
+	if commit > r.commit {
+		r.commit = commit
+	}
+	r.execute()
+}
+
+func (r *Replica) execute() {
+	for r.executed < r.commit {
+		e := &r.log[r.executed]
+		r.executed++
+
+		v := state.NIL()
+		if r.Exec {
+			dlog.Printf("Executing " + e.Cmd.String())
+			v = e.Cmd.Execute(r.State)
+		}
+		if p, exists := r.proposes[e.CmdId]; exists {
+			if !r.Dreply {
+				v = state.NIL()
+			}
+			rep := &smr.ProposeReplyTS{
+				OK:        smr.TRUE,
+				CommandId: p.CommandId,
+				Value:     v,
+				Timestamp: p.Timestamp,
+			}
+			r.ReplyProposeTS(rep, p.Reply, p.Mutex)
+			delete(r.proposes, e.CmdId)
+		}
+	}
+}
+
+func (r *Replica) primary(view int32) int32 {
+	return view % int32(r.N)
+}
+
+func (r *Replica) op() int32 {
+	return int32(len(r.log))
+}
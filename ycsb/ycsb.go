@@ -3,7 +3,9 @@ package ycsb
 import (
 	"github.com/vonaka/shreplic/client/base"
 	"github.com/vonaka/shreplic/curp"
+	"github.com/vonaka/shreplic/fastpaxos"
 	"github.com/vonaka/shreplic/paxoi"
+	"github.com/vonaka/shreplic/unistore"
 )
 
 type ShreplicClient interface {
@@ -29,6 +31,12 @@ func NewShreplicClient(protocol, maddr, collocated string, mport int,
 	case "curp":
 		c = curp.NewClient(maddr, collocated, mport,
 			0, 0, 0, 0, fast, lread, leaderless, verbose, nil, args)
+	case "fastpaxos":
+		c = fastpaxos.NewClient(maddr, collocated, mport,
+			0, 0, 0, 0, fast, lread, leaderless, verbose, nil, args)
+	case "unistore":
+		c = unistore.NewClient(maddr, collocated, mport,
+			0, 0, 0, 0, fast, lread, leaderless, verbose, nil, args)
 	}
 
 	return c